@@ -37,6 +37,7 @@ var (
 	typeUpgradeConfig                   mic.TypeUpgradeConfig
 	updateUserMSIConfig                 mic.UpdateUserMSIConfig
 	identityAssignmentReconcileInterval time.Duration
+	dryRun                              bool
 )
 
 func main() {
@@ -96,6 +97,9 @@ func main() {
 	// Parameters for reconciling identity assignment on Azure
 	flag.DurationVar(&identityAssignmentReconcileInterval, "identity-assignment-reconcile-interval", 3*time.Minute, "The interval between reconciling identity assignment on Azure based on an existing list of AzureAssignedIdentities")
 
+	// Dry-run mode only computes the changes MIC would make and serves them on the http probe port
+	flag.BoolVar(&dryRun, "dry-run", false, "Compute the identity assignment plan without updating the VM/VMSS or AzureAssignedIdentities. The plan is served at /plan on the http probe port")
+
 	flag.Parse()
 
 	if err := logOptions.Apply(); err != nil {
@@ -165,6 +169,7 @@ func main() {
 		TypeUpgradeCfg:                      &typeUpgradeConfig,
 		UpdateUserMSICfg:                    &updateUserMSIConfig,
 		IdentityAssignmentReconcileInterval: identityAssignmentReconcileInterval,
+		DryRun:                              dryRun,
 	}
 
 	micClient, err := mic.NewMICClient(micConfig)
@@ -172,6 +177,11 @@ func main() {
 		klog.Fatalf("failed to create MIC client, error: %+v", err)
 	}
 
+	if dryRun {
+		klog.Infof("running MIC in dry-run mode, the plan is served at /plan on port %s", httpProbePort)
+		http.HandleFunc("/plan", micClient.PlanHandler)
+	}
+
 	// Health probe will always report success once its started.
 	// MIC instance will report the contents as "Active" only once its elected the leader
 	// and starts the sync loop.
@@ -55,6 +55,10 @@ var (
 	kubeconfig                         = pflag.String("kubeconfig", "", "Path to the kube config")
 	allowNetworkPluginKubenet          = pflag.Bool("allow-network-plugin-kubenet", false, "Allow running aad-pod-identity in cluster with kubenet")
 	kubeletConfig                      = pflag.String("kubelet-config", "/etc/default/kubelet", "Path to kubelet default config")
+	enableTokenCache                   = pflag.Bool("enable-token-cache", true, "Enable/Disable caching of tokens acquired by NMI")
+	tokenRefreshWindow                 = pflag.Duration("token-refresh-window", nmi.DefaultTokenRefreshWindow, "Duration before expiry at which cached tokens are refreshed in the background")
+	tokenRequestTimeout                = pflag.Duration("token-request-timeout", nmi.DefaultTokenRequestTimeout, "Timeout of a token acquisition shared by concurrent token requests")
+	identityEndpointPath               = pflag.String("identity-endpoint-path", "", "Path at which the App Service managed identity protocol (IDENTITY_ENDPOINT) is served, disabled if empty")
 )
 
 // Delay nmi startup due to DNS not being available during first seconds of nmi process execution.
@@ -131,6 +135,10 @@ func main() {
 	s.HostIP = *hostIP
 	s.NodeName = *nodename
 	s.IPTableUpdateTimeIntervalInSeconds = *ipTableUpdateTimeIntervalInSeconds
+	if *identityEndpointPath != "" {
+		klog.Infof("serving App Service managed identity protocol at %s", *identityEndpointPath)
+		s.IdentityEndpointPath = *identityEndpointPath
+	}
 
 	nmiConfig := nmi.Config{
 		Mode:                               strings.ToLower(*operationMode),
@@ -138,6 +146,7 @@ func main() {
 		RetryAttemptsForAssigned:           *retryAttemptsForAssigned,
 		FindIdentityRetryIntervalInSeconds: *findIdentityRetryIntervalInSeconds,
 		Namespaced:                         *forceNamespaced,
+		EventRecorder:                      s.EventRecorder,
 	}
 
 	// Create new token client based on the nmi mode
@@ -145,6 +154,13 @@ func main() {
 	if err != nil {
 		klog.Fatalf("failed to initialize token client, error: %+v", err)
 	}
+	// coalesce concurrent requests for the same token into a single call to AAD or IMDS
+	tokenClient = nmi.NewCoalescingTokenClient(tokenClient, *tokenRequestTimeout)
+	if *enableTokenCache {
+		tokenCache := nmi.NewTokenCache(tokenClient, client, s.Reporter, *tokenRefreshWindow)
+		go tokenCache.Run(exit)
+		tokenClient = tokenCache
+	}
 	s.TokenClient = tokenClient
 
 	mainRoutineDone := make(chan struct{})
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	aadpodv1 "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+	"github.com/Azure/aad-pod-identity/pkg/log"
+	"github.com/Azure/aad-pod-identity/pkg/mic"
+
+	corev1 "k8s.io/api/core/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/klog/v2"
+)
+
+var (
+	forceNamespaced   bool
+	immutableUserMSIs string
+	output            string
+)
+
+func main() {
+	klog.InitFlags(nil)
+	defer klog.Flush()
+
+	logOptions := log.NewOptions()
+	logOptions.AddFlags()
+
+	flag.BoolVar(&forceNamespaced, "forceNamespaced", false, "Simulate MIC with forced namespaced identities, binding, and assignment")
+	flag.StringVar(&immutableUserMSIs, "immutable-user-msis", "", "Simulate MIC with these IDs prevented from deletion from the underlying VM/VMSS")
+	flag.StringVar(&output, "output", "text", "Output format of the plan, text or json")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <file or directory>...\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Simulates a MIC sync cycle against the pods, nodes, namespaces, AzureIdentities, AzureIdentityBindings")
+		fmt.Fprintln(flag.CommandLine.Output(), "and AzureAssignedIdentities in the given YAML or JSON files, such as the output of kubectl get -o yaml")
+		fmt.Fprintln(flag.CommandLine.Output(), "or a kubectl cluster-info dump, and prints the changes MIC would make to each VM/VMSS.")
+		fmt.Fprintln(flag.CommandLine.Output(), "Run with -v=5 to log why pods are matched or not matched with identities.")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if err := logOptions.Apply(); err != nil {
+		klog.Fatalf("unable to apply logging options, error: %+v", err)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if output != "text" && output != "json" {
+		klog.Fatalf("invalid output format %s, must be text or json", output)
+	}
+
+	input := mic.SimulationInput{IsNamespaced: forceNamespaced}
+	if immutableUserMSIs != "" {
+		input.ImmutableUserMSIs = strings.Split(immutableUserMSIs, ",")
+	}
+	for _, path := range flag.Args() {
+		if err := loadPath(path, &input); err != nil {
+			klog.Fatalf("failed to load %s, error: %+v", path, err)
+		}
+	}
+	klog.Infof("loaded %d pods, %d nodes, %d namespaces, %d AzureIdentities, %d AzureIdentityBindings and %d AzureAssignedIdentities",
+		len(input.Pods), len(input.Nodes), len(input.Namespaces), len(input.AzureIdentities), len(input.AzureIdentityBindings), len(input.AzureAssignedIdentities))
+
+	plan, err := mic.Simulate(input)
+	if err != nil {
+		klog.Fatalf("failed to simulate MIC sync cycle, error: %+v", err)
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plan); err != nil {
+			klog.Fatalf("failed to encode plan, error: %+v", err)
+		}
+		return
+	}
+	printPlan(os.Stdout, plan)
+}
+
+// loadPath loads the objects in a file, or in all YAML and JSON files in a directory.
+func loadPath(path string, input *mic.SimulationInput) error {
+	return filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		// a cluster dump also contains the logs of the pods
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			if file != path {
+				return nil
+			}
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+		for {
+			var obj map[string]interface{}
+			if err := decoder.Decode(&obj); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("failed to decode %s, error: %+v", file, err)
+			}
+			if obj == nil {
+				continue
+			}
+			if err := addObject(obj, "", input); err != nil {
+				return fmt.Errorf("failed to load object from %s, error: %+v", file, err)
+			}
+		}
+	})
+}
+
+// addObject adds obj to the input by kind. The items of lists are added recursively. Items of typed
+// lists, e.g. PodList, don't always have a kind, in which case itemKind is used.
+func addObject(obj map[string]interface{}, itemKind string, input *mic.SimulationInput) error {
+	kind, _ := obj["kind"].(string)
+	if kind == "" {
+		kind = itemKind
+	}
+
+	if items, ok := obj["items"].([]interface{}); ok && strings.HasSuffix(kind, "List") {
+		for _, item := range items {
+			if itemObj, ok := item.(map[string]interface{}); ok {
+				if err := addObject(itemObj, strings.TrimSuffix(kind, "List"), input); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "Pod":
+		var pod corev1.Pod
+		if err := json.Unmarshal(data, &pod); err != nil {
+			return err
+		}
+		input.Pods = append(input.Pods, pod)
+	case "Node":
+		var node corev1.Node
+		if err := json.Unmarshal(data, &node); err != nil {
+			return err
+		}
+		input.Nodes = append(input.Nodes, node)
+	case "Namespace":
+		var ns corev1.Namespace
+		if err := json.Unmarshal(data, &ns); err != nil {
+			return err
+		}
+		input.Namespaces = append(input.Namespaces, ns)
+	case "AzureIdentity":
+		var id aadpodv1.AzureIdentity
+		if err := json.Unmarshal(data, &id); err != nil {
+			return err
+		}
+		input.AzureIdentities = append(input.AzureIdentities, aadpodv1.ConvertV1IdentityToInternalIdentity(id))
+	case "AzureIdentityBinding":
+		var binding aadpodv1.AzureIdentityBinding
+		if err := json.Unmarshal(data, &binding); err != nil {
+			return err
+		}
+		input.AzureIdentityBindings = append(input.AzureIdentityBindings, aadpodv1.ConvertV1BindingToInternalBinding(binding))
+	case "AzureAssignedIdentity":
+		var assignedID aadpodv1.AzureAssignedIdentity
+		if err := json.Unmarshal(data, &assignedID); err != nil {
+			return err
+		}
+		input.AzureAssignedIdentities = append(input.AzureAssignedIdentities, aadpodv1.ConvertV1AssignedIdentityToInternalAssignedIdentity(assignedID))
+	case "AzureIdentityPolicy":
+		var policy aadpodv1.AzureIdentityPolicy
+		if err := json.Unmarshal(data, &policy); err != nil {
+			return err
+		}
+		input.AzureIdentityPolicies = append(input.AzureIdentityPolicies, aadpodv1.ConvertV1IdentityPolicyToInternalIdentityPolicy(policy))
+	default:
+		klog.V(2).Infof("ignoring object of kind %q", kind)
+	}
+	return nil
+}
+
+func printPlan(w io.Writer, plan []mic.NodePlan) {
+	if len(plan) == 0 {
+		fmt.Fprintln(w, "no changes")
+		return
+	}
+	for _, node := range plan {
+		nodeType := "VM"
+		if node.IsVMSS {
+			nodeType = "VMSS"
+		}
+		fmt.Fprintf(w, "%s %s\n", nodeType, node.Name)
+		printList(w, "identities to assign", node.AssignIdentities)
+		printList(w, "identities to remove", node.RemoveIdentities)
+		printList(w, "AzureAssignedIdentities to create", node.CreateAssignedIdentities)
+		printList(w, "AzureAssignedIdentities to update", node.UpdateAssignedIdentities)
+		printList(w, "AzureAssignedIdentities to delete", node.DeleteAssignedIdentities)
+	}
+}
+
+func printList(w io.Writer, title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %s:\n", title)
+	for _, item := range items {
+		fmt.Fprintf(w, "    %s\n", item)
+	}
+}
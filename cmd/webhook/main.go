@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/crd"
+	"github.com/Azure/aad-pod-identity/pkg/log"
+	"github.com/Azure/aad-pod-identity/pkg/probes"
+	"github.com/Azure/aad-pod-identity/pkg/webhook"
+	"github.com/Azure/aad-pod-identity/version"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+// serverTimeout bounds reading a request and writing its response, the API server
+// calls webhooks with a timeout of at most 30s
+const serverTimeout = 30 * time.Second
+
+var (
+	kubeconfig    string
+	versionInfo   bool
+	port          string
+	tlsCertFile   string
+	tlsKeyFile    string
+	httpProbePort string
+	clientQPS     float64
+	initialized   bool
+
+	forceNamespaced    bool
+	injectEnv          bool
+	identityEndpoint   string
+	initContainerImage string
+	nmiEndpoint        string
+)
+
+func main() {
+	defer klog.Flush()
+
+	logOptions := log.NewOptions()
+	logOptions.AddFlags()
+
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to the kube config")
+	flag.BoolVar(&versionInfo, "version", false, "Prints the version information")
+	flag.StringVar(&port, "port", "9443", "Port of the webhook server")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "/etc/webhook/certs/tls.crt", "Path to the serving certificate of the webhook server")
+	flag.StringVar(&tlsKeyFile, "tls-private-key-file", "/etc/webhook/certs/tls.key", "Path to the private key of the serving certificate")
+	flag.StringVar(&httpProbePort, "http-probe-port", "8080", "http liveliness probe port")
+	flag.Float64Var(&clientQPS, "clientQps", 5, "Client QPS used for throttling of calls to kube-api server")
+	flag.BoolVar(&forceNamespaced, "forceNamespaced", false, "Only binds pods to identities in their own namespace when injecting the environment and init container")
+	flag.BoolVar(&injectEnv, "inject-env", false, "Injects AZURE_CLIENT_ID of the default identity into the containers of bound pods")
+	flag.StringVar(&identityEndpoint, "identity-endpoint", "", "Injects IDENTITY_ENDPOINT with this value and the IDENTITY_HEADER of the pod when --inject-env is set")
+	flag.StringVar(&initContainerImage, "init-container-image", "", "Image of the init container injected into bound pods to wait until their identity is assigned")
+	flag.StringVar(&nmiEndpoint, "nmi-endpoint", webhook.DefaultNMIEndpoint, "Address at which the injected init container reaches NMI")
+	flag.Parse()
+
+	if err := logOptions.Apply(); err != nil {
+		klog.Fatalf("unable to apply logging options, error: %+v", err)
+	}
+
+	if versionInfo {
+		version.PrintVersionAndExit()
+	}
+	klog.Infof("starting webhook process. Version: %v. Build date: %v", version.WebhookVersion, version.BuildDate)
+
+	forceNamespaced = forceNamespaced || "true" == os.Getenv("FORCENAMESPACED")
+	injection := webhook.InjectionConfig{
+		Namespaced:         forceNamespaced,
+		InjectEnv:          injectEnv,
+		InitContainerImage: initContainerImage,
+		NMIEndpoint:        nmiEndpoint,
+	}
+	if injectEnv {
+		injection.IdentityEndpoint = identityEndpoint
+	}
+
+	config, err := buildConfig(kubeconfig)
+	if err != nil {
+		klog.Fatalf("failed to build config from %s, error: %+v", kubeconfig, err)
+	}
+	config.UserAgent = version.GetUserAgent("webhook", version.WebhookVersion)
+	config.QPS = float32(clientQPS)
+	config.Burst = int(clientQPS)
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Fatalf("failed to create kube client, error: %+v", err)
+	}
+	// the lite client in non-standard mode watches bindings, identities and exceptions
+	crdClient, err := crd.NewCRDClientLite(config, "", false, false)
+	if err != nil {
+		klog.Fatalf("failed to create CRD client, error: %+v", err)
+	}
+
+	certLoader, err := webhook.NewCertLoader(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		klog.Fatalf("failed to load serving certificate, error: %+v", err)
+	}
+
+	probes.InitAndStart(httpProbePort, &initialized)
+
+	exit := make(<-chan struct{})
+	crdClient.StartLite(exit)
+	webhookServer := webhook.NewServer(crdClient, kubeClient, injection)
+	webhookServer.Start(exit)
+	if err := certLoader.Watch(exit); err != nil {
+		klog.Fatalf("failed to watch serving certificate, error: %+v", err)
+	}
+
+	server := &http.Server{
+		Addr:         ":" + port,
+		Handler:      webhookServer.Handler(),
+		ReadTimeout:  serverTimeout,
+		WriteTimeout: serverTimeout,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certLoader.GetCertificate,
+		},
+	}
+
+	initialized = true
+	klog.Infof("listening on port %s", port)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		klog.Fatalf("failed to listen and serve on port %s, error: %+v", port, err)
+	}
+}
+
+// Create the client config. Use kubeconfig if given, otherwise assume in-cluster.
+func buildConfig(kubeconfigPath string) (*rest.Config, error) {
+	if kubeconfigPath != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	}
+	return rest.InClusterConfig()
+}
@@ -38,6 +38,12 @@ const (
 
 	// Exit is an event that is sent to the event channel when the program exits.
 	Exit EventType = 9
+
+	// NamespaceUpdated is an event that is sent to the event channel when the labels of a namespace are updated.
+	NamespaceUpdated EventType = 10
+
+	// PolicyUpdated is an event that is sent to the event channel when an AzureIdentityPolicy is created, updated or deleted.
+	PolicyUpdated EventType = 11
 )
 
 const (
@@ -50,6 +56,15 @@ const (
 	// CRDLabelKey is the static label that is used in pods.
 	CRDLabelKey = "aadpodidbinding"
 
+	// BindingSelectorAnnotationKey is the annotation of namespaces and service accounts whose value
+	// is set as the CRDLabelKey label of their pods by the mutating webhook.
+	BindingSelectorAnnotationKey = "aadpodidentity.k8s.io/binding-selector"
+
+	// IdentityHeaderAnnotationKey is the annotation with the random X-IDENTITY-HEADER which the mutating
+	// webhook generates for each pod, and which NMI requires in requests of the pod to the App Service
+	// managed identity protocol.
+	IdentityHeaderAnnotationKey = "aadpodidentity.k8s.io/identity-header"
+
 	// BehaviorKey is the key that describes the behavior of aad-pod-identity.
 	// Supported values:
 	// namespaced - used for running in namespaced mode. AzureIdentity,
@@ -68,6 +83,30 @@ const (
 
 	// AssignedIDUnAssigned indicates that an identity has been unassigned from the node.
 	AssignedIDUnAssigned = "Unassigned"
+
+	// AssignedIDOverflowed indicates that an identity could not be assigned to the node because
+	// the node or VMSS has reached the maximum number of user-assigned identities.
+	AssignedIDOverflowed = "Overflowed"
+)
+
+const (
+	// IdentityConditionAssigned indicates whether an AzureIdentity is assigned to any node.
+	IdentityConditionAssigned = "Assigned"
+
+	// IdentityConditionAssignmentFailed indicates whether the last assignment or removal
+	// of an AzureIdentity failed. The reason is the Azure error code.
+	IdentityConditionAssignmentFailed = "AssignmentFailed"
+
+	// IdentityConditionPolicyViolated indicates whether an AzureIdentity violates an AzureIdentityPolicy
+	// which applies to its namespace. Identities which violate a policy are ignored.
+	IdentityConditionPolicyViolated = "PolicyViolated"
+
+	// BindingConditionIdentityFound indicates whether the AzureIdentity referenced by an
+	// AzureIdentityBinding exists.
+	BindingConditionIdentityFound = "IdentityFound"
+
+	// BindingConditionPodsMatched indicates whether an AzureIdentityBinding matches any pod.
+	BindingConditionPodsMatched = "PodsMatched"
 )
 
 // AzureIdentity is the specification of the identity data structure.
@@ -111,6 +150,15 @@ type AzurePodIdentityException struct {
 	Status AzurePodIdentityExceptionStatus `json:"Status"`
 }
 
+// AzureIdentityPolicy restricts the AzureIdentities which can be used in the namespaces it applies to.
+//+k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type AzureIdentityPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec AzureIdentityPolicySpec `json:"spec"`
+}
+
 // AzureIdentityList contains a list of AzureIdentities.
 //+k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type AzureIdentityList struct {
@@ -147,6 +195,15 @@ type AzurePodIdentityExceptionList struct {
 	Items []AzurePodIdentityException `json:"items"`
 }
 
+// AzureIdentityPolicyList contains a list of AzureIdentityPolicies.
+//+k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type AzureIdentityPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []AzureIdentityPolicy `json:"items"`
+}
+
 // IdentityType represents different types of identities.
 //+k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type IdentityType int
@@ -160,6 +217,10 @@ const (
 
 	// ServicePrincipalCertificate represents a service principal certificate.
 	ServicePrincipalCertificate IdentityType = 2
+
+	// FederatedWorkloadIdentity represents an application with a federated credential that trusts
+	// the service account tokens issued by the cluster.
+	FederatedWorkloadIdentity IdentityType = 3
 )
 
 // AzureIdentitySpec describes the credential specifications of an identity on Azure.
@@ -172,6 +233,8 @@ type AzureIdentitySpec struct {
 	ResourceID string `json:"resourceid"`
 	// Both User Assigned MSI and SP can use this field.
 	ClientID string `json:"clientid"`
+	// Object (principal) id of the identity, used to match token requests with object_id.
+	ObjectID string `json:"objectid,omitempty"`
 
 	// Used for service principal
 	ClientPassword api.SecretReference `json:"clientpassword"`
@@ -184,12 +247,24 @@ type AzureIdentitySpec struct {
 	ADEndpoint   string `json:"adendpoint"`
 
 	Replicas *int32 `json:"replicas"`
+
+	// AllowedNamespaces lists the namespaces, other than the namespace of the identity,
+	// whose pods can be bound to the identity.
+	AllowedNamespaces []string `json:"allowednamespaces,omitempty"`
+	// NamespaceSelector selects the namespaces, other than the namespace of the identity,
+	// whose pods can be bound to the identity by their labels.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceselector,omitempty"`
 }
 
 // AzureIdentityStatus contains the replica status of the resource.
 type AzureIdentityStatus struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	AvailableReplicas int32 `json:"availableReplicas"`
+	// AssignedNodes is the number of nodes and VMSS the identity is assigned to.
+	AssignedNodes int32 `json:"assignednodes"`
+	// Conditions report whether the identity is assigned and the last Azure error
+	// encountered while assigning it.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // AssignedIDState represents the state of an AzureAssignedIdentity
@@ -216,6 +291,9 @@ const (
 
 	// AzurePodIdentityExceptionResource is the name of AzureIdentityException.
 	AzurePodIdentityExceptionResource = "azurepodidentityexceptions"
+
+	// AzureIdentityPolicyResource is the name of AzureIdentityPolicy.
+	AzureIdentityPolicyResource = "azureidentitypolicies"
 )
 
 // AzureIdentityBindingSpec matches the pod with the Identity.
@@ -225,14 +303,26 @@ type AzureIdentityBindingSpec struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	AzureIdentity     string `json:"azureidentity"`
 	Selector          string `json:"selector"`
-	// Weight is used to figure out which of the matching identities would be selected.
+	// LabelSelector selects pods in the namespace of the binding by their labels.
+	LabelSelector *metav1.LabelSelector `json:"labelselector,omitempty"`
+	// ServiceAccountName selects pods in the namespace of the binding which run as the service account.
+	ServiceAccountName string `json:"serviceaccountname,omitempty"`
+	// Weight is used to figure out which of the matching identities would be selected
+	// for token requests that do not specify an identity. The highest weight wins.
 	Weight int `json:"weight"`
+	// AllowedResources restricts the resources pods can request tokens for with the identity.
+	// Tokens can be requested for any resource if it is empty.
+	AllowedResources []string `json:"allowedresources,omitempty"`
 }
 
 // AzureIdentityBindingStatus contains the status of an AzureIdentityBinding.
 type AzureIdentityBindingStatus struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	AvailableReplicas int32 `json:"availableReplicas"`
+	// MatchedPods is the number of pods the binding matches.
+	MatchedPods int32 `json:"matchedpods"`
+	// Conditions report whether the referenced identity exists and pods are matched.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // AzureAssignedIdentitySpec contains the relationship
@@ -268,3 +358,21 @@ type AzurePodIdentityExceptionStatus struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	Status            string `json:"status"`
 }
+
+// AzureIdentityPolicySpec describes the namespaces a policy applies to and the identities allowed in them.
+// A policy without namespaces and namespace selector applies to all namespaces. An empty list of allowed
+// values doesn't restrict the identities.
+type AzureIdentityPolicySpec struct {
+	// Namespaces lists the namespaces the policy applies to.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector selects the namespaces the policy applies to by their labels.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceselector,omitempty"`
+	// AllowedResourceIDPrefixes restricts the resource IDs of user-assigned identities, e.g. to
+	// /subscriptions/<subscription-id> or /subscriptions/<subscription-id>/resourceGroups/<resource-group>.
+	AllowedResourceIDPrefixes []string `json:"allowedresourceidprefixes,omitempty"`
+	// AllowedTypes restricts the types of identities.
+	AllowedTypes []IdentityType `json:"allowedtypes,omitempty"`
+	// AllowedTenantIDs restricts the tenant and auxiliary tenants of service principals
+	// and federated workload identities.
+	AllowedTenantIDs []string `json:"allowedtenantids,omitempty"`
+}
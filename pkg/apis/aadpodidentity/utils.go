@@ -1,9 +1,233 @@
 package aadpodidentity
 
+import (
+	"fmt"
+	"strings"
+
+	api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// defaultServiceAccountName is the service account of pods which don't specify one
+const defaultServiceAccountName = "default"
+
 // IsNamespacedIdentity returns true if azureID is a namespaced identity.
 func IsNamespacedIdentity(azureID *AzureIdentity) bool {
-	if val, ok := azureID.Annotations[BehaviorKey]; ok {
-		if val == BehaviorNamespaced {
+	return azureID.IsNamespaced()
+}
+
+// IsNamespaced returns true if the identity has the namespaced behavior annotation.
+func (id *AzureIdentity) IsNamespaced() bool {
+	return id.Annotations[BehaviorKey] == BehaviorNamespaced
+}
+
+// HasNamespacePolicy returns true if the identity lists or selects the namespaces whose pods can be bound to it.
+func (id *AzureIdentity) HasNamespacePolicy() bool {
+	return len(id.Spec.AllowedNamespaces) != 0 || id.Spec.NamespaceSelector != nil
+}
+
+// AllowsNamespace returns true if pods in the namespace can be bound to the identity. Pods in the
+// namespace of the identity are always allowed. If namespaced is set, i.e. the cluster forces identities
+// to be namespaced, pods in other namespaces never are, regardless of the namespace policy of the identity.
+// Otherwise pods in other namespaces are allowed if the namespace is listed in AllowedNamespaces or
+// selected by NamespaceSelector, or, without a namespace policy, unless the identity is namespaced.
+func (id *AzureIdentity) AllowsNamespace(ns *api.Namespace, namespaced bool) (bool, error) {
+	if ns.Name == id.Namespace {
+		return true, nil
+	}
+	if namespaced {
+		return false, nil
+	}
+	if !id.HasNamespacePolicy() {
+		return !id.IsNamespaced(), nil
+	}
+	for _, allowed := range id.Spec.AllowedNamespaces {
+		if allowed == ns.Name {
+			return true, nil
+		}
+	}
+	if id.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(id.Spec.NamespaceSelector)
+		if err != nil {
+			return false, err
+		}
+		return selector.Matches(labels.Set(ns.Labels)), nil
+	}
+	return false, nil
+}
+
+// HasPodSelector returns true if the binding selects pods by LabelSelector or ServiceAccountName
+// in addition to the aadpodidbinding label.
+func (b *AzureIdentityBinding) HasPodSelector() bool {
+	return b.Spec.LabelSelector != nil || b.Spec.ServiceAccountName != ""
+}
+
+// MatchesPod returns true if the binding selects the pod. Selector matches the value of the
+// aadpodidbinding label of the pod in any namespace, whereas LabelSelector and ServiceAccountName
+// only select pods in the namespace of the binding. All of the specified criteria have to match,
+// and a binding without any criteria doesn't select any pod.
+func (b *AzureIdentityBinding) MatchesPod(pod *api.Pod) (bool, error) {
+	if b.Spec.Selector == "" && !b.HasPodSelector() {
+		return false, nil
+	}
+	if b.Spec.Selector != "" && b.Spec.Selector != pod.Labels[CRDLabelKey] {
+		return false, nil
+	}
+	if b.HasPodSelector() && b.Namespace != pod.Namespace {
+		return false, nil
+	}
+	if b.Spec.ServiceAccountName != "" {
+		serviceAccountName := pod.Spec.ServiceAccountName
+		if serviceAccountName == "" {
+			serviceAccountName = defaultServiceAccountName
+		}
+		if b.Spec.ServiceAccountName != serviceAccountName {
+			return false, nil
+		}
+	}
+	if b.Spec.LabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(b.Spec.LabelSelector)
+		if err != nil {
+			return false, err
+		}
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// AppliesTo returns true if the policy applies to identities in the namespace. A policy which neither
+// lists nor selects namespaces applies to all namespaces.
+func (p *AzureIdentityPolicy) AppliesTo(ns *api.Namespace) (bool, error) {
+	if len(p.Spec.Namespaces) == 0 && p.Spec.NamespaceSelector == nil {
+		return true, nil
+	}
+	for _, name := range p.Spec.Namespaces {
+		if name == ns.Name {
+			return true, nil
+		}
+	}
+	if p.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(p.Spec.NamespaceSelector)
+		if err != nil {
+			return false, err
+		}
+		return selector.Matches(labels.Set(ns.Labels)), nil
+	}
+	return false, nil
+}
+
+// Check returns an error describing why the policy doesn't allow the identity, or nil if it does.
+// Resource IDs are only restricted for user-assigned identities, and tenants for service principals
+// and federated workload identities.
+func (p *AzureIdentityPolicy) Check(id *AzureIdentity) error {
+	if len(p.Spec.AllowedTypes) != 0 {
+		allowed := false
+		for _, t := range p.Spec.AllowedTypes {
+			allowed = allowed || t == id.Spec.Type
+		}
+		if !allowed {
+			return fmt.Errorf("identity type %d is not allowed by AzureIdentityPolicy %s", id.Spec.Type, p.Name)
+		}
+	}
+
+	switch id.Spec.Type {
+	case UserAssignedMSI:
+		if len(p.Spec.AllowedResourceIDPrefixes) != 0 && !hasResourceIDPrefix(id.Spec.ResourceID, p.Spec.AllowedResourceIDPrefixes) {
+			return fmt.Errorf("resource ID %s is not allowed by AzureIdentityPolicy %s", id.Spec.ResourceID, p.Name)
+		}
+	case ServicePrincipal, ServicePrincipalCertificate, FederatedWorkloadIdentity:
+		if len(p.Spec.AllowedTenantIDs) == 0 {
+			return nil
+		}
+		for _, tenantID := range append([]string{id.Spec.TenantID}, id.Spec.AuxiliaryTenantIDs...) {
+			if !containsFold(p.Spec.AllowedTenantIDs, tenantID) {
+				return fmt.Errorf("tenant %s is not allowed by AzureIdentityPolicy %s", tenantID, p.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckIdentityPolicies returns an error if one of the policies which apply to ns, the namespace
+// of the identity, doesn't allow the identity.
+func CheckIdentityPolicies(policies []AzureIdentityPolicy, id *AzureIdentity, ns *api.Namespace) error {
+	for i := range policies {
+		applies, err := policies[i].AppliesTo(ns)
+		if err != nil {
+			return fmt.Errorf("failed to check if AzureIdentityPolicy %s applies to namespace %s, error: %+v", policies[i].Name, ns.Name, err)
+		}
+		if !applies {
+			continue
+		}
+		if err := policies[i].Check(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPolicyViolations returns the error of each identity which violates one of the policies that apply
+// to its namespace, or nil if it doesn't, in the order of the identities. The namespaces of the identities
+// are only looked up with getNamespace if a policy selects namespaces by their labels. Identities whose
+// namespace can't be looked up are considered in violation.
+func GetPolicyViolations(policies []AzureIdentityPolicy, identities []AzureIdentity, getNamespace func(name string) (*api.Namespace, error)) []error {
+	violations := make([]error, len(identities))
+	if len(policies) == 0 {
+		return violations
+	}
+
+	selectsNamespaces := SelectsNamespaces(policies)
+	namespaces := make(map[string]*api.Namespace)
+	for i := range identities {
+		id := &identities[i]
+		ns, ok := namespaces[id.Namespace]
+		if !ok {
+			ns = &api.Namespace{ObjectMeta: metav1.ObjectMeta{Name: id.Namespace}}
+			if selectsNamespaces {
+				fetched, err := getNamespace(id.Namespace)
+				if err != nil {
+					violations[i] = fmt.Errorf("failed to get namespace %s to check AzureIdentityPolicies, error: %+v", id.Namespace, err)
+					continue
+				}
+				ns = fetched
+			}
+			namespaces[id.Namespace] = ns
+		}
+		violations[i] = CheckIdentityPolicies(policies, id, ns)
+	}
+	return violations
+}
+
+// SelectsNamespaces returns true if one of the policies selects namespaces by their labels,
+// i.e. the namespace of an identity has to be looked up to check the policies.
+func SelectsNamespaces(policies []AzureIdentityPolicy) bool {
+	for i := range policies {
+		if policies[i].Spec.NamespaceSelector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasResourceIDPrefix returns true if the resource ID is one of the prefixes or is contained in the
+// resource, e.g. the subscription or resource group, identified by one of the prefixes.
+func hasResourceIDPrefix(resourceID string, prefixes []string) bool {
+	resourceID = strings.ToLower(resourceID)
+	for _, prefix := range prefixes {
+		prefix = strings.ToLower(strings.TrimSuffix(prefix, "/"))
+		if prefix != "" && (resourceID == prefix || strings.HasPrefix(resourceID, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
 			return true
 		}
 	}
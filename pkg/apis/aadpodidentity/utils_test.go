@@ -0,0 +1,465 @@
+package aadpodidentity
+
+import (
+	"fmt"
+	"testing"
+
+	api "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMatchesPod(t *testing.T) {
+	pod := &api.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod1",
+			Namespace: "default",
+			Labels:    map[string]string{CRDLabelKey: "select1", "app": "frontend"},
+		},
+		Spec: api.PodSpec{ServiceAccountName: "workload"},
+	}
+
+	cases := []struct {
+		desc        string
+		namespace   string
+		spec        AzureIdentityBindingSpec
+		expected    bool
+		expectedErr bool
+	}{
+		{
+			desc:      "no selector",
+			namespace: "default",
+			expected:  false,
+		},
+		{
+			desc:      "legacy selector",
+			namespace: "default",
+			spec:      AzureIdentityBindingSpec{Selector: "select1"},
+			expected:  true,
+		},
+		{
+			desc:      "legacy selector in another namespace",
+			namespace: "other",
+			spec:      AzureIdentityBindingSpec{Selector: "select1"},
+			expected:  true,
+		},
+		{
+			desc:      "legacy selector mismatch",
+			namespace: "default",
+			spec:      AzureIdentityBindingSpec{Selector: "select2"},
+			expected:  false,
+		},
+		{
+			desc:      "label selector",
+			namespace: "default",
+			spec: AzureIdentityBindingSpec{LabelSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"frontend"}}},
+			}},
+			expected: true,
+		},
+		{
+			desc:      "label selector in another namespace",
+			namespace: "other",
+			spec:      AzureIdentityBindingSpec{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}}},
+			expected:  false,
+		},
+		{
+			desc:      "label selector and legacy selector mismatch",
+			namespace: "default",
+			spec: AzureIdentityBindingSpec{
+				Selector:      "select2",
+				LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}},
+			},
+			expected: false,
+		},
+		{
+			desc:      "service account",
+			namespace: "default",
+			spec:      AzureIdentityBindingSpec{ServiceAccountName: "workload"},
+			expected:  true,
+		},
+		{
+			desc:      "service account mismatch",
+			namespace: "default",
+			spec: AzureIdentityBindingSpec{
+				ServiceAccountName: "default",
+				LabelSelector:      &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}},
+			},
+			expected: false,
+		},
+		{
+			desc:      "invalid label selector",
+			namespace: "default",
+			spec: AzureIdentityBindingSpec{LabelSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Invalid"}},
+			}},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			binding := &AzureIdentityBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: "binding1", Namespace: tc.namespace},
+				Spec:       tc.spec,
+			}
+			matched, err := binding.MatchesPod(pod)
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedErr, err)
+			}
+			if matched != tc.expected {
+				t.Fatalf("expected matched to be %v, got: %v", tc.expected, matched)
+			}
+		})
+	}
+}
+
+func TestAllowsNamespace(t *testing.T) {
+	ns := &api.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "tenant1",
+			Labels: map[string]string{"team": "payments"},
+		},
+	}
+
+	cases := []struct {
+		desc        string
+		namespace   string
+		annotations map[string]string
+		spec        AzureIdentitySpec
+		namespaced  bool
+		expected    bool
+		expectedErr bool
+	}{
+		{
+			desc:      "same namespace",
+			namespace: "tenant1",
+			spec:      AzureIdentitySpec{AllowedNamespaces: []string{"tenant2"}},
+			expected:  true,
+		},
+		{
+			desc:      "no namespace policy",
+			namespace: "platform",
+			expected:  true,
+		},
+		{
+			desc:       "no namespace policy in namespaced mode",
+			namespace:  "platform",
+			namespaced: true,
+			expected:   false,
+		},
+		{
+			desc:        "no namespace policy for namespaced identity",
+			namespace:   "platform",
+			annotations: map[string]string{BehaviorKey: BehaviorNamespaced},
+			expected:    false,
+		},
+		{
+			desc:      "allowed namespace",
+			namespace: "platform",
+			spec:      AzureIdentitySpec{AllowedNamespaces: []string{"tenant2", "tenant1"}},
+			expected:  true,
+		},
+		{
+			desc:       "allowed namespace in namespaced mode",
+			namespace:  "platform",
+			spec:       AzureIdentitySpec{AllowedNamespaces: []string{"tenant1"}},
+			namespaced: true,
+			expected:   false,
+		},
+		{
+			desc:       "selected namespace in namespaced mode",
+			namespace:  "platform",
+			spec:       AzureIdentitySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}},
+			namespaced: true,
+			expected:   false,
+		},
+		{
+			desc:        "allowed namespace for namespaced identity",
+			namespace:   "platform",
+			annotations: map[string]string{BehaviorKey: BehaviorNamespaced},
+			spec:        AzureIdentitySpec{AllowedNamespaces: []string{"tenant1"}},
+			expected:    true,
+		},
+		{
+			desc:      "namespace not allowed",
+			namespace: "platform",
+			spec:      AzureIdentitySpec{AllowedNamespaces: []string{"tenant2"}},
+			expected:  false,
+		},
+		{
+			desc:      "namespace selected",
+			namespace: "platform",
+			spec:      AzureIdentitySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}}},
+			expected:  true,
+		},
+		{
+			desc:      "namespace not selected",
+			namespace: "platform",
+			spec:      AzureIdentitySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "checkout"}}},
+			expected:  false,
+		},
+		{
+			desc:      "invalid namespace selector",
+			namespace: "platform",
+			spec: AzureIdentitySpec{NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Unknown"}},
+			}},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			id := &AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{Name: "id1", Namespace: tc.namespace, Annotations: tc.annotations},
+				Spec:       tc.spec,
+			}
+			allowed, err := id.AllowsNamespace(ns, tc.namespaced)
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedErr, err)
+			}
+			if allowed != tc.expected {
+				t.Fatalf("expected %v, got: %v", tc.expected, allowed)
+			}
+		})
+	}
+}
+
+func TestAppliesTo(t *testing.T) {
+	ns := &api.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "tenant1",
+			Labels: map[string]string{"team": "payments"},
+		},
+	}
+
+	cases := []struct {
+		desc        string
+		spec        AzureIdentityPolicySpec
+		expected    bool
+		expectedErr bool
+	}{
+		{
+			desc:     "all namespaces",
+			expected: true,
+		},
+		{
+			desc:     "listed namespace",
+			spec:     AzureIdentityPolicySpec{Namespaces: []string{"tenant2", "tenant1"}},
+			expected: true,
+		},
+		{
+			desc:     "namespace not listed",
+			spec:     AzureIdentityPolicySpec{Namespaces: []string{"tenant2"}},
+			expected: false,
+		},
+		{
+			desc: "namespace selected",
+			spec: AzureIdentityPolicySpec{
+				Namespaces:        []string{"tenant2"},
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			},
+			expected: true,
+		},
+		{
+			desc:     "namespace not selected",
+			spec:     AzureIdentityPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "checkout"}}},
+			expected: false,
+		},
+		{
+			desc: "invalid namespace selector",
+			spec: AzureIdentityPolicySpec{NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Unknown"}},
+			}},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			policy := &AzureIdentityPolicy{ObjectMeta: metav1.ObjectMeta{Name: "policy1"}, Spec: tc.spec}
+			applies, err := policy.AppliesTo(ns)
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedErr, err)
+			}
+			if applies != tc.expected {
+				t.Fatalf("expected %v, got: %v", tc.expected, applies)
+			}
+		})
+	}
+}
+
+func TestCheckIdentityPolicy(t *testing.T) {
+	resourceID := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1"
+
+	cases := []struct {
+		desc    string
+		spec    AzureIdentityPolicySpec
+		id      AzureIdentitySpec
+		allowed bool
+	}{
+		{
+			desc:    "no restrictions",
+			id:      AzureIdentitySpec{Type: UserAssignedMSI, ResourceID: resourceID},
+			allowed: true,
+		},
+		{
+			desc:    "allowed type",
+			spec:    AzureIdentityPolicySpec{AllowedTypes: []IdentityType{ServicePrincipal, UserAssignedMSI}},
+			id:      AzureIdentitySpec{Type: UserAssignedMSI, ResourceID: resourceID},
+			allowed: true,
+		},
+		{
+			desc:    "type not allowed",
+			spec:    AzureIdentityPolicySpec{AllowedTypes: []IdentityType{UserAssignedMSI}},
+			id:      AzureIdentitySpec{Type: ServicePrincipal, TenantID: "tenant1"},
+			allowed: false,
+		},
+		{
+			desc:    "subscription allowed",
+			spec:    AzureIdentityPolicySpec{AllowedResourceIDPrefixes: []string{"/subscriptions/SUB1/"}},
+			id:      AzureIdentitySpec{Type: UserAssignedMSI, ResourceID: resourceID},
+			allowed: true,
+		},
+		{
+			desc:    "resource group allowed",
+			spec:    AzureIdentityPolicySpec{AllowedResourceIDPrefixes: []string{"/subscriptions/sub2", "/subscriptions/sub1/resourceGroups/rg1"}},
+			id:      AzureIdentitySpec{Type: UserAssignedMSI, ResourceID: resourceID},
+			allowed: true,
+		},
+		{
+			desc:    "resource group with the same prefix not allowed",
+			spec:    AzureIdentityPolicySpec{AllowedResourceIDPrefixes: []string{"/subscriptions/sub1/resourceGroups/rg"}},
+			id:      AzureIdentitySpec{Type: UserAssignedMSI, ResourceID: resourceID},
+			allowed: false,
+		},
+		{
+			desc:    "resource IDs of service principals are not restricted",
+			spec:    AzureIdentityPolicySpec{AllowedResourceIDPrefixes: []string{"/subscriptions/sub2"}},
+			id:      AzureIdentitySpec{Type: ServicePrincipal, TenantID: "tenant1"},
+			allowed: true,
+		},
+		{
+			desc:    "tenant allowed",
+			spec:    AzureIdentityPolicySpec{AllowedTenantIDs: []string{"TENANT1", "tenant2"}},
+			id:      AzureIdentitySpec{Type: ServicePrincipal, TenantID: "tenant1", AuxiliaryTenantIDs: []string{"tenant2"}},
+			allowed: true,
+		},
+		{
+			desc:    "auxiliary tenant not allowed",
+			spec:    AzureIdentityPolicySpec{AllowedTenantIDs: []string{"tenant1"}},
+			id:      AzureIdentitySpec{Type: ServicePrincipal, TenantID: "tenant1", AuxiliaryTenantIDs: []string{"tenant2"}},
+			allowed: false,
+		},
+		{
+			desc:    "tenant of federated workload identity not allowed",
+			spec:    AzureIdentityPolicySpec{AllowedTenantIDs: []string{"tenant1"}},
+			id:      AzureIdentitySpec{Type: FederatedWorkloadIdentity, TenantID: "tenant2"},
+			allowed: false,
+		},
+		{
+			desc:    "tenants of user-assigned identities are not restricted",
+			spec:    AzureIdentityPolicySpec{AllowedTenantIDs: []string{"tenant1"}},
+			id:      AzureIdentitySpec{Type: UserAssignedMSI, ResourceID: resourceID},
+			allowed: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			policy := &AzureIdentityPolicy{ObjectMeta: metav1.ObjectMeta{Name: "policy1"}, Spec: tc.spec}
+			id := &AzureIdentity{ObjectMeta: metav1.ObjectMeta{Name: "id1", Namespace: "tenant1"}, Spec: tc.id}
+			err := policy.Check(id)
+			if tc.allowed != (err == nil) {
+				t.Fatalf("expected allowed: %v, got error: %v", tc.allowed, err)
+			}
+		})
+	}
+}
+
+func TestCheckIdentityPolicies(t *testing.T) {
+	ns := &api.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant1"}}
+	id := &AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "id1", Namespace: "tenant1"},
+		Spec:       AzureIdentitySpec{Type: ServicePrincipal, TenantID: "tenant1"},
+	}
+	policies := []AzureIdentityPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "all"},
+			Spec:       AzureIdentityPolicySpec{AllowedTenantIDs: []string{"tenant1"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-namespace"},
+			Spec:       AzureIdentityPolicySpec{Namespaces: []string{"tenant2"}, AllowedTypes: []IdentityType{UserAssignedMSI}},
+		},
+	}
+	if err := CheckIdentityPolicies(policies, id, ns); err != nil {
+		t.Fatalf("expected identity to be allowed, got error: %v", err)
+	}
+
+	// every policy which applies to the namespace has to allow the identity
+	policies[1].Spec.Namespaces = []string{"tenant1"}
+	if err := CheckIdentityPolicies(policies, id, ns); err == nil {
+		t.Fatalf("expected identity to violate AzureIdentityPolicy other-namespace")
+	}
+	if SelectsNamespaces(policies) {
+		t.Fatalf("expected policies not to select namespaces by their labels")
+	}
+}
+
+func TestGetPolicyViolations(t *testing.T) {
+	identities := []AzureIdentity{
+		{ObjectMeta: metav1.ObjectMeta{Name: "id1", Namespace: "restricted"}, Spec: AzureIdentitySpec{Type: ServicePrincipal}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "id2", Namespace: "restricted"}, Spec: AzureIdentitySpec{Type: UserAssignedMSI}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "id3", Namespace: "open"}, Spec: AzureIdentitySpec{Type: ServicePrincipal}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "id4", Namespace: "missing"}, Spec: AzureIdentitySpec{Type: ServicePrincipal}},
+	}
+	namespaces := map[string]*api.Namespace{
+		"restricted": {ObjectMeta: metav1.ObjectMeta{Name: "restricted", Labels: map[string]string{"tier": "restricted"}}},
+		"open":       {ObjectMeta: metav1.ObjectMeta{Name: "open"}},
+	}
+	lookups := 0
+	getNamespace := func(name string) (*api.Namespace, error) {
+		lookups++
+		if ns, ok := namespaces[name]; ok {
+			return ns, nil
+		}
+		return nil, fmt.Errorf("namespace %s not found", name)
+	}
+
+	policies := []AzureIdentityPolicy{{
+		ObjectMeta: metav1.ObjectMeta{Name: "restricted"},
+		Spec: AzureIdentityPolicySpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "restricted"}},
+			AllowedTypes:      []IdentityType{UserAssignedMSI},
+		},
+	}}
+	violations := GetPolicyViolations(policies, identities, getNamespace)
+	for i, expectedViolation := range []bool{true, false, false, true} {
+		if (violations[i] != nil) != expectedViolation {
+			t.Errorf("expected violation of identity %s: %v, got: %v", identities[i].Name, expectedViolation, violations[i])
+		}
+	}
+	// every namespace is looked up once
+	if lookups != 3 {
+		t.Errorf("expected 3 namespace lookups, got: %d", lookups)
+	}
+
+	// namespaces are not looked up if no policy selects them by their labels
+	lookups = 0
+	policies[0].Spec.NamespaceSelector = nil
+	policies[0].Spec.Namespaces = []string{"missing"}
+	violations = GetPolicyViolations(policies, identities, getNamespace)
+	for i, expectedViolation := range []bool{false, false, false, true} {
+		if (violations[i] != nil) != expectedViolation {
+			t.Errorf("expected violation of identity %s: %v, got: %v", identities[i].Name, expectedViolation, violations[i])
+		}
+	}
+	if lookups != 0 {
+		t.Errorf("expected no namespace lookups, got: %d", lookups)
+	}
+
+	if violations := GetPolicyViolations(nil, identities, getNamespace); len(violations) != len(identities) || violations[3] != nil {
+		t.Errorf("expected no violations without policies, got: %v", violations)
+	}
+}
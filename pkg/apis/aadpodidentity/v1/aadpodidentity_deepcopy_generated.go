@@ -21,6 +21,7 @@ limitations under the License.
 package v1
 
 import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -227,6 +228,16 @@ func (in *AzureIdentityBindingList) DeepCopyObject() runtime.Object {
 func (in *AzureIdentityBindingSpec) DeepCopyInto(out *AzureIdentityBindingSpec) {
 	*out = *in
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.LabelSelector != nil {
+		in, out := &in.LabelSelector, &out.LabelSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AllowedResources != nil {
+		in, out := &in.AllowedResources, &out.AllowedResources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -244,6 +255,13 @@ func (in *AzureIdentityBindingSpec) DeepCopy() *AzureIdentityBindingSpec {
 func (in *AzureIdentityBindingStatus) DeepCopyInto(out *AzureIdentityBindingStatus) {
 	*out = *in
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -290,6 +308,107 @@ func (in *AzureIdentityList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureIdentityPolicy) DeepCopyInto(out *AzureIdentityPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureIdentityPolicy.
+func (in *AzureIdentityPolicy) DeepCopy() *AzureIdentityPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureIdentityPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *AzureIdentityPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureIdentityPolicyList) DeepCopyInto(out *AzureIdentityPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]AzureIdentityPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureIdentityPolicyList.
+func (in *AzureIdentityPolicyList) DeepCopy() *AzureIdentityPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureIdentityPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *AzureIdentityPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AzureIdentityPolicySpec) DeepCopyInto(out *AzureIdentityPolicySpec) {
+	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AllowedResourceIDPrefixes != nil {
+		in, out := &in.AllowedResourceIDPrefixes, &out.AllowedResourceIDPrefixes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedTypes != nil {
+		in, out := &in.AllowedTypes, &out.AllowedTypes
+		*out = make([]IdentityType, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedTenantIDs != nil {
+		in, out := &in.AllowedTenantIDs, &out.AllowedTenantIDs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureIdentityPolicySpec.
+func (in *AzureIdentityPolicySpec) DeepCopy() *AzureIdentityPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AzureIdentityPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureIdentitySpec) DeepCopyInto(out *AzureIdentitySpec) {
 	*out = *in
@@ -300,6 +419,16 @@ func (in *AzureIdentitySpec) DeepCopyInto(out *AzureIdentitySpec) {
 		*out = new(int32)
 		**out = **in
 	}
+	if in.AllowedNamespaces != nil {
+		in, out := &in.AllowedNamespaces, &out.AllowedNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -317,6 +446,13 @@ func (in *AzureIdentitySpec) DeepCopy() *AzureIdentitySpec {
 func (in *AzureIdentityStatus) DeepCopyInto(out *AzureIdentityStatus) {
 	*out = *in
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -14,10 +14,13 @@ func ConvertV1BindingToInternalBinding(identityBinding AzureIdentityBinding) (re
 		TypeMeta:   identityBinding.TypeMeta,
 		ObjectMeta: identityBinding.ObjectMeta,
 		Spec: aadpodid.AzureIdentityBindingSpec{
-			ObjectMeta:    identityBinding.Spec.ObjectMeta,
-			AzureIdentity: identityBinding.Spec.AzureIdentity,
-			Selector:      identityBinding.Spec.Selector,
-			Weight:        identityBinding.Spec.Weight,
+			ObjectMeta:         identityBinding.Spec.ObjectMeta,
+			AzureIdentity:      identityBinding.Spec.AzureIdentity,
+			Selector:           identityBinding.Spec.Selector,
+			LabelSelector:      identityBinding.Spec.LabelSelector,
+			ServiceAccountName: identityBinding.Spec.ServiceAccountName,
+			Weight:             identityBinding.Spec.Weight,
+			AllowedResources:   identityBinding.Spec.AllowedResources,
 		},
 		Status: aadpodid.AzureIdentityBindingStatus(identityBinding.Status),
 	}
@@ -33,12 +36,15 @@ func ConvertV1IdentityToInternalIdentity(identity AzureIdentity) (resIdentity aa
 			Type:               aadpodid.IdentityType(identity.Spec.Type),
 			ResourceID:         identity.Spec.ResourceID,
 			ClientID:           identity.Spec.ClientID,
+			ObjectID:           identity.Spec.ObjectID,
 			ClientPassword:     identity.Spec.ClientPassword,
 			TenantID:           identity.Spec.TenantID,
 			AuxiliaryTenantIDs: identity.Spec.AuxiliaryTenantIDs,
 			ADResourceID:       identity.Spec.ADResourceID,
 			ADEndpoint:         identity.Spec.ADEndpoint,
 			Replicas:           identity.Spec.Replicas,
+			AllowedNamespaces:  identity.Spec.AllowedNamespaces,
+			NamespaceSelector:  identity.Spec.NamespaceSelector,
 		},
 		Status: aadpodid.AzureIdentityStatus(identity.Status),
 	}
@@ -84,16 +90,39 @@ func ConvertV1PodIdentityExceptionToInternalPodIdentityException(idException Azu
 	}
 }
 
+// ConvertV1IdentityPolicyToInternalIdentityPolicy converts v1.AzureIdentityPolicy to an internal AzureIdentityPolicy type.
+func ConvertV1IdentityPolicyToInternalIdentityPolicy(policy AzureIdentityPolicy) (resPolicy aadpodid.AzureIdentityPolicy) {
+	var allowedTypes []aadpodid.IdentityType
+	for _, t := range policy.Spec.AllowedTypes {
+		allowedTypes = append(allowedTypes, aadpodid.IdentityType(t))
+	}
+
+	return aadpodid.AzureIdentityPolicy{
+		TypeMeta:   policy.TypeMeta,
+		ObjectMeta: policy.ObjectMeta,
+		Spec: aadpodid.AzureIdentityPolicySpec{
+			Namespaces:                policy.Spec.Namespaces,
+			NamespaceSelector:         policy.Spec.NamespaceSelector,
+			AllowedResourceIDPrefixes: policy.Spec.AllowedResourceIDPrefixes,
+			AllowedTypes:              allowedTypes,
+			AllowedTenantIDs:          policy.Spec.AllowedTenantIDs,
+		},
+	}
+}
+
 // ConvertInternalBindingToV1Binding converts an internal AzureIdentityBinding type to v1.AzureIdentityBinding.
 func ConvertInternalBindingToV1Binding(identityBinding aadpodid.AzureIdentityBinding) (resIdentityBinding AzureIdentityBinding) {
 	out := AzureIdentityBinding{
 		TypeMeta:   identityBinding.TypeMeta,
 		ObjectMeta: identityBinding.ObjectMeta,
 		Spec: AzureIdentityBindingSpec{
-			ObjectMeta:    identityBinding.Spec.ObjectMeta,
-			AzureIdentity: identityBinding.Spec.AzureIdentity,
-			Selector:      identityBinding.Spec.Selector,
-			Weight:        identityBinding.Spec.Weight,
+			ObjectMeta:         identityBinding.Spec.ObjectMeta,
+			AzureIdentity:      identityBinding.Spec.AzureIdentity,
+			Selector:           identityBinding.Spec.Selector,
+			LabelSelector:      identityBinding.Spec.LabelSelector,
+			ServiceAccountName: identityBinding.Spec.ServiceAccountName,
+			Weight:             identityBinding.Spec.Weight,
+			AllowedResources:   identityBinding.Spec.AllowedResources,
 		},
 		Status: AzureIdentityBindingStatus(identityBinding.Status),
 	}
@@ -116,12 +145,15 @@ func ConvertInternalIdentityToV1Identity(identity aadpodid.AzureIdentity) (resId
 			Type:               IdentityType(identity.Spec.Type),
 			ResourceID:         identity.Spec.ResourceID,
 			ClientID:           identity.Spec.ClientID,
+			ObjectID:           identity.Spec.ObjectID,
 			ClientPassword:     identity.Spec.ClientPassword,
 			TenantID:           identity.Spec.TenantID,
 			AuxiliaryTenantIDs: identity.Spec.AuxiliaryTenantIDs,
 			ADResourceID:       identity.Spec.ADResourceID,
 			ADEndpoint:         identity.Spec.ADEndpoint,
 			Replicas:           identity.Spec.Replicas,
+			AllowedNamespaces:  identity.Spec.AllowedNamespaces,
+			NamespaceSelector:  identity.Spec.NamespaceSelector,
 		},
 		Status: AzureIdentityStatus(identity.Status),
 	}
@@ -32,9 +32,12 @@ func CreateV1Binding() (retV1Binding AzureIdentityBinding) {
 			APIVersion: "aadpodidentity.k8s.io/v1",
 		},
 		Spec: AzureIdentityBindingSpec{
-			AzureIdentity: identityName,
-			Selector:      selectorName,
-			Weight:        weight,
+			AzureIdentity:      identityName,
+			Selector:           selectorName,
+			LabelSelector:      &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}},
+			ServiceAccountName: "workload",
+			Weight:             weight,
+			AllowedResources:   []string{"https://vault.azure.net"},
 		},
 		Status: AzureIdentityBindingStatus{
 			AvailableReplicas: replicas,
@@ -52,9 +55,11 @@ func CreateV1Identity() (retV1Identity AzureIdentity) {
 			APIVersion: "aadpodidentity.k8s.io/v1",
 		},
 		Spec: AzureIdentitySpec{
-			Type:       idTypeV1,
-			ResourceID: rID,
-			Replicas:   &replicas,
+			Type:              idTypeV1,
+			ResourceID:        rID,
+			Replicas:          &replicas,
+			AllowedNamespaces: []string{"tenant1"},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
 		},
 		Status: AzureIdentityStatus{
 			AvailableReplicas: replicas,
@@ -96,9 +101,12 @@ func CreateInternalBinding() (retV1Binding aadpodid.AzureIdentityBinding) {
 			APIVersion: "aadpodidentity.k8s.io/v1",
 		},
 		Spec: aadpodid.AzureIdentityBindingSpec{
-			AzureIdentity: identityName,
-			Selector:      selectorName,
-			Weight:        weight,
+			AzureIdentity:      identityName,
+			Selector:           selectorName,
+			LabelSelector:      &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}},
+			ServiceAccountName: "workload",
+			Weight:             weight,
+			AllowedResources:   []string{"https://vault.azure.net"},
 		},
 		Status: aadpodid.AzureIdentityBindingStatus{
 			AvailableReplicas: replicas,
@@ -116,9 +124,11 @@ func CreateInternalIdentity() (retInternalIdentity aadpodid.AzureIdentity) {
 			APIVersion: "aadpodidentity.k8s.io/v1",
 		},
 		Spec: aadpodid.AzureIdentitySpec{
-			Type:       idTypeInternal,
-			ResourceID: rID,
-			Replicas:   &replicas,
+			Type:              idTypeInternal,
+			ResourceID:        rID,
+			Replicas:          &replicas,
+			AllowedNamespaces: []string{"tenant1"},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
 		},
 		Status: aadpodid.AzureIdentityStatus{
 			AvailableReplicas: replicas,
@@ -238,6 +248,29 @@ func TestConvertInternalIdentityToV1Identity(t *testing.T) {
 	}
 }
 
+func TestConvertFederatedWorkloadIdentity(t *testing.T) {
+	idV1 := CreateV1Identity()
+	idV1.Spec.Type = FederatedWorkloadIdentity
+	idV1.Spec.ResourceID = ""
+	idV1.Spec.ClientID = "clientID"
+	idV1.Spec.ObjectID = "objectID"
+	idV1.Spec.TenantID = "tenantID"
+
+	idInternal := CreateInternalIdentity()
+	idInternal.Spec.Type = aadpodid.FederatedWorkloadIdentity
+	idInternal.Spec.ResourceID = ""
+	idInternal.Spec.ClientID = "clientID"
+	idInternal.Spec.ObjectID = "objectID"
+	idInternal.Spec.TenantID = "tenantID"
+
+	if !cmp.Equal(idInternal, ConvertV1IdentityToInternalIdentity(idV1)) {
+		t.Errorf("Failed to convert from v1 to internal AzureIdentity")
+	}
+	if !cmp.Equal(idV1, ConvertInternalIdentityToV1Identity(idInternal)) {
+		t.Errorf("Failed to convert from internal to v1 AzureIdentity")
+	}
+}
+
 func TestConvertInternalAssignedIdentityToV1AssignedIdentity(t *testing.T) {
 	assignedIDInternal := CreateInternalAssignedIdentity()
 
@@ -259,3 +292,34 @@ func TestConvertV1PodIdentityExceptionToInternalPodIdentityException(t *testing.
 		t.Errorf("Failed to convert from v1 to internal AzureAssignedIdentity")
 	}
 }
+
+func TestConvertV1IdentityPolicyToInternalIdentityPolicy(t *testing.T) {
+	policyV1 := AzureIdentityPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: objectMetaName,
+		},
+		Spec: AzureIdentityPolicySpec{
+			Namespaces:                []string{"team-a"},
+			NamespaceSelector:         &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			AllowedResourceIDPrefixes: []string{"/subscriptions/sub/resourceGroups/rg"},
+			AllowedTypes:              []IdentityType{UserAssignedMSI, FederatedWorkloadIdentity},
+			AllowedTenantIDs:          []string{"tenantID"},
+		},
+	}
+	policyInternal := aadpodid.AzureIdentityPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: objectMetaName,
+		},
+		Spec: aadpodid.AzureIdentityPolicySpec{
+			Namespaces:                []string{"team-a"},
+			NamespaceSelector:         &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			AllowedResourceIDPrefixes: []string{"/subscriptions/sub/resourceGroups/rg"},
+			AllowedTypes:              []aadpodid.IdentityType{aadpodid.UserAssignedMSI, aadpodid.FederatedWorkloadIdentity},
+			AllowedTenantIDs:          []string{"tenantID"},
+		},
+	}
+
+	if !cmp.Equal(policyInternal, ConvertV1IdentityPolicyToInternalIdentityPolicy(policyV1)) {
+		t.Errorf("Failed to convert from v1 to internal AzureIdentityPolicy")
+	}
+}
@@ -33,6 +33,10 @@ const (
 
 	// AssignedIDUnAssigned indicates that an identity has been unassigned from the node.
 	AssignedIDUnAssigned = "Unassigned"
+
+	// AssignedIDOverflowed indicates that an identity could not be assigned to the node because
+	// the node or VMSS has reached the maximum number of user-assigned identities.
+	AssignedIDOverflowed = "Overflowed"
 )
 
 // AzureIdentity is the specification of the identity data structure.
@@ -76,6 +80,15 @@ type AzurePodIdentityException struct {
 	Status AzurePodIdentityExceptionStatus `json:"status"`
 }
 
+// AzureIdentityPolicy restricts the AzureIdentities which can be used in the namespaces it applies to.
+//+k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type AzureIdentityPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec AzureIdentityPolicySpec `json:"spec"`
+}
+
 // AzureIdentityList contains a list of AzureIdentities.
 //+k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type AzureIdentityList struct {
@@ -112,6 +125,15 @@ type AzurePodIdentityExceptionList struct {
 	Items []AzurePodIdentityException `json:"items"`
 }
 
+// AzureIdentityPolicyList contains a list of AzureIdentityPolicies.
+//+k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type AzureIdentityPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []AzureIdentityPolicy `json:"items"`
+}
+
 // IdentityType represents different types of identities.
 //+k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type IdentityType int
@@ -122,6 +144,10 @@ const (
 
 	// ServicePrincipal represents a service principal.
 	ServicePrincipal IdentityType = 1
+
+	// FederatedWorkloadIdentity represents an application with a federated credential that trusts
+	// the service account tokens issued by the cluster.
+	FederatedWorkloadIdentity IdentityType = 3
 )
 
 // AzureIdentitySpec describes the credential specifications of an identity on Azure.
@@ -134,6 +160,8 @@ type AzureIdentitySpec struct {
 	ResourceID string `json:"resourceID"`
 	// Both User Assigned MSI and SP can use this field.
 	ClientID string `json:"clientID"`
+	// Object (principal) id of the identity, used to match token requests with object_id.
+	ObjectID string `json:"objectID,omitempty"`
 
 	// Used for service principal
 	ClientPassword api.SecretReference `json:"clientPassword"`
@@ -146,12 +174,24 @@ type AzureIdentitySpec struct {
 	ADEndpoint   string `json:"adEndpoint"`
 
 	Replicas *int32 `json:"replicas"`
+
+	// AllowedNamespaces lists the namespaces, other than the namespace of the identity,
+	// whose pods can be bound to the identity.
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+	// NamespaceSelector selects the namespaces, other than the namespace of the identity,
+	// whose pods can be bound to the identity by their labels.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
 }
 
 // AzureIdentityStatus contains the replica status of the resource.
 type AzureIdentityStatus struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	AvailableReplicas int32 `json:"availableReplicas"`
+	// AssignedNodes is the number of nodes and VMSS the identity is assigned to.
+	AssignedNodes int32 `json:"assignedNodes"`
+	// Conditions report whether the identity is assigned and the last Azure error
+	// encountered while assigning it.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // AssignedIDState represents the state of an AzureAssignedIdentity
@@ -178,6 +218,9 @@ const (
 
 	// AzurePodIdentityExceptionResource is the name of AzureIdentityException.
 	AzurePodIdentityExceptionResource = "azurepodidentityexceptions"
+
+	// AzureIdentityPolicyResource is the name of AzureIdentityPolicy.
+	AzureIdentityPolicyResource = "azureidentitypolicies"
 )
 
 // AzureIdentityBindingSpec matches the pod with the Identity.
@@ -187,14 +230,26 @@ type AzureIdentityBindingSpec struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	AzureIdentity     string `json:"azureIdentity"`
 	Selector          string `json:"selector"`
-	// Weight is used to figure out which of the matching identities would be selected.
+	// LabelSelector selects pods in the namespace of the binding by their labels.
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	// ServiceAccountName selects pods in the namespace of the binding which run as the service account.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// Weight is used to figure out which of the matching identities would be selected
+	// for token requests that do not specify an identity. The highest weight wins.
 	Weight int `json:"weight"`
+	// AllowedResources restricts the resources pods can request tokens for with the identity.
+	// Tokens can be requested for any resource if it is empty.
+	AllowedResources []string `json:"allowedResources,omitempty"`
 }
 
 // AzureIdentityBindingStatus contains the status of an AzureIdentityBinding.
 type AzureIdentityBindingStatus struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	AvailableReplicas int32 `json:"availableReplicas"`
+	// MatchedPods is the number of pods the binding matches.
+	MatchedPods int32 `json:"matchedPods"`
+	// Conditions report whether the referenced identity exists and pods are matched.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // AzureAssignedIdentitySpec contains the relationship
@@ -230,3 +285,21 @@ type AzurePodIdentityExceptionStatus struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 	Status            string `json:"status"`
 }
+
+// AzureIdentityPolicySpec describes the namespaces a policy applies to and the identities allowed in them.
+// A policy without namespaces and namespace selector applies to all namespaces. An empty list of allowed
+// values doesn't restrict the identities.
+type AzureIdentityPolicySpec struct {
+	// Namespaces lists the namespaces the policy applies to.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector selects the namespaces the policy applies to by their labels.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// AllowedResourceIDPrefixes restricts the resource IDs of user-assigned identities, e.g. to
+	// /subscriptions/<subscription-id> or /subscriptions/<subscription-id>/resourceGroups/<resource-group>.
+	AllowedResourceIDPrefixes []string `json:"allowedResourceIDPrefixes,omitempty"`
+	// AllowedTypes restricts the types of identities.
+	AllowedTypes []IdentityType `json:"allowedTypes,omitempty"`
+	// AllowedTenantIDs restricts the tenant and auxiliary tenants of service principals
+	// and federated workload identities.
+	AllowedTenantIDs []string `json:"allowedTenantIDs,omitempty"`
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/rsa"
 	"fmt"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
@@ -17,9 +19,29 @@ import (
 
 const (
 	defaultActiveDirectoryEndpoint = "https://login.microsoftonline.com/"
+	// clientAssertionType is the client assertion type for JWT bearer tokens (RFC 7523)
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
 )
 
-var reporter *metrics.Reporter
+var (
+	reporter *metrics.Reporter
+	// msiEndpoint overrides the token endpoint of the Azure Instance Metadata Service
+	msiEndpoint string
+)
+
+// SetMSIEndpoint overrides the MSI endpoint from which the tokens of managed identities
+// are acquired, e.g. with a fake in tests. An empty endpoint restores the default.
+func SetMSIEndpoint(endpoint string) {
+	msiEndpoint = endpoint
+}
+
+// getMSIEndpoint returns the overridden MSI endpoint or the default one of the VM
+func getMSIEndpoint() (string, error) {
+	if msiEndpoint != "" {
+		return msiEndpoint, nil
+	}
+	return adal.GetMSIVMEndpoint()
+}
 
 // GetServicePrincipalTokenFromMSI return the token for the assigned user
 func GetServicePrincipalTokenFromMSI(resource string) (*adal.Token, error) {
@@ -40,12 +62,12 @@ func GetServicePrincipalTokenFromMSI(resource string) (*adal.Token, error) {
 		}
 	}()
 
-	msiEndpoint, err := adal.GetMSIVMEndpoint()
+	endpoint, err := getMSIEndpoint()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get the MSI endpoint, error: %+v", err)
 	}
 	// Set up the configuration of the service principal
-	spt, err := adal.NewServicePrincipalTokenFromMSI(msiEndpoint, resource)
+	spt, err := adal.NewServicePrincipalTokenFromMSI(endpoint, resource)
 	if err != nil {
 		return nil, fmt.Errorf("failed to acquire a token for MSI, error: %+v", err)
 	}
@@ -77,17 +99,58 @@ func GetServicePrincipalTokenFromMSIWithUserAssignedID(clientID, resource string
 		}
 	}()
 
-	msiEndpoint, err := adal.GetMSIVMEndpoint()
+	endpoint, err := getMSIEndpoint()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get the MSI endpoint, error: %+v", err)
 	}
 	// The ID of the user for whom the token is requested
 	userAssignedID := clientID
 	// Set up the configuration of the service principal
-	spt, err := adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, resource, userAssignedID)
+	spt, err := adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(endpoint, resource, userAssignedID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire a token using the MSI VM extension, error: %+v", err)
+	}
+
+	// obtain a fresh token
+	err = spt.Refresh()
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token, error: %+v", err)
+	}
+	token := spt.Token()
+	return &token, nil
+}
+
+// GetServicePrincipalTokenFromMSIWithIdentityResourceID return the token for the assigned user
+// identified by its resource ID, so that a client ID cannot select another identity on the node
+func GetServicePrincipalTokenFromMSIWithIdentityResourceID(resourceID, resource string) (*adal.Token, error) {
+	begin := time.Now()
+	var err error
+
+	defer func() {
+		if err != nil {
+			err = reporter.ReportIMDSOperationError(metrics.AdalTokenFromMSIWithUserAssignedIDOperationName)
+			if err != nil {
+				klog.Warningf("failed to report metrics, error: %+v", err)
+			}
+			return
+		}
+		err = reporter.ReportIMDSOperationDuration(metrics.AdalTokenFromMSIWithUserAssignedIDOperationName, time.Since(begin))
+		if err != nil {
+			klog.Warningf("failed to report metrics, error: %+v", err)
+		}
+	}()
+
+	endpoint, err := getMSIEndpoint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the MSI endpoint, error: %+v", err)
+	}
+	// Set up the configuration of the service principal. adal only supports client IDs,
+	// so the resource ID of the identity is added to the query of the token request.
+	spt, err := adal.NewServicePrincipalTokenFromMSI(endpoint, resource)
 	if err != nil {
 		return nil, fmt.Errorf("failed to acquire a token using the MSI VM extension, error: %+v", err)
 	}
+	spt.SetSender(adal.CreateSender(withIdentityResourceID(resourceID)))
 
 	// obtain a fresh token
 	err = spt.Refresh()
@@ -98,6 +161,19 @@ func GetServicePrincipalTokenFromMSIWithUserAssignedID(clientID, resource string
 	return &token, nil
 }
 
+// withIdentityResourceID returns a SendDecorator that requests the token of the
+// user-assigned identity with the given resource ID
+func withIdentityResourceID(resourceID string) adal.SendDecorator {
+	return func(s adal.Sender) adal.Sender {
+		return adal.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			q := r.URL.Query()
+			q.Set("mi_res_id", resourceID)
+			r.URL.RawQuery = q.Encode()
+			return s.Do(r)
+		})
+	}
+}
+
 // GetServicePrincipalToken return the token for the assigned user with client secret
 func GetServicePrincipalToken(adEndpointFromSpec, tenantID, clientID, secret, resource string, auxiliaryTenantIDs []string) ([]*adal.Token, error) {
 	begin := time.Now()
@@ -224,6 +300,60 @@ func GetServicePrincipalTokenWithCertificate(adEndpointFromSpec, tenantID, clien
 	return &token, nil
 }
 
+// clientAssertionSecret implements adal.ServicePrincipalSecret for client_assertion type authorization.
+type clientAssertionSecret struct {
+	assertion string
+}
+
+// SetAuthenticationValues populates the form submitted during oAuth token acquisition using the client assertion.
+func (secret *clientAssertionSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	v.Set("client_assertion_type", clientAssertionType)
+	v.Set("client_assertion", secret.assertion)
+	return nil
+}
+
+// GetServicePrincipalTokenWithClientAssertion return the token for the assigned user by exchanging
+// a JWT issued by an identity provider trusted by the application, such as a service account token
+func GetServicePrincipalTokenWithClientAssertion(adEndpointFromSpec, tenantID, clientID, assertion, resource string) (*adal.Token, error) {
+	begin := time.Now()
+	var err error
+
+	defer func() {
+		if err != nil {
+			err = reporter.ReportIMDSOperationError(metrics.AdalTokenOperationName)
+			if err != nil {
+				klog.Warningf("failed to report metrics, error: %+v", err)
+			}
+			return
+		}
+		err = reporter.ReportIMDSOperationDuration(metrics.AdalTokenOperationName, time.Since(begin))
+		if err != nil {
+			klog.Warningf("failed to report metrics, error: %+v", err)
+		}
+	}()
+
+	activeDirectoryEndpoint := defaultActiveDirectoryEndpoint
+	if adEndpointFromSpec != "" {
+		activeDirectoryEndpoint = adEndpointFromSpec
+	}
+	oauthConfig, err := adal.NewOAuthConfig(activeDirectoryEndpoint, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OAuth config, error: %+v", err)
+	}
+
+	spt, err := adal.NewServicePrincipalTokenWithSecret(*oauthConfig, clientID, resource, &clientAssertionSecret{assertion: assertion})
+	if err != nil {
+		return nil, err
+	}
+	// obtain a fresh token
+	err = spt.Refresh()
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token, error: %+v", err)
+	}
+	token := spt.Token()
+	return &token, nil
+}
+
 func init() {
 	err := adal.AddToUserAgent(version.GetUserAgent("NMI", version.NMIVersion))
 	if err != nil {
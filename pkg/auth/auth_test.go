@@ -1,7 +1,12 @@
 package auth
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
 )
@@ -17,3 +22,68 @@ func TestGetServicePrincipalToken(t *testing.T) {
 		t.Fatal("should be error with empty secret")
 	}
 }
+
+func TestGetServicePrincipalTokenWithClientAssertion(t *testing.T) {
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	InitReporter(reporter)
+
+	// fake AAD token endpoint
+	aad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tid/oauth2/token" {
+			http.Error(w, "unexpected path", http.StatusNotFound)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.PostForm.Get("client_assertion_type") != clientAssertionType ||
+			r.PostForm.Get("client_assertion") != "assertion" ||
+			r.PostForm.Get("client_id") != "cid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		_, _ = fmt.Fprintf(w, `{"access_token":"token","expires_in":"3600","expires_on":"%s","not_before":"%s","resource":"%s","token_type":"Bearer"}`,
+			expiresOn, expiresOn, r.PostForm.Get("resource"))
+	}))
+	defer aad.Close()
+
+	cases := []struct {
+		desc        string
+		assertion   string
+		expectedErr bool
+	}{
+		{
+			desc:      "valid assertion",
+			assertion: "assertion",
+		},
+		{
+			desc:        "invalid assertion",
+			assertion:   "invalid",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			token, err := GetServicePrincipalTokenWithClientAssertion(aad.URL, "tid", "cid", tc.assertion, "https://management.azure.com/")
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected nil error, got: %+v", err)
+			}
+			if token.AccessToken != "token" || token.Resource != "https://management.azure.com/" {
+				t.Fatalf("unexpected token: %+v", token)
+			}
+		})
+	}
+}
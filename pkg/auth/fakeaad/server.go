@@ -0,0 +1,383 @@
+// Package fakeaad implements an in-process fake of the token endpoints of Azure Active Directory
+// and of the Azure Instance Metadata Service, for testing token acquisition without Azure.
+package fakeaad
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EndpointIMDS is the endpoint of token requests to the Azure Instance Metadata Service
+	EndpointIMDS = "imds"
+	// EndpointAAD is the endpoint of token requests to Azure Active Directory
+	EndpointAAD = "aad"
+
+	// MSIPath is the path of the token endpoint of the Azure Instance Metadata Service
+	MSIPath = "/metadata/identity/oauth2/token"
+
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	defaultLifetime     = time.Hour
+)
+
+var aadTokenPattern = regexp.MustCompile(`^/([^/]+)/oauth2/token$`)
+
+// Request is a token request received by the server.
+type Request struct {
+	Endpoint string
+	TenantID string
+	ClientID string
+	// ResourceID is the resource ID of the managed identity requested from the Azure
+	// Instance Metadata Service
+	ResourceID string
+	Resource   string
+}
+
+// Server is a fake of the token endpoints of Azure Active Directory and of the Azure Instance
+// Metadata Service. It issues unsigned JWT access tokens to the registered managed identities
+// and applications, and can be configured to respond slowly or to fail.
+type Server struct {
+	*httptest.Server
+
+	// tenantID is the tenant of the managed identities
+	tenantID string
+
+	mu sync.Mutex
+	// managedIdentities contains the client IDs of the managed identities, where the empty
+	// client ID is the system-assigned identity
+	managedIdentities map[string]bool
+	// resourceIDs contains the client IDs of the user-assigned identities by resource ID
+	resourceIDs map[string]string
+	// secrets and assertions contain the credentials of applications by tenant and client ID.
+	// An empty assertion accepts any client assertion, e.g. signed with a certificate.
+	secrets    map[string]string
+	assertions map[string]string
+	latency    time.Duration
+	lifetime   time.Duration
+	claims     map[string]interface{}
+	// failures is the number of requests to fail with failureStatusCode
+	failures          int
+	failureStatusCode int
+	requests          []Request
+}
+
+// NewServer starts a fake token server whose managed identities are in the tenant.
+// The server must be closed with Close.
+func NewServer(tenantID string) *Server {
+	s := &Server{
+		tenantID:          tenantID,
+		managedIdentities: make(map[string]bool),
+		resourceIDs:       make(map[string]string),
+		secrets:           make(map[string]string),
+		assertions:        make(map[string]string),
+		lifetime:          defaultLifetime,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(MSIPath, s.handleIMDS)
+	mux.HandleFunc("/", s.handleAAD)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// MSIEndpoint returns the URL of the token endpoint of the fake Azure Instance Metadata Service.
+func (s *Server) MSIEndpoint() string {
+	return s.URL + MSIPath
+}
+
+// ActiveDirectoryEndpoint returns the URL of the fake Azure Active Directory, e.g. to be used
+// as the ADEndpoint of an AzureIdentity.
+func (s *Server) ActiveDirectoryEndpoint() string {
+	return s.URL + "/"
+}
+
+// AddSystemAssignedIdentity enables the system-assigned identity of the VM.
+func (s *Server) AddSystemAssignedIdentity() {
+	s.AddUserAssignedIdentity("")
+}
+
+// AddUserAssignedIdentity assigns the user-assigned identity to the VM.
+func (s *Server) AddUserAssignedIdentity(clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.managedIdentities[strings.ToLower(clientID)] = true
+}
+
+// AddUserAssignedIdentityWithResourceID assigns the user-assigned identity to the VM, so that its
+// tokens can be requested by client ID or by resource ID.
+func (s *Server) AddUserAssignedIdentityWithResourceID(clientID, resourceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.managedIdentities[strings.ToLower(clientID)] = true
+	s.resourceIDs[strings.ToLower(resourceID)] = clientID
+}
+
+// AddClientSecret registers an application which authenticates with the client secret.
+func (s *Server) AddClientSecret(tenantID, clientID, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[applicationKey(tenantID, clientID)] = secret
+}
+
+// AddClientAssertion registers an application which authenticates with the client assertion.
+// An empty assertion accepts any client assertion, e.g. one signed with a certificate.
+func (s *Server) AddClientAssertion(tenantID, clientID, assertion string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assertions[applicationKey(tenantID, clientID)] = assertion
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetTokenLifetime sets the lifetime of the issued tokens, which is an hour by default.
+func (s *Server) SetTokenLifetime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifetime = d
+}
+
+// SetClaims sets additional claims of the issued tokens, which override the default ones.
+func (s *Server) SetClaims(claims map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.claims = claims
+}
+
+// FailRequests fails the next n token requests with the HTTP status code.
+func (s *Server) FailRequests(n, statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+	s.failureStatusCode = statusCode
+}
+
+// Requests returns the token requests received by the server, including failed ones.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// ParseClaims returns the claims of an access token issued by the server.
+func ParseClaims(accessToken string) (map[string]interface{}, error) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("access token has %d parts, expected 3", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode claims, error: %+v", err)
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal claims, error: %+v", err)
+	}
+	return claims, nil
+}
+
+func (s *Server) handleIMDS(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	request := Request{
+		Endpoint:   EndpointIMDS,
+		TenantID:   s.tenantID,
+		ClientID:   query.Get("client_id"),
+		ResourceID: query.Get("mi_res_id"),
+		Resource:   query.Get("resource"),
+	}
+	if !s.receive(w, r, request) {
+		return
+	}
+
+	if r.Header.Get("Metadata") != "true" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Required metadata header not specified")
+		return
+	}
+	if request.Resource == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Required query variable 'resource' is missing")
+		return
+	}
+	if request.ClientID != "" && request.ResourceID != "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Multiple identities specified")
+		return
+	}
+	clientID := request.ClientID
+	s.mu.Lock()
+	found := s.managedIdentities[strings.ToLower(clientID)]
+	if request.ResourceID != "" {
+		clientID, found = s.resourceIDs[strings.ToLower(request.ResourceID)]
+	}
+	s.mu.Unlock()
+	if !found {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Identity not found")
+		return
+	}
+
+	if clientID == "" {
+		clientID = "system-assigned"
+	}
+	s.writeToken(w, request, clientID)
+}
+
+func (s *Server) handleAAD(w http.ResponseWriter, r *http.Request) {
+	m := aadTokenPattern.FindStringSubmatch(r.URL.Path)
+	if m == nil || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("AADSTS900144: The request body must contain the following parameter: 'grant_type'. %s", err))
+		return
+	}
+	request := Request{
+		Endpoint: EndpointAAD,
+		TenantID: m[1],
+		ClientID: r.PostForm.Get("client_id"),
+		Resource: r.PostForm.Get("resource"),
+	}
+	if !s.receive(w, r, request) {
+		return
+	}
+
+	key := applicationKey(request.TenantID, request.ClientID)
+	s.mu.Lock()
+	secret, hasSecret := s.secrets[key]
+	assertion, hasAssertion := s.assertions[key]
+	s.mu.Unlock()
+
+	switch {
+	case !hasSecret && !hasAssertion:
+		writeError(w, http.StatusBadRequest, "unauthorized_client", fmt.Sprintf("AADSTS700016: Application with identifier '%s' was not found in the directory '%s'.", request.ClientID, request.TenantID))
+	case r.PostForm.Get("client_assertion_type") == clientAssertionType:
+		if !hasAssertion || (assertion != "" && assertion != r.PostForm.Get("client_assertion")) {
+			writeError(w, http.StatusUnauthorized, "invalid_client", "AADSTS700027: Client assertion contains an invalid signature.")
+			return
+		}
+		s.writeToken(w, request, request.ClientID)
+	default:
+		if !hasSecret || secret != r.PostForm.Get("client_secret") {
+			writeError(w, http.StatusUnauthorized, "invalid_client", "AADSTS7000215: Invalid client secret is provided.")
+			return
+		}
+		s.writeToken(w, request, request.ClientID)
+	}
+}
+
+// receive records the request, waits for the configured latency and fails the request if
+// configured to. It returns false if the request was answered.
+func (s *Server) receive(w http.ResponseWriter, r *http.Request, request Request) bool {
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	latency := s.latency
+	failureStatusCode := 0
+	if s.failures > 0 {
+		s.failures--
+		failureStatusCode = s.failureStatusCode
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	if failureStatusCode != 0 {
+		code := "invalid_request"
+		if failureStatusCode >= http.StatusInternalServerError {
+			code = "server_error"
+		}
+		writeError(w, failureStatusCode, code, fmt.Sprintf("fake failure of %s token request", request.Endpoint))
+		return false
+	}
+	return true
+}
+
+func (s *Server) writeToken(w http.ResponseWriter, request Request, clientID string) {
+	s.mu.Lock()
+	lifetime := s.lifetime
+	extraClaims := s.claims
+	s.mu.Unlock()
+
+	now := time.Now()
+	expiresOn := now.Add(lifetime)
+	objectID := newObjectID(request.TenantID, clientID)
+	claims := map[string]interface{}{
+		"aud":   request.Resource,
+		"iss":   fmt.Sprintf("https://sts.windows.net/%s/", request.TenantID),
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   expiresOn.Unix(),
+		"appid": clientID,
+		"oid":   objectID,
+		"sub":   objectID,
+		"tid":   request.TenantID,
+	}
+	for k, v := range extraClaims {
+		claims[k] = v
+	}
+	accessToken, err := newAccessToken(claims)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": accessToken,
+		"client_id":    clientID,
+		"expires_in":   strconv.FormatInt(int64(lifetime.Seconds()), 10),
+		"expires_on":   strconv.FormatInt(expiresOn.Unix(), 10),
+		"not_before":   strconv.FormatInt(now.Unix(), 10),
+		"resource":     request.Resource,
+		"token_type":   "Bearer",
+	})
+}
+
+// newAccessToken returns an unsigned JWT with the claims
+func newAccessToken(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + ".", nil
+}
+
+// newObjectID returns a stable object ID in GUID format for the client in the tenant
+func newObjectID(tenantID, clientID string) string {
+	h := sha1.Sum([]byte(applicationKey(tenantID, clientID)))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func applicationKey(tenantID, clientID string) string {
+	return strings.ToLower(tenantID + "/" + clientID)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, description string) {
+	writeJSON(w, statusCode, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
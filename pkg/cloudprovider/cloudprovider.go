@@ -1,6 +1,7 @@
 package cloudprovider
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/aad-pod-identity/pkg/config"
@@ -32,12 +34,29 @@ type Client struct {
 	ExtClient   compute.VirtualMachineExtensionsClient
 	Config      config.AzureConfig
 	configFile  string
+	// throttle is the gate of the subscription shared with VMClient and VMSSClient
+	throttle *throttleGate
+	// armEndpoint is the ARM endpoint the gates of other subscriptions than the configured one are keyed by
+	armEndpoint string
+	// spt is the token the compute clients of other subscriptions than the configured one are created with
+	spt *adal.ServicePrincipalToken
+
+	// clientsMu guards Config, the clients and the gate, which Init replaces when the config file changes
+	clientsMu sync.Mutex
+	// subscriptionClients contains the compute clients of other subscriptions by lowercase subscription ID
+	subscriptionClients map[string]*computeClients
 }
 
 // ClientInt client interface
+// The node or vmss of UpdateUserMSI and GetUserMSIs is given either by its ARM resource ID,
+// which is parsed for its subscription and resource group, or by its name in the configured
+// subscription and resource group.
 type ClientInt interface {
-	UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, name string, isvmss bool) error
+	UpdateUserMSI(ctx context.Context, addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, name string, isvmss bool) error
 	GetUserMSIs(name string, isvmss bool) ([]string, error)
+	// RetryAfter returns the time until which ARM requests of the node or vmss are blocked
+	// because ARM throttles its subscription, which is in the past if they are not blocked.
+	RetryAfter(name string) time.Time
 	Init() error
 }
 
@@ -49,6 +68,11 @@ const (
 	failedIdentityOperation retry.RetriableError = "FailedIdentityOperation"
 	// retryAfterHeaderKey is the retry-after header key in ARM responses.
 	retryAfterHeaderKey = "Retry-After"
+	// maxConflictRetries is the number of times an update of a VM or VMSS which was
+	// modified concurrently is re-applied to its latest version.
+	maxConflictRetries = 3
+	// updateUserMSIMaxElapsedTime is the maximum time UpdateUserMSI retries an update for.
+	updateUserMSIMaxElapsedTime = 2 * time.Minute
 )
 
 // NewCloudProvider returns a azure cloud provider client
@@ -59,38 +83,47 @@ func NewCloudProvider(configFile string, updateUserMSIMaxRetry int, updateUseMSI
 	if err := client.Init(); err != nil {
 		return nil, fmt.Errorf("failed to initialize cloud provider client, error: %+v", err)
 	}
-	client.RetryClient = retry.NewRetryClient(updateUserMSIMaxRetry, updateUseMSIRetryInterval)
+	client.RetryClient = retry.NewBackoffRetryClient(retry.Backoff{
+		InitialInterval: updateUseMSIRetryInterval,
+		Multiplier:      2,
+		Jitter:          0.2,
+		MaxRetries:      updateUserMSIMaxRetry,
+		MaxElapsedTime:  updateUserMSIMaxElapsedTime,
+	})
 	client.RetryClient.RegisterRetriableErrors(linkedAuthorizationFailed, failedIdentityOperation)
+	// Occurs when another operation on the VM or VMSS is in progress.
+	client.RetryClient.RegisterRetriableStatusCodes(http.StatusConflict)
 	return client, nil
 }
 
 // Init initializes the cloud provider client based
-// on a config path or environment variables
+// on a config path or environment variables. It is called again when the config file
+// changes, so the config and clients are replaced at once under clientsMu.
 func (c *Client) Init() error {
-	c.Config = config.AzureConfig{}
+	cfg := config.AzureConfig{}
 	if c.configFile != "" {
 		klog.V(6).Info("populating AzureConfig from azure.json")
 		bytes, err := ioutil.ReadFile(c.configFile)
 		if err != nil {
 			return fmt.Errorf("failed to config file %s, error: %+v", c.configFile, err)
 		}
-		if err = yaml.Unmarshal(bytes, &c.Config); err != nil {
+		if err = yaml.Unmarshal(bytes, &cfg); err != nil {
 			return fmt.Errorf("failed to unmarshal JSON, error: %+v", err)
 		}
 	} else {
 		klog.V(6).Info("populating AzureConfig from secret/environment variables")
-		c.Config.Cloud = os.Getenv("CLOUD")
-		c.Config.TenantID = os.Getenv("TENANT_ID")
-		c.Config.ClientID = os.Getenv("CLIENT_ID")
-		c.Config.ClientSecret = os.Getenv("CLIENT_SECRET")
-		c.Config.SubscriptionID = os.Getenv("SUBSCRIPTION_ID")
-		c.Config.ResourceGroupName = os.Getenv("RESOURCE_GROUP")
-		c.Config.VMType = os.Getenv("VM_TYPE")
-		c.Config.UseManagedIdentityExtension = strings.EqualFold(os.Getenv("USE_MSI"), "True")
-		c.Config.UserAssignedIdentityID = os.Getenv("USER_ASSIGNED_MSI_CLIENT_ID")
-	}
-
-	azureEnv, err := azure.EnvironmentFromName(c.Config.Cloud)
+		cfg.Cloud = os.Getenv("CLOUD")
+		cfg.TenantID = os.Getenv("TENANT_ID")
+		cfg.ClientID = os.Getenv("CLIENT_ID")
+		cfg.ClientSecret = os.Getenv("CLIENT_SECRET")
+		cfg.SubscriptionID = os.Getenv("SUBSCRIPTION_ID")
+		cfg.ResourceGroupName = os.Getenv("RESOURCE_GROUP")
+		cfg.VMType = os.Getenv("VM_TYPE")
+		cfg.UseManagedIdentityExtension = strings.EqualFold(os.Getenv("USE_MSI"), "True")
+		cfg.UserAssignedIdentityID = os.Getenv("USER_ASSIGNED_MSI_CLIENT_ID")
+	}
+
+	azureEnv, err := azure.EnvironmentFromName(cfg.Cloud)
 	if err != nil {
 		return fmt.Errorf("failed to get cloud environment, error: %+v", err)
 	}
@@ -100,28 +133,28 @@ func (c *Client) Init() error {
 		return fmt.Errorf("failed to add MIC to user agent, error: %+v", err)
 	}
 
-	oauthConfig, err := adal.NewOAuthConfig(azureEnv.ActiveDirectoryEndpoint, c.Config.TenantID)
+	oauthConfig, err := adal.NewOAuthConfig(azureEnv.ActiveDirectoryEndpoint, cfg.TenantID)
 	if err != nil {
 		return fmt.Errorf("failed to create OAuth config, error: %+v", err)
 	}
 
 	var spt *adal.ServicePrincipalToken
-	if c.Config.UseManagedIdentityExtension {
+	if cfg.UseManagedIdentityExtension {
 		// MSI endpoint is required for both types of MSI - system assigned and user assigned.
 		msiEndpoint, err := adal.GetMSIVMEndpoint()
 		if err != nil {
 			return fmt.Errorf("failed to get MSI endpoint, error: %+v", err)
 		}
 		// UserAssignedIdentityID is empty, so we are going to use system assigned MSI
-		if c.Config.UserAssignedIdentityID == "" {
+		if cfg.UserAssignedIdentityID == "" {
 			klog.Infof("MIC using system assigned identity for authentication.")
 			spt, err = adal.NewServicePrincipalTokenFromMSI(msiEndpoint, azureEnv.ResourceManagerEndpoint)
 			if err != nil {
 				return fmt.Errorf("failed to get token from system-assigned identity, error: %+v", err)
 			}
 		} else { // User assigned identity usage.
-			klog.Infof("MIC using user assigned identity: %s for authentication.", utils.RedactClientID(c.Config.UserAssignedIdentityID))
-			spt, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, azureEnv.ResourceManagerEndpoint, c.Config.UserAssignedIdentityID)
+			klog.Infof("MIC using user assigned identity: %s for authentication.", utils.RedactClientID(cfg.UserAssignedIdentityID))
+			spt, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, azureEnv.ResourceManagerEndpoint, cfg.UserAssignedIdentityID)
 			if err != nil {
 				return fmt.Errorf("failed to get token from user-assigned identity, error: %+v", err)
 			}
@@ -129,8 +162,8 @@ func (c *Client) Init() error {
 	} else { // This is the default scenario - use service principal to get the token.
 		spt, err = adal.NewServicePrincipalToken(
 			*oauthConfig,
-			c.Config.ClientID,
-			c.Config.ClientSecret,
+			cfg.ClientID,
+			cfg.ClientSecret,
 			azureEnv.ResourceManagerEndpoint,
 		)
 		if err != nil {
@@ -138,22 +171,39 @@ func (c *Client) Init() error {
 		}
 	}
 
-	extClient := compute.NewVirtualMachineExtensionsClient(c.Config.SubscriptionID)
+	extClient := compute.NewVirtualMachineExtensionsClient(cfg.SubscriptionID)
 	extClient.BaseURI = azure.PublicCloud.ResourceManagerEndpoint
 	extClient.Authorizer = autorest.NewBearerAuthorizer(spt)
 	extClient.PollingDelay = 5 * time.Second
 
-	c.VMSSClient, err = NewVMSSClient(c.Config, spt)
+	vmssClient, err := NewVMSSClient(cfg, spt)
 	if err != nil {
 		return fmt.Errorf("failed to create VMSS client, error: %+v", err)
 	}
-	c.VMClient, err = NewVirtualMachinesClient(c.Config, spt)
+	vmClient, err := NewVirtualMachinesClient(cfg, spt)
 	if err != nil {
 		return fmt.Errorf("failed to create VM client, error: %+v", err)
 	}
+	armEndpoint := getResourceManagerEndpoint(cfg, azureEnv)
+
+	c.clientsMu.Lock()
+	c.Config = cfg
+	c.VMSSClient = vmssClient
+	c.VMClient = vmClient
+	c.armEndpoint = armEndpoint
+	c.throttle = getThrottleGate(armEndpoint, cfg.SubscriptionID)
+	c.spt = spt
+	c.subscriptionClients = nil
+	c.clientsMu.Unlock()
+
+	disableTooManyRequestsRetry()
 
-	// We explicitly removes http.StatusTooManyRequests from autorest.StatusCodesForRetry.
-	// Refer https://github.com/Azure/go-autorest/issues/398.
+	return nil
+}
+
+// disableTooManyRequestsRetry explicitly removes http.StatusTooManyRequests from autorest.StatusCodesForRetry.
+// Refer https://github.com/Azure/go-autorest/issues/398.
+func disableTooManyRequestsRetry() {
 	statusCodesForRetry := make([]int, 0)
 	for _, code := range autorest.StatusCodesForRetry {
 		if code != http.StatusTooManyRequests {
@@ -161,8 +211,27 @@ func (c *Client) Init() error {
 		}
 	}
 	autorest.StatusCodesForRetry = statusCodesForRetry
+}
 
-	return nil
+// getResourceManagerEndpoint returns the ARM endpoint of the cloud, unless overridden in the config
+func getResourceManagerEndpoint(config config.AzureConfig, azureEnv azure.Environment) string {
+	if config.ResourceManagerEndpoint != "" {
+		return config.ResourceManagerEndpoint
+	}
+	return azureEnv.ResourceManagerEndpoint
+}
+
+// RetryAfter returns the time until which ARM requests of the subscription of the node or vmss
+// are blocked after ARM throttled a request. The node or vmss is given like for UpdateUserMSI.
+func (c *Client) RetryAfter(name string) time.Time {
+	subscriptionID, _, _, err := c.parseNodeOrVMSS(name)
+
+	c.clientsMu.Lock()
+	defer c.clientsMu.Unlock()
+	if err != nil || c.spt == nil || subscriptionID == "" || strings.EqualFold(subscriptionID, c.Config.SubscriptionID) {
+		return c.throttle.RetryAfter()
+	}
+	return getThrottleGate(c.armEndpoint, subscriptionID).RetryAfter()
 }
 
 // GetUserMSIs will return a list of all identities on the node or vmss based on value of isvmss
@@ -179,18 +248,11 @@ func (c *Client) GetUserMSIs(name string, isvmss bool) ([]string, error) {
 	return idList, nil
 }
 
-// UpdateUserMSI will batch process the removal and addition of ids
-func (c *Client) UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, name string, isvmss bool) error {
-	idH, updateFunc, err := c.getIdentityResource(name, isvmss)
-	if err != nil {
-		return fmt.Errorf("failed to get identity resource, error: %v", err)
-	}
-
-	info := idH.IdentityInfo()
-	if info == nil {
-		info = idH.ResetIdentity()
-	}
-
+// UpdateUserMSI will batch process the removal and addition of ids. The identities in
+// addUserAssignedMSIIDs are assigned in order until the node or vmss reaches the limit
+// of user-assigned identities, in which case an OverflowError is returned. The update is no
+// longer retried once ctx is done.
+func (c *Client) UpdateUserMSI(ctx context.Context, addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, name string, isvmss bool) error {
 	ids := make(map[string]bool)
 	// remove msi ids from the list
 	for _, userAssignedMSIID := range removeUserAssignedMSIIDs {
@@ -203,16 +265,63 @@ func (c *Client) UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs [
 		ids[userAssignedMSIID] = true
 	}
 
+	klog.Infof("updating user-assigned identities on %s, assign [%d], unassign [%d]", name, len(addUserAssignedMSIIDs), len(removeUserAssignedMSIIDs))
+	timeStarted := time.Now()
+	// the update is conditional on the VM or VMSS not having been modified since it was fetched,
+	// so if it was, e.g. by the cluster autoscaler, the changes are applied to the latest version
+	for conflicts := 0; ; conflicts++ {
+		err := c.updateUserMSI(ctx, ids, addUserAssignedMSIIDs, name, isvmss)
+		if err == nil {
+			break
+		}
+		if !isConflict(err) || conflicts >= maxConflictRetries {
+			return err
+		}
+		klog.Infof("%s was modified since it was fetched, re-applying the identity changes to its latest version", name)
+	}
+
+	klog.V(6).Infof("UpdateUserMSI of %s completed in %s", name, time.Since(timeStarted))
+
+	return nil
+}
+
+// updateUserMSI fetches the node or vmss and updates it with the changes in ids,
+// which maps the IDs of the identities to assign to true and to remove to false.
+// If the node or vmss can't hold all identities, those in addIDs are assigned in order
+// and an OverflowError with the identities which are not is returned.
+func (c *Client) updateUserMSI(ctx context.Context, ids map[string]bool, addIDs []string, name string, isvmss bool) error {
+	idH, updateFunc, err := c.getIdentityResource(name, isvmss)
+	if err != nil {
+		return fmt.Errorf("failed to get identity resource, error: %v", err)
+	}
+
+	info := idH.IdentityInfo()
+	if info == nil {
+		info = idH.ResetIdentity()
+	}
+
+	var overflowErr error
+	ids, overflowed := limitIdentities(info.GetUserIdentityList(), ids, addIDs)
+	if len(overflowed) > 0 {
+		overflowErr = &OverflowError{Name: name, Identities: overflowed}
+		klog.Warningf("%s has reached the limit of %d user-assigned identities, not assigning %v", name, maxIdentitiesCount, overflowed)
+	}
+
 	if requiresUpdate := info.SetUserIdentities(ids); !requiresUpdate {
-		return nil
+		return overflowErr
 	}
 
-	klog.Infof("updating user-assigned identities on %s, assign [%d], unassign [%d]", name, len(addUserAssignedMSIIDs), len(removeUserAssignedMSIIDs))
-	timeStarted := time.Now()
+	var removedIDs []string
+	var removalErr error
 	shouldRetry := func(err error) bool {
 		if err == nil {
 			return false
 		}
+		// the update is retried as is when it conflicts with another operation
+		if statusCode, ok := retry.StatusCode(err); ok && statusCode == http.StatusConflict {
+			klog.Infof("attempting to retry the update of %s after a conflicting operation", name)
+			return true
+		}
 
 		// Filter previously-assigned IDs based on which identities
 		// are erroneous from the last occurred error
@@ -221,9 +330,13 @@ func (c *Client) UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs [
 		for _, erroneousID := range erroneousIDs {
 			if removed := info.RemoveUserIdentity(erroneousID); removed {
 				removedAny = true
+				removedIDs = append(removedIDs, erroneousID)
 				klog.Infof("removing %s from ID list since it is erroneous", erroneousID)
 			}
 		}
+		if removedAny {
+			removalErr = err
+		}
 
 		// Only retry if there is at least one ID after deleting
 		remainingIDs := info.GetUserIdentityList()
@@ -234,37 +347,51 @@ func (c *Client) UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs [
 
 		return false
 	}
-	if err := c.RetryClient.Do(updateFunc, shouldRetry); err != nil {
+	attempts, err := c.RetryClient.DoWithContext(ctx, updateFunc, shouldRetry)
+	for i, attempt := range attempts[:len(attempts)-1] {
+		klog.V(2).Infof("attempt %d to update %s failed after %s, error: %+v", i+1, name, attempt.Duration, attempt.Err)
+	}
+	if err != nil {
 		return err
 	}
-
-	klog.V(6).Infof("UpdateUserMSI of %s completed in %s", name, time.Since(timeStarted))
-
-	return nil
+	if len(removedIDs) > 0 {
+		// the other identities were updated, but the erroneous ones were not
+		return fmt.Errorf("failed to update erroneous identities %v of %s, error: %+v", removedIDs, name, removalErr)
+	}
+	return overflowErr
 }
 
+// getIdentityResource fetches the node or vmss, which is given either by its ARM resource ID
+// or by its name in the configured subscription and resource group.
 func (c *Client) getIdentityResource(name string, isvmss bool) (idH IdentityHolder, update func() error, retErr error) {
-	rg := c.Config.ResourceGroupName
+	subscriptionID, rg, name, err := c.parseNodeOrVMSS(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	vmClient, vmssClient, err := c.getComputeClients(subscriptionID)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	if isvmss {
-		vmss, err := c.VMSSClient.Get(rg, name)
+		vmss, err := vmssClient.Get(rg, name)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to get vmss %s in resource group %s, error: %+v", name, rg, err)
 		}
 
 		update = func() error {
-			return c.VMSSClient.UpdateIdentities(rg, name, vmss)
+			return vmssClient.UpdateIdentities(rg, name, vmss)
 		}
 		idH = &vmssIdentityHolder{&vmss}
 		return idH, update, nil
 	}
 
-	vm, err := c.VMClient.Get(rg, name)
+	vm, err := vmClient.Get(rg, name)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to get vm %s in resource group %s, error: %+v", name, rg, err)
 	}
 	update = func() error {
-		return c.VMClient.UpdateIdentities(rg, name, vm)
+		return vmClient.UpdateIdentities(rg, name, vm)
 	}
 	idH = &vmIdentityHolder{&vm}
 	return idH, update, nil
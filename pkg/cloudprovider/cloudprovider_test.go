@@ -1,16 +1,23 @@
 package cloudprovider
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider/fakearm"
 	"github.com/Azure/aad-pod-identity/pkg/config"
 	"github.com/Azure/aad-pod-identity/pkg/retry"
+	"github.com/Azure/aad-pod-identity/pkg/stats"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
 	"github.com/Azure/go-autorest/autorest/azure"
@@ -81,23 +88,23 @@ func TestSimple(t *testing.T) {
 			node3 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node3-0"}, Spec: corev1.NodeSpec{ProviderID: vmProvider}}
 			node4 := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node4-vmss0000000"}, Spec: corev1.NodeSpec{ProviderID: vmssProvider}}
 
-			err := cloudClient.UpdateUserMSI([]string{"ID0", "ID0again"}, []string{}, node0.Name, false)
+			err := cloudClient.UpdateUserMSI(context.Background(), []string{"ID0", "ID0again"}, []string{}, node0.Name, false)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
-			err = cloudClient.UpdateUserMSI([]string{"ID1"}, []string{}, node1.Name, false)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{"ID1"}, []string{}, node1.Name, false)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
-			err = cloudClient.UpdateUserMSI([]string{"ID2"}, []string{}, node2.Name, false)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{"ID2"}, []string{}, node2.Name, false)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
-			err = cloudClient.UpdateUserMSI([]string{"ID3"}, []string{}, node3.Name, false)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{"ID3"}, []string{}, node3.Name, false)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
-			err = cloudClient.UpdateUserMSI([]string{"ID4"}, []string{}, node4.Name, true)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{"ID4"}, []string{}, node4.Name, true)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
@@ -108,11 +115,11 @@ func TestSimple(t *testing.T) {
 				t.Error("MSI mismatch")
 			}
 
-			err = cloudClient.UpdateUserMSI([]string{}, []string{"ID0"}, node0.Name, false)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{}, []string{"ID0"}, node0.Name, false)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
-			err = cloudClient.UpdateUserMSI([]string{}, []string{"ID2"}, node2.Name, false)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{}, []string{"ID2"}, node2.Name, false)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
@@ -141,7 +148,7 @@ func TestSimple(t *testing.T) {
 			}
 
 			// test the UpdateUserMSI interface
-			err = cloudClient.UpdateUserMSI([]string{"ID1", "ID2", "ID3"}, []string{"ID0again"}, node0.Name, false)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{"ID1", "ID2", "ID3"}, []string{"ID0again"}, node0.Name, false)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
@@ -152,7 +159,7 @@ func TestSimple(t *testing.T) {
 				t.Error("MSI mismatch")
 			}
 
-			err = cloudClient.UpdateUserMSI(nil, []string{"ID3"}, node3.Name, false)
+			err = cloudClient.UpdateUserMSI(context.Background(), nil, []string{"ID3"}, node3.Name, false)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
@@ -163,7 +170,7 @@ func TestSimple(t *testing.T) {
 				t.Error("MSI mismatch")
 			}
 
-			err = cloudClient.UpdateUserMSI([]string{"ID3"}, nil, node4.Name, true)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{"ID3"}, nil, node4.Name, true)
 			if err != nil {
 				t.Error("Couldn't update MSI")
 			}
@@ -174,7 +181,7 @@ func TestSimple(t *testing.T) {
 				t.Error("MSI mismatch")
 			}
 
-			err = cloudClient.UpdateUserMSI([]string{"ID3"}, []string{"ID3"}, node4.Name, true)
+			err = cloudClient.UpdateUserMSI(context.Background(), []string{"ID3"}, []string{"ID3"}, node4.Name, true)
 			if err != nil {
 				t.Errorf("Couldn't update MSI: %v", err)
 			}
@@ -579,3 +586,377 @@ func TestGetRetryAfter(t *testing.T) {
 		})
 	}
 }
+
+// newFakeARMClient returns a cloud provider client which sends its requests to the fake server
+func newFakeARMClient(t *testing.T, server *fakearm.Server) *Client {
+	stats.Init()
+	disableTooManyRequestsRetry()
+
+	cfg := server.AzureConfig("fakeGroup")
+	spt, err := fakearm.NewServicePrincipalToken()
+	if err != nil {
+		t.Fatalf("failed to create service principal token, error: %+v", err)
+	}
+	vmClient, err := NewVirtualMachinesClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VM client, error: %+v", err)
+	}
+	vmssClient, err := NewVMSSClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VMSS client, error: %+v", err)
+	}
+	retryClient := retry.NewRetryClient(2, 0)
+	retryClient.RegisterRetriableErrors(linkedAuthorizationFailed, failedIdentityOperation)
+	retryClient.RegisterRetriableStatusCodes(http.StatusConflict)
+
+	return &Client{
+		VMClient:    vmClient,
+		VMSSClient:  vmssClient,
+		RetryClient: retryClient,
+		Config:      cfg,
+		throttle:    getThrottleGate(cfg.ResourceManagerEndpoint, cfg.SubscriptionID),
+		armEndpoint: cfg.ResourceManagerEndpoint,
+		spt:         spt,
+	}
+}
+
+func TestUpdateUserMSIWithFakeARM(t *testing.T) {
+	id1 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id1"
+	id2 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id2"
+	id3 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id3"
+	var manyIDs []string
+	for i := 0; i <= maxIdentitiesCount; i++ {
+		manyIDs = append(manyIDs, fmt.Sprintf("/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id%03d", i))
+	}
+
+	cases := []struct {
+		desc               string
+		isvmss             bool
+		initialIDs         []string
+		add                []string
+		remove             []string
+		setup              func(server *fakearm.Server)
+		expectedIDs        []string
+		expectedErr        string
+		expectedPatchCount int
+	}{
+		{
+			desc:               "assign and remove identities of vm",
+			initialIDs:         []string{id1},
+			add:                []string{id2},
+			remove:             []string{id1},
+			expectedIDs:        []string{id2},
+			expectedPatchCount: 1,
+		},
+		{
+			desc:               "assign identities to vmss",
+			isvmss:             true,
+			add:                []string{id1, id2},
+			expectedIDs:        []string{id1, id2},
+			expectedPatchCount: 1,
+		},
+		{
+			desc:               "remove all identities of vmss",
+			isvmss:             true,
+			initialIDs:         []string{id1, id2},
+			remove:             []string{id1, id2},
+			expectedIDs:        []string{},
+			expectedPatchCount: 1,
+		},
+		{
+			desc:       "long-running operation is polled until completion",
+			add:        []string{id1},
+			initialIDs: []string{},
+			setup: func(server *fakearm.Server) {
+				server.SetPollingAttempts(3)
+			},
+			expectedIDs:        []string{id1},
+			expectedPatchCount: 1,
+		},
+		{
+			desc: "unauthorized identity is removed from the update on retry",
+			add:  []string{id1, id2},
+			setup: func(server *fakearm.Server) {
+				server.SetUnauthorizedIdentities(id2)
+			},
+			expectedIDs:        []string{id1},
+			expectedErr:        "LinkedAuthorizationFailed",
+			expectedPatchCount: 2,
+		},
+		{
+			desc:       "missing identity is removed from the update on retry",
+			isvmss:     true,
+			initialIDs: []string{id3},
+			add:        []string{id1, id2},
+			setup: func(server *fakearm.Server) {
+				server.SetMissingIdentities(id1)
+			},
+			expectedIDs:        []string{id2, id3},
+			expectedErr:        "FailedIdentityOperation",
+			expectedPatchCount: 2,
+		},
+		{
+			desc:   "update conflicting with another operation is retried",
+			isvmss: true,
+			add:    []string{id1},
+			setup: func(server *fakearm.Server) {
+				server.SetConflictingOperations(2)
+			},
+			expectedIDs:        []string{id1},
+			expectedPatchCount: 3,
+		},
+		{
+			desc: "update conflicting with another operation fails after the retries",
+			add:  []string{id1},
+			setup: func(server *fakearm.Server) {
+				server.SetConflictingOperations(3)
+			},
+			expectedIDs:        []string{},
+			expectedErr:        "OperationNotAllowed",
+			expectedPatchCount: 3,
+		},
+		{
+			desc: "throttled get is not retried",
+			add:  []string{id1},
+			setup: func(server *fakearm.Server) {
+				server.ThrottleRequests(1, time.Minute)
+			},
+			expectedIDs:        []string{},
+			expectedErr:        "429",
+			expectedPatchCount: 0,
+		},
+		{
+			desc:       "update of concurrently modified vm is re-applied to its latest version",
+			initialIDs: []string{id1},
+			add:        []string{id2},
+			remove:     []string{id1},
+			setup: func(server *fakearm.Server) {
+				server.SetConcurrentModifications(1, id3)
+			},
+			expectedIDs:        []string{id2, id3},
+			expectedPatchCount: 2,
+		},
+		{
+			desc:   "update of concurrently modified vmss is re-applied to its latest version",
+			isvmss: true,
+			add:    []string{id1},
+			setup: func(server *fakearm.Server) {
+				server.SetConcurrentModifications(2, id3)
+			},
+			expectedIDs:        []string{id1, id3},
+			expectedPatchCount: 3,
+		},
+		{
+			desc:   "update of continuously modified vmss fails",
+			isvmss: true,
+			add:    []string{id1},
+			setup: func(server *fakearm.Server) {
+				server.SetConcurrentModifications(maxConflictRetries+1, id3)
+			},
+			expectedIDs:        []string{id3},
+			expectedErr:        "PreconditionFailed",
+			expectedPatchCount: maxConflictRetries + 1,
+		},
+		{
+			desc:               "identities beyond the limit of a vmss are not assigned",
+			isvmss:             true,
+			add:                manyIDs,
+			expectedIDs:        manyIDs[:maxIdentitiesCount],
+			expectedErr:        "has reached the limit",
+			expectedPatchCount: 1,
+		},
+		{
+			desc:               "identities beyond the limit of a vm are not assigned",
+			initialIDs:         manyIDs[:maxIdentitiesCount],
+			add:                []string{id1},
+			expectedIDs:        manyIDs[:maxIdentitiesCount],
+			expectedErr:        "has reached the limit",
+			expectedPatchCount: 0,
+		},
+		{
+			desc:               "changes beyond the limit of an update are applied to the updated vmss",
+			isvmss:             true,
+			initialIDs:         manyIDs[:100],
+			add:                manyIDs[100:],
+			remove:             manyIDs[:100],
+			expectedIDs:        manyIDs[100:],
+			expectedPatchCount: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			server := fakearm.NewServer("fakeSub")
+			defer server.Close()
+
+			if tc.isvmss {
+				server.AddVMSS("fakeGroup", "node", tc.initialIDs...)
+			} else {
+				server.AddVM("fakeGroup", "node", tc.initialIDs...)
+			}
+			if tc.setup != nil {
+				tc.setup(server)
+			}
+
+			client := newFakeARMClient(t, server)
+			err := client.UpdateUserMSI(context.Background(), tc.add, tc.remove, "node", tc.isvmss)
+			if tc.expectedErr == "" && err != nil {
+				t.Fatalf("expected nil error, got: %+v", err)
+			}
+			if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Fatalf("expected error to contain %s, got: %+v", tc.expectedErr, err)
+			}
+
+			ids := server.VMIdentities("fakeGroup", "node")
+			if tc.isvmss {
+				ids = server.VMSSIdentities("fakeGroup", "node")
+			}
+			if !isSliceEqual(ids, tc.expectedIDs) {
+				t.Fatalf("expected identities %v, got: %v", tc.expectedIDs, ids)
+			}
+			if patchCount := server.RequestCount(http.MethodPatch); patchCount != tc.expectedPatchCount {
+				t.Fatalf("expected %d PATCH requests, got: %d", tc.expectedPatchCount, patchCount)
+			}
+		})
+	}
+}
+
+func TestUpdateUserMSICanceledWithFakeARM(t *testing.T) {
+	id1 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id1"
+
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	server.AddVM("fakeGroup", "node")
+	server.SetConflictingOperations(10)
+
+	client := newFakeARMClient(t, server)
+	client.RetryClient = retry.NewBackoffRetryClient(retry.Backoff{InitialInterval: time.Hour, Multiplier: 1, MaxRetries: 1})
+	client.RetryClient.RegisterRetriableStatusCodes(http.StatusConflict)
+
+	// the conflicting update is not retried once the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.UpdateUserMSI(ctx, []string{id1}, nil, "node", false); err == nil || !strings.Contains(err.Error(), "OperationNotAllowed") {
+		t.Fatalf("expected OperationNotAllowed error, got: %+v", err)
+	}
+	// the requests of the first attempt, which autorest retries itself
+	if patchCount := server.RequestCount(http.MethodPatch); patchCount != 3 {
+		t.Fatalf("expected 3 PATCH requests, got: %d", patchCount)
+	}
+}
+
+func TestInitConcurrentWithUpdates(t *testing.T) {
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	server.AddVM("fakeGroup", "node")
+
+	dir, err := ioutil.TempDir("", "cloudprovider")
+	if err != nil {
+		t.Fatalf("failed to create temp dir, error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "azure.json")
+	cfg := server.AzureConfig("fakeGroup")
+	data := fmt.Sprintf(`{"cloud": %q, "tenantId": %q, "aadClientId": %q, "aadClientSecret": %q, "subscriptionId": %q, "resourceGroup": %q, "resourceManagerEndpoint": %q}`,
+		cfg.Cloud, cfg.TenantID, cfg.ClientID, cfg.ClientSecret, cfg.SubscriptionID, cfg.ResourceGroupName, cfg.ResourceManagerEndpoint)
+	if err := ioutil.WriteFile(configFile, []byte(data), 0600); err != nil {
+		t.Fatalf("failed to write config file, error: %+v", err)
+	}
+
+	client := &Client{configFile: configFile}
+	if err := client.Init(); err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+
+	// the config file is reloaded while the clients are used
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if err := client.Init(); err != nil {
+				t.Errorf("expected nil error, got: %+v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		client.RetryAfter("node")
+		vmClient, vmssClient, err := client.getComputeClients("fakeSub")
+		if err != nil || vmClient == nil || vmssClient == nil {
+			t.Fatalf("expected the clients of the configured subscription, got: %v, %v, %+v", vmClient, vmssClient, err)
+		}
+		if subscriptionID, rg, _, _ := client.parseNodeOrVMSS("node"); subscriptionID != "fakeSub" || rg != "fakeGroup" {
+			t.Fatalf("expected subscription fakeSub and resource group fakeGroup, got: %s, %s", subscriptionID, rg)
+		}
+	}
+	<-done
+}
+
+func TestGetUserMSIsWithFakeARM(t *testing.T) {
+	id1 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id1"
+
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	server.AddVMSS("fakeGroup", "vmss", id1)
+
+	client := newFakeARMClient(t, server)
+	ids, err := client.GetUserMSIs("vmss", true)
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	if !isSliceEqual(ids, []string{id1}) {
+		t.Fatalf("expected identities %v, got: %v", []string{id1}, ids)
+	}
+
+	if _, err = client.GetUserMSIs("unknown", false); err == nil || !strings.Contains(err.Error(), "ResourceNotFound") {
+		t.Fatalf("expected ResourceNotFound error, got: %+v", err)
+	}
+}
+
+func TestUpdateUserMSIByResourceIDWithFakeARM(t *testing.T) {
+	id1 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id1"
+	id2 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id2"
+
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	server.AddVM("fakeGroup", "node", id1)
+	server.AddVM("otherGroup", "node")
+	server.AddVMSSInSubscription("otherSub", "otherGroup", "vmss", id1)
+
+	client := newFakeARMClient(t, server)
+
+	// vm in another resource group of the configured subscription
+	vmID := ComputeResourceID("fakeSub", "otherGroup", "virtualMachines", "node")
+	if err := client.UpdateUserMSI(context.Background(), []string{id2}, nil, vmID, false); err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	if ids := server.VMIdentities("otherGroup", "node"); !isSliceEqual(ids, []string{id2}) {
+		t.Fatalf("expected identities %v, got: %v", []string{id2}, ids)
+	}
+	if ids := server.VMIdentities("fakeGroup", "node"); !isSliceEqual(ids, []string{id1}) {
+		t.Fatalf("expected identities of vm in the configured resource group to be unchanged, got: %v", ids)
+	}
+
+	// vmss in another subscription
+	vmssID := ComputeResourceID("otherSub", "otherGroup", "virtualMachineScaleSets", "vmss")
+	if err := client.UpdateUserMSI(context.Background(), []string{id2}, []string{id1}, vmssID, true); err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	if ids := server.VMSSIdentitiesInSubscription("otherSub", "otherGroup", "vmss"); !isSliceEqual(ids, []string{id2}) {
+		t.Fatalf("expected identities %v, got: %v", []string{id2}, ids)
+	}
+	ids, err := client.GetUserMSIs(vmssID, true)
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	if !isSliceEqual(ids, []string{id2}) {
+		t.Fatalf("expected identities %v, got: %v", []string{id2}, ids)
+	}
+	if len(client.subscriptionClients) != 1 {
+		t.Fatalf("expected compute clients of 1 other subscription, got: %d", len(client.subscriptionClients))
+	}
+
+	if _, err := client.GetUserMSIs("/subscriptions/otherSub/resourceGroups/otherGroup", true); err == nil {
+		t.Fatalf("expected error for an invalid resource ID, got nil")
+	}
+}
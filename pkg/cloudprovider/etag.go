@@ -0,0 +1,38 @@
+package cloudprovider
+
+import (
+	"net/http"
+)
+
+const (
+	// etagHeaderKey is the header of the version of a resource in ARM responses.
+	etagHeaderKey = "ETag"
+	// ifMatchHeaderKey is the header which makes an ARM update conditional on the version of the resource.
+	ifMatchHeaderKey = "If-Match"
+)
+
+// conflictError is returned for an update which ARM rejected with 412 Precondition Failed
+// because the VM or VMSS was modified since it was fetched.
+type conflictError struct {
+	error
+}
+
+// isConflict returns true if err is a conflictError.
+func isConflict(err error) bool {
+	_, ok := err.(*conflictError)
+	return ok
+}
+
+// getETag returns the version of the resource in the response, or an empty string if unknown.
+func getETag(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	return resp.Header.Get(etagHeaderKey)
+}
+
+// isPreconditionFailed returns true if an update was rejected because the If-Match header
+// doesn't match the version of the resource.
+func isPreconditionFailed(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusPreconditionFailed
+}
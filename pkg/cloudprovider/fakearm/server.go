@@ -0,0 +1,511 @@
+// Package fakearm implements an in-process fake of the Azure Resource Manager endpoints of
+// virtual machines and virtual machine scale sets used by the cloud provider, for testing
+// identity assignment without Azure.
+package fakearm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/config"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	// Location is the location of all virtual machines and scale sets of the server
+	Location = "fakelocation"
+
+	vmResourceType   = "virtualMachines"
+	vmssResourceType = "virtualMachineScaleSets"
+
+	identityTypeNone           = "None"
+	identityTypeUserAssigned   = "UserAssigned"
+	identityTypeSystemAssigned = "SystemAssigned"
+
+	// MaxUserAssignedIdentities is the maximum number of user-assigned identities of a virtual machine or scale set
+	MaxUserAssignedIdentities = 150
+
+	operationInProgress = "InProgress"
+	operationSucceeded  = "Succeeded"
+	operationFailed     = "Failed"
+)
+
+var (
+	resourcePattern  = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Compute/(virtualMachines|virtualMachineScaleSets)/([^/]+)$`)
+	operationPattern = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/providers/Microsoft\.Compute/locations/[^/]+/operations/([^/]+)$`)
+)
+
+// Server is a fake of the Azure Resource Manager compute API. It keeps the user-assigned
+// identities of virtual machines and scale sets, completes updates through long-running
+// operations and returns the errors of Azure Resource Manager when configured to.
+type Server struct {
+	*httptest.Server
+
+	subscriptionID string
+
+	mu sync.Mutex
+	// subscriptions contains the lowercase IDs of the served subscriptions
+	subscriptions map[string]bool
+	resources     map[string]*resource
+	// operations contains the pending and completed long-running operations by ID
+	operations  map[string]*operation
+	operationID int
+	// pollingAttempts is the number of times an operation is polled before it completes
+	pollingAttempts int
+	// unauthorized contains the identities which can't be assigned due to missing permissions
+	unauthorized map[string]bool
+	// missing contains the identities which don't exist
+	missing map[string]bool
+	// throttled is the number of requests to throttle and retryAfter the Retry-After header
+	// of the throttled responses
+	throttled  int
+	retryAfter time.Duration
+	// concurrentModifications is the number of updates before which the identities in
+	// concurrentIdentities are assigned by another client
+	concurrentModifications int
+	concurrentIdentities    []string
+	// conflictingOperations is the number of updates to reject because another operation is in progress
+	conflictingOperations int
+	requests              map[string]int
+}
+
+type resource struct {
+	subscriptionID string
+	id             string
+	name           string
+	resourceType   string
+	identityType   string
+	// identities contains the user-assigned identities by lowercase resource ID
+	identities map[string]string
+	// version is incremented on every update and returned as ETag
+	version int
+}
+
+type operation struct {
+	remainingPolls int
+	apply          func()
+	err            *azure.ServiceError
+	status         string
+}
+
+// NewServer starts a fake Azure Resource Manager server of the subscription.
+// The server must be closed with Close.
+func NewServer(subscriptionID string) *Server {
+	s := &Server{
+		subscriptionID: subscriptionID,
+		subscriptions:  map[string]bool{strings.ToLower(subscriptionID): true},
+		resources:      make(map[string]*resource),
+		operations:     make(map[string]*operation),
+		unauthorized:   make(map[string]bool),
+		missing:        make(map[string]bool),
+		requests:       make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AzureConfig returns the configuration of a cloud provider client for the resource group
+// which sends its requests to the server.
+func (s *Server) AzureConfig(resourceGroup string) config.AzureConfig {
+	return config.AzureConfig{
+		Cloud:                   azure.PublicCloud.Name,
+		TenantID:                "fake-tenant-id",
+		ClientID:                "fake-client-id",
+		ClientSecret:            "fake-client-secret",
+		SubscriptionID:          s.subscriptionID,
+		ResourceGroupName:       resourceGroup,
+		ResourceManagerEndpoint: s.URL,
+	}
+}
+
+// NewServicePrincipalToken returns a token which never expires, so that clients of the server
+// don't need to authenticate with Azure Active Directory.
+func NewServicePrincipalToken() (*adal.ServicePrincipalToken, error) {
+	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, "fake-tenant-id")
+	if err != nil {
+		return nil, err
+	}
+	token := adal.Token{
+		AccessToken: "fake-access-token",
+		Type:        "Bearer",
+		ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)),
+	}
+	return adal.NewServicePrincipalTokenFromManualToken(*oauthConfig, "fake-client-id", azure.PublicCloud.ResourceManagerEndpoint, token)
+}
+
+// AddVM adds a virtual machine with the user-assigned identities.
+func (s *Server) AddVM(resourceGroup, name string, identities ...string) {
+	s.addResource(s.subscriptionID, resourceGroup, vmResourceType, name, identities)
+}
+
+// AddVMSS adds a virtual machine scale set with the user-assigned identities.
+func (s *Server) AddVMSS(resourceGroup, name string, identities ...string) {
+	s.addResource(s.subscriptionID, resourceGroup, vmssResourceType, name, identities)
+}
+
+// AddVMInSubscription adds a virtual machine with the user-assigned identities to another
+// subscription, which is served by the server from then on.
+func (s *Server) AddVMInSubscription(subscriptionID, resourceGroup, name string, identities ...string) {
+	s.addResource(subscriptionID, resourceGroup, vmResourceType, name, identities)
+}
+
+// AddVMSSInSubscription adds a virtual machine scale set with the user-assigned identities to another
+// subscription, which is served by the server from then on.
+func (s *Server) AddVMSSInSubscription(subscriptionID, resourceGroup, name string, identities ...string) {
+	s.addResource(subscriptionID, resourceGroup, vmssResourceType, name, identities)
+}
+
+// VMIdentities returns the sorted user-assigned identities of a virtual machine.
+func (s *Server) VMIdentities(resourceGroup, name string) []string {
+	return s.identities(s.subscriptionID, resourceGroup, vmResourceType, name)
+}
+
+// VMSSIdentities returns the sorted user-assigned identities of a virtual machine scale set.
+func (s *Server) VMSSIdentities(resourceGroup, name string) []string {
+	return s.identities(s.subscriptionID, resourceGroup, vmssResourceType, name)
+}
+
+// VMIdentitiesInSubscription returns the sorted user-assigned identities of a virtual machine in another subscription.
+func (s *Server) VMIdentitiesInSubscription(subscriptionID, resourceGroup, name string) []string {
+	return s.identities(subscriptionID, resourceGroup, vmResourceType, name)
+}
+
+// VMSSIdentitiesInSubscription returns the sorted user-assigned identities of a virtual machine scale set in another subscription.
+func (s *Server) VMSSIdentitiesInSubscription(subscriptionID, resourceGroup, name string) []string {
+	return s.identities(subscriptionID, resourceGroup, vmssResourceType, name)
+}
+
+// SetPollingAttempts sets the number of times a long-running operation is polled
+// before it completes. Operations complete on the first poll by default.
+func (s *Server) SetPollingAttempts(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pollingAttempts = n
+}
+
+// SetUnauthorizedIdentities makes the updates which assign any of the identities fail with
+// LinkedAuthorizationFailed, as if the client isn't allowed to assign them.
+func (s *Server) SetUnauthorizedIdentities(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		s.unauthorized[strings.ToLower(id)] = true
+	}
+}
+
+// SetMissingIdentities makes the operations which assign any of the identities fail with
+// FailedIdentityOperation, as if the identities don't exist.
+func (s *Server) SetMissingIdentities(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		s.missing[strings.ToLower(id)] = true
+	}
+}
+
+// ThrottleRequests throttles the next n requests to virtual machines and scale sets with
+// 429 Too Many Requests and the Retry-After header.
+func (s *Server) ThrottleRequests(n int, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.throttled = n
+	s.retryAfter = retryAfter
+}
+
+// SetConcurrentModifications simulates another client, e.g. the cluster autoscaler, which modifies
+// virtual machines and scale sets between the requests of the cloud provider: the identities are
+// assigned to the resource of each of the next n updates, and its ETag changes, right before the update.
+func (s *Server) SetConcurrentModifications(n int, identities ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.concurrentModifications = n
+	s.concurrentIdentities = identities
+}
+
+// SetConflictingOperations rejects the next n updates of virtual machines and scale sets with
+// 409 Conflict, as if another operation on the resource were in progress.
+func (s *Server) SetConflictingOperations(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conflictingOperations = n
+}
+
+// RequestCount returns the number of requests of the HTTP method to virtual machines and
+// scale sets, including throttled and failed requests.
+func (s *Server) RequestCount(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+func (s *Server) addResource(subscriptionID, resourceGroup, resourceType, name string, identities []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &resource{
+		subscriptionID: subscriptionID,
+		id:             fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/%s/%s", subscriptionID, resourceGroup, resourceType, name),
+		name:           name,
+		resourceType:   resourceType,
+		identityType:   identityTypeNone,
+		identities:     make(map[string]string),
+		version:        1,
+	}
+	for _, id := range identities {
+		r.identities[strings.ToLower(id)] = id
+	}
+	if len(r.identities) > 0 {
+		r.identityType = identityTypeUserAssigned
+	}
+	s.resources[resourceKey(subscriptionID, resourceGroup, resourceType, name)] = r
+	s.subscriptions[strings.ToLower(subscriptionID)] = true
+}
+
+func (s *Server) identities(subscriptionID, resourceGroup, resourceType, name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.resources[resourceKey(subscriptionID, resourceGroup, resourceType, name)]
+	if !ok {
+		return nil
+	}
+	ids := make([]string, 0, len(r.identities))
+	for _, id := range r.identities {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func resourceKey(subscriptionID, resourceGroup, resourceType, name string) string {
+	return strings.ToLower(fmt.Sprintf("%s/%s/%s/%s", subscriptionID, resourceGroup, resourceType, name))
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if m := operationPattern.FindStringSubmatch(req.URL.Path); m != nil && req.Method == http.MethodGet {
+		s.getOperation(w, m[2])
+		return
+	}
+
+	m := resourcePattern.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "InvalidResourceType", fmt.Sprintf("The resource type could not be found for path '%s'.", req.URL.Path))
+		return
+	}
+	subscriptionID, resourceGroup, resourceType, name := m[1], m[2], m[3], m[4]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[req.Method]++
+	if s.throttled > 0 {
+		s.throttled--
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.retryAfter.Seconds())))
+		writeError(w, http.StatusTooManyRequests, "OperationNotAllowed", "The server rejected the request because too many requests have been received for this subscription.")
+		return
+	}
+	if !s.subscriptions[strings.ToLower(subscriptionID)] {
+		writeError(w, http.StatusNotFound, "SubscriptionNotFound", fmt.Sprintf("The subscription '%s' could not be found.", subscriptionID))
+		return
+	}
+	r, ok := s.resources[resourceKey(subscriptionID, resourceGroup, resourceType, name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", fmt.Sprintf("The Resource 'Microsoft.Compute/%s/%s' under resource group '%s' was not found.", resourceType, name, resourceGroup))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("ETag", r.etag())
+		writeJSON(w, http.StatusOK, r.toJSON(operationSucceeded))
+	case http.MethodPatch:
+		s.patch(w, req, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("The method '%s' is not allowed.", req.Method))
+	}
+}
+
+// patch starts a long-running operation which updates the identities of the resource.
+// s.mu must be held.
+func (s *Server) patch(w http.ResponseWriter, req *http.Request, r *resource) {
+	var body struct {
+		Identity *struct {
+			Type                   string               `json:"type"`
+			UserAssignedIdentities map[string]*struct{} `json:"userAssignedIdentities"`
+		} `json:"identity"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", fmt.Sprintf("The request content was invalid and could not be deserialized: '%s'.", err))
+		return
+	}
+
+	if s.concurrentModifications > 0 {
+		s.concurrentModifications--
+		for _, id := range s.concurrentIdentities {
+			r.identities[strings.ToLower(id)] = id
+		}
+		if len(r.identities) > 0 && r.identityType == identityTypeNone {
+			r.identityType = identityTypeUserAssigned
+		}
+		r.version++
+	}
+	if s.conflictingOperations > 0 {
+		s.conflictingOperations--
+		writeError(w, http.StatusConflict, "OperationNotAllowed", fmt.Sprintf("Operation 'Update' is not allowed since another operation is in progress on '%s'.", r.id))
+		return
+	}
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" && ifMatch != r.etag() {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", fmt.Sprintf("The condition specified using HTTP conditional header(s) is not met. If-Match: %s, ETag: %s.", ifMatch, r.etag()))
+		return
+	}
+
+	identityType := r.identityType
+	identities := make(map[string]string, len(r.identities))
+	for key, id := range r.identities {
+		identities[key] = id
+	}
+	var unauthorized, missing []string
+	if body.Identity != nil {
+		if body.Identity.Type != "" {
+			identityType = body.Identity.Type
+		}
+		for id, value := range body.Identity.UserAssignedIdentities {
+			key := strings.ToLower(id)
+			if value == nil {
+				delete(identities, key)
+				continue
+			}
+			if _, exists := identities[key]; !exists {
+				if s.unauthorized[key] {
+					unauthorized = append(unauthorized, id)
+				}
+				if s.missing[key] {
+					missing = append(missing, id)
+				}
+			}
+			identities[key] = id
+		}
+		if identityType == identityTypeNone || identityType == identityTypeSystemAssigned {
+			identities = make(map[string]string)
+		}
+	}
+
+	if len(identities) > MaxUserAssignedIdentities {
+		writeError(w, http.StatusBadRequest, "TooManyUserAssignedIdentities", fmt.Sprintf("The number of user-assigned identities of resource '%s' would exceed the limit of %d.", r.id, MaxUserAssignedIdentities))
+		return
+	}
+	if len(unauthorized) > 0 {
+		sort.Strings(unauthorized)
+		writeError(w, http.StatusForbidden, "LinkedAuthorizationFailed", fmt.Sprintf("The client 'fake-client-id' with object id 'fake-object-id' has permission to perform action 'Microsoft.Compute/%s/write' on scope '%s'; however, it does not have permission to perform action 'Microsoft.ManagedIdentity/userAssignedIdentities/assign/action' on the linked scope(s) '%s' or the linked scope(s) are invalid.", r.resourceType, r.id, strings.Join(unauthorized, ",")))
+		return
+	}
+
+	s.operationID++
+	operationID := fmt.Sprintf("00000000-0000-0000-0000-%012d", s.operationID)
+	op := &operation{
+		remainingPolls: s.pollingAttempts,
+		status:         operationInProgress,
+		apply: func() {
+			r.identityType = identityType
+			r.identities = identities
+			r.version++
+		},
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		op.err = &azure.ServiceError{
+			Code:    "FailedIdentityOperation",
+			Message: fmt.Sprintf("Identity operation for resource '%s' failed with error 'Failed to perform resource identity operation. Status: 'NotFound'. Response: 'Resource '%s' was not found.''.", r.id, strings.Join(missing, ",")),
+		}
+	}
+	s.operations[operationID] = op
+
+	w.Header().Set("Azure-AsyncOperation", fmt.Sprintf("%s/subscriptions/%s/providers/Microsoft.Compute/locations/%s/operations/%s?api-version=2019-12-01", s.URL, r.subscriptionID, Location, operationID))
+	w.Header().Set("Retry-After", "0")
+	writeJSON(w, http.StatusOK, r.toJSON("Updating"))
+}
+
+// getOperation returns the status of a long-running operation and completes it
+// once it's been polled the configured number of times.
+func (s *Server) getOperation(w http.ResponseWriter, operationID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.operations[operationID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("The operation '%s' was not found.", operationID))
+		return
+	}
+	if op.status == operationInProgress {
+		if op.remainingPolls > 0 {
+			op.remainingPolls--
+		} else if op.err != nil {
+			op.status = operationFailed
+		} else {
+			op.apply()
+			op.status = operationSucceeded
+		}
+	}
+
+	body := map[string]interface{}{
+		"name":   operationID,
+		"status": op.status,
+	}
+	if op.status == operationFailed {
+		body["error"] = op.err
+	}
+	w.Header().Set("Retry-After", "0")
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (r *resource) etag() string {
+	return fmt.Sprintf("\"%d\"", r.version)
+}
+
+func (r *resource) toJSON(provisioningState string) map[string]interface{} {
+	identity := map[string]interface{}{
+		"type": r.identityType,
+	}
+	if len(r.identities) > 0 {
+		userAssignedIdentities := make(map[string]interface{}, len(r.identities))
+		for _, id := range r.identities {
+			userAssignedIdentities[id] = map[string]interface{}{}
+		}
+		identity["userAssignedIdentities"] = userAssignedIdentities
+	}
+	return map[string]interface{}{
+		"id":       r.id,
+		"name":     r.name,
+		"type":     "Microsoft.Compute/" + r.resourceType,
+		"location": Location,
+		"identity": identity,
+		"properties": map[string]interface{}{
+			"provisioningState": provisioningState,
+		},
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	writeJSON(w, statusCode, map[string]interface{}{
+		"error": azure.ServiceError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,75 @@
+package cloudprovider
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// computeClients are the VM and VMSS clients of a subscription
+type computeClients struct {
+	vmClient   VMClientInt
+	vmssClient VMSSClientInt
+}
+
+// isResourceID returns true if name is an ARM resource ID rather than the name of a VM or VMSS
+func isResourceID(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "/subscriptions/")
+}
+
+// ComputeResourceID returns the ARM resource ID of a VM or VMSS, e.g. the one parsed
+// from the provider ID of a node with ParseResourceID.
+func ComputeResourceID(subscriptionID, resourceGroup, resourceType, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/%s/%s", subscriptionID, resourceGroup, resourceType, name)
+}
+
+// parseNodeOrVMSS returns the subscription, resource group and name of a VM or VMSS,
+// which is given either by its ARM resource ID or by its name in the configured
+// subscription and resource group.
+func (c *Client) parseNodeOrVMSS(name string) (subscriptionID, resourceGroup, resourceName string, err error) {
+	if !isResourceID(name) {
+		c.clientsMu.Lock()
+		defer c.clientsMu.Unlock()
+		return c.Config.SubscriptionID, c.Config.ResourceGroupName, name, nil
+	}
+	r, err := ParseResourceID(name)
+	if err != nil {
+		return "", "", "", err
+	}
+	return r.SubscriptionID, r.ResourceGroup, r.ResourceName, nil
+}
+
+// getComputeClients returns the VM and VMSS clients of the subscription, which are created
+// on first use and cached. VMClient and VMSSClient are used for the configured subscription,
+// and for all subscriptions if the client wasn't initialized with Init.
+func (c *Client) getComputeClients(subscriptionID string) (VMClientInt, VMSSClientInt, error) {
+	c.clientsMu.Lock()
+	defer c.clientsMu.Unlock()
+
+	if c.spt == nil || subscriptionID == "" || strings.EqualFold(subscriptionID, c.Config.SubscriptionID) {
+		return c.VMClient, c.VMSSClient, nil
+	}
+
+	key := strings.ToLower(subscriptionID)
+	if clients, ok := c.subscriptionClients[key]; ok {
+		return clients.vmClient, clients.vmssClient, nil
+	}
+
+	config := c.Config
+	config.SubscriptionID = subscriptionID
+	vmClient, err := NewVirtualMachinesClient(config, c.spt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create VM client for subscription %s, error: %+v", subscriptionID, err)
+	}
+	vmssClient, err := NewVMSSClient(config, c.spt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create VMSS client for subscription %s, error: %+v", subscriptionID, err)
+	}
+	if c.subscriptionClients == nil {
+		c.subscriptionClients = make(map[string]*computeClients)
+	}
+	c.subscriptionClients[key] = &computeClients{vmClient: vmClient, vmssClient: vmssClient}
+	klog.Infof("created compute clients for subscription %s", subscriptionID)
+	return vmClient, vmssClient, nil
+}
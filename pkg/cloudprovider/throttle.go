@@ -0,0 +1,123 @@
+package cloudprovider
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultThrottleDuration is how long requests are blocked after a throttled
+	// response without a Retry-After header.
+	defaultThrottleDuration = 10 * time.Second
+)
+
+// throttledError is returned for the ARM requests which are not sent because
+// ARM throttled an earlier request of the same subscription.
+type throttledError struct {
+	retryAfter time.Time
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("ARM requests are throttled, retry after: %v", e.retryAfter)
+}
+
+// throttleGate blocks all ARM requests of a subscription until the Retry-After of
+// the last throttled response has elapsed. ARM throttles per subscription, so any
+// further request, including those of other VMs and VMSS, would only extend the throttling.
+// A nil gate never blocks.
+type throttleGate struct {
+	name string
+
+	mu         sync.RWMutex
+	retryAfter time.Time
+}
+
+var (
+	throttleGatesMu sync.Mutex
+	// throttleGates contains the gate of every subscription, keyed by ARM endpoint and subscription ID
+	throttleGates = make(map[string]*throttleGate)
+)
+
+// getThrottleGate returns the gate shared by all the clients of the subscription on the ARM endpoint.
+func getThrottleGate(endpoint, subscriptionID string) *throttleGate {
+	key := strings.ToLower(strings.TrimSuffix(endpoint, "/") + "/subscriptions/" + subscriptionID)
+
+	throttleGatesMu.Lock()
+	defer throttleGatesMu.Unlock()
+
+	gate, ok := throttleGates[key]
+	if !ok {
+		gate = &throttleGate{name: subscriptionID}
+		throttleGates[key] = gate
+	}
+	return gate
+}
+
+// RetryAfter returns the time until which requests are blocked, which is in the past if they are not.
+func (g *throttleGate) RetryAfter() time.Time {
+	if g == nil {
+		return time.Time{}
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.retryAfter
+}
+
+// check returns a throttledError if requests are blocked.
+func (g *throttleGate) check() error {
+	if retryAfter := g.RetryAfter(); retryAfter.After(time.Now()) {
+		return &throttledError{retryAfter: retryAfter}
+	}
+	return nil
+}
+
+// update blocks requests until the Retry-After of the response has elapsed if the response is throttled,
+// i.e. it has the status code 429 or a Retry-After header. It returns true if the response is throttled.
+func (g *throttleGate) update(resp *http.Response) bool {
+	if g == nil || resp == nil {
+		return false
+	}
+	duration := getRetryAfter(resp)
+	if duration <= 0 {
+		if resp.StatusCode != http.StatusTooManyRequests {
+			return false
+		}
+		duration = defaultThrottleDuration
+	}
+
+	retryAfter := time.Now().Add(duration)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if retryAfter.After(g.retryAfter) {
+		g.retryAfter = retryAfter
+		klog.Warningf("ARM requests of subscription %s are throttled, blocking requests until %v", g.name, retryAfter)
+	}
+	return true
+}
+
+// checkThrottle returns a throttledError and reports the blocked operation if requests are blocked by the gate.
+func checkThrottle(gate *throttleGate, reporter *metrics.Reporter, operation string) error {
+	err := gate.check()
+	if err != nil {
+		if reportErr := reporter.ReportCloudProviderBlocked(operation); reportErr != nil {
+			klog.Warningf("failed to report metrics, error: %+v", reportErr)
+		}
+	}
+	return err
+}
+
+// updateThrottle updates the gate with the response of a failed request and reports the operation if it was throttled.
+func updateThrottle(gate *throttleGate, reporter *metrics.Reporter, operation string, resp *http.Response) {
+	if gate.update(resp) {
+		if err := reporter.ReportCloudProviderThrottled(operation); err != nil {
+			klog.Warningf("failed to report metrics, error: %+v", err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package cloudprovider
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider/fakearm"
+)
+
+func TestThrottleGate(t *testing.T) {
+	cases := []struct {
+		desc              string
+		resp              *http.Response
+		expectedThrottled bool
+		expectedDuration  time.Duration
+	}{
+		{
+			desc: "nil response",
+		},
+		{
+			desc: "response is not throttled",
+			resp: &http.Response{StatusCode: http.StatusNotFound},
+		},
+		{
+			desc:              "throttled response with Retry-After",
+			resp:              &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"120"}}},
+			expectedThrottled: true,
+			expectedDuration:  2 * time.Minute,
+		},
+		{
+			desc:              "throttled response without Retry-After",
+			resp:              &http.Response{StatusCode: http.StatusTooManyRequests},
+			expectedThrottled: true,
+			expectedDuration:  defaultThrottleDuration,
+		},
+		{
+			desc:              "unavailable response with Retry-After",
+			resp:              &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": []string{"60"}}},
+			expectedThrottled: true,
+			expectedDuration:  time.Minute,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			gate := &throttleGate{name: "sub"}
+			if throttled := gate.update(tc.resp); throttled != tc.expectedThrottled {
+				t.Fatalf("expected throttled to be %t, got: %t", tc.expectedThrottled, throttled)
+			}
+			err := gate.check()
+			if !tc.expectedThrottled {
+				if err != nil {
+					t.Fatalf("expected nil error, got: %+v", err)
+				}
+				return
+			}
+			if _, ok := err.(*throttledError); !ok {
+				t.Fatalf("expected throttled error, got: %+v", err)
+			}
+			if duration := time.Until(gate.RetryAfter()).Round(time.Second); duration != tc.expectedDuration {
+				t.Fatalf("expected requests to be blocked for %s, got: %s", tc.expectedDuration, duration)
+			}
+
+			// a shorter Retry-After doesn't unblock requests earlier
+			gate.update(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"1"}}})
+			if duration := time.Until(gate.RetryAfter()).Round(time.Second); duration != tc.expectedDuration {
+				t.Fatalf("expected requests to be blocked for %s, got: %s", tc.expectedDuration, duration)
+			}
+		})
+	}
+}
+
+func TestNilThrottleGate(t *testing.T) {
+	var gate *throttleGate
+	if gate.update(&http.Response{StatusCode: http.StatusTooManyRequests}) {
+		t.Fatal("expected nil gate not to be throttled")
+	}
+	if err := gate.check(); err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+}
+
+func TestGetThrottleGate(t *testing.T) {
+	gate := getThrottleGate("https://management.azure.com/", "Sub1")
+	if gate != getThrottleGate("https://management.azure.com", "sub1") {
+		t.Fatal("expected the clients of a subscription to share the gate")
+	}
+	if gate == getThrottleGate("https://management.azure.com/", "sub2") {
+		t.Fatal("expected different subscriptions not to share the gate")
+	}
+	if gate == getThrottleGate("https://management.chinacloudapi.cn/", "sub1") {
+		t.Fatal("expected subscriptions of different clouds not to share the gate")
+	}
+}
+
+func TestThrottlingWithFakeARM(t *testing.T) {
+	id1 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id1"
+
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	server.AddVM("fakeGroup", "vm")
+	server.AddVMSS("fakeGroup", "vmss")
+	server.ThrottleRequests(1, time.Minute)
+
+	client := newFakeARMClient(t, server)
+	if err := client.UpdateUserMSI(context.Background(), []string{id1}, nil, "vm", false); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("expected 429 error, got: %+v", err)
+	}
+	if duration := time.Until(client.RetryAfter("vm")).Round(time.Second); duration != time.Minute {
+		t.Fatalf("expected requests to be blocked for 1m, got: %s", duration)
+	}
+
+	// no further requests of the subscription are sent until Retry-After has elapsed
+	requests := server.RequestCount(http.MethodGet) + server.RequestCount(http.MethodPatch)
+	if err := client.UpdateUserMSI(context.Background(), []string{id1}, nil, "vmss", true); err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("expected throttled error, got: %+v", err)
+	}
+	if _, err := client.GetUserMSIs("vm", false); err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("expected throttled error, got: %+v", err)
+	}
+	if sent := server.RequestCount(http.MethodGet) + server.RequestCount(http.MethodPatch) - requests; sent != 0 {
+		t.Fatalf("expected no requests to be sent while throttled, got: %d", sent)
+	}
+
+	// requests are sent again once Retry-After has elapsed
+	client.throttle.mu.Lock()
+	client.throttle.retryAfter = time.Now()
+	client.throttle.mu.Unlock()
+	if err := client.UpdateUserMSI(context.Background(), []string{id1}, nil, "vmss", true); err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	if ids := server.VMSSIdentities("fakeGroup", "vmss"); !isSliceEqual(ids, []string{id1}) {
+		t.Fatalf("expected identities %v, got: %v", []string{id1}, ids)
+	}
+}
+
+func TestThrottlingOfOtherSubscriptionWithFakeARM(t *testing.T) {
+	id1 := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/id1"
+
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	server.AddVM("fakeGroup", "vm")
+	server.AddVMSSInSubscription("otherSub", "otherGroup", "vmss")
+	server.ThrottleRequests(1, time.Minute)
+
+	client := newFakeARMClient(t, server)
+	vmssID := ComputeResourceID("otherSub", "otherGroup", "virtualMachineScaleSets", "vmss")
+	if err := client.UpdateUserMSI(context.Background(), []string{id1}, nil, vmssID, true); err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("expected throttled error, got: %+v", err)
+	}
+	if duration := time.Until(client.RetryAfter(vmssID)).Round(time.Second); duration != time.Minute {
+		t.Fatalf("expected requests of the other subscription to be blocked for 1m, got: %s", duration)
+	}
+
+	// the configured subscription is not throttled
+	if retryAfter := client.RetryAfter("vm"); retryAfter.After(time.Now()) {
+		t.Fatalf("expected requests of the configured subscription not to be blocked, got: %v", retryAfter)
+	}
+	if err := client.UpdateUserMSI(context.Background(), []string{id1}, nil, "vm", false); err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+}
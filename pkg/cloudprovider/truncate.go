@@ -1,38 +1,100 @@
 package cloudprovider
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
 )
 
 const (
+	// maxIdentitiesCount is the maximum number of user-assigned identities of a VM or VMSS,
+	// which is also the maximum number of identity changes sent in a single update.
 	maxIdentitiesCount = 150
 )
 
+// OverflowError is returned by UpdateUserMSI when identities are not assigned to a node or vmss
+// because it has reached the maximum number of user-assigned identities.
+type OverflowError struct {
+	// Name is the name of the node or vmss
+	Name string
+	// Identities contains the resource IDs of the identities which are not assigned
+	Identities []string
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("%s has reached the limit of %d user-assigned identities, identities %v are not assigned", e.Name, maxIdentitiesCount, e.Identities)
+}
+
+// limitIdentities returns the changes in ids without the identities to assign which exceed
+// maxIdentitiesCount together with the current identities of a node or vmss. The identities
+// are assigned in the order of addIDs and the ones which are not are returned.
+func limitIdentities(current []string, ids map[string]bool, addIDs []string) (map[string]bool, []string) {
+	assigned := make(map[string]bool)
+	for _, id := range current {
+		assigned[strings.ToLower(id)] = true
+	}
+	limited := make(map[string]bool, len(ids))
+	for id, add := range ids {
+		limited[id] = add
+		if !add {
+			delete(assigned, strings.ToLower(id))
+		}
+	}
+
+	var overflowed []string
+	for _, id := range addIDs {
+		key := strings.ToLower(id)
+		if assigned[key] {
+			continue
+		}
+		if len(assigned) < maxIdentitiesCount {
+			assigned[key] = true
+			continue
+		}
+		delete(limited, id)
+		overflowed = append(overflowed, id)
+	}
+	return limited, overflowed
+}
+
 // truncateVMIdentities truncates a given list of vm identities to maxIdentitiesCount and returns any extra identities.
+// Removals are kept before additions so that no update exceeds the limit of identities of the vm.
 func truncateVMIdentities(ids map[string]*compute.VirtualMachineIdentityUserAssignedIdentitiesValue) (map[string]*compute.VirtualMachineIdentityUserAssignedIdentitiesValue, map[string]*compute.VirtualMachineIdentityUserAssignedIdentitiesValue) {
 	rest := make(map[string]*compute.VirtualMachineIdentityUserAssignedIdentitiesValue)
 	i := 0
-	for k, v := range ids {
-		if i >= maxIdentitiesCount {
-			rest[k] = v
-			delete(ids, k)
+	for _, removal := range []bool{true, false} {
+		for k, v := range ids {
+			if (v == nil) != removal {
+				continue
+			}
+			if i >= maxIdentitiesCount {
+				rest[k] = v
+				delete(ids, k)
+			}
+			i++
 		}
-		i++
 	}
 
 	return ids, rest
 }
 
 // truncateVMSSIdentities truncates a given list of vmss identities to maxIdentitiesCount and returns any extra identities.
+// Removals are kept before additions so that no update exceeds the limit of identities of the vmss.
 func truncateVMSSIdentities(ids map[string]*compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue) (map[string]*compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue, map[string]*compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue) {
 	rest := make(map[string]*compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue)
 	i := 0
-	for k, v := range ids {
-		if i >= maxIdentitiesCount {
-			rest[k] = v
-			delete(ids, k)
+	for _, removal := range []bool{true, false} {
+		for k, v := range ids {
+			if (v == nil) != removal {
+				continue
+			}
+			if i >= maxIdentitiesCount {
+				rest[k] = v
+				delete(ids, k)
+			}
+			i++
 		}
-		i++
 	}
 
 	return ids, rest
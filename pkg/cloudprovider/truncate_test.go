@@ -61,3 +61,69 @@ func TestTruncateVMSSIdentities(t *testing.T) {
 		assert.True(t, ok1 || ok2, "%s does not exist in both ids and rest", key)
 	}
 }
+
+func TestTruncateVMSSIdentitiesRemovalsFirst(t *testing.T) {
+	ids := make(map[string]*compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue)
+	for i := 0; i < maxIdentitiesCount; i++ {
+		ids[fmt.Sprintf("add-%d", i)] = &compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+		ids[fmt.Sprintf("remove-%d", i)] = nil
+	}
+	truncated, rest := truncateVMSSIdentities(ids)
+	assert.Len(t, truncated, maxIdentitiesCount)
+	assert.Len(t, rest, maxIdentitiesCount)
+	for k, v := range truncated {
+		assert.Nil(t, v, "%s is not a removal", k)
+	}
+	for k, v := range rest {
+		assert.NotNil(t, v, "%s is not an addition", k)
+	}
+}
+
+func TestLimitIdentities(t *testing.T) {
+	var current []string
+	for i := 0; i < maxIdentitiesCount-1; i++ {
+		current = append(current, fmt.Sprintf("id-%d", i))
+	}
+
+	cases := []struct {
+		desc               string
+		ids                map[string]bool
+		addIDs             []string
+		expectedIDs        map[string]bool
+		expectedOverflowed []string
+	}{
+		{
+			desc:        "identities within the limit are assigned",
+			ids:         map[string]bool{"new-1": true},
+			addIDs:      []string{"new-1"},
+			expectedIDs: map[string]bool{"new-1": true},
+		},
+		{
+			desc:               "identities beyond the limit are not assigned in order",
+			ids:                map[string]bool{"new-1": true, "new-2": true, "new-3": true},
+			addIDs:             []string{"new-2", "new-1", "new-3"},
+			expectedIDs:        map[string]bool{"new-2": true},
+			expectedOverflowed: []string{"new-1", "new-3"},
+		},
+		{
+			desc:        "removed identities make room for new identities",
+			ids:         map[string]bool{"id-0": false, "new-1": true, "new-2": true},
+			addIDs:      []string{"new-1", "new-2"},
+			expectedIDs: map[string]bool{"id-0": false, "new-1": true, "new-2": true},
+		},
+		{
+			desc:        "current identities are not counted twice",
+			ids:         map[string]bool{"ID-1": true, "new-1": true},
+			addIDs:      []string{"ID-1", "new-1"},
+			expectedIDs: map[string]bool{"ID-1": true, "new-1": true},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ids, overflowed := limitIdentities(current, tc.ids, tc.addIDs)
+			assert.Equal(t, tc.expectedIDs, ids)
+			assert.Equal(t, tc.expectedOverflowed, overflowed)
+		})
+	}
+}
@@ -22,9 +22,8 @@ import (
 type VMClient struct {
 	client   compute.VirtualMachinesClient
 	reporter *metrics.Reporter
-	// ARM throttling configures.
-	retryAfterReader time.Time
-	retryAfterWriter time.Time
+	// throttle blocks requests while ARM throttles the subscription
+	throttle *throttleGate
 }
 
 // VMClientInt is the interface used by "cloudprovider" for interacting with Azure vmas
@@ -41,7 +40,7 @@ func NewVirtualMachinesClient(config config.AzureConfig, spt *adal.ServicePrinci
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cloud environment, error: %+v", err)
 	}
-	client.BaseURI = azureEnv.ResourceManagerEndpoint
+	client.BaseURI = getResourceManagerEndpoint(config, azureEnv)
 	client.Authorizer = autorest.NewBearerAuthorizer(spt)
 	client.PollingDelay = 5 * time.Second
 	err = client.AddToUserAgent(version.GetUserAgent("MIC", version.MICVersion))
@@ -57,6 +56,7 @@ func NewVirtualMachinesClient(config config.AzureConfig, spt *adal.ServicePrinci
 	return &VMClient{
 		client:   client,
 		reporter: reporter,
+		throttle: getThrottleGate(client.BaseURI, config.SubscriptionID),
 	}, nil
 }
 
@@ -80,16 +80,15 @@ func (c *VMClient) Get(rgName string, nodeName string) (compute.VirtualMachine,
 		}
 	}()
 
-	// Report errors if the client is throttled.
-	if c.retryAfterReader.After(time.Now()) {
-		return compute.VirtualMachine{}, fmt.Errorf("VMGet client throttled, retry after: %v", c.retryAfterReader)
+	// Report errors if ARM is throttling the subscription.
+	if err = checkThrottle(c.throttle, c.reporter, metrics.GetVMOperationName); err != nil {
+		return compute.VirtualMachine{}, err
 	}
 
 	vm, err := c.client.Get(ctx, rgName, nodeName, "")
 	if err != nil {
-		resp := vm.Response.Response
-		// Update RetryAfterReader so that no more requests would be sent until RetryAfter expires.
-		c.retryAfterReader = time.Now().Add(getRetryAfter(resp))
+		// No more requests are sent until Retry-After has elapsed if the request was throttled.
+		updateThrottle(c.throttle, c.reporter, metrics.GetVMOperationName, vm.Response.Response)
 		return vm, fmt.Errorf("failed to get vm %s in resource group %s, error: %+v", nodeName, rgName, err)
 	}
 	stats.Increment(stats.TotalGetCalls, 1)
@@ -118,24 +117,40 @@ func (c *VMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualMachi
 		}
 	}()
 
-	// Report errors if the client is throttled.
-	if c.retryAfterWriter.After(time.Now()) {
-		return fmt.Errorf("VMUpdate client throttled, retry after: %v", c.retryAfterWriter)
+	// Report errors if ARM is throttling the subscription.
+	if err = checkThrottle(c.throttle, c.reporter, metrics.UpdateVMOperationName); err != nil {
+		return err
 	}
 
+	// the update fails if the vm was modified since it was fetched
+	etag := getETag(vm.Response.Response)
 	hasUpdated := false
 	remainingIDs := vm.Identity.UserAssignedIdentities
 	for !hasUpdated || len(remainingIDs) > 0 {
 		hasUpdated = true
 		vm.Identity.UserAssignedIdentities, remainingIDs = truncateVMIdentities(remainingIDs)
-		if future, err = c.client.Update(ctx, rg, nodeName, compute.VirtualMachineUpdate{Identity: vm.Identity}); err != nil {
-			resp := future.Response()
-			// Update RetryAfterWriter so that no more requests would be sent until RetryAfter expires.
-			c.retryAfterWriter = time.Now().Add(getRetryAfter(resp))
-			return fmt.Errorf("failed to update identities for %s in %s, error: %+v", nodeName, rg, err)
+		if future, err = c.update(ctx, rg, nodeName, compute.VirtualMachineUpdate{Identity: vm.Identity}, etag); err != nil {
+			// No more requests are sent until Retry-After has elapsed if the request was throttled.
+			updateThrottle(c.throttle, c.reporter, metrics.UpdateVMOperationName, future.Response())
+			updateErr := fmt.Errorf("failed to update identities for %s in %s, error: %w", nodeName, rg, err)
+			if isPreconditionFailed(future.Response()) {
+				if reportErr := c.reporter.ReportCloudProviderConflict(metrics.UpdateVMOperationName); reportErr != nil {
+					klog.Warningf("failed to report metrics, error: %+v", reportErr)
+				}
+				return &conflictError{updateErr}
+			}
+			return updateErr
 		}
 		if err = future.WaitForCompletionRef(ctx, c.client.Client); err != nil {
-			return fmt.Errorf("failed to wait for identity update completion for vm %s in resource group %s, error: %+v", nodeName, rg, err)
+			return fmt.Errorf("failed to wait for identity update completion for vm %s in resource group %s, error: %w", nodeName, rg, err)
+		}
+		if len(remainingIDs) > 0 {
+			// the remaining identities are assigned to the version of the vm which was just updated
+			var updated compute.VirtualMachine
+			if updated, err = future.Result(c.client); err != nil {
+				return fmt.Errorf("failed to get updated vm %s in resource group %s, error: %+v", nodeName, rg, err)
+			}
+			etag = getETag(updated.Response.Response)
 		}
 		stats.Increment(stats.TotalPatchCalls, 1)
 		stats.AggregateConcurrent(stats.CloudPatch, begin, time.Now())
@@ -144,6 +159,22 @@ func (c *VMClient) UpdateIdentities(rg, nodeName string, vm compute.VirtualMachi
 	return nil
 }
 
+// update sends the update of the vm, which is conditional on the version of the vm if etag is not empty.
+func (c *VMClient) update(ctx context.Context, rg, nodeName string, parameters compute.VirtualMachineUpdate, etag string) (compute.VirtualMachinesUpdateFuture, error) {
+	req, err := c.client.UpdatePreparer(ctx, rg, nodeName, parameters)
+	if err != nil {
+		return compute.VirtualMachinesUpdateFuture{}, autorest.NewErrorWithError(err, "compute.VirtualMachinesClient", "Update", nil, "Failure preparing request")
+	}
+	if etag != "" {
+		req.Header.Set(ifMatchHeaderKey, etag)
+	}
+	future, err := c.client.UpdateSender(req)
+	if err != nil {
+		return future, autorest.NewErrorWithError(err, "compute.VirtualMachinesClient", "Update", future.Response(), "Failure sending request")
+	}
+	return future, nil
+}
+
 type vmIdentityHolder struct {
 	vm *compute.VirtualMachine
 }
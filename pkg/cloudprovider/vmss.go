@@ -22,9 +22,8 @@ import (
 type VMSSClient struct {
 	client   compute.VirtualMachineScaleSetsClient
 	reporter *metrics.Reporter
-	// ARM throttling configures.
-	retryAfterReader time.Time
-	retryAfterWriter time.Time
+	// throttle blocks requests while ARM throttles the subscription
+	throttle *throttleGate
 }
 
 // VMSSClientInt is the interface used by "cloudprovider" for interacting with Azure vmss
@@ -41,7 +40,7 @@ func NewVMSSClient(config config.AzureConfig, spt *adal.ServicePrincipalToken) (
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cloud environment, error: %+v", err)
 	}
-	client.BaseURI = azureEnv.ResourceManagerEndpoint
+	client.BaseURI = getResourceManagerEndpoint(config, azureEnv)
 	client.Authorizer = autorest.NewBearerAuthorizer(spt)
 	client.PollingDelay = 5 * time.Second
 	err = client.AddToUserAgent(version.GetUserAgent("MIC", version.MICVersion))
@@ -57,6 +56,7 @@ func NewVMSSClient(config config.AzureConfig, spt *adal.ServicePrincipalToken) (
 	return &VMSSClient{
 		client:   client,
 		reporter: reporter,
+		throttle: getThrottleGate(client.BaseURI, config.SubscriptionID),
 	}, nil
 }
 
@@ -81,24 +81,40 @@ func (c *VMSSClient) UpdateIdentities(rg, vmssName string, vmss compute.VirtualM
 		}
 	}()
 
-	// Report errors if the client is throttled.
-	if c.retryAfterWriter.After(time.Now()) {
-		return fmt.Errorf("VMSSUpdate client throttled, retry after: %v", c.retryAfterWriter)
+	// Report errors if ARM is throttling the subscription.
+	if err = checkThrottle(c.throttle, c.reporter, metrics.UpdateVMSSOperationName); err != nil {
+		return err
 	}
 
+	// the update fails if the VMSS was modified since it was fetched
+	etag := getETag(vmss.Response.Response)
 	hasUpdated := false
 	remainingIDs := vmss.Identity.UserAssignedIdentities
 	for !hasUpdated || len(remainingIDs) > 0 {
 		hasUpdated = true
 		vmss.Identity.UserAssignedIdentities, remainingIDs = truncateVMSSIdentities(remainingIDs)
-		if future, err = c.client.Update(ctx, rg, vmssName, compute.VirtualMachineScaleSetUpdate{Identity: vmss.Identity}); err != nil {
-			resp := future.Response()
-			// Update RetryAfterWriter so that no more requests would be sent until RetryAfter expires.
-			c.retryAfterWriter = time.Now().Add(getRetryAfter(resp))
-			return fmt.Errorf("failed to update identities for %s in %s, error: %+v", vmssName, rg, err)
+		if future, err = c.update(ctx, rg, vmssName, compute.VirtualMachineScaleSetUpdate{Identity: vmss.Identity}, etag); err != nil {
+			// No more requests are sent until Retry-After has elapsed if the request was throttled.
+			updateThrottle(c.throttle, c.reporter, metrics.UpdateVMSSOperationName, future.Response())
+			updateErr := fmt.Errorf("failed to update identities for %s in %s, error: %w", vmssName, rg, err)
+			if isPreconditionFailed(future.Response()) {
+				if reportErr := c.reporter.ReportCloudProviderConflict(metrics.UpdateVMSSOperationName); reportErr != nil {
+					klog.Warningf("failed to report metrics, error: %+v", reportErr)
+				}
+				return &conflictError{updateErr}
+			}
+			return updateErr
 		}
 		if err = future.WaitForCompletionRef(ctx, c.client.Client); err != nil {
-			return fmt.Errorf("failed to wait for identity update completion for vmss %s in resource group %s, error: %+v", vmssName, rg, err)
+			return fmt.Errorf("failed to wait for identity update completion for vmss %s in resource group %s, error: %w", vmssName, rg, err)
+		}
+		if len(remainingIDs) > 0 {
+			// the remaining identities are assigned to the version of the VMSS which was just updated
+			var updated compute.VirtualMachineScaleSet
+			if updated, err = future.Result(c.client); err != nil {
+				return fmt.Errorf("failed to get updated vmss %s in resource group %s, error: %+v", vmssName, rg, err)
+			}
+			etag = getETag(updated.Response.Response)
 		}
 		stats.Increment(stats.TotalPatchCalls, 1)
 		stats.AggregateConcurrent(stats.CloudPatch, begin, time.Now())
@@ -107,6 +123,22 @@ func (c *VMSSClient) UpdateIdentities(rg, vmssName string, vmss compute.VirtualM
 	return nil
 }
 
+// update sends the update of the VMSS, which is conditional on the version of the VMSS if etag is not empty.
+func (c *VMSSClient) update(ctx context.Context, rg, vmssName string, parameters compute.VirtualMachineScaleSetUpdate, etag string) (compute.VirtualMachineScaleSetsUpdateFuture, error) {
+	req, err := c.client.UpdatePreparer(ctx, rg, vmssName, parameters)
+	if err != nil {
+		return compute.VirtualMachineScaleSetsUpdateFuture{}, autorest.NewErrorWithError(err, "compute.VirtualMachineScaleSetsClient", "Update", nil, "Failure preparing request")
+	}
+	if etag != "" {
+		req.Header.Set(ifMatchHeaderKey, etag)
+	}
+	future, err := c.client.UpdateSender(req)
+	if err != nil {
+		return future, autorest.NewErrorWithError(err, "compute.VirtualMachineScaleSetsClient", "Update", future.Response(), "Failure sending request")
+	}
+	return future, nil
+}
+
 // Get gets the passed in vmss.
 func (c *VMSSClient) Get(rgName string, vmssName string) (ret compute.VirtualMachineScaleSet, err error) {
 	ctx := context.Background()
@@ -126,16 +158,15 @@ func (c *VMSSClient) Get(rgName string, vmssName string) (ret compute.VirtualMac
 		}
 	}()
 
-	// Report errors if the client is throttled.
-	if c.retryAfterReader.After(time.Now()) {
-		return compute.VirtualMachineScaleSet{}, fmt.Errorf("VMSSGet client throttled, retry after: %v", c.retryAfterReader)
+	// Report errors if ARM is throttling the subscription.
+	if err = checkThrottle(c.throttle, c.reporter, metrics.GetVmssOperationName); err != nil {
+		return compute.VirtualMachineScaleSet{}, err
 	}
 
 	vmss, err := c.client.Get(ctx, rgName, vmssName)
 	if err != nil {
-		resp := vmss.Response.Response
-		// Update RetryAfterReader so that no more requests would be sent until RetryAfter expires.
-		c.retryAfterReader = time.Now().Add(getRetryAfter(resp))
+		// No more requests are sent until Retry-After has elapsed if the request was throttled.
+		updateThrottle(c.throttle, c.reporter, metrics.GetVmssOperationName, vmss.Response.Response)
 		return vmss, fmt.Errorf("failed to get vmss %s in resource group %s, error: %+v", vmssName, rgName, err)
 	}
 	stats.Increment(stats.TotalGetCalls, 1)
@@ -12,4 +12,7 @@ type AzureConfig struct {
 	VMType                      string `json:"vmType" yaml:"vmType"`
 	UseManagedIdentityExtension bool   `json:"useManagedIdentityExtension,omitempty" yaml:"useManagedIdentityExtension,omitempty"`
 	UserAssignedIdentityID      string `json:"userAssignedIdentityID,omitempty" yaml:"userAssignedIdentityID,omitempty"`
+	// ResourceManagerEndpoint overrides the Azure Resource Manager endpoint of the cloud,
+	// e.g. to send the requests to a fake server in tests
+	ResourceManagerEndpoint string `json:"resourceManagerEndpoint,omitempty" yaml:"resourceManagerEndpoint,omitempty"`
 }
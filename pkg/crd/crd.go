@@ -13,6 +13,7 @@ import (
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
 	"github.com/Azure/aad-pod-identity/pkg/stats"
 
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -39,6 +40,7 @@ type Client struct {
 	IDInformer                   cache.SharedInformer
 	AssignedIDInformer           cache.SharedInformer
 	PodIdentityExceptionInformer cache.SharedInformer
+	PolicyInformer               cache.SharedInformer
 	reporter                     *metrics.Reporter
 }
 
@@ -51,6 +53,8 @@ type ClientInt interface {
 	CreateAssignedIdentity(assignedIdentity *aadpodid.AzureAssignedIdentity) error
 	UpdateAssignedIdentity(assignedIdentity *aadpodid.AzureAssignedIdentity) error
 	UpdateAzureAssignedIdentityStatus(assignedIdentity *aadpodid.AzureAssignedIdentity, status string) error
+	UpdateAzureIdentityStatus(identity *aadpodid.AzureIdentity) error
+	UpdateAzureIdentityBindingStatus(binding *aadpodid.AzureIdentityBinding) error
 	UpgradeAll() error
 	ListBindings() (res *[]aadpodid.AzureIdentityBinding, err error)
 	ListAssignedIDs() (res *[]aadpodid.AzureAssignedIdentity, err error)
@@ -58,6 +62,7 @@ type ClientInt interface {
 	ListIds() (res *[]aadpodid.AzureIdentity, err error)
 	ListPodIds(podns, podname string) (map[string][]aadpodid.AzureIdentity, error)
 	ListPodIdentityExceptions(ns string) (res *[]aadpodid.AzurePodIdentityException, err error)
+	ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error)
 	ListAssignedIDsFromAPIServer() (*aadpodv1.AzureAssignedIdentityList, error)
 }
 
@@ -97,6 +102,10 @@ func NewCRDClientLite(config *rest.Config, nodeName string, scale, isStandardMod
 	if err != nil {
 		return nil, err
 	}
+	policyInformer, err := newPolicyInformer(nil, newPolicyListWatch(restClient))
+	if err != nil {
+		return nil, err
+	}
 
 	reporter, err := metrics.NewReporter()
 	if err != nil {
@@ -108,6 +117,7 @@ func NewCRDClientLite(config *rest.Config, nodeName string, scale, isStandardMod
 		PodIdentityExceptionInformer: podIdentityExceptionInformer,
 		BindingInformer:              bindingListInformer,
 		IDInformer:                   idListInformer,
+		PolicyInformer:               policyInformer,
 		rest:                         restClient,
 		reporter:                     reporter,
 	}, nil
@@ -138,6 +148,11 @@ func NewCRDClient(config *rest.Config, eventCh chan aadpodid.EventType) (crdClie
 		return nil, err
 	}
 
+	policyInformer, err := newPolicyInformer(eventCh, newPolicyListWatch(restClient))
+	if err != nil {
+		return nil, err
+	}
+
 	reporter, err := metrics.NewReporter()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create reporter for metrics, error: %+v", err)
@@ -148,6 +163,7 @@ func NewCRDClient(config *rest.Config, eventCh chan aadpodid.EventType) (crdClie
 		BindingInformer:    bindingInformer,
 		IDInformer:         idInformer,
 		AssignedIDInformer: assignedIDListInformer,
+		PolicyInformer:     policyInformer,
 		reporter:           reporter,
 	}, nil
 }
@@ -168,6 +184,8 @@ func newRestClient(config *rest.Config) (r *rest.RESTClient, err error) {
 		&aadpodv1.AzureAssignedIdentityList{},
 		&aadpodv1.AzurePodIdentityException{},
 		&aadpodv1.AzurePodIdentityExceptionList{},
+		&aadpodv1.AzureIdentityPolicy{},
+		&aadpodv1.AzureIdentityPolicyList{},
 	)
 
 	if err := clientgoscheme.AddToScheme(scheme); err != nil {
@@ -200,15 +218,25 @@ func newBindingInformer(r *rest.RESTClient, eventCh chan aadpodid.EventType, lw
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				klog.V(6).Infof("binding created")
-				eventCh <- aadpodid.BindingCreated
+				if eventCh != nil {
+					eventCh <- aadpodid.BindingCreated
+				}
 			},
 			DeleteFunc: func(obj interface{}) {
 				klog.V(6).Infof("binding deleted")
-				eventCh <- aadpodid.BindingDeleted
+				if eventCh != nil {
+					eventCh <- aadpodid.BindingDeleted
+				}
 			},
-			UpdateFunc: func(OldObj, newObj interface{}) {
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if isStatusUpdate(oldObj, newObj) {
+					klog.V(6).Infof("binding status updated")
+					return
+				}
 				klog.V(6).Infof("binding updated")
-				eventCh <- aadpodid.BindingUpdated
+				if eventCh != nil {
+					eventCh <- aadpodid.BindingUpdated
+				}
 			},
 		},
 	)
@@ -231,21 +259,52 @@ func newIDInformer(r *rest.RESTClient, eventCh chan aadpodid.EventType, lw *cach
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				klog.V(6).Infof("identity created")
-				eventCh <- aadpodid.IdentityCreated
+				if eventCh != nil {
+					eventCh <- aadpodid.IdentityCreated
+				}
 			},
 			DeleteFunc: func(obj interface{}) {
 				klog.V(6).Infof("identity deleted")
-				eventCh <- aadpodid.IdentityDeleted
+				if eventCh != nil {
+					eventCh <- aadpodid.IdentityDeleted
+				}
 			},
-			UpdateFunc: func(OldObj, newObj interface{}) {
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if isStatusUpdate(oldObj, newObj) {
+					klog.V(6).Infof("identity status updated")
+					return
+				}
 				klog.V(6).Infof("identity updated")
-				eventCh <- aadpodid.IdentityUpdated
+				if eventCh != nil {
+					eventCh <- aadpodid.IdentityUpdated
+				}
 			},
 		},
 	)
 	return azIDInformer, nil
 }
 
+// isStatusUpdate returns true if only the status of an AzureIdentity or AzureIdentityBinding
+// changed. MIC updates the status at the end of every sync cycle, which must not trigger
+// another sync cycle.
+func isStatusUpdate(oldObj, newObj interface{}) bool {
+	switch o := oldObj.(type) {
+	case *aadpodv1.AzureIdentity:
+		n, ok := newObj.(*aadpodv1.AzureIdentity)
+		return ok && o.ResourceVersion != n.ResourceVersion &&
+			reflect.DeepEqual(o.Spec, n.Spec) &&
+			reflect.DeepEqual(o.Labels, n.Labels) &&
+			reflect.DeepEqual(o.Annotations, n.Annotations)
+	case *aadpodv1.AzureIdentityBinding:
+		n, ok := newObj.(*aadpodv1.AzureIdentityBinding)
+		return ok && o.ResourceVersion != n.ResourceVersion &&
+			reflect.DeepEqual(o.Spec, n.Spec) &&
+			reflect.DeepEqual(o.Labels, n.Labels) &&
+			reflect.DeepEqual(o.Annotations, n.Annotations)
+	}
+	return false
+}
+
 // NodeNameFilter - CRDs do not yet support field selectors. Instead of that we
 // apply labels with node name and then later use the NodeNameFilter to tweak
 // options to filter using nodename label.
@@ -308,6 +367,41 @@ func newPodIdentityExceptionInformer(lw *cache.ListWatch) (cache.SharedInformer,
 	return azPodIDExceptionInformer, nil
 }
 
+func newPolicyListWatch(r *rest.RESTClient) *cache.ListWatch {
+	return cache.NewListWatchFromClient(r, aadpodv1.AzureIdentityPolicyResource, v1.NamespaceAll, fields.Everything())
+}
+
+// newPolicyInformer returns an informer of the cluster-scoped AzureIdentityPolicies, which sends
+// PolicyUpdated to eventCh whenever a policy is added, changed or deleted if it is not nil.
+func newPolicyInformer(eventCh chan aadpodid.EventType, lw *cache.ListWatch) (cache.SharedInformer, error) {
+	azPolicyInformer := cache.NewSharedInformer(lw, &aadpodv1.AzureIdentityPolicy{}, time.Minute*10)
+	if azPolicyInformer == nil {
+		return nil, fmt.Errorf("failed to create %s informer", aadpodv1.AzureIdentityPolicyResource)
+	}
+	if eventCh != nil {
+		notify := func() {
+			klog.V(6).Infof("identity policy updated")
+			eventCh <- aadpodid.PolicyUpdated
+		}
+		azPolicyInformer.AddEventHandler(
+			cache.ResourceEventHandlerFuncs{
+				AddFunc:    func(obj interface{}) { notify() },
+				DeleteFunc: func(obj interface{}) { notify() },
+				UpdateFunc: func(oldObj, newObj interface{}) {
+					// periodic resyncs deliver updates of unchanged policies
+					oldPolicy, oldOK := oldObj.(*aadpodv1.AzureIdentityPolicy)
+					newPolicy, newOK := newObj.(*aadpodv1.AzureIdentityPolicy)
+					if oldOK && newOK && oldPolicy.ResourceVersion == newPolicy.ResourceVersion {
+						return
+					}
+					notify()
+				},
+			},
+		)
+	}
+	return azPolicyInformer, nil
+}
+
 func (c *Client) getObjectList(resource string, i runtime.Object) (runtime.Object, error) {
 	options := v1.ListOptions{}
 	do := c.rest.Get().Namespace(v1.NamespaceAll).Resource(resource).VersionedParams(&options, v1.ParameterCodec).Do(context.TODO())
@@ -444,6 +538,10 @@ func (c *Client) StartLite(exit <-chan struct{}) {
 		go c.PodIdentityExceptionInformer.Run(exit)
 		cacheHasSynced = append(cacheHasSynced, c.PodIdentityExceptionInformer.HasSynced)
 	}
+	if c.PolicyInformer != nil {
+		go c.PolicyInformer.Run(exit)
+		cacheHasSynced = append(cacheHasSynced, c.PolicyInformer.HasSynced)
+	}
 	c.SyncCache(exit, true, cacheHasSynced...)
 	klog.Info("CRD lite informers started ")
 }
@@ -453,7 +551,8 @@ func (c *Client) Start(exit <-chan struct{}) {
 	go c.BindingInformer.Run(exit)
 	go c.IDInformer.Run(exit)
 	go c.AssignedIDInformer.Run(exit)
-	c.SyncCache(exit, true, c.BindingInformer.HasSynced, c.IDInformer.HasSynced, c.AssignedIDInformer.HasSynced)
+	go c.PolicyInformer.Run(exit)
+	c.SyncCache(exit, true, c.BindingInformer.HasSynced, c.IDInformer.HasSynced, c.AssignedIDInformer.HasSynced, c.PolicyInformer.HasSynced)
 	klog.Info("CRD informers started")
 }
 
@@ -470,7 +569,7 @@ func (c *Client) SyncCache(exit <-chan struct{}, initial bool, cacheSyncs ...cac
 
 // SyncCacheAll - sync all caches related to the client.
 func (c *Client) SyncCacheAll(exit <-chan struct{}, initial bool) {
-	c.SyncCache(exit, initial, c.BindingInformer.HasSynced, c.IDInformer.HasSynced, c.AssignedIDInformer.HasSynced)
+	c.SyncCache(exit, initial, c.BindingInformer.HasSynced, c.IDInformer.HasSynced, c.AssignedIDInformer.HasSynced, c.PolicyInformer.HasSynced)
 }
 
 // RemoveAssignedIdentity removes the assigned identity
@@ -718,6 +817,21 @@ func (c *Client) ListPodIdentityExceptions(ns string) (res *[]aadpodid.AzurePodI
 	return &resList, nil
 }
 
+// ListIdentityPolicies returns the AzureIdentityPolicies
+func (c *Client) ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error) {
+	var resList []aadpodid.AzureIdentityPolicy
+
+	list := c.PolicyInformer.GetStore().List()
+	for _, policy := range list {
+		o, ok := policy.(*aadpodv1.AzureIdentityPolicy)
+		if !ok {
+			return nil, fmt.Errorf("failed to cast %T to %s", policy, aadpodv1.AzureIdentityPolicyResource)
+		}
+		resList = append(resList, aadpodv1.ConvertV1IdentityPolicyToInternalIdentityPolicy(*o))
+	}
+	return resList, nil
+}
+
 // ListPodIds - given a pod with pod name space
 // returns a map with list of azure identities in each state
 func (c *Client) ListPodIds(podns, podname string) (map[string][]aadpodid.AzureIdentity, error) {
@@ -735,9 +849,58 @@ func (c *Client) ListPodIds(podns, podname string) (map[string][]aadpodid.AzureI
 	return idStateMap, nil
 }
 
+// ListPodBindings returns the bindings of the identities assigned to the pod
+func (c *Client) ListPodBindings(podns, podname string) ([]aadpodid.AzureIdentityBinding, error) {
+	list, err := c.ListAssignedIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var bindings []aadpodid.AzureIdentityBinding
+	for _, v := range *list {
+		if v.Spec.Pod == podname && v.Spec.PodNamespace == podns && v.Spec.AzureBindingRef != nil {
+			bindings = append(bindings, *v.Spec.AzureBindingRef)
+		}
+	}
+	return bindings, nil
+}
+
+// ListActiveIdentities returns the azure identities that are currently in use.
+// When the assigned identity informer is running (standard mode), these are the
+// identities referenced by AzureAssignedIdentities. Otherwise, all AzureIdentities
+// are returned.
+func (c *Client) ListActiveIdentities() ([]aadpodid.AzureIdentity, error) {
+	if c.AssignedIDInformer == nil {
+		azIdentities, err := c.ListIds()
+		if err != nil {
+			return nil, err
+		}
+		return *azIdentities, nil
+	}
+
+	assignedIDs, err := c.ListAssignedIDs()
+	if err != nil {
+		return nil, err
+	}
+	var azIdentities []aadpodid.AzureIdentity
+	seen := make(map[string]bool)
+	for _, assignedID := range *assignedIDs {
+		if assignedID.Spec.AzureIdentityRef == nil {
+			continue
+		}
+		key := getMapKey(assignedID.Spec.AzureIdentityRef.Namespace, assignedID.Spec.AzureIdentityRef.Name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		azIdentities = append(azIdentities, *assignedID.Spec.AzureIdentityRef)
+	}
+	return azIdentities, nil
+}
+
 // GetPodIDsWithBinding returns list of azure identity based on bindings
-// that match pod label.
-func (c *Client) GetPodIDsWithBinding(namespace string, labels map[string]string) ([]aadpodid.AzureIdentity, error) {
+// that match the pod.
+func (c *Client) GetPodIDsWithBinding(pod *corev1.Pod) ([]aadpodid.AzureIdentity, error) {
 	// get all bindings
 	bindings, err := c.ListBindings()
 	if err != nil {
@@ -747,13 +910,8 @@ func (c *Client) GetPodIDsWithBinding(namespace string, labels map[string]string
 		return nil, fmt.Errorf("binding list is nil from cache")
 	}
 	matchingIds := make(map[string]bool)
-	podLabel := labels[aadpodid.CRDLabelKey]
-
-	for _, binding := range *bindings {
-		// check if binding selector in pod labels
-		if podLabel == binding.Spec.Selector && binding.Namespace == namespace {
-			matchingIds[binding.Spec.AzureIdentity] = true
-		}
+	for _, binding := range getMatchingBindings(*bindings, pod) {
+		matchingIds[binding.Namespace+"/"+binding.Spec.AzureIdentity] = true
 	}
 	// get the azure identity objects based on the list generated
 	azIdentities, err := c.ListIds()
@@ -765,13 +923,43 @@ func (c *Client) GetPodIDsWithBinding(namespace string, labels map[string]string
 	}
 	var azIds []aadpodid.AzureIdentity
 	for _, azIdentity := range *azIdentities {
-		if _, exists := matchingIds[azIdentity.Name]; exists && azIdentity.Namespace == namespace {
+		if _, exists := matchingIds[azIdentity.Namespace+"/"+azIdentity.Name]; exists {
 			azIds = append(azIds, azIdentity)
 		}
 	}
 	return azIds, nil
 }
 
+// GetPodBindings returns the bindings which match the pod
+func (c *Client) GetPodBindings(pod *corev1.Pod) ([]aadpodid.AzureIdentityBinding, error) {
+	bindings, err := c.ListBindings()
+	if err != nil {
+		return nil, err
+	}
+	if bindings == nil {
+		return nil, fmt.Errorf("binding list is nil from cache")
+	}
+	return getMatchingBindings(*bindings, pod), nil
+}
+
+// getMatchingBindings returns the bindings which match the pod. Bindings in other namespaces
+// can only match the pod by its aadpodidbinding label, and the namespace policy of their
+// identities decides whether the pod can use them.
+func getMatchingBindings(bindings []aadpodid.AzureIdentityBinding, pod *corev1.Pod) []aadpodid.AzureIdentityBinding {
+	var matchingBindings []aadpodid.AzureIdentityBinding
+	for _, binding := range bindings {
+		matched, err := binding.MatchesPod(pod)
+		if err != nil {
+			klog.Errorf("failed to match binding %s/%s with pod %s/%s, error: %+v", binding.Namespace, binding.Name, pod.Namespace, pod.Name, err)
+			continue
+		}
+		if matched {
+			matchingBindings = append(matchingBindings, binding)
+		}
+	}
+	return matchingBindings
+}
+
 type patchStatusOps struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
@@ -814,6 +1002,67 @@ func (c *Client) UpdateAzureAssignedIdentityStatus(assignedIdentity *aadpodid.Az
 	return err
 }
 
+// UpdateAzureIdentityStatus updates the assigned nodes and conditions in the status of an AzureIdentity
+func (c *Client) UpdateAzureIdentityStatus(identity *aadpodid.AzureIdentity) (err error) {
+	klog.V(5).Infof("updating AzureIdentity %s/%s status", identity.Namespace, identity.Name)
+
+	defer func() {
+		if err != nil {
+			merr := c.reporter.ReportKubernetesAPIOperationError(metrics.UpdateAzureIdentityStatusOperationName)
+			if merr != nil {
+				klog.Warningf("failed to report metrics, error: %+v", merr)
+			}
+		}
+	}()
+
+	status := aadpodv1.AzureIdentityStatus(identity.Status)
+	return c.patchStatus(aadpodid.AzureIDResource, identity.Namespace, identity.Name, map[string]interface{}{
+		"assignedNodes": status.AssignedNodes,
+		"conditions":    status.Conditions,
+	})
+}
+
+// UpdateAzureIdentityBindingStatus updates the matched pods and conditions in the status of an AzureIdentityBinding
+func (c *Client) UpdateAzureIdentityBindingStatus(binding *aadpodid.AzureIdentityBinding) (err error) {
+	klog.V(5).Infof("updating AzureIdentityBinding %s/%s status", binding.Namespace, binding.Name)
+
+	defer func() {
+		if err != nil {
+			merr := c.reporter.ReportKubernetesAPIOperationError(metrics.UpdateAzureIdentityBindingStatusOperationName)
+			if merr != nil {
+				klog.Warningf("failed to report metrics, error: %+v", merr)
+			}
+		}
+	}()
+
+	status := aadpodv1.AzureIdentityBindingStatus(binding.Status)
+	return c.patchStatus(aadpodid.AzureIDBindingResource, binding.Namespace, binding.Name, map[string]interface{}{
+		"matchedPods": status.MatchedPods,
+		"conditions":  status.Conditions,
+	})
+}
+
+// patchStatus merges the given fields into the status of a resource through the status subresource
+func (c *Client) patchStatus(resource, namespace, name string, status map[string]interface{}) error {
+	patchBytes, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+
+	begin := time.Now()
+	err = c.rest.
+		Patch(types.MergePatchType).
+		Namespace(namespace).
+		Resource(resource).
+		Name(name).
+		SubResource("status").
+		Body(patchBytes).
+		Do(context.TODO()).
+		Error()
+	klog.V(5).Infof("patch of %s/%s status took: %v", resource, name, time.Since(begin))
+	return err
+}
+
 // ListAzureIdentitiesFromAPIServer lists all azure identities, not from cache
 func (c *Client) ListAzureIdentitiesFromAPIServer() (*aadpodv1.AzureIdentityList, error) {
 	klog.V(6).Infof("Get azure identities from API server")
@@ -828,6 +1077,20 @@ func (c *Client) ListAzureIdentitiesFromAPIServer() (*aadpodv1.AzureIdentityList
 	return &res, nil
 }
 
+// ListAssignedIDsFromAPIServer lists all azure assigned identities, not from cache
+func (c *Client) ListAssignedIDsFromAPIServer() (*aadpodv1.AzureAssignedIdentityList, error) {
+	klog.V(6).Infof("Get azure assigned identities from API server")
+
+	var res aadpodv1.AzureAssignedIdentityList
+	err := c.rest.Get().Resource(aadpodid.AzureAssignedIDResource).Do(context.TODO()).Into(&res)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
 func getMapKey(ns, name string) string {
 	return strings.Join([]string{ns, name}, "/")
 }
@@ -108,3 +108,48 @@ func TestRemoveFinalizer(t *testing.T) {
 		t.Fatalf("expected len to be 0, got: %d", len(assignedID.GetFinalizers()))
 	}
 }
+
+func TestIsStatusUpdate(t *testing.T) {
+	id := &aadpodid.AzureIdentity{
+		ObjectMeta: v1.ObjectMeta{Name: "test-id", ResourceVersion: "1"},
+		Spec:       aadpodid.AzureIdentitySpec{ClientID: "clientid1"},
+	}
+	statusUpdated := id.DeepCopy()
+	statusUpdated.ResourceVersion = "2"
+	statusUpdated.Status.AssignedNodes = 1
+	specUpdated := id.DeepCopy()
+	specUpdated.ResourceVersion = "2"
+	specUpdated.Spec.ClientID = "clientid2"
+	labelsUpdated := id.DeepCopy()
+	labelsUpdated.ResourceVersion = "2"
+	labelsUpdated.Labels = map[string]string{"foo": "bar"}
+
+	binding := &aadpodid.AzureIdentityBinding{
+		ObjectMeta: v1.ObjectMeta{Name: "test-binding", ResourceVersion: "1"},
+		Spec:       aadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-id"},
+	}
+	bindingStatusUpdated := binding.DeepCopy()
+	bindingStatusUpdated.ResourceVersion = "2"
+	bindingStatusUpdated.Status.MatchedPods = 1
+
+	cases := []struct {
+		desc     string
+		oldObj   interface{}
+		newObj   interface{}
+		expected bool
+	}{
+		{desc: "identity status updated", oldObj: id, newObj: statusUpdated, expected: true},
+		{desc: "identity spec updated", oldObj: id, newObj: specUpdated},
+		{desc: "identity labels updated", oldObj: id, newObj: labelsUpdated},
+		{desc: "identity resync", oldObj: id, newObj: id},
+		{desc: "binding status updated", oldObj: binding, newObj: bindingStatusUpdated, expected: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if actual := isStatusUpdate(tc.oldObj, tc.newObj); actual != tc.expected {
+				t.Fatalf("expected isStatusUpdate to be %t, got: %t", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
 	"github.com/Azure/aad-pod-identity/version"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	informersv1 "k8s.io/client-go/informers/core/v1"
@@ -28,6 +29,8 @@ import (
 const (
 	getPodListRetries               = 4
 	getPodListSleepTimeMilliseconds = 300
+	// serviceAccountTokenExpirationSeconds is the minimum lifetime accepted by the TokenRequest API
+	serviceAccountTokenExpirationSeconds = 600
 )
 
 // Client api client
@@ -41,13 +44,25 @@ type Client interface {
 	// ListPodIds pod matching azure identity or nil
 	ListPodIds(podns, podname string) (map[string][]aadpodid.AzureIdentity, error)
 	// ListPodIdsWithBinding pod matching azure identity or nil
-	ListPodIdsWithBinding(podns string, labels map[string]string) ([]aadpodid.AzureIdentity, error)
+	ListPodIdsWithBinding(pod *v1.Pod) ([]aadpodid.AzureIdentity, error)
+	// ListPodBindings returns the bindings of the identities assigned to the pod
+	ListPodBindings(podns, podname string) ([]aadpodid.AzureIdentityBinding, error)
+	// ListPodBindingsWithSelector returns the bindings selecting the pod
+	ListPodBindingsWithSelector(pod *v1.Pod) ([]aadpodid.AzureIdentityBinding, error)
 	// GetSecret returns secret the secretRef represents
 	GetSecret(secretRef *v1.SecretReference) (*v1.Secret, error)
+	// GetNamespace returns the namespace with the given name
+	GetNamespace(name string) (*v1.Namespace, error)
 	// ListPodIdentityExceptions returns list of azurepodidentityexceptions
 	ListPodIdentityExceptions(namespace string) (*[]aadpodid.AzurePodIdentityException, error)
+	// ListIdentityPolicies returns the azureidentitypolicies
+	ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error)
 	// ListAzureIdentitiesFromAPIServer lists all azure identities, not from cache
 	ListAzureIdentitiesFromAPIServer() (*aadpodv1.AzureIdentityList, error)
+	// ListActiveIdentities lists the azure identities currently in use from cache
+	ListActiveIdentities() ([]aadpodid.AzureIdentity, error)
+	// GetServiceAccountToken requests a token for the service account of the pod, bound to the pod
+	GetServiceAccountToken(pod *v1.Pod, audience string) (string, error)
 }
 
 // KubeClient k8s client
@@ -57,7 +72,9 @@ type KubeClient struct {
 	// Crd client used to access our CRD resources.
 	CrdClient   *crd.Client
 	PodInformer cache.SharedIndexInformer
-	reporter    *metrics.Reporter
+	// NamespaceInformer caches the namespaces used to evaluate the namespace selector of identities
+	NamespaceInformer cache.SharedIndexInformer
+	reporter          *metrics.Reporter
 }
 
 // NewKubeClient new kubernetes api client
@@ -84,11 +101,14 @@ func NewKubeClient(nodeName string, scale, isStandardMode bool) (Client, error)
 		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
 		NodeNameFilter(nodeName))
 
+	namespaceInformer := informersv1.NewNamespaceInformer(clientset, 10*time.Minute, cache.Indexers{})
+
 	kubeClient := &KubeClient{
-		CrdClient:   crdclient,
-		ClientSet:   clientset,
-		PodInformer: podInformer,
-		reporter:    reporter,
+		CrdClient:         crdclient,
+		ClientSet:         clientset,
+		PodInformer:       podInformer,
+		NamespaceInformer: namespaceInformer,
+		reporter:          reporter,
 	}
 
 	return kubeClient, nil
@@ -99,11 +119,15 @@ func (c *KubeClient) Sync(exit <-chan struct{}) {
 	if !cache.WaitForCacheSync(exit, c.PodInformer.HasSynced) {
 		klog.Error("pod cache could not be synchronized")
 	}
+	if !cache.WaitForCacheSync(exit, c.NamespaceInformer.HasSynced) {
+		klog.Error("namespace cache could not be synchronized")
+	}
 }
 
 // Start the corresponding starts
 func (c *KubeClient) Start(exit <-chan struct{}) {
 	go c.PodInformer.Run(exit)
+	go c.NamespaceInformer.Run(exit)
 	c.CrdClient.StartLite(exit)
 	c.Sync(exit)
 }
@@ -241,8 +265,18 @@ func (c *KubeClient) ListPodIds(podns, podname string) (map[string][]aadpodid.Az
 }
 
 // ListPodIdsWithBinding list matching ids for pod based on the bindings
-func (c *KubeClient) ListPodIdsWithBinding(podns string, labels map[string]string) ([]aadpodid.AzureIdentity, error) {
-	return c.CrdClient.GetPodIDsWithBinding(podns, labels)
+func (c *KubeClient) ListPodIdsWithBinding(pod *v1.Pod) ([]aadpodid.AzureIdentity, error) {
+	return c.CrdClient.GetPodIDsWithBinding(pod)
+}
+
+// ListPodBindings returns the bindings of the identities assigned to the pod
+func (c *KubeClient) ListPodBindings(podns, podname string) ([]aadpodid.AzureIdentityBinding, error) {
+	return c.CrdClient.ListPodBindings(podns, podname)
+}
+
+// ListPodBindingsWithSelector returns the bindings in the namespace of the pod selecting the pod
+func (c *KubeClient) ListPodBindingsWithSelector(pod *v1.Pod) ([]aadpodid.AzureIdentityBinding, error) {
+	return c.CrdClient.GetPodBindings(pod)
 }
 
 // ListPodIdentityExceptions lists azurepodidentityexceptions
@@ -250,11 +284,21 @@ func (c *KubeClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodI
 	return c.CrdClient.ListPodIdentityExceptions(ns)
 }
 
+// ListIdentityPolicies lists azureidentitypolicies
+func (c *KubeClient) ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error) {
+	return c.CrdClient.ListIdentityPolicies()
+}
+
 // ListAzureIdentitiesFromAPIServer lists all azure identities, not from cache
 func (c *KubeClient) ListAzureIdentitiesFromAPIServer() (*aadpodv1.AzureIdentityList, error) {
 	return c.CrdClient.ListAzureIdentitiesFromAPIServer()
 }
 
+// ListActiveIdentities lists the azure identities currently in use from cache
+func (c *KubeClient) ListActiveIdentities() ([]aadpodid.AzureIdentity, error) {
+	return c.CrdClient.ListActiveIdentities()
+}
+
 // GetSecret returns secret the secretRef represents
 func (c *KubeClient) GetSecret(secretRef *v1.SecretReference) (*v1.Secret, error) {
 	start := time.Now()
@@ -276,6 +320,65 @@ func (c *KubeClient) GetSecret(secretRef *v1.SecretReference) (*v1.Secret, error
 	return secret, nil
 }
 
+// GetNamespace returns the namespace with the given name from the namespace informer, as it is looked
+// up on token requests to evaluate the namespace selector of identities.
+func (c *KubeClient) GetNamespace(name string) (*v1.Namespace, error) {
+	obj, exists, err := c.NamespaceInformer.GetStore().GetByKey(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s, error: %+v", name, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("namespace %s doesn't exist", name)
+	}
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("could not cast %T to v1.Namespace", obj)
+	}
+	return ns, nil
+}
+
+// GetServiceAccountToken requests a token for the service account of the pod using the
+// TokenRequest API. The token is bound to the pod and is invalidated when the pod is deleted.
+func (c *KubeClient) GetServiceAccountToken(pod *v1.Pod, audience string) (string, error) {
+	start := time.Now()
+
+	defer func() {
+		if c.reporter != nil {
+			c.reporter.ReportKubernetesAPIOperationsDuration(metrics.CreateServiceAccountTokenOperationName, time.Since(start))
+		}
+	}()
+
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	expirationSeconds := int64(serviceAccountTokenExpirationSeconds)
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         []string{audience},
+			ExpirationSeconds: &expirationSeconds,
+			BoundObjectRef: &authenticationv1.BoundObjectReference{
+				Kind:       "Pod",
+				APIVersion: "v1",
+				Name:       pod.Name,
+				UID:        pod.UID,
+			},
+		},
+	}
+
+	tokenRequest, err := c.ClientSet.CoreV1().ServiceAccounts(pod.Namespace).CreateToken(context.TODO(), serviceAccountName, tokenRequest, metav1.CreateOptions{})
+	if err != nil {
+		if c.reporter != nil {
+			merr := c.reporter.ReportKubernetesAPIOperationError(metrics.CreateServiceAccountTokenOperationName)
+			if merr != nil {
+				klog.Warningf("failed to report metrics, error: %+v", merr)
+			}
+		}
+		return "", fmt.Errorf("failed to request token for service account %s/%s, error: %+v", pod.Namespace, serviceAccountName, err)
+	}
+	return tokenRequest.Status.Token, nil
+}
+
 func getkubeclient(config *rest.Config) (*kubernetes.Clientset, error) {
 	// creates the clientset
 	kubeClient, err := kubernetes.NewForConfig(config)
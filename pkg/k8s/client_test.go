@@ -11,15 +11,18 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	informersv1 "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	fakerest "k8s.io/client-go/rest/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 func TestGetSecret(t *testing.T) {
@@ -48,6 +51,33 @@ func TestGetSecret(t *testing.T) {
 	}
 }
 
+func TestGetNamespace(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "tenant1", Labels: map[string]string{"team": "payments"}},
+	})
+	kubeClient := &KubeClient{
+		ClientSet:         fakeClient,
+		NamespaceInformer: informersv1.NewNamespaceInformer(fakeClient, time.Minute, cache.Indexers{}),
+	}
+	exit := make(chan struct{})
+	defer close(exit)
+	go kubeClient.NamespaceInformer.Run(exit)
+	if !cache.WaitForCacheSync(exit, kubeClient.NamespaceInformer.HasSynced) {
+		t.Fatal("namespace cache could not be synchronized")
+	}
+
+	ns, err := kubeClient.GetNamespace("tenant1")
+	if err != nil {
+		t.Fatalf("Error getting namespace: %v", err)
+	}
+	if ns.Labels["team"] != "payments" {
+		t.Fatalf("Incorrect namespace labels: %v", ns.Labels)
+	}
+	if _, err := kubeClient.GetNamespace("tenant2"); err == nil {
+		t.Fatal("Expected error getting a namespace which doesn't exist")
+	}
+}
+
 type TestClientSet struct {
 	mu      *sync.Mutex
 	podList []v1.Pod
@@ -36,7 +36,17 @@ func (c *FakeClient) ListPodIds(podns, podname string) (map[string][]aadpodid.Az
 }
 
 // ListPodIdsWithBinding for pod
-func (c *FakeClient) ListPodIdsWithBinding(podns string, labels map[string]string) ([]aadpodid.AzureIdentity, error) {
+func (c *FakeClient) ListPodIdsWithBinding(pod *v1.Pod) ([]aadpodid.AzureIdentity, error) {
+	return nil, nil
+}
+
+// ListPodBindings for pod
+func (c *FakeClient) ListPodBindings(podns, podname string) ([]aadpodid.AzureIdentityBinding, error) {
+	return nil, nil
+}
+
+// ListPodBindingsWithSelector for pod
+func (c *FakeClient) ListPodBindingsWithSelector(pod *v1.Pod) ([]aadpodid.AzureIdentityBinding, error) {
 	return nil, nil
 }
 
@@ -45,11 +55,21 @@ func (c *FakeClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodI
 	return nil, nil
 }
 
+// ListIdentityPolicies returns no policies
+func (c *FakeClient) ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error) {
+	return nil, nil
+}
+
 // GetSecret returns secret the secretRef represents
 func (c *FakeClient) GetSecret(secretRef *v1.SecretReference) (*v1.Secret, error) {
 	return nil, nil
 }
 
+// GetNamespace returns a fake namespace with the given name
+func (c *FakeClient) GetNamespace(name string) (*v1.Namespace, error) {
+	return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+}
+
 // Start - for starting informer clients in the fake Client
 func (c *FakeClient) Start(exit <-chan struct{}) {
 
@@ -59,3 +79,13 @@ func (c *FakeClient) Start(exit <-chan struct{}) {
 func (c *FakeClient) ListAzureIdentitiesFromAPIServer() (*aadpodv1.AzureIdentityList, error) {
 	return nil, nil
 }
+
+// ListActiveIdentities lists the azure identities currently in use
+func (c *FakeClient) ListActiveIdentities() ([]aadpodid.AzureIdentity, error) {
+	return nil, nil
+}
+
+// GetServiceAccountToken returns a fake service account token
+func (c *FakeClient) GetServiceAccountToken(pod *v1.Pod, audience string) (string, error) {
+	return "", nil
+}
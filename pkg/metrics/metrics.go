@@ -20,17 +20,27 @@ const (
 	assignedIdentityDeletionCountName      = "assigned_identity_deletion_count"
 	assignedIdentityUpdateDurationName     = "assigned_identity_update_duration_seconds"
 	assignedIdentityUpdateCountName        = "assigned_identity_update_count"
+	assignedIdentityOverflowCountName      = "assigned_identity_overflow_count"
 	nmiOperationsDurationName              = "nmi_operations_duration_seconds"
 	nmiTokenOperationCountName             = "nmi_token_operation_count"
 	nmiTokenOperationFailureCountName      = "nmi_token_operation_failure_count"
+	nmiTokenCacheHitCountName              = "nmi_token_cache_hit_count"
+	nmiTokenCacheMissCountName             = "nmi_token_cache_miss_count"
+	nmiTokenCacheRefreshCountName          = "nmi_token_cache_refresh_count"
+	nmiTokenCacheRefreshFailureCountName   = "nmi_token_cache_refresh_failure_count"
+	nmiTokenCacheEvictionCountName         = "nmi_token_cache_eviction_count"
 	nmiHostPolicyApplyCountName            = "nmi_host_policy_apply_count"
 	nmiHostPolicyApplyFailedCountName      = "nmi_host_policy_apply_failed_count"
 	nmiHostPolicyMisMatchCountName         = "nmi_host_policy_mismatch_count"
 	micCycleDurationName                   = "mic_cycle_duration_seconds"
 	micCycleCountName                      = "mic_cycle_count"
 	micNewLeaderElectionCountName          = "mic_new_leader_election_count"
+	micDryRunPlanCountName                 = "mic_dry_run_plan_count"
 	cloudProviderOperationsErrorsCountName = "cloud_provider_operations_errors_count"
 	cloudProviderOperationsDurationName    = "cloud_provider_operations_duration_seconds"
+	cloudProviderThrottledCountName        = "cloud_provider_throttled_count"
+	cloudProviderBlockedCountName          = "cloud_provider_blocked_count"
+	cloudProviderConflictCountName         = "cloud_provider_conflict_count"
 	kubernetesAPIOperationsErrorsCountName = "kubernetes_api_operations_errors_count"
 	kubernetesAPIOperationsDurationName    = "kubernetes_api_operations_duration_seconds"
 	imdsOperationsErrorsCountName          = "imds_operations_errors_count"
@@ -69,11 +79,38 @@ const (
 	// UpdateAzureAssignedIdentityStatusOperationName represents the status of an AzureAssignedIdentity update operation.
 	UpdateAzureAssignedIdentityStatusOperationName = "update_azure_assigned_identity_status"
 
+	// UpdateAzureIdentityStatusOperationName represents the status of an AzureIdentity status update operation.
+	UpdateAzureIdentityStatusOperationName = "update_azure_identity_status"
+
+	// UpdateAzureIdentityBindingStatusOperationName represents the status of an AzureIdentityBinding status update operation.
+	UpdateAzureIdentityBindingStatusOperationName = "update_azure_identity_binding_status"
+
 	// GetPodListOperationName represents the status of a pod list operation.
 	GetPodListOperationName = "get_pod_list"
 
 	// GetSecretOperationName represents the status of a secret get operation.
 	GetSecretOperationName = "get_secret"
+
+	// CreateServiceAccountTokenOperationName represents the status of a service account token request.
+	CreateServiceAccountTokenOperationName = "create_service_account_token" // #nosec
+	// DryRunNodeOperationName represents the nodes and VMSS with changes in the dry run plan.
+	DryRunNodeOperationName = "node"
+
+	// DryRunAssignIdentityOperationName represents the identities to assign in the dry run plan.
+	DryRunAssignIdentityOperationName = "assign_identity"
+
+	// DryRunRemoveIdentityOperationName represents the identities to remove in the dry run plan.
+	DryRunRemoveIdentityOperationName = "remove_identity"
+
+	// DryRunCreateAssignedIdentityOperationName represents the AzureAssignedIdentities to create in the dry run plan.
+	DryRunCreateAssignedIdentityOperationName = "create_assigned_identity"
+
+	// DryRunUpdateAssignedIdentityOperationName represents the AzureAssignedIdentities to update in the dry run plan.
+	DryRunUpdateAssignedIdentityOperationName = "update_assigned_identity"
+
+	// DryRunDeleteAssignedIdentityOperationName represents the AzureAssignedIdentities to delete in the dry run plan.
+	DryRunDeleteAssignedIdentityOperationName = "delete_assigned_identity"
+
 	// HostTokenType
 	HostTokenOperationType = "get_host_token"
 	// PodTokenType
@@ -123,6 +160,36 @@ var (
 		"Total number of failed get token calls to nmi",
 		stats.UnitDimensionless)
 
+	// NMITokenCacheHitCountM is a measure that tracks the cumulative number of token requests served from the token cache.
+	NMITokenCacheHitCountM = stats.Int64(
+		nmiTokenCacheHitCountName,
+		"Total number of token requests served from the token cache",
+		stats.UnitDimensionless)
+
+	// NMITokenCacheMissCountM is a measure that tracks the cumulative number of token requests not found in the token cache.
+	NMITokenCacheMissCountM = stats.Int64(
+		nmiTokenCacheMissCountName,
+		"Total number of token requests not found in the token cache",
+		stats.UnitDimensionless)
+
+	// NMITokenCacheRefreshCountM is a measure that tracks the cumulative number of background token refreshes.
+	NMITokenCacheRefreshCountM = stats.Int64(
+		nmiTokenCacheRefreshCountName,
+		"Total number of background token refreshes in the token cache",
+		stats.UnitDimensionless)
+
+	// NMITokenCacheRefreshFailureCountM is a measure that tracks the cumulative number of failed background token refreshes.
+	NMITokenCacheRefreshFailureCountM = stats.Int64(
+		nmiTokenCacheRefreshFailureCountName,
+		"Total number of failed background token refreshes in the token cache",
+		stats.UnitDimensionless)
+
+	// NMITokenCacheEvictionCountM is a measure that tracks the cumulative number of entries evicted from the token cache.
+	NMITokenCacheEvictionCountM = stats.Int64(
+		nmiTokenCacheEvictionCountName,
+		"Total number of entries evicted from the token cache",
+		stats.UnitDimensionless)
+
 	// NMIHostPolicyApplyCountM is a measure that tracks the count of host policy update operation.
 	NMIHostPolicyApplyCountM = stats.Int64(
 		nmiHostPolicyApplyCountName,
@@ -159,6 +226,12 @@ var (
 		"Total number of new leader election in mic",
 		stats.UnitDimensionless)
 
+	// MICDryRunPlanCountM is a measure that tracks the number of changes in the dry run plan of mic.
+	MICDryRunPlanCountM = stats.Int64(
+		micDryRunPlanCountName,
+		"Number of changes mic would make in dry run mode",
+		stats.UnitDimensionless)
+
 	// CloudProviderOperationsErrorsCountM is a measure that tracks the cumulative number of errors in cloud provider operations.
 	CloudProviderOperationsErrorsCountM = stats.Int64(
 		cloudProviderOperationsErrorsCountName,
@@ -171,6 +244,26 @@ var (
 		"Duration in seconds of cloudprovider operations",
 		stats.UnitMilliseconds)
 
+	// CloudProviderThrottledCountM is a measure that tracks the cumulative number of cloud provider requests throttled by ARM.
+	CloudProviderThrottledCountM = stats.Int64(
+		cloudProviderThrottledCountName,
+		"Total number of cloud provider requests throttled by ARM",
+		stats.UnitDimensionless)
+
+	// CloudProviderBlockedCountM is a measure that tracks the cumulative number of cloud provider requests
+	// which were not sent because ARM throttled an earlier request of the same subscription.
+	CloudProviderBlockedCountM = stats.Int64(
+		cloudProviderBlockedCountName,
+		"Total number of cloud provider requests blocked while ARM throttles the subscription",
+		stats.UnitDimensionless)
+
+	// CloudProviderConflictCountM is a measure that tracks the cumulative number of cloud provider updates
+	// which failed because the resource was modified since it was fetched.
+	CloudProviderConflictCountM = stats.Int64(
+		cloudProviderConflictCountName,
+		"Total number of cloud provider updates rejected because the resource was modified concurrently",
+		stats.UnitDimensionless)
+
 	// KubernetesAPIOperationsErrorsCountM is a measure that tracks the cumulative number of errors in cloud provider operations.
 	KubernetesAPIOperationsErrorsCountM = stats.Int64(
 		kubernetesAPIOperationsErrorsCountName,
@@ -206,6 +299,13 @@ var (
 		assignedIdentityUpdateCountName,
 		"Total number of assigned identity update operations",
 		stats.UnitDimensionless)
+
+	// AssignedIdentityOverflowCountM is a measure that tracks the cumulative number of assigned identities
+	// which could not be assigned because the node or VMSS reached the limit of user-assigned identities.
+	AssignedIdentityOverflowCountM = stats.Int64(
+		assignedIdentityOverflowCountName,
+		"Total number of assigned identities not assigned because the node or VMSS reached the limit of user-assigned identities",
+		stats.UnitDimensionless)
 )
 
 var (
@@ -266,6 +366,31 @@ func registerViews() error {
 			Aggregation: view.Count(),
 			TagKeys:     []tag.Key{operationTypeKey, resourceKey, workloadNamespaceKey, workloadPodKey, statusCodeKey},
 		},
+		{
+			Description: NMITokenCacheHitCountM.Description(),
+			Measure:     NMITokenCacheHitCountM,
+			Aggregation: view.Count(),
+		},
+		{
+			Description: NMITokenCacheMissCountM.Description(),
+			Measure:     NMITokenCacheMissCountM,
+			Aggregation: view.Count(),
+		},
+		{
+			Description: NMITokenCacheRefreshCountM.Description(),
+			Measure:     NMITokenCacheRefreshCountM,
+			Aggregation: view.Count(),
+		},
+		{
+			Description: NMITokenCacheRefreshFailureCountM.Description(),
+			Measure:     NMITokenCacheRefreshFailureCountM,
+			Aggregation: view.Count(),
+		},
+		{
+			Description: NMITokenCacheEvictionCountM.Description(),
+			Measure:     NMITokenCacheEvictionCountM,
+			Aggregation: view.Count(),
+		},
 		&view.View{
 			Description: NMIHostPolicyApplyCountM.Description(),
 			Measure:     NMIHostPolicyApplyCountM,
@@ -299,6 +424,12 @@ func registerViews() error {
 			Measure:     MICNewLeaderElectionCountM,
 			Aggregation: view.Count(),
 		},
+		{
+			Description: MICDryRunPlanCountM.Description(),
+			Measure:     MICDryRunPlanCountM,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{operationTypeKey},
+		},
 		{
 			Description: CloudProviderOperationsErrorsCountM.Description(),
 			Measure:     CloudProviderOperationsErrorsCountM,
@@ -311,6 +442,24 @@ func registerViews() error {
 			Aggregation: view.Distribution(0.5, 1, 5, 10, 30, 60, 120, 300, 600, 900, 1200),
 			TagKeys:     []tag.Key{operationTypeKey},
 		},
+		{
+			Description: CloudProviderThrottledCountM.Description(),
+			Measure:     CloudProviderThrottledCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{operationTypeKey},
+		},
+		{
+			Description: CloudProviderBlockedCountM.Description(),
+			Measure:     CloudProviderBlockedCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{operationTypeKey},
+		},
+		{
+			Description: CloudProviderConflictCountM.Description(),
+			Measure:     CloudProviderConflictCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{operationTypeKey},
+		},
 		{
 			Description: KubernetesAPIOperationsErrorsCountM.Description(),
 			Measure:     KubernetesAPIOperationsErrorsCountM,
@@ -345,6 +494,12 @@ func registerViews() error {
 			Measure:     AssignedIdentityUpdateCountM,
 			Aggregation: view.Count(),
 		},
+		{
+			Description: AssignedIdentityOverflowCountM.Description(),
+			Measure:     AssignedIdentityOverflowCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{operationTypeKey},
+		},
 	}
 	err := view.Register(views...)
 	return err
@@ -490,6 +645,27 @@ func (r *Reporter) ReportCloudProviderOperationDuration(operation string, durati
 	return r.ReportOperation(operation, CloudProviderOperationsDurationM.M(duration.Seconds()))
 }
 
+// ReportCloudProviderThrottled reports a cloud provider request throttled by ARM
+func (r *Reporter) ReportCloudProviderThrottled(operation string) error {
+	return r.ReportOperation(operation, CloudProviderThrottledCountM.M(1))
+}
+
+// ReportCloudProviderBlocked reports a cloud provider request blocked while ARM throttles the subscription
+func (r *Reporter) ReportCloudProviderBlocked(operation string) error {
+	return r.ReportOperation(operation, CloudProviderBlockedCountM.M(1))
+}
+
+// ReportCloudProviderConflict reports a cloud provider update rejected because the resource was modified concurrently
+func (r *Reporter) ReportCloudProviderConflict(operation string) error {
+	return r.ReportOperation(operation, CloudProviderConflictCountM.M(1))
+}
+
+// ReportAssignedIdentityOverflow reports an assigned identity which could not be assigned because the
+// node or VMSS reached the limit of user-assigned identities
+func (r *Reporter) ReportAssignedIdentityOverflow(operation string) error {
+	return r.ReportOperation(operation, AssignedIdentityOverflowCountM.M(1))
+}
+
 // ReportKubernetesAPIOperationError reports kubernetes operation error count
 func (r *Reporter) ReportKubernetesAPIOperationError(operation string) error {
 	return r.ReportOperation(operation, KubernetesAPIOperationsErrorsCountM.M(1))
@@ -18,12 +18,21 @@ func TestBasicAndDurationReport(t *testing.T) {
 	testCounterMetric(t, reporter, AssignedIdentityAdditionCountM)
 	testCounterMetric(t, reporter, AssignedIdentityDeletionCountM)
 	testCounterMetric(t, reporter, AssignedIdentityUpdateCountM)
+	testCounterMetric(t, reporter, AssignedIdentityOverflowCountM)
 	testCounterMetric(t, reporter, MICCycleCountM)
 	testCounterMetric(t, reporter, MICNewLeaderElectionCountM)
 	testCounterMetric(t, reporter, CloudProviderOperationsErrorsCountM)
+	testCounterMetric(t, reporter, CloudProviderThrottledCountM)
+	testCounterMetric(t, reporter, CloudProviderBlockedCountM)
+	testCounterMetric(t, reporter, CloudProviderConflictCountM)
 	testCounterMetric(t, reporter, KubernetesAPIOperationsErrorsCountM)
 	testCounterMetric(t, reporter, NMITokenOperationCountM)
 	testCounterMetric(t, reporter, NMITokenOperationFailureCountM)
+	testCounterMetric(t, reporter, NMITokenCacheHitCountM)
+	testCounterMetric(t, reporter, NMITokenCacheMissCountM)
+	testCounterMetric(t, reporter, NMITokenCacheRefreshCountM)
+	testCounterMetric(t, reporter, NMITokenCacheRefreshFailureCountM)
+	testCounterMetric(t, reporter, NMITokenCacheEvictionCountM)
 	testCounterMetric(t, reporter, NMIHostPolicyApplyCountM)
 	testCounterMetric(t, reporter, NMIHostPolicyApplyFailedCountM)
 	testOperationDurationMetric(t, reporter, CloudProviderOperationsDurationM)
@@ -0,0 +1,158 @@
+package mic
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+
+	"k8s.io/klog/v2"
+)
+
+// NodePlan is the change MIC would make to a node or VMSS in dry-run mode.
+type NodePlan struct {
+	// Name is the name of the node or VMSS on Azure
+	Name   string `json:"name"`
+	IsVMSS bool   `json:"isVMSS"`
+	// ResourceID is the ARM resource ID of the VM or VMSS, whose name differs from the node
+	// name for the VMs of scale sets in Flexible orchestration mode
+	ResourceID string `json:"resourceID,omitempty"`
+	// AssignIdentities and RemoveIdentities are the resource IDs of the user-assigned identities
+	// which would be assigned to and removed from the node or VMSS
+	AssignIdentities []string `json:"assignIdentities,omitempty"`
+	RemoveIdentities []string `json:"removeIdentities,omitempty"`
+	// CreateAssignedIdentities, UpdateAssignedIdentities and DeleteAssignedIdentities are the
+	// AzureAssignedIdentities which would be created, updated and deleted, as namespace/name
+	CreateAssignedIdentities []string `json:"createAssignedIdentities,omitempty"`
+	UpdateAssignedIdentities []string `json:"updateAssignedIdentities,omitempty"`
+	DeleteAssignedIdentities []string `json:"deleteAssignedIdentities,omitempty"`
+}
+
+// dryRunPlan contains the last computed plan of every node or VMSS with pending changes.
+type dryRunPlan struct {
+	mu    sync.RWMutex
+	nodes map[string]NodePlan
+}
+
+func newDryRunPlan() *dryRunPlan {
+	return &dryRunPlan{nodes: make(map[string]NodePlan)}
+}
+
+func newNodePlan(name string, trackList trackUserAssignedMSIIds) NodePlan {
+	plan := NodePlan{
+		Name:       name,
+		IsVMSS:     trackList.isvmss,
+		ResourceID: trackList.resourceID,
+	}
+	plan.AssignIdentities = sortedUniqueIDs(trackList.addUserAssignedMSIIDs)
+	plan.RemoveIdentities = sortedUniqueIDs(trackList.removeUserAssignedMSIIDs)
+	plan.CreateAssignedIdentities = assignedIDNames(trackList.assignedIDsToCreate)
+	plan.UpdateAssignedIdentities = assignedIDNames(trackList.assignedIDsToUpdate)
+	plan.DeleteAssignedIdentities = assignedIDNames(trackList.assignedIDsToDelete)
+	return plan
+}
+
+func (p NodePlan) isEmpty() bool {
+	return len(p.AssignIdentities) == 0 && len(p.RemoveIdentities) == 0 &&
+		len(p.CreateAssignedIdentities) == 0 && len(p.UpdateAssignedIdentities) == 0 && len(p.DeleteAssignedIdentities) == 0
+}
+
+// recordPlan replaces the plan of the nodes synced in a cycle with the changes in nodeMap,
+// which is keyed by node or VMSS name. It is called instead of updating the nodes in dry-run mode.
+func (c *Client) recordPlan(nodes map[string]bool, nodeMap map[string]trackUserAssignedMSIIds) {
+	c.plan.mu.Lock()
+	defer c.plan.mu.Unlock()
+
+	for nodeName := range nodes {
+		delete(c.plan.nodes, c.getNodeOrVMSSName(nodeName))
+	}
+	for name, trackList := range nodeMap {
+		plan := newNodePlan(name, trackList)
+		if plan.isEmpty() {
+			continue
+		}
+		klog.Infof("dry run: node %s, assign %v, remove %v, create %v, update %v, delete %v", name,
+			plan.AssignIdentities, plan.RemoveIdentities, plan.CreateAssignedIdentities, plan.UpdateAssignedIdentities, plan.DeleteAssignedIdentities)
+		c.plan.nodes[name] = plan
+	}
+	c.reportPlan()
+}
+
+// reportPlan reports the total number of planned changes. plan.mu must be held.
+func (c *Client) reportPlan() {
+	counts := make(map[string]int)
+	for _, plan := range c.plan.nodes {
+		counts[metrics.DryRunNodeOperationName]++
+		counts[metrics.DryRunAssignIdentityOperationName] += len(plan.AssignIdentities)
+		counts[metrics.DryRunRemoveIdentityOperationName] += len(plan.RemoveIdentities)
+		counts[metrics.DryRunCreateAssignedIdentityOperationName] += len(plan.CreateAssignedIdentities)
+		counts[metrics.DryRunUpdateAssignedIdentityOperationName] += len(plan.UpdateAssignedIdentities)
+		counts[metrics.DryRunDeleteAssignedIdentityOperationName] += len(plan.DeleteAssignedIdentities)
+	}
+	for _, operationType := range []string{
+		metrics.DryRunNodeOperationName,
+		metrics.DryRunAssignIdentityOperationName,
+		metrics.DryRunRemoveIdentityOperationName,
+		metrics.DryRunCreateAssignedIdentityOperationName,
+		metrics.DryRunUpdateAssignedIdentityOperationName,
+		metrics.DryRunDeleteAssignedIdentityOperationName,
+	} {
+		if err := c.Reporter.ReportOperation(operationType, metrics.MICDryRunPlanCountM.M(int64(counts[operationType]))); err != nil {
+			klog.Warningf("failed to report metrics, error: %+v", err)
+		}
+	}
+}
+
+// GetPlan returns the changes MIC would make in dry-run mode, sorted by node or VMSS name.
+func (c *Client) GetPlan() []NodePlan {
+	if c.plan == nil {
+		return nil
+	}
+	c.plan.mu.RLock()
+	defer c.plan.mu.RUnlock()
+
+	plans := make([]NodePlan, 0, len(c.plan.nodes))
+	for _, plan := range c.plan.nodes {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].Name < plans[j].Name
+	})
+	return plans
+}
+
+// PlanHandler serves the changes MIC would make in dry-run mode as JSON.
+func (c *Client) PlanHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.GetPlan()); err != nil {
+		klog.Errorf("failed to encode dry run plan, error: %+v", err)
+	}
+}
+
+func sortedUniqueIDs(ids []string) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	var unique []string
+	for _, id := range ids {
+		if !set[id] {
+			set[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+func assignedIDNames(assignedIDs []aadpodid.AzureAssignedIdentity) []string {
+	var names []string
+	for _, assignedID := range assignedIDs {
+		names = append(names, getIDKey(assignedID.Namespace, assignedID.Name))
+	}
+	sort.Strings(names)
+	return names
+}
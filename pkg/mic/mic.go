@@ -34,6 +34,7 @@ import (
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
 
@@ -45,6 +46,13 @@ const (
 // NodeGetter is an abstraction used to get Kubernetes node info.
 type NodeGetter interface {
 	Get(name string) (*corev1.Node, error)
+	List() ([]*corev1.Node, error)
+	Start(<-chan struct{})
+}
+
+// NamespaceGetter is an abstraction used to get Kubernetes namespace info.
+type NamespaceGetter interface {
+	Get(name string) (*corev1.Namespace, error)
 	Start(<-chan struct{})
 }
 
@@ -85,6 +93,7 @@ type Client struct {
 	EventRecorder                       record.EventRecorder
 	EventChannel                        chan aadpodid.EventType
 	NodeClient                          NodeGetter
+	NamespaceClient                     NamespaceGetter
 	IsNamespaced                        bool
 	SyncLoopStarted                     bool
 	syncRetryInterval                   time.Duration
@@ -92,8 +101,20 @@ type Client struct {
 	createDeleteBatch                   int64
 	ImmutableUserMSIsMap                map[string]bool
 	identityAssignmentReconcileInterval time.Duration
+	// dryRun computes the changes to identities and AzureAssignedIdentities without making them
+	dryRun bool
+	// plan contains the changes computed in dry-run mode
+	plan *dryRunPlan
 
 	syncing int32 // protect against conucrrent sync's
+	// syncMu serializes the sync cycles and the reconciliation of the identity assignment
+	syncMu sync.Mutex
+	// queue contains the nodes and VMSS to reconcile, keyed by node name or VMSS ID
+	queue               workqueue.RateLimitingInterface
+	totalSyncCycles     int
+	totalWorkDoneCycles int
+	// syncStatus records the outcome of the current sync cycle for the status of identities and bindings
+	syncStatus *syncStatus
 
 	leaderElector *leaderelection.LeaderElector
 	*LeaderElectionConfig
@@ -117,6 +138,7 @@ type Config struct {
 	TypeUpgradeCfg                      *TypeUpgradeConfig
 	UpdateUserMSICfg                    *UpdateUserMSIConfig
 	IdentityAssignmentReconcileInterval time.Duration
+	DryRun                              bool
 }
 
 // ClientInt is an abstraction used to perform an MIC sync cycle.
@@ -132,6 +154,8 @@ type trackUserAssignedMSIIds struct {
 	assignedIDsToDelete      []aadpodid.AzureAssignedIdentity
 	assignedIDsToUpdate      []aadpodid.AzureAssignedIdentity
 	isvmss                   bool
+	// resourceID is the ARM resource ID of the VM or VMSS, which is empty if the node has no provider ID
+	resourceID string
 }
 
 // NewMICClient returnes new mic client
@@ -155,13 +179,15 @@ func NewMICClient(cfg *Config) (*Client, error) {
 
 	eventCh := make(chan aadpodid.EventType, 100)
 
-	crdClient, err := crd.NewCRDClient(cfg.RestConfig, eventCh)
+	// the nodes affected by changes to pods, identities and bindings are enqueued by the
+	// event handlers of MIC, so the CRD and pod clients don't send events
+	crdClient, err := crd.NewCRDClient(cfg.RestConfig, nil)
 	if err != nil {
 		return nil, err
 	}
 	klog.V(1).Infof("CRD client initialized")
 
-	podClient := pod.NewPodClient(informer, eventCh)
+	podClient := pod.NewPodClient(informer, nil)
 	klog.V(1).Infof("pod Client initialized")
 
 	cloudConfigWatcher, err := filewatcher.NewFileWatcher(
@@ -210,6 +236,7 @@ func NewMICClient(cfg *Config) (*Client, error) {
 		EventRecorder:                       recorder,
 		EventChannel:                        eventCh,
 		NodeClient:                          &NodeClient{informer.Core().V1().Nodes()},
+		NamespaceClient:                     NewNamespaceClient(informer.Core().V1().Namespaces(), eventCh),
 		IsNamespaced:                        cfg.IsNamespaced,
 		syncRetryInterval:                   cfg.SyncRetryInterval,
 		enableScaleFeatures:                 cfg.EnableScaleFeatures,
@@ -219,7 +246,13 @@ func NewMICClient(cfg *Config) (*Client, error) {
 		CMCfg:                               cfg.CMcfg,
 		CMClient:                            cmClient,
 		identityAssignmentReconcileInterval: cfg.IdentityAssignmentReconcileInterval,
+		queue:                               newNodeQueue(),
+		dryRun:                              cfg.DryRun,
 	}
+	if c.dryRun {
+		c.plan = newDryRunPlan()
+	}
+	c.addEventHandlers(informer.Core().V1().Pods().Informer(), informer.Core().V1().Nodes().Informer(), crdClient.BindingInformer, crdClient.IDInformer, crdClient.PolicyInformer)
 
 	leaderElector, err := c.NewLeaderElector(clientSet, recorder, cfg.LeaderElectionCfg)
 	if err != nil {
@@ -237,6 +270,12 @@ func NewMICClient(cfg *Config) (*Client, error) {
 
 // Run - Initiates the leader election run call to find if its leader and run it
 func (c *Client) Run() {
+	if c.dryRun {
+		// a MIC in dry-run mode runs alongside the active MIC and must not take over its leader lease
+		klog.Info("starting MIC in dry-run mode without leader election")
+		go c.Start(make(chan struct{}))
+		return
+	}
 	klog.Info("initiating MIC Leader election")
 	// counter to track number of mic election
 	c.Reporter.Report(metrics.MICNewLeaderElectionCountM.M(1))
@@ -335,7 +374,9 @@ func (c *Client) UpgradeTypeIfRequired() error {
 func (c *Client) Start(exit <-chan struct{}) {
 	klog.V(6).Infof("MIC client starting..")
 
-	if err := c.UpgradeTypeIfRequired(); err != nil {
+	if c.dryRun {
+		klog.Info("skipping type upgrade in dry-run mode")
+	} else if err := c.UpgradeTypeIfRequired(); err != nil {
 		klog.Fatalf("type upgrade failed with error: %+v", err)
 		return
 	}
@@ -363,6 +404,13 @@ func (c *Client) Start(exit <-chan struct{}) {
 		wg.Done()
 	}()
 
+	wg.Add(1)
+	go func() {
+		c.NamespaceClient.Start(exit)
+		klog.V(6).Infof("namespace client started")
+		wg.Done()
+	}()
+
 	wg.Add(1)
 	go func() {
 		c.CloudConfigWatcher.Start(exit)
@@ -382,162 +430,252 @@ func (c *Client) setStopped() {
 	atomic.StoreInt32(&c.syncing, stopped)
 }
 
-// Sync perform a sync cycle.
+// Sync reconciles the nodes and VMSS in the work queue until exit is closed. All nodes are
+// reconciled on EventChannel events and every syncRetryInterval.
 func (c *Client) Sync(exit <-chan struct{}) {
 	if !c.canSync() {
 		panic("concurrent syncs")
 	}
 	defer c.setStopped()
 
+	klog.Info("sync thread started.")
+	c.SyncLoopStarted = true
+
+	if c.queue.ShuttingDown() {
+		// the nodes left in the queue of the previous sync loop are lost, so all nodes are reconciled
+		c.queue = newNodeQueue()
+		c.enqueueAllNodes()
+	}
+
+	go c.handleEvents(exit)
+	go func() {
+		<-exit
+		c.queue.ShutDown()
+	}()
+
+	for c.processNextBatch(exit) {
+	}
+}
+
+// handleEvents enqueues all nodes on the events of EventChannel and periodically,
+// and periodically reconciles the identity assignment on Azure.
+func (c *Client) handleEvents(exit <-chan struct{}) {
 	ticker := time.NewTicker(c.syncRetryInterval)
 	defer ticker.Stop()
 
 	identityAssignmentReconcileTicker := time.NewTicker(c.identityAssignmentReconcileInterval)
 	defer identityAssignmentReconcileTicker.Stop()
 
-	klog.Info("sync thread started.")
-	c.SyncLoopStarted = true
-	var event aadpodid.EventType
-	totalWorkDoneCycles := 0
-	totalSyncCycles := 0
+	ctx, cancel := contextForExit(exit)
+	defer cancel()
 
 	for {
 		select {
 		case <-exit:
 			return
-		case event = <-c.EventChannel:
+		case event := <-c.EventChannel:
 			klog.V(6).Infof("received event: %v", event)
+			c.enqueueAllNodes()
 		case <-ticker.C:
 			klog.V(6).Infof("running periodic sync loop")
+			c.enqueueAllNodes()
 		case <-identityAssignmentReconcileTicker.C:
 			klog.V(6).Infof("reconciling identity assignment on Azure")
-			c.reconcileIdentityAssignment()
-			continue
-		}
-		totalSyncCycles++
-		stats.Init()
-		// This is the only place where the AzureAssignedIdentity creation is initiated.
-		begin := time.Now()
-		workDone := false
-
-		cacheTime := time.Now()
-
-		// There is a delay in data propagation to cache. It's possible that the creates performed in the previous sync cycle
-		// are not propagated before this sync cycle began. In order to avoid redoing the cycle, we sync cache again.
-		c.CRDClient.SyncCacheAll(exit, false)
-		stats.Put(stats.CacheSync, time.Since(cacheTime))
-
-		// List all pods in all namespaces
-		systemTime := time.Now()
-		listPods, err := c.PodClient.GetPods()
-		if err != nil {
-			klog.Errorf("failed to list pods, error: %+v", err)
-			continue
-		}
-		listBindings, err := c.CRDClient.ListBindings()
-		if err != nil {
-			continue
-		}
-		klog.V(6).Infof("number of bindings: %d", len(*listBindings))
-		listIDs, err := c.CRDClient.ListIds()
-		if err != nil {
-			continue
-		}
-		klog.V(6).Infof("number of identities: %d", len(*listIDs))
-		idMap, err := c.convertIDListToMap(*listIDs)
-		if err != nil {
-			klog.Errorf("failed to convert ID list to map, error: %+v", err)
-			continue
+			c.syncMu.Lock()
+			c.reconcileIdentityAssignment(ctx)
+			c.syncMu.Unlock()
 		}
+	}
+}
 
-		currentAssignedIDs, err := c.CRDClient.ListAssignedIDsInMap()
-		if err != nil {
-			continue
+// contextForExit returns a context which is canceled when exit is closed, so that the retries of
+// ARM requests stop when MIC stops syncing, e.g. because it lost the leader election.
+func contextForExit(exit <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-exit:
+			cancel()
+		case <-ctx.Done():
 		}
-		klog.V(6).Infof("number of assigned identities: %d", len(currentAssignedIDs))
-		stats.Put(stats.System, time.Since(systemTime))
+	}()
+	return ctx, cancel
+}
 
-		beginNewListTime := time.Now()
-		newAssignedIDs, nodeRefs, err := c.createDesiredAssignedIdentityList(listPods, listBindings, idMap)
-		if err != nil {
-			klog.Errorf("failed to create a list of desired AzureAssignedIdentity, error: %+v", err)
-			continue
-		}
-		stats.Put(stats.CurrentState, time.Since(beginNewListTime))
+// syncNodes performs a sync cycle for the nodes and VMSS of the given work queue keys.
+// It returns the keys whose identities failed to be assigned or removed.
+func (c *Client) syncNodes(exit <-chan struct{}, keys []string) map[string]error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
 
-		// Extract add list and delete list based on existing assigned ids in the system (currentAssignedIDs).
-		// and the ones we have arrived at in the volatile list (newAssignedIDs).
-		addList, err := c.getAzureAssignedIDsToCreate(currentAssignedIDs, newAssignedIDs)
-		if err != nil {
-			klog.Errorf("failed to get a list of AzureAssignedIdentities to create, error: %+v", err)
-			continue
-		}
-		deleteList, err := c.getAzureAssignedIDsToDelete(currentAssignedIDs, newAssignedIDs)
-		if err != nil {
-			klog.Errorf("failed to get a list of AzureAssignedIdentities to delete, error: %+v", err)
-			continue
-		}
-		beforeUpdateList, afterUpdateList := c.getAzureAssignedIdentitiesToUpdate(addList, deleteList)
-		klog.V(5).Infof("del: %v, add: %v, update: %v", deleteList, addList, afterUpdateList)
+	c.totalSyncCycles++
+	stats.Init()
+	// This is the only place where the AzureAssignedIdentity creation is initiated.
+	begin := time.Now()
+	workDone := false
 
-		// the node map is used to track assigned ids to create/delete, identities to assign/remove
-		// for each node or vmss
-		nodeMap := make(map[string]trackUserAssignedMSIIds)
+	cacheTime := time.Now()
 
-		// separate the add, delete and update list per node
-		c.convertAssignedIDListToMap(addList, deleteList, afterUpdateList, nodeMap)
+	// There is a delay in data propagation to cache. It's possible that the creates performed in the previous sync cycle
+	// are not propagated before this sync cycle began. In order to avoid redoing the cycle, we sync cache again.
+	c.CRDClient.SyncCacheAll(exit, false)
+	stats.Put(stats.CacheSync, time.Since(cacheTime))
+
+	nodes, keyNodes, err := c.getNodesForKeys(keys)
+	if err != nil {
+		klog.Errorf("failed to get nodes to sync, error: %+v", err)
+		return failAll(keys, err)
+	}
 
-		// process the delete and add list
-		// determine the list of identities that need to updated, create a node to identity list mapping for add and delete
-		if len(deleteList) > 0 || len(beforeUpdateList) > 0 {
-			workDone = true
-			c.getListOfIdsToDelete(deleteList, beforeUpdateList, afterUpdateList, newAssignedIDs, nodeMap, nodeRefs)
+	systemTime := time.Now()
+	listBindings, err := c.CRDClient.ListBindings()
+	if err != nil {
+		return failAll(keys, err)
+	}
+	klog.V(6).Infof("number of bindings: %d", len(*listBindings))
+	allPods, err := c.getPods(*listBindings)
+	if err != nil {
+		klog.Errorf("failed to list pods, error: %+v", err)
+		return failAll(keys, err)
+	}
+	// only the pods scheduled to the nodes in this cycle are considered
+	var listPods []*corev1.Pod
+	for _, pod := range allPods {
+		if nodes[pod.Spec.NodeName] {
+			listPods = append(listPods, pod)
 		}
-		if len(addList) > 0 || len(afterUpdateList) > 0 {
-			workDone = true
-			c.getListOfIdsToAssign(addList, afterUpdateList, nodeMap)
+	}
+	listIDs, err := c.CRDClient.ListIds()
+	if err != nil {
+		return failAll(keys, err)
+	}
+	klog.V(6).Infof("number of identities: %d", len(*listIDs))
+	idMap, err := c.convertIDListToMap(*listIDs)
+	if err != nil {
+		klog.Errorf("failed to convert ID list to map, error: %+v", err)
+		return failAll(keys, err)
+	}
+
+	allAssignedIDs, err := c.CRDClient.ListAssignedIDsInMap()
+	if err != nil {
+		return failAll(keys, err)
+	}
+	currentAssignedIDs := make(map[string]aadpodid.AzureAssignedIdentity)
+	for name, assignedID := range allAssignedIDs {
+		if nodes[assignedID.Spec.NodeName] {
+			currentAssignedIDs[name] = assignedID
 		}
+	}
+	klog.V(6).Infof("number of assigned identities: %d", len(currentAssignedIDs))
+	stats.Put(stats.System, time.Since(systemTime))
 
-		var wg sync.WaitGroup
+	beginNewListTime := time.Now()
+	newAssignedIDs, nodeRefs, err := c.createDesiredAssignedIdentityList(listPods, listBindings, idMap)
+	if err != nil {
+		klog.Errorf("failed to create a list of desired AzureAssignedIdentity, error: %+v", err)
+		return failAll(keys, err)
+	}
+	stats.Put(stats.CurrentState, time.Since(beginNewListTime))
 
-		// check if vmss and consolidate vmss nodes into vmss if necessary
-		c.consolidateVMSSNodes(nodeMap, &wg)
+	// Extract add list and delete list based on existing assigned ids in the system (currentAssignedIDs).
+	// and the ones we have arrived at in the volatile list (newAssignedIDs).
+	addList, err := c.getAzureAssignedIDsToCreate(currentAssignedIDs, newAssignedIDs)
+	if err != nil {
+		klog.Errorf("failed to get a list of AzureAssignedIdentities to create, error: %+v", err)
+		return failAll(keys, err)
+	}
+	deleteList, err := c.getAzureAssignedIDsToDelete(currentAssignedIDs, newAssignedIDs)
+	if err != nil {
+		klog.Errorf("failed to get a list of AzureAssignedIdentities to delete, error: %+v", err)
+		return failAll(keys, err)
+	}
+	beforeUpdateList, afterUpdateList := c.getAzureAssignedIdentitiesToUpdate(addList, deleteList)
+	klog.V(5).Infof("del: %v, add: %v, update: %v", deleteList, addList, afterUpdateList)
 
-		// one final createorupdate to each node or vmss in the map
-		c.updateNodeAndDeps(newAssignedIDs, nodeMap, nodeRefs, &wg)
+	// the node map is used to track assigned ids to create/delete, identities to assign/remove
+	// for each node or vmss
+	nodeMap := make(map[string]trackUserAssignedMSIIds)
 
-		wg.Wait()
+	// separate the add, delete and update list per node
+	c.convertAssignedIDListToMap(addList, deleteList, afterUpdateList, nodeMap)
 
-		if workDone || ((totalSyncCycles % 1000) == 0) {
-			if workDone {
-				totalWorkDoneCycles++
-			}
-			idsFound := 0
-			bindingsFound := 0
-			if listIDs != nil {
-				idsFound = len(*listIDs)
-			}
-			if listBindings != nil {
-				bindingsFound = len(*listBindings)
-			}
-			klog.Infof("work done: %v. Found %d pods, %d ids, %d bindings", workDone, len(listPods), idsFound, bindingsFound)
-			klog.Infof("total work cycles: %d, out of which work was done in: %d", totalSyncCycles, totalWorkDoneCycles)
-			stats.Put(stats.Total, time.Since(begin))
-
-			c.Reporter.Report(
-				metrics.MICCycleCountM.M(1),
-				metrics.MICCycleDurationM.M(metrics.SinceInSeconds(begin)))
-
-			stats.PrintSync()
-			if workDone {
-				// We need to synchronize the cache inorder to get the latest updates.
-				// Even though we sync at the beginning of every cycle, we are still seeing
-				// conflicts indicating the assigned identities are not reflecting in
-				// the cache. Continue to use the sleep workaround.
-				time.Sleep(time.Millisecond * 200)
+	// process the delete and add list
+	// determine the list of identities that need to updated, create a node to identity list mapping for add and delete
+	if len(deleteList) > 0 || len(beforeUpdateList) > 0 {
+		workDone = true
+		c.getListOfIdsToDelete(deleteList, beforeUpdateList, afterUpdateList, newAssignedIDs, nodeMap, nodeRefs)
+	}
+	if len(addList) > 0 || len(afterUpdateList) > 0 {
+		workDone = true
+		c.getListOfIdsToAssign(addList, afterUpdateList, nodeMap)
+	}
+
+	var wg sync.WaitGroup
+	c.syncStatus = newSyncStatus()
+
+	// check if vmss and consolidate vmss nodes into vmss if necessary
+	c.consolidateVMSSNodes(nodeMap, &wg)
+
+	if c.dryRun {
+		c.recordPlan(nodes, nodeMap)
+		c.syncStatus = nil
+		klog.V(5).Infof("dry run: found %d pods on %d nodes, %d ids, %d bindings", len(listPods), len(nodes), len(*listIDs), len(*listBindings))
+		return nil
+	}
+
+	// one final createorupdate to each node or vmss in the map
+	ctx, cancel := contextForExit(exit)
+	defer cancel()
+	c.updateNodeAndDeps(ctx, newAssignedIDs, nodeMap, nodeRefs, &wg)
+
+	wg.Wait()
+
+	// the desired state of the nodes which are not part of this cycle is unchanged
+	desiredAssignedIDs := make(map[string]aadpodid.AzureAssignedIdentity)
+	for name, assignedID := range allAssignedIDs {
+		if !nodes[assignedID.Spec.NodeName] {
+			desiredAssignedIDs[name] = assignedID
+		}
+	}
+	for name, assignedID := range newAssignedIDs {
+		desiredAssignedIDs[name] = assignedID
+	}
+	// update the status of all identities and bindings at once with the outcome of this cycle
+	c.updateStatus(listIDs, listBindings, idMap, allAssignedIDs, desiredAssignedIDs)
+
+	errs := make(map[string]error)
+	for _, key := range keys {
+		for _, nodeName := range keyNodes[key] {
+			if err := c.syncStatus.nodeErrors[c.getNodeOrVMSSName(nodeName)]; err != nil {
+				errs[key] = err
+				break
 			}
 		}
 	}
+	c.syncStatus = nil
+
+	if workDone || ((c.totalSyncCycles % 1000) == 0) {
+		if workDone {
+			c.totalWorkDoneCycles++
+		}
+		klog.Infof("work done: %v. Found %d pods on %d nodes, %d ids, %d bindings", workDone, len(listPods), len(nodes), len(*listIDs), len(*listBindings))
+		klog.Infof("total work cycles: %d, out of which work was done in: %d", c.totalSyncCycles, c.totalWorkDoneCycles)
+		stats.Put(stats.Total, time.Since(begin))
+
+		c.Reporter.Report(
+			metrics.MICCycleCountM.M(1),
+			metrics.MICCycleDurationM.M(metrics.SinceInSeconds(begin)))
+
+		stats.PrintSync()
+		if workDone {
+			// We need to synchronize the cache inorder to get the latest updates.
+			// Even though we sync at the beginning of every cycle, we are still seeing
+			// conflicts indicating the assigned identities are not reflecting in
+			// the cache. Continue to use the sleep workaround.
+			time.Sleep(time.Millisecond * 200)
+		}
+	}
+	return errs
 }
 
 func (c *Client) convertAssignedIDListToMap(addList, deleteList, updateList map[string]aadpodid.AzureAssignedIdentity, nodeMap map[string]trackUserAssignedMSIIds) {
@@ -569,6 +707,17 @@ func (c *Client) convertAssignedIDListToMap(addList, deleteList, updateList map[
 	}
 }
 
+// getPods returns the pods which can be matched by the bindings. Only pods with the aadpodidbinding
+// label are listed unless a binding selects pods by label selector or service account.
+func (c *Client) getPods(bindings []aadpodid.AzureIdentityBinding) ([]*corev1.Pod, error) {
+	for _, binding := range bindings {
+		if binding.HasPodSelector() {
+			return c.PodClient.ListPods()
+		}
+	}
+	return c.PodClient.GetPods()
+}
+
 func (c *Client) createDesiredAssignedIdentityList(
 	listPods []*corev1.Pod, listBindings *[]aadpodid.AzureIdentityBinding, idMap map[string]aadpodid.AzureIdentity) (map[string]aadpodid.AzureAssignedIdentity, map[string]bool, error) {
 	// For each pod, check what bindings are matching. For each binding create volatile azure assigned identity.
@@ -587,15 +736,15 @@ func (c *Client) createDesiredAssignedIdentityList(
 		}
 		crdPodLabelVal := pod.Labels[aadpodid.CRDLabelKey]
 		klog.V(6).Infof("pod: %s/%s. Label value: %v", pod.Namespace, pod.Name, crdPodLabelVal)
-		if crdPodLabelVal == "" {
-			// No binding mentioned in the label. Just continue to the next pod
-			klog.Infof("pod %s/%s doesn't contain %s label field. it will be ignored", pod.Namespace, pod.Name, aadpodid.CRDLabelKey)
-			continue
-		}
 		var matchedBindings []aadpodid.AzureIdentityBinding
 		for _, allBinding := range *listBindings {
-			klog.V(6).Infof("check the binding (pod - %s/%s): %s", pod.Namespace, pod.Name, allBinding.Spec.Selector)
-			if allBinding.Spec.Selector == crdPodLabelVal {
+			klog.V(6).Infof("check the binding (pod - %s/%s): %s/%s", pod.Namespace, pod.Name, allBinding.Namespace, allBinding.Name)
+			matched, err := allBinding.MatchesPod(pod)
+			if err != nil {
+				klog.Errorf("failed to match binding %s/%s with pod %s/%s, error: %+v", allBinding.Namespace, allBinding.Name, pod.Namespace, pod.Name, err)
+				continue
+			}
+			if matched {
 				klog.V(5).Infof("found binding match for pod %s/%s with binding %s/%s", pod.Namespace, pod.Name, allBinding.Namespace, allBinding.Name)
 				matchedBindings = append(matchedBindings, allBinding)
 				nodeRefs[pod.Spec.NodeName] = true
@@ -603,21 +752,26 @@ func (c *Client) createDesiredAssignedIdentityList(
 		}
 
 		if len(matchedBindings) == 0 {
-			klog.Infof("No AzureIdentityBinding found for pod %s/%s that matches selector: %s. it will be ignored", pod.Namespace, pod.Name, crdPodLabelVal)
+			// pods without the label can only be matched by the label selector or service account of a binding,
+			// so they are ignored silently as most of them are not meant to have an identity
+			if crdPodLabelVal != "" {
+				klog.Infof("No AzureIdentityBinding found for pod %s/%s that matches selector: %s. it will be ignored", pod.Namespace, pod.Name, crdPodLabelVal)
+			}
 			continue
 		}
 
 		for _, binding := range matchedBindings {
 			klog.V(5).Infof("looking up id map: %s/%s", binding.Namespace, binding.Spec.AzureIdentity)
 			if azureID, idPresent := idMap[getIDKey(binding.Namespace, binding.Spec.AzureIdentity)]; idPresent {
-				// working in Namespaced mode or this specific identity is namespaced
-				if c.IsNamespaced || aadpodid.IsNamespacedIdentity(&azureID) {
-					// They have to match all
-					if !(azureID.Namespace == binding.Namespace && binding.Namespace == pod.Namespace) {
-						klog.V(5).Infof("identity %s/%s was matched via binding %s/%s to %s/%s but namespaced identity is enforced, so it will be ignored",
-							azureID.Namespace, azureID.Name, binding.Namespace, binding.Name, pod.Namespace, pod.Name)
-						continue
-					}
+				allowed, err := c.isNamespaceAllowed(&azureID, pod.Namespace)
+				if err != nil {
+					klog.Errorf("failed to check if identity %s/%s allows namespace %s, error: %+v", azureID.Namespace, azureID.Name, pod.Namespace, err)
+					continue
+				}
+				if !allowed {
+					klog.V(5).Infof("identity %s/%s was matched via binding %s/%s to %s/%s but the namespace of the pod is not allowed, so it will be ignored",
+						azureID.Namespace, azureID.Name, binding.Namespace, binding.Name, pod.Namespace, pod.Name)
+					continue
 				}
 				klog.V(5).Infof("identity %s/%s assigned to %s/%s via %s/%s", azureID.Namespace, azureID.Name, pod.Namespace, pod.Name, binding.Namespace, binding.Name)
 				assignedID, err := c.makeAssignedIDs(azureID, binding, pod.Name, pod.Namespace, pod.Spec.NodeName)
@@ -688,7 +842,8 @@ func (c *Client) shouldAssignID(assignedID aadpodid.AzureAssignedIdentity, nodeM
 	id := assignedID.Spec.AzureIdentityRef
 	isUserAssignedMSI := c.checkIfUserAssignedMSI(*id)
 
-	if assignedID.Status.Status == "" || assignedID.Status.Status == aadpodid.AssignedIDCreated {
+	// overflowed identities are assigned again once the node or VMSS has capacity
+	if assignedID.Status.Status == "" || assignedID.Status.Status == aadpodid.AssignedIDCreated || assignedID.Status.Status == aadpodid.AssignedIDOverflowed {
 		if isUserAssignedMSI {
 			c.appendToAddListForNode(id.Spec.ResourceID, assignedID.Spec.NodeName, nodeMap)
 		}
@@ -736,15 +891,29 @@ func (c *Client) matchAssignedID(x aadpodid.AzureAssignedIdentity, y aadpodid.Az
 	klog.V(7).Infof("idX - %+v\n", idX)
 	klog.V(7).Infof("idY - %+v\n", idY)
 
+	// the status of identities and bindings is updated by MIC itself, so a changed resource
+	// version with the same spec and metadata doesn't require the AzureAssignedIdentity to be updated
 	return bindingX.Name == bindingY.Name &&
-		bindingX.ResourceVersion == bindingY.ResourceVersion &&
+		(bindingX.ResourceVersion == bindingY.ResourceVersion || sameBindingSpec(bindingX, bindingY)) &&
 		idX.Name == idY.Name &&
-		idX.ResourceVersion == idY.ResourceVersion &&
+		(idX.ResourceVersion == idY.ResourceVersion || sameIdentitySpec(idX, idY)) &&
 		x.Spec.Pod == y.Spec.Pod &&
 		x.Spec.PodNamespace == y.Spec.PodNamespace &&
 		x.Spec.NodeName == y.Spec.NodeName
 }
 
+func sameIdentitySpec(x, y *aadpodid.AzureIdentity) bool {
+	return reflect.DeepEqual(x.Spec, y.Spec) &&
+		reflect.DeepEqual(x.Labels, y.Labels) &&
+		reflect.DeepEqual(x.Annotations, y.Annotations)
+}
+
+func sameBindingSpec(x, y *aadpodid.AzureIdentityBinding) bool {
+	return reflect.DeepEqual(x.Spec, y.Spec) &&
+		reflect.DeepEqual(x.Labels, y.Labels) &&
+		reflect.DeepEqual(x.Annotations, y.Annotations)
+}
+
 func (c *Client) getAzureAssignedIDsToCreate(old, new map[string]aadpodid.AzureAssignedIdentity) (map[string]aadpodid.AzureAssignedIdentity, error) {
 	// everything in new needs to be created
 	if len(old) == 0 {
@@ -760,9 +929,9 @@ func (c *Client) getAzureAssignedIDsToCreate(old, new map[string]aadpodid.AzureA
 		if exists {
 			idMatch = c.matchAssignedID(oldAssignedID, newAssignedID)
 		}
-		if idMatch && oldAssignedID.Status.Status == aadpodid.AssignedIDCreated {
-			// if the old assigned id is in created state, then the identity assignment to the node
-			// is not done. Adding to the list will ensure we retry identity assignment to node for
+		if idMatch && (oldAssignedID.Status.Status == aadpodid.AssignedIDCreated || oldAssignedID.Status.Status == aadpodid.AssignedIDOverflowed) {
+			// if the old assigned id is in created or overflowed state, then the identity assignment to
+			// the node is not done. Adding to the list will ensure we retry identity assignment to node for
 			// this assigned identity.
 			klog.V(5).Infof("ok: %v, Create added: %s as assignedID in CREATED state", idMatch, assignedIDName)
 			create[assignedIDName] = oldAssignedID
@@ -834,6 +1003,19 @@ func (c *Client) getAzureAssignedIdentitiesToUpdate(add, del map[string]aadpodid
 	return beforeUpdate, afterUpdate
 }
 
+// isNamespaceAllowed returns true if pods in the namespace can be bound to the identity. The namespace
+// is only looked up if its labels are needed to evaluate the namespace selector of the identity.
+func (c *Client) isNamespaceAllowed(azureID *aadpodid.AzureIdentity, namespace string) (bool, error) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+	if azureID.Spec.NamespaceSelector != nil && namespace != azureID.Namespace && !c.IsNamespaced {
+		var err error
+		if ns, err = c.NamespaceClient.Get(namespace); err != nil {
+			return false, fmt.Errorf("failed to get namespace %s, error: %+v", namespace, err)
+		}
+	}
+	return azureID.AllowsNamespace(ns, c.IsNamespaced)
+}
+
 func (c *Client) makeAssignedIDs(azID aadpodid.AzureIdentity, azBinding aadpodid.AzureIdentityBinding, podName, podNameSpace, nodeName string) (res *aadpodid.AzureAssignedIdentity, err error) {
 	binding := azBinding
 	id := azID
@@ -859,7 +1041,7 @@ func (c *Client) makeAssignedIDs(azID aadpodid.AzureIdentity, azBinding aadpodid
 		},
 	}
 	// if we are in namespaced mode (or az identity is namespaced)
-	if c.IsNamespaced || aadpodid.IsNamespacedIdentity(&id) {
+	if c.IsNamespaced || id.IsNamespaced() {
 		assignedID.Namespace = azID.Namespace
 	} else {
 		// eventually this should be identity namespace
@@ -886,6 +1068,7 @@ func (c *Client) removeAssignedIdentity(assignedID *aadpodid.AzureAssignedIdenti
 	if err != nil {
 		return err
 	}
+	c.recordRemoved(*assignedID)
 	return nil
 }
 
@@ -932,11 +1115,26 @@ func (c *Client) getUserMSIListForNode(nodeOrVMSSName string, isvmss bool) ([]st
 	return c.CloudClient.GetUserMSIs(nodeOrVMSSName, isvmss)
 }
 
+// getAzureName returns the ARM resource ID of a node or VMSS if known, which the cloud provider
+// resolves in its own subscription and resource group, or else its name in the configured ones.
+func getAzureName(nodeOrVMSSName, resourceID string) string {
+	if resourceID != "" {
+		return resourceID
+	}
+	return nodeOrVMSSName
+}
+
 func getIDKey(ns, name string) string {
 	return strings.Join([]string{ns, name}, "/")
 }
 
+// convertIDListToMap returns the valid identities by key. Identities which violate an AzureIdentityPolicy are ignored.
 func (c *Client) convertIDListToMap(azureIdentities []aadpodid.AzureIdentity) (m map[string]aadpodid.AzureIdentity, err error) {
+	violations, err := c.getPolicyViolations(azureIdentities)
+	if err != nil {
+		return nil, err
+	}
+
 	m = make(map[string]aadpodid.AzureIdentity, len(azureIdentities))
 	for _, azureIdentity := range azureIdentities {
 		// validate the resourceID in azure identity for type 0 (UserAssignedMSI) to ensure format is as expected
@@ -947,6 +1145,10 @@ func (c *Client) convertIDListToMap(azureIdentities []aadpodid.AzureIdentity) (m
 				continue
 			}
 		}
+		if err := violations[getIDKey(azureIdentity.Namespace, azureIdentity.Name)]; err != nil {
+			klog.Errorf("ignoring azure identity %s/%s, error: %+v", azureIdentity.Namespace, azureIdentity.Name, err)
+			continue
+		}
 		m[getIDKey(azureIdentity.Namespace, azureIdentity.Name)] = azureIdentity
 	}
 	return m, nil
@@ -1007,23 +1209,34 @@ func (c *Client) getUniqueIDs(idList []string) []string {
 }
 
 func (c *Client) updateAssignedIdentityStatus(assignedID *aadpodid.AzureAssignedIdentity, status string) error {
-	return c.CRDClient.UpdateAzureAssignedIdentityStatus(assignedID, status)
+	if err := c.CRDClient.UpdateAzureAssignedIdentityStatus(assignedID, status); err != nil {
+		return err
+	}
+	switch status {
+	case aadpodid.AssignedIDAssigned:
+		c.recordAssigned(*assignedID)
+	case aadpodid.AssignedIDUnAssigned:
+		c.recordRemoved(*assignedID)
+	}
+	return nil
 }
 
-func (c *Client) updateNodeAndDeps(newAssignedIDs map[string]aadpodid.AzureAssignedIdentity, nodeMap map[string]trackUserAssignedMSIIds, nodeRefs map[string]bool, wg *sync.WaitGroup) {
+func (c *Client) updateNodeAndDeps(ctx context.Context, newAssignedIDs map[string]aadpodid.AzureAssignedIdentity, nodeMap map[string]trackUserAssignedMSIIds, nodeRefs map[string]bool, wg *sync.WaitGroup) {
 	for nodeName, nodeTrackList := range nodeMap {
 		wg.Add(1)
-		go c.updateUserMSI(newAssignedIDs, nodeName, nodeTrackList, nodeRefs, wg)
+		go c.updateUserMSI(ctx, newAssignedIDs, nodeName, nodeTrackList, nodeRefs, wg)
 	}
 }
 
-func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedIdentity, nodeOrVMSSName string, nodeTrackList trackUserAssignedMSIIds, nodeRefs map[string]bool, wg *sync.WaitGroup) {
+// updateUserMSI updates the identities of the node or VMSS and the AzureAssignedIdentities of its pods.
+// The retries of the update on Azure are canceled when ctx is done.
+func (c *Client) updateUserMSI(ctx context.Context, newAssignedIDs map[string]aadpodid.AzureAssignedIdentity, nodeOrVMSSName string, nodeTrackList trackUserAssignedMSIIds, nodeRefs map[string]bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 	beginAdding := time.Now()
 	klog.Infof("processing node %s, add [%d], del [%d], update [%d]", nodeOrVMSSName,
 		len(nodeTrackList.assignedIDsToCreate), len(nodeTrackList.assignedIDsToDelete), len(nodeTrackList.assignedIDsToUpdate))
 
-	ctx := context.TODO()
+	semCtx := context.TODO()
 	// We have to ensure that we don't overwhelm the API server with too many
 	// requests in flight. We use a token based approach implemented using semaphore to
 	// ensure that only given createDeleteBatch requests are in flight at any point in time.
@@ -1031,7 +1244,7 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 	semCreateOrUpdate := semaphore.NewWeighted(c.createDeleteBatch)
 
 	for _, createID := range nodeTrackList.assignedIDsToCreate {
-		if err := semCreateOrUpdate.Acquire(ctx, 1); err != nil {
+		if err := semCreateOrUpdate.Acquire(semCtx, 1); err != nil {
 			klog.Errorf("failed to acquire semaphore in the create loop, error: %+v", err)
 			return
 		}
@@ -1055,7 +1268,7 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 	}
 
 	for _, updateID := range nodeTrackList.assignedIDsToUpdate {
-		if err := semCreateOrUpdate.Acquire(ctx, 1); err != nil {
+		if err := semCreateOrUpdate.Acquire(semCtx, 1); err != nil {
 			klog.Errorf("failed to acquire semaphore in the update loop, error: %+v", err)
 			return
 		}
@@ -1079,25 +1292,29 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 	}
 
 	// Ensure that all creates are complete
-	if err := semCreateOrUpdate.Acquire(ctx, c.createDeleteBatch); err != nil {
+	if err := semCreateOrUpdate.Acquire(semCtx, c.createDeleteBatch); err != nil {
 		klog.Errorf("failed to acquire semaphore at the end of creates, error: %+v", err)
 		return
 	}
-	// generate unique list so we don't make multiple calls to assign/remove same id
-	addUserAssignedMSIIDs := c.getUniqueIDs(nodeTrackList.addUserAssignedMSIIDs)
+	// generate unique list so we don't make multiple calls to assign/remove same id.
+	// The identities to assign are ordered by usage in case the node or VMSS reaches the identity limit.
+	addUserAssignedMSIIDs := c.prioritizeIDs(nodeTrackList.addUserAssignedMSIIDs, nodeOrVMSSName, newAssignedIDs)
 	removeUserAssignedMSIIDs := c.getUniqueIDs(nodeTrackList.removeUserAssignedMSIIDs)
 	createOrUpdateList := append([]aadpodid.AzureAssignedIdentity{}, nodeTrackList.assignedIDsToCreate...)
 	createOrUpdateList = append(createOrUpdateList, nodeTrackList.assignedIDsToUpdate...)
 
-	err := c.CloudClient.UpdateUserMSI(addUserAssignedMSIIDs, removeUserAssignedMSIIDs, nodeOrVMSSName, nodeTrackList.isvmss)
+	azureName := getAzureName(nodeOrVMSSName, nodeTrackList.resourceID)
+	err := c.CloudClient.UpdateUserMSI(ctx, addUserAssignedMSIIDs, removeUserAssignedMSIIDs, azureName, nodeTrackList.isvmss)
+	c.recordNodeResult(nodeOrVMSSName, azureName, err)
 	if err != nil {
 		klog.Errorf("failed to update user-assigned identities on node %s (add [%d], del [%d], update[%d]), error: %+v", nodeOrVMSSName, len(nodeTrackList.assignedIDsToCreate), len(nodeTrackList.assignedIDsToDelete), len(nodeTrackList.assignedIDsToUpdate), err)
-		idList, getErr := c.getUserMSIListForNode(nodeOrVMSSName, nodeTrackList.isvmss)
+		idList, getErr := c.getUserMSIListForNode(azureName, nodeTrackList.isvmss)
 		if getErr != nil {
 			klog.Errorf("failed to get a list of user-assigned identites from node %s, error: %+v", nodeOrVMSSName, getErr)
 			return
 		}
 
+		overflowedIDs := getOverflowedIDs(err)
 		for _, createID := range createOrUpdateList {
 			createID := createID // avoid implicit memory aliasing in for loop
 			id := createID.Spec.AzureIdentityRef
@@ -1106,13 +1323,19 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 			isUserAssignedMSI := c.checkIfUserAssignedMSI(*id)
 			idExistsOnNode := c.checkIfMSIExistsOnNode(id, createID.Spec.NodeName, idList)
 
+			if isUserAssignedMSI && !idExistsOnNode && overflowedIDs[strings.ToLower(id.Spec.ResourceID)] {
+				c.setOverflowed(createID, nodeTrackList.isvmss, err)
+				continue
+			}
 			if isUserAssignedMSI && !idExistsOnNode {
 				message := fmt.Sprintf("failed to apply binding %s/%s node %s for pod %s/%s, error: %+v", binding.Namespace, binding.Name, createID.Spec.NodeName, createID.Spec.PodNamespace, createID.Spec.Pod, err)
 				c.EventRecorder.Event(binding, corev1.EventTypeWarning, "binding apply error", message)
 				klog.Error(message)
+				c.recordResult(createID, err)
 				continue
 			}
 			// the identity was successfully assigned to the node
+			c.recordResult(createID, nil)
 			c.EventRecorder.Event(binding, corev1.EventTypeNormal, "binding applied",
 				fmt.Sprintf("binding %s applied on node %s for pod %s", binding.Name, createID.Spec.NodeName, createID.Name))
 
@@ -1158,8 +1381,10 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 			// the identity still exists on node, which means removing the identity from the node failed
 			if isUserAssignedMSI && !inUse && idExistsOnNode {
 				klog.Errorf("failed to remove AzureIdentityBinding %s from node %s for pod %s/%s, error: %+v", removedBinding.Name, delID.Spec.NodeName, delID.Spec.PodNamespace, delID.Spec.Pod, err)
+				c.recordResult(delID, err)
 				continue
 			}
+			c.recordResult(delID, nil)
 
 			klog.Infof("updating msis on node %s failed, but identity %s/%s has successfully been removed from node", delID.Spec.NodeName, id.Namespace, id.Name)
 
@@ -1176,6 +1401,13 @@ func (c *Client) updateUserMSI(newAssignedIDs map[string]aadpodid.AzureAssignedI
 		return
 	}
 
+	for _, assignedID := range createOrUpdateList {
+		c.recordResult(assignedID, nil)
+	}
+	for _, assignedID := range nodeTrackList.assignedIDsToDelete {
+		c.recordResult(assignedID, nil)
+	}
+
 	semUpdate := semaphore.NewWeighted(c.createDeleteBatch)
 
 	for _, createID := range createOrUpdateList {
@@ -1270,6 +1502,7 @@ func (c *Client) cleanUpAllAssignedIdentitiesOnNode(node string, nodeTrackList t
 // currently operate on all nodes in the vmss not just a single node.
 func (c *Client) consolidateVMSSNodes(nodeMap map[string]trackUserAssignedMSIIds, wg *sync.WaitGroup) {
 	vmssMap := make(map[string][]string)
+	vmssResourceIDs := make(map[string]string)
 
 	for nodeName, nodeTrackList := range nodeMap {
 		node, err := c.NodeClient.Get(nodeName)
@@ -1279,6 +1512,10 @@ func (c *Client) consolidateVMSSNodes(nodeMap map[string]trackUserAssignedMSIIds
 		}
 		if err != nil && strings.Contains(err.Error(), "not found") {
 			klog.Warningf("failed to get node %s while updating user-assigned identities, error: %+v", nodeName, err)
+			if c.dryRun {
+				// the AzureAssignedIdentities of the node would be deleted
+				continue
+			}
 			wg.Add(1)
 			// node is no longer found in the cluster, all the assigned identities that were created in this sync loop
 			// and those that already exist for this node need to be deleted.
@@ -1291,14 +1528,23 @@ func (c *Client) consolidateVMSSNodes(nodeMap map[string]trackUserAssignedMSIIds
 			klog.Errorf("failed to check if node %s is VMSS, error: %+v", nodeName, err)
 			continue
 		}
+		resourceID, err := getResourceID(node)
+		if err != nil {
+			klog.Errorf("failed to get the resource ID of node %s, error: %+v", nodeName, err)
+			continue
+		}
 		if isvmss {
+			vmssResourceIDs[vmssName] = resourceID
 			if nodes, ok := vmssMap[vmssName]; ok {
 				nodes = append(nodes, nodeName)
 				vmssMap[vmssName] = nodes
 				continue
 			}
 			vmssMap[vmssName] = []string{nodeName}
+			continue
 		}
+		nodeTrackList.resourceID = resourceID
+		nodeMap[nodeName] = nodeTrackList
 	}
 
 	// aggregate vmss nodes into vmss name
@@ -1315,6 +1561,7 @@ func (c *Client) consolidateVMSSNodes(nodeMap map[string]trackUserAssignedMSIIds
 			vmssTrackList.assignedIDsToDelete = append(vmssTrackList.assignedIDsToDelete, nodeMap[vmssNode].assignedIDsToDelete...)
 			vmssTrackList.assignedIDsToUpdate = append(vmssTrackList.assignedIDsToUpdate, nodeMap[vmssNode].assignedIDsToUpdate...)
 			vmssTrackList.isvmss = true
+			vmssTrackList.resourceID = vmssResourceIDs[vmssName]
 
 			delete(nodeMap, vmssNode)
 			nodeMap[getVMSSName(vmssName)] = vmssTrackList
@@ -1337,21 +1584,25 @@ func (c *Client) checkIfIdentityImmutable(id string) bool {
 	return false
 }
 
+// nodeMetadata is the VM or VMSS of a node on Azure.
+type nodeMetadata struct {
+	nodeName string
+	isVMSS   bool
+	// resourceID is the ARM resource ID of the VM or VMSS, which is empty if the node has no provider ID
+	resourceID string
+}
+
 // generateIdentityAssignmentState generates the current and desired state of each node's identity
 // assignments based on an existing list of AzureAssignedIdentity as the source of truth.
-func (c *Client) generateIdentityAssignmentState() (currentState map[string]map[string]bool, desiredState map[string]map[string]bool, isVMSSMap map[string]bool, err error) {
-	type nodeMetadata struct {
-		nodeName string
-		isVMSS   bool
-	}
-
+// The metadata of the VMs and VMSS are returned by name for the reconciliation.
+func (c *Client) generateIdentityAssignmentState() (currentState map[string]map[string]bool, desiredState map[string]map[string]bool, nodeMetadataMap map[string]nodeMetadata, err error) {
 	assignedIDs, err := c.CRDClient.ListAssignedIDs()
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to list AzureAssignedIdentities, error: %+v", err)
 	}
 
 	nodeMetadataCache := make(map[string]nodeMetadata)
-	isVMSSMap = make(map[string]bool)
+	nodeMetadataMap = make(map[string]nodeMetadata)
 	currentState = make(map[string]map[string]bool)
 	desiredState = make(map[string]map[string]bool)
 	for _, assignedID := range *assignedIDs {
@@ -1370,17 +1621,22 @@ func (c *Client) generateIdentityAssignmentState() (currentState map[string]map[
 				// VM node name does not require conversion
 				nodeName = assignedID.Spec.NodeName
 			}
+			resourceID, err := getResourceID(node)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to get the resource ID of node %s, error: %+v", assignedID.Spec.NodeName, err)
+			}
 
 			// cache node metadata to avoid excessive GET calls
 			nodeMetadataCache[assignedID.Spec.NodeName] = nodeMetadata{
-				nodeName: nodeName,
-				isVMSS:   isVMSS,
+				nodeName:   nodeName,
+				isVMSS:     isVMSS,
+				resourceID: resourceID,
 			}
 		}
 
-		nodeName := nodeMetadataCache[assignedID.Spec.NodeName].nodeName
-		isVMSS := nodeMetadataCache[assignedID.Spec.NodeName].isVMSS
-		isVMSSMap[nodeName] = isVMSS
+		metadata := nodeMetadataCache[assignedID.Spec.NodeName]
+		nodeName := metadata.nodeName
+		nodeMetadataMap[nodeName] = metadata
 
 		// only consider AzureAssignedIdentities in ASSIGNED state
 		// do not consider AzureAssignedIdentities in CREATED state because they are either:
@@ -1395,7 +1651,7 @@ func (c *Client) generateIdentityAssignmentState() (currentState map[string]map[
 
 		if _, ok := currentState[nodeName]; !ok {
 			currentState[nodeName] = make(map[string]bool)
-			idList, err := c.getUserMSIListForNode(nodeName, isVMSS)
+			idList, err := c.getUserMSIListForNode(getAzureName(nodeName, metadata.resourceID), metadata.isVMSS)
 			if err != nil {
 				return nil, nil, nil, fmt.Errorf("failed to get a list of user-assigned identites from node %s, error: %+v", nodeName, err)
 			}
@@ -1406,7 +1662,7 @@ func (c *Client) generateIdentityAssignmentState() (currentState map[string]map[
 		}
 	}
 
-	return currentState, desiredState, isVMSSMap, nil
+	return currentState, desiredState, nodeMetadataMap, nil
 }
 
 // generateIdentityAssignmentDiff perform a diff between current
@@ -1434,8 +1690,8 @@ func generateIdentityAssignmentDiff(currentState map[string]map[string]bool, des
 
 // reconcileIdentityAssignment uses the existing list of AzureAssignedIdentities
 // as the single source of truth and reconciles identity assignment on Azure.
-func (c *Client) reconcileIdentityAssignment() {
-	currentState, desiredState, isVMSSMap, err := c.generateIdentityAssignmentState()
+func (c *Client) reconcileIdentityAssignment(ctx context.Context) {
+	currentState, desiredState, nodeMetadataMap, err := c.generateIdentityAssignmentState()
 	if err != nil {
 		klog.Errorf("failed to generate identity assignment state, error: %+v", err)
 		return
@@ -1446,8 +1702,13 @@ func (c *Client) reconcileIdentityAssignment() {
 
 	diff := generateIdentityAssignmentDiff(currentState, desiredState)
 	for nodeNameOnAzure, identitiesToAssign := range diff {
+		if c.dryRun {
+			klog.Infof("dry run: identity assignment for %v on node %s would be reconciled", identitiesToAssign, nodeNameOnAzure)
+			continue
+		}
 		klog.Infof("reconciling identity assignment for %v on node %s", identitiesToAssign, nodeNameOnAzure)
-		if err := c.CloudClient.UpdateUserMSI(identitiesToAssign, nil, nodeNameOnAzure, isVMSSMap[nodeNameOnAzure]); err != nil {
+		metadata := nodeMetadataMap[nodeNameOnAzure]
+		if err := c.CloudClient.UpdateUserMSI(ctx, identitiesToAssign, nil, getAzureName(nodeNameOnAzure, metadata.resourceID), metadata.isVMSS); err != nil {
 			klog.Errorf("failed to update user-assigned identities on node %s, error: %+v", nodeNameOnAzure, err)
 		}
 	}
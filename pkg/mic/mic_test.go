@@ -1,30 +1,41 @@
 package mic
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	internalaadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
 	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
 	cp "github.com/Azure/aad-pod-identity/pkg/cloudprovider"
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider/fakearm"
 	"github.com/Azure/aad-pod-identity/pkg/config"
 	"github.com/Azure/aad-pod-identity/pkg/crd"
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
 	"github.com/Azure/aad-pod-identity/pkg/retry"
+	"github.com/Azure/aad-pod-identity/pkg/stats"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
 	"github.com/stretchr/testify/assert"
 	api "k8s.io/api/core/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	fcache "k8s.io/client-go/tools/cache/testing"
 	"k8s.io/klog/v2"
 )
 
@@ -266,6 +277,9 @@ func (c *TestVMSSClient) CompareMSI(nodeName string, expectedUserIDs []string) b
 }
 
 func (c *TestCloudClient) GetUserMSIs(name string, isvmss bool) ([]string, error) {
+	if r, err := cp.ParseResourceID(name); err == nil {
+		name = r.ResourceName
+	}
 	var ret []string
 	if isvmss {
 		vmss, _ := c.testVMSSClient.Get("", name)
@@ -452,6 +466,7 @@ type TestCrdClient struct {
 	assignedIDMap map[string]*internalaadpodid.AzureAssignedIdentity
 	bindingMap    map[string]*aadpodid.AzureIdentityBinding
 	idMap         map[string]*aadpodid.AzureIdentity
+	policies      []internalaadpodid.AzureIdentityPolicy
 	err           *error
 }
 
@@ -516,6 +531,24 @@ func (c *TestCrdClient) UpdateAzureAssignedIdentityStatus(assignedIdentity *inte
 	return nil
 }
 
+func (c *TestCrdClient) UpdateAzureIdentityStatus(identity *internalaadpodid.AzureIdentity) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id, ok := c.idMap[getIDKey(identity.Namespace, identity.Name)]; ok {
+		id.Status = aadpodid.AzureIdentityStatus(identity.Status)
+	}
+	return nil
+}
+
+func (c *TestCrdClient) UpdateAzureIdentityBindingStatus(binding *internalaadpodid.AzureIdentityBinding) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.bindingMap[getIDKey(binding.Namespace, binding.Name)]; ok {
+		b.Status = aadpodid.AzureIdentityBindingStatus(binding.Status)
+	}
+	return nil
+}
+
 func (c *TestCrdClient) CreateBinding(name, ns, idName, selector, resourceVersion string) {
 	binding := &aadpodid.AzureIdentityBinding{
 		ObjectMeta: metav1.ObjectMeta{
@@ -604,6 +637,18 @@ func (c *Client) ListPodIdentityExceptions(ns string) (*[]internalaadpodid.Azure
 	return nil, nil
 }
 
+func (c *TestCrdClient) CreatePolicy(policy internalaadpodid.AzureIdentityPolicy) {
+	c.mu.Lock()
+	c.policies = append(c.policies, policy)
+	c.mu.Unlock()
+}
+
+func (c *TestCrdClient) ListIdentityPolicies() ([]internalaadpodid.AzureIdentityPolicy, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]internalaadpodid.AzureIdentityPolicy{}, c.policies...), nil
+}
+
 func (c *TestCrdClient) SetError(err error) {
 	c.err = &err
 }
@@ -651,6 +696,17 @@ func (c *TestNodeClient) Get(name string) (*corev1.Node, error) {
 	return node, nil
 }
 
+func (c *TestNodeClient) List() ([]*corev1.Node, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var nodes []*corev1.Node
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
 func (c *TestNodeClient) Delete(name string) {
 	c.mu.Lock()
 	delete(c.nodes, name)
@@ -672,6 +728,37 @@ func (c *TestNodeClient) AddNode(name string, opts ...func(*corev1.Node)) {
 	c.nodes[name] = n
 }
 
+/************************ NAMESPACE MOCK *************************************/
+
+type TestNamespaceClient struct {
+	mu         sync.Mutex
+	namespaces map[string]*corev1.Namespace
+}
+
+func NewTestNamespaceClient() *TestNamespaceClient {
+	return &TestNamespaceClient{namespaces: make(map[string]*corev1.Namespace)}
+}
+
+func (c *TestNamespaceClient) Get(name string) (*corev1.Namespace, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ns, exists := c.namespaces[name]
+	if !exists {
+		return nil, errors.New("namespace not found")
+	}
+	return ns, nil
+}
+
+func (c *TestNamespaceClient) Start(<-chan struct{}) {}
+
+func (c *TestNamespaceClient) AddNamespace(name string, labels map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.namespaces[name] = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
 /************************ EVENT RECORDER MOCK *************************************/
 type LastEvent struct {
 	Type    string
@@ -760,12 +847,14 @@ func NewMICTestClient(eventCh chan internalaadpodid.EventType,
 		PodClient:                           podClient,
 		EventChannel:                        eventCh,
 		NodeClient:                          nodeClient,
+		NamespaceClient:                     NewTestNamespaceClient(),
 		syncRetryInterval:                   120 * time.Second,
 		IsNamespaced:                        isNamespaced,
 		createDeleteBatch:                   createDeleteBatch,
 		ImmutableUserMSIsMap:                immutableUserMSIs,
 		Reporter:                            reporter,
 		identityAssignmentReconcileInterval: 3 * time.Minute,
+		queue:                               newNodeQueue(),
 	}
 
 	return &TestMICClient{
@@ -821,7 +910,7 @@ func TestMapMICClient_1(t *testing.T) {
 		},
 	}
 
-	micClient := &TestMICClient{}
+	micClient := &TestMICClient{&Client{CRDClient: NewTestCrdClient(nil)}}
 	idMap, err := micClient.convertIDListToMap(idList)
 	if err != nil {
 		t.Fatalf("expected err to be nil, got: %+v", err)
@@ -1801,10 +1890,10 @@ func TestGenerateIdentityAssignmentStateVM(t *testing.T) {
 	evtRecorder.eventChannel = make(chan bool)
 
 	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
-	currentState, desiredState, isVMSSMap, err := micClient.generateIdentityAssignmentState()
+	currentState, desiredState, nodeMetadataMap, err := micClient.generateIdentityAssignmentState()
 	assert.Empty(t, currentState)
 	assert.Empty(t, desiredState)
-	assert.Empty(t, isVMSSMap)
+	assert.Empty(t, nodeMetadataMap)
 	assert.NoError(t, err)
 
 	nodeClient.AddNode("node-0", func(n *corev1.Node) {
@@ -1826,7 +1915,7 @@ func TestGenerateIdentityAssignmentStateVM(t *testing.T) {
 	})
 
 	// the user-assigned identity isn't assigned to a VMSS instance on Azure
-	currentState, desiredState, isVMSSMap, err = micClient.generateIdentityAssignmentState()
+	currentState, desiredState, nodeMetadataMap, err = micClient.generateIdentityAssignmentState()
 	assert.Equal(t, currentState, map[string]map[string]bool{
 		"node-0": {},
 	})
@@ -1835,8 +1924,11 @@ func TestGenerateIdentityAssignmentStateVM(t *testing.T) {
 			testResourceID: true,
 		},
 	})
-	assert.Equal(t, isVMSSMap, map[string]bool{
-		"node-0": false,
+	assert.Equal(t, nodeMetadataMap, map[string]nodeMetadata{
+		"node-0": {
+			nodeName:   "node-0",
+			resourceID: "/subscriptions/xxx/resourceGroups/xxx/providers/Microsoft.Compute/virtualMachines/node-0",
+		},
 	})
 	assert.NoError(t, err)
 
@@ -1849,7 +1941,7 @@ func TestGenerateIdentityAssignmentStateVM(t *testing.T) {
 	}
 	_ = cloudClient.testVMClient.UpdateIdentities("", "node-0", vm)
 
-	currentState, desiredState, isVMSSMap, err = micClient.generateIdentityAssignmentState()
+	currentState, desiredState, nodeMetadataMap, err = micClient.generateIdentityAssignmentState()
 	assert.Equal(t, currentState, map[string]map[string]bool{
 		"node-0": {
 			testResourceID: true,
@@ -1860,8 +1952,11 @@ func TestGenerateIdentityAssignmentStateVM(t *testing.T) {
 			testResourceID: true,
 		},
 	})
-	assert.Equal(t, isVMSSMap, map[string]bool{
-		"node-0": false,
+	assert.Equal(t, nodeMetadataMap, map[string]nodeMetadata{
+		"node-0": {
+			nodeName:   "node-0",
+			resourceID: "/subscriptions/xxx/resourceGroups/xxx/providers/Microsoft.Compute/virtualMachines/node-0",
+		},
 	})
 	assert.NoError(t, err)
 }
@@ -1877,10 +1972,10 @@ func TestGenerateIdentityAssignmentStateVMSS(t *testing.T) {
 	evtRecorder.eventChannel = make(chan bool)
 
 	micClient := NewMICTestClient(eventCh, cloudClient, crdClient, podClient, nodeClient, &evtRecorder, false, 4, nil)
-	currentState, desiredState, isVMSSMap, err := micClient.generateIdentityAssignmentState()
+	currentState, desiredState, nodeMetadataMap, err := micClient.generateIdentityAssignmentState()
 	assert.Empty(t, currentState)
 	assert.Empty(t, desiredState)
-	assert.Empty(t, isVMSSMap)
+	assert.Empty(t, nodeMetadataMap)
 	assert.NoError(t, err)
 
 	nodeClient.AddNode("node-0", func(n *corev1.Node) {
@@ -1903,7 +1998,7 @@ func TestGenerateIdentityAssignmentStateVMSS(t *testing.T) {
 	})
 
 	// the user-assigned identity isn't assigned to a VMSS instance on Azure
-	currentState, desiredState, isVMSSMap, err = micClient.generateIdentityAssignmentState()
+	currentState, desiredState, nodeMetadataMap, err = micClient.generateIdentityAssignmentState()
 	assert.Equal(t, currentState, map[string]map[string]bool{
 		"node-0": {},
 	})
@@ -1912,8 +2007,12 @@ func TestGenerateIdentityAssignmentStateVMSS(t *testing.T) {
 			testResourceID: true,
 		},
 	})
-	assert.Equal(t, isVMSSMap, map[string]bool{
-		"node-0": true,
+	assert.Equal(t, nodeMetadataMap, map[string]nodeMetadata{
+		"node-0": {
+			nodeName:   "node-0",
+			isVMSS:     true,
+			resourceID: "/subscriptions/xxx/resourceGroups/xxx/providers/Microsoft.Compute/virtualMachineScaleSets/node-0",
+		},
 	})
 	assert.NoError(t, err)
 
@@ -1926,7 +2025,7 @@ func TestGenerateIdentityAssignmentStateVMSS(t *testing.T) {
 	}
 	_ = cloudClient.testVMSSClient.UpdateIdentities("", "node-0", vmss)
 
-	currentState, desiredState, isVMSSMap, err = micClient.generateIdentityAssignmentState()
+	currentState, desiredState, nodeMetadataMap, err = micClient.generateIdentityAssignmentState()
 	assert.Equal(t, currentState, map[string]map[string]bool{
 		"node-0": {
 			testResourceID: true,
@@ -1937,8 +2036,12 @@ func TestGenerateIdentityAssignmentStateVMSS(t *testing.T) {
 			testResourceID: true,
 		},
 	})
-	assert.Equal(t, isVMSSMap, map[string]bool{
-		"node-0": true,
+	assert.Equal(t, nodeMetadataMap, map[string]nodeMetadata{
+		"node-0": {
+			nodeName:   "node-0",
+			isVMSS:     true,
+			resourceID: "/subscriptions/xxx/resourceGroups/xxx/providers/Microsoft.Compute/virtualMachineScaleSets/node-0",
+		},
 	})
 	assert.NoError(t, err)
 }
@@ -2023,3 +2126,1178 @@ func findAssignedIDByName(name string, assignedIDs *[]internalaadpodid.AzureAssi
 	}
 	return nil
 }
+
+func TestCreateDesiredAssignedIdentityListWithPodSelector(t *testing.T) {
+	micClient := NewMICTestClient(nil, NewTestCloudClient(config.AzureConfig{}), NewTestCrdClient(nil), NewTestPodClient(), NewTestNodeClient(), nil, false, 4, nil)
+
+	newPod := func(name, ns, serviceAccountName string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: labels},
+			Spec:       corev1.PodSpec{NodeName: "test-node1", ServiceAccountName: serviceAccountName},
+		}
+	}
+	pods := []*corev1.Pod{
+		newPod("legacy-pod", "default", "", map[string]string{internalaadpodid.CRDLabelKey: "test-select1"}),
+		newPod("app-pod", "default", "", map[string]string{"app": "frontend", "tier": "web"}),
+		newPod("app-pod", "other", "", map[string]string{"app": "frontend", "tier": "web"}),
+		newPod("sa-pod", "default", "workload", nil),
+		newPod("unlabeled-pod", "default", "", nil),
+	}
+	bindings := []internalaadpodid.AzureIdentityBinding{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "legacy-binding", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-id1", Selector: "test-select1"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "label-selector-binding", Namespace: "default"},
+			Spec: internalaadpodid.AzureIdentityBindingSpec{
+				AzureIdentity: "test-id1",
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "frontend"},
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"web", "api"}},
+					},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "service-account-binding", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: "test-id1", ServiceAccountName: "workload"},
+		},
+	}
+	idMap := map[string]internalaadpodid.AzureIdentity{
+		getIDKey("default", "test-id1"): {
+			ObjectMeta: metav1.ObjectMeta{Name: "test-id1", Namespace: "default"},
+			Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, ResourceID: testResourceID},
+		},
+	}
+
+	assignedIDs, nodeRefs, err := micClient.createDesiredAssignedIdentityList(pods, &bindings, idMap)
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	if !nodeRefs["test-node1"] {
+		t.Fatalf("expected test-node1 to be referenced")
+	}
+
+	var matchedPods []string
+	for _, assignedID := range assignedIDs {
+		matchedPods = append(matchedPods, fmt.Sprintf("%s/%s", assignedID.Spec.PodNamespace, assignedID.Spec.Pod))
+	}
+	sort.Strings(matchedPods)
+	expectedPods := []string{"default/app-pod", "default/legacy-pod", "default/sa-pod"}
+	assert.Equal(t, expectedPods, matchedPods)
+}
+
+func TestCreateDesiredAssignedIdentityListWithNamespacePolicy(t *testing.T) {
+	namespaceClient := NewTestNamespaceClient()
+	namespaceClient.AddNamespace("tenant1", map[string]string{"team": "payments"})
+	namespaceClient.AddNamespace("tenant2", map[string]string{"team": "checkout"})
+	namespaceClient.AddNamespace("tenant3", nil)
+
+	newPod := func(ns, selector string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: ns, Labels: map[string]string{internalaadpodid.CRDLabelKey: selector}},
+			Spec:       corev1.PodSpec{NodeName: "test-node1"},
+		}
+	}
+	newIdentity := func(name string, spec internalaadpodid.AzureIdentitySpec) internalaadpodid.AzureIdentity {
+		spec.Type = internalaadpodid.UserAssignedMSI
+		spec.ResourceID = testResourceID
+		return internalaadpodid.AzureIdentity{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "platform"}, Spec: spec}
+	}
+	newBinding := func(name, azureIdentity, selector string) internalaadpodid.AzureIdentityBinding {
+		return internalaadpodid.AzureIdentityBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "platform"},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: azureIdentity, Selector: selector},
+		}
+	}
+
+	pods := []*corev1.Pod{
+		newPod("platform", "shared"),
+		newPod("tenant1", "shared"),
+		newPod("tenant2", "shared"),
+		newPod("tenant3", "shared"),
+		newPod("tenant1", "listed"),
+		newPod("tenant2", "listed"),
+		newPod("tenant3", "listed"),
+		newPod("tenant1", "global"),
+	}
+	bindings := []internalaadpodid.AzureIdentityBinding{
+		newBinding("shared-binding", "shared-id", "shared"),
+		newBinding("listed-binding", "listed-id", "listed"),
+		newBinding("global-binding", "global-id", "global"),
+	}
+	idMap := map[string]internalaadpodid.AzureIdentity{
+		getIDKey("platform", "shared-id"): newIdentity("shared-id", internalaadpodid.AzureIdentitySpec{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+		}),
+		getIDKey("platform", "listed-id"): newIdentity("listed-id", internalaadpodid.AzureIdentitySpec{
+			AllowedNamespaces: []string{"tenant2", "tenant3"},
+		}),
+		getIDKey("platform", "global-id"): newIdentity("global-id", internalaadpodid.AzureIdentitySpec{}),
+	}
+
+	cases := []struct {
+		desc         string
+		isNamespaced bool
+		expected     []string
+	}{
+		{
+			desc:     "namespace policy",
+			expected: []string{"global-id:tenant1", "listed-id:tenant2", "listed-id:tenant3", "shared-id:platform", "shared-id:tenant1"},
+		},
+		{
+			desc:         "namespace policy in namespaced mode",
+			isNamespaced: true,
+			expected:     []string{"shared-id:platform"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			micClient := NewMICTestClient(nil, NewTestCloudClient(config.AzureConfig{}), NewTestCrdClient(nil), NewTestPodClient(), NewTestNodeClient(), nil, tc.isNamespaced, 4, nil)
+			micClient.NamespaceClient = namespaceClient
+
+			assignedIDs, _, err := micClient.createDesiredAssignedIdentityList(pods, &bindings, idMap)
+			if err != nil {
+				t.Fatalf("expected nil error, got: %+v", err)
+			}
+
+			var matched []string
+			for _, assignedID := range assignedIDs {
+				matched = append(matched, fmt.Sprintf("%s:%s", assignedID.Spec.AzureIdentityRef.Name, assignedID.Spec.PodNamespace))
+			}
+			sort.Strings(matched)
+			assert.Equal(t, tc.expected, matched)
+		})
+	}
+}
+
+func TestComputeStatus(t *testing.T) {
+	nodeClient := NewTestNodeClient()
+	nodeClient.AddNode("test-node1")
+	for i := 0; i < 2; i++ {
+		nodeClient.AddNode(fmt.Sprintf("test-vmss-node%d", i), func(n *corev1.Node) {
+			n.Spec.ProviderID = fmt.Sprintf("azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachineScaleSets/testvmss1/virtualMachines/%d", i)
+		})
+	}
+
+	newIdentity := func(name string) internalaadpodid.AzureIdentity {
+		return internalaadpodid.AzureIdentity{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Generation: 1},
+			Spec:       internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, ResourceID: testResourceID},
+		}
+	}
+	newBinding := func(name, azureIdentity string) internalaadpodid.AzureIdentityBinding {
+		return internalaadpodid.AzureIdentityBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Generation: 1},
+			Spec:       internalaadpodid.AzureIdentityBindingSpec{AzureIdentity: azureIdentity, Selector: name},
+		}
+	}
+	newAssignedID := func(pod, node, status string, id internalaadpodid.AzureIdentity, binding internalaadpodid.AzureIdentityBinding) internalaadpodid.AzureAssignedIdentity {
+		return internalaadpodid.AzureAssignedIdentity{
+			ObjectMeta: metav1.ObjectMeta{Name: pod + "-" + id.Name},
+			Spec: internalaadpodid.AzureAssignedIdentitySpec{
+				AzureIdentityRef: &id,
+				AzureBindingRef:  &binding,
+				Pod:              pod,
+				PodNamespace:     "default",
+				NodeName:         node,
+			},
+			Status: internalaadpodid.AzureAssignedIdentityStatus{Status: status},
+		}
+	}
+
+	id1, id2, id3 := newIdentity("test-id1"), newIdentity("test-id2"), newIdentity("test-id3")
+	binding1, binding2, binding3 := newBinding("test-binding1", "test-id1"), newBinding("test-binding2", "test-id2"), newBinding("test-binding3", "missing-id")
+	listIDs := []internalaadpodid.AzureIdentity{id1, id2, id3}
+	listBindings := []internalaadpodid.AzureIdentityBinding{binding1, binding2, binding3}
+	idMap := map[string]internalaadpodid.AzureIdentity{
+		getIDKey("default", "test-id1"): id1,
+		getIDKey("default", "test-id2"): id2,
+		getIDKey("default", "test-id3"): id3,
+	}
+
+	// test-id1 is assigned to a node and a VMSS with two nodes, test-id2 failed to be assigned
+	// and the assigned identity of test-id3 was removed in this cycle
+	assigned := newAssignedID("pod1", "test-node1", internalaadpodid.AssignedIDAssigned, id1, binding1)
+	removed := newAssignedID("pod5", "test-node1", internalaadpodid.AssignedIDAssigned, id3, binding1)
+	currentAssignedIDs := map[string]internalaadpodid.AzureAssignedIdentity{
+		assigned.Name: assigned,
+		removed.Name:  removed,
+	}
+	newAssignedIDs := map[string]internalaadpodid.AzureAssignedIdentity{
+		assigned.Name: assigned,
+	}
+	for _, assignedID := range []internalaadpodid.AzureAssignedIdentity{
+		newAssignedID("pod2", "test-vmss-node0", internalaadpodid.AssignedIDCreated, id1, binding1),
+		newAssignedID("pod3", "test-vmss-node1", internalaadpodid.AssignedIDCreated, id1, binding1),
+		newAssignedID("pod4", "test-node1", internalaadpodid.AssignedIDCreated, id2, binding2),
+	} {
+		newAssignedIDs[assignedID.Name] = assignedID
+	}
+
+	micClient := NewMICTestClient(nil, NewTestCloudClient(config.AzureConfig{}), NewTestCrdClient(nil), NewTestPodClient(), nodeClient, nil, false, 4, nil)
+	micClient.syncStatus = newSyncStatus()
+	micClient.recordAssigned(newAssignedIDs["pod2-test-id1"])
+	micClient.recordAssigned(newAssignedIDs["pod3-test-id1"])
+	micClient.recordResult(newAssignedIDs["pod2-test-id1"], nil)
+	micClient.recordResult(newAssignedIDs["pod4-test-id2"], errors.New(`compute.VirtualMachinesClient#CreateOrUpdate: Failure sending request: StatusCode=403 -- Original Error: Code="LinkedAuthorizationFailed" Message="The client has permission to perform action on scope, however it does not have permission to perform action on the linked scope."`))
+	micClient.recordResult(newAssignedIDs["pod4-test-id2"], nil)
+	micClient.recordRemoved(removed)
+
+	identities, bindings := micClient.computeStatus(&listIDs, &listBindings, idMap, currentAssignedIDs, newAssignedIDs)
+
+	identityStatus := make(map[string]internalaadpodid.AzureIdentityStatus)
+	for _, id := range identities {
+		identityStatus[id.Name] = id.Status
+	}
+	assert.Len(t, identityStatus, 3)
+	assert.Equal(t, int32(2), identityStatus["test-id1"].AssignedNodes)
+	assert.True(t, meta.IsStatusConditionTrue(identityStatus["test-id1"].Conditions, internalaadpodid.IdentityConditionAssigned))
+	assert.True(t, meta.IsStatusConditionFalse(identityStatus["test-id1"].Conditions, internalaadpodid.IdentityConditionAssignmentFailed))
+	assert.Equal(t, int32(0), identityStatus["test-id2"].AssignedNodes)
+	assert.True(t, meta.IsStatusConditionFalse(identityStatus["test-id2"].Conditions, internalaadpodid.IdentityConditionAssigned))
+	failed := meta.FindStatusCondition(identityStatus["test-id2"].Conditions, internalaadpodid.IdentityConditionAssignmentFailed)
+	if assert.NotNil(t, failed) {
+		assert.Equal(t, metav1.ConditionTrue, failed.Status)
+		assert.Equal(t, "LinkedAuthorizationFailed", failed.Reason)
+		assert.Equal(t, int64(1), failed.ObservedGeneration)
+	}
+	assert.Equal(t, int32(0), identityStatus["test-id3"].AssignedNodes)
+	assert.Nil(t, meta.FindStatusCondition(identityStatus["test-id3"].Conditions, internalaadpodid.IdentityConditionAssignmentFailed))
+
+	bindingStatus := make(map[string]internalaadpodid.AzureIdentityBindingStatus)
+	for _, binding := range bindings {
+		bindingStatus[binding.Name] = binding.Status
+	}
+	assert.Len(t, bindingStatus, 3)
+	assert.Equal(t, int32(3), bindingStatus["test-binding1"].MatchedPods)
+	assert.True(t, meta.IsStatusConditionTrue(bindingStatus["test-binding1"].Conditions, internalaadpodid.BindingConditionPodsMatched))
+	assert.True(t, meta.IsStatusConditionTrue(bindingStatus["test-binding1"].Conditions, internalaadpodid.BindingConditionIdentityFound))
+	assert.Equal(t, int32(1), bindingStatus["test-binding2"].MatchedPods)
+	assert.Equal(t, int32(0), bindingStatus["test-binding3"].MatchedPods)
+	assert.True(t, meta.IsStatusConditionFalse(bindingStatus["test-binding3"].Conditions, internalaadpodid.BindingConditionPodsMatched))
+	assert.True(t, meta.IsStatusConditionFalse(bindingStatus["test-binding3"].Conditions, internalaadpodid.BindingConditionIdentityFound))
+
+	// the status is only updated if it changed
+	for i := range listIDs {
+		listIDs[i].Status = identityStatus[listIDs[i].Name]
+	}
+	for i := range listBindings {
+		listBindings[i].Status = bindingStatus[listBindings[i].Name]
+	}
+	identities, bindings = micClient.computeStatus(&listIDs, &listBindings, idMap, currentAssignedIDs, newAssignedIDs)
+	assert.Empty(t, identities)
+	assert.Empty(t, bindings)
+}
+
+func TestIdentityPolicies(t *testing.T) {
+	crdClient := NewTestCrdClient(nil)
+	crdClient.CreatePolicy(internalaadpodid.AzureIdentityPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-subscription"},
+		Spec: internalaadpodid.AzureIdentityPolicySpec{
+			NamespaceSelector:         &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			AllowedResourceIDPrefixes: []string{"/subscriptions/sub1"},
+			AllowedTypes:              []internalaadpodid.IdentityType{internalaadpodid.UserAssignedMSI},
+		},
+	})
+	crdClient.CreatePolicy(internalaadpodid.AzureIdentityPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "tenants"},
+		Spec:       internalaadpodid.AzureIdentityPolicySpec{AllowedTenantIDs: []string{"tenant1"}},
+	})
+	namespaceClient := NewTestNamespaceClient()
+	namespaceClient.AddNamespace("payments", map[string]string{"team": "payments"})
+	namespaceClient.AddNamespace("default", nil)
+
+	newIdentity := func(name, namespace string, spec internalaadpodid.AzureIdentitySpec) internalaadpodid.AzureIdentity {
+		return internalaadpodid.AzureIdentity{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Generation: 1}, Spec: spec}
+	}
+	listIDs := []internalaadpodid.AzureIdentity{
+		newIdentity("allowed", "payments", internalaadpodid.AzureIdentitySpec{
+			ResourceID: "/subscriptions/sub1/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1",
+		}),
+		newIdentity("other-subscription", "payments", internalaadpodid.AzureIdentitySpec{
+			ResourceID: "/subscriptions/sub2/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1",
+		}),
+		newIdentity("service-principal", "payments", internalaadpodid.AzureIdentitySpec{
+			Type:     internalaadpodid.ServicePrincipal,
+			TenantID: "tenant1",
+		}),
+		// the policy which restricts the subscription doesn't apply to the default namespace
+		newIdentity("other-namespace", "default", internalaadpodid.AzureIdentitySpec{
+			ResourceID: "/subscriptions/sub2/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1",
+		}),
+		newIdentity("other-tenant", "default", internalaadpodid.AzureIdentitySpec{
+			Type:     internalaadpodid.ServicePrincipal,
+			TenantID: "tenant2",
+		}),
+		// identities whose namespace can't be looked up are ignored
+		newIdentity("unknown-namespace", "unknown", internalaadpodid.AzureIdentitySpec{
+			ResourceID: "/subscriptions/sub1/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1",
+		}),
+	}
+
+	micClient := NewMICTestClient(nil, NewTestCloudClient(config.AzureConfig{}), crdClient, NewTestPodClient(), NewTestNodeClient(), nil, false, 4, nil)
+	micClient.NamespaceClient = namespaceClient
+	idMap, err := micClient.convertIDListToMap(listIDs)
+	assert.NoError(t, err)
+	var keys []string
+	for key := range idMap {
+		keys = append(keys, key)
+	}
+	assert.ElementsMatch(t, []string{"payments/allowed", "default/other-namespace"}, keys)
+
+	identities, _ := micClient.computeStatus(&listIDs, nil, idMap, nil, nil)
+	conditions := make(map[string]*metav1.Condition)
+	for _, id := range identities {
+		conditions[getIDKey(id.Namespace, id.Name)] = meta.FindStatusCondition(id.Status.Conditions, internalaadpodid.IdentityConditionPolicyViolated)
+	}
+	assert.Nil(t, conditions["payments/allowed"])
+	assert.Nil(t, conditions["default/other-namespace"])
+	for _, key := range []string{"payments/other-subscription", "payments/service-principal", "default/other-tenant", "unknown/unknown-namespace"} {
+		if assert.NotNil(t, conditions[key], key) {
+			assert.Equal(t, metav1.ConditionTrue, conditions[key].Status, key)
+			assert.Equal(t, policyViolatedReason, conditions[key].Reason, key)
+		}
+	}
+
+	// the condition is cleared once the identity complies with the policies
+	for _, id := range identities {
+		if id.Name == "other-subscription" {
+			listIDs[1].Status = id.Status
+		}
+	}
+	listIDs[1].Spec.ResourceID = "/subscriptions/sub1/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id2"
+	identities, _ = micClient.computeStatus(&listIDs, nil, idMap, nil, nil)
+	conditions = make(map[string]*metav1.Condition)
+	for _, id := range identities {
+		conditions[getIDKey(id.Namespace, id.Name)] = meta.FindStatusCondition(id.Status.Conditions, internalaadpodid.IdentityConditionPolicyViolated)
+	}
+	if assert.NotNil(t, conditions["payments/other-subscription"]) {
+		assert.Equal(t, metav1.ConditionFalse, conditions["payments/other-subscription"].Status)
+	}
+}
+
+func TestPolicyChangeEnqueuesNodes(t *testing.T) {
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, cloudClient, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+	namespaceClient := NewTestNamespaceClient()
+	namespaceClient.AddNamespace("default", nil)
+	micClient.NamespaceClient = namespaceClient
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	newInformer := func(obj runtime.Object) (*fcache.FakeControllerSource, cache.SharedInformer) {
+		source := fcache.NewFakeControllerSource()
+		return source, cache.NewSharedInformer(source, obj, 0)
+	}
+	_, podInformer := newInformer(&corev1.Pod{})
+	_, nodeInformer := newInformer(&corev1.Node{})
+	_, bindingInformer := newInformer(&aadpodid.AzureIdentityBinding{})
+	_, idInformer := newInformer(&aadpodid.AzureIdentity{})
+	policySource, policyInformer := newInformer(&aadpodid.AzureIdentityPolicy{})
+	micClient.addEventHandlers(podInformer, nodeInformer, bindingInformer, idInformer, policyInformer)
+	exit := make(chan struct{})
+	defer close(exit)
+	go policyInformer.Run(exit)
+	if !cache.WaitForCacheSync(exit, policyInformer.HasSynced) {
+		t.Fatal("failed to sync policy informer")
+	}
+	defer micClient.queue.ShutDown()
+
+	micClient.enqueueNode("test-node1")
+	if !micClient.processNextBatch(nil) {
+		t.Fatal("expected work queue not to be shut down")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{testResourceID}) {
+		t.Fatalf("missing identity: %+v", cloudClient.ListMSI()["test-node1"])
+	}
+
+	// a policy which disallows the subscription of the identity removes it without waiting for the next sync
+	policy := aadpodid.AzureIdentityPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "other-subscription"},
+		Spec:       aadpodid.AzureIdentityPolicySpec{AllowedResourceIDPrefixes: []string{"/subscriptions/other"}},
+	}
+	crdClient.CreatePolicy(aadpodid.ConvertV1IdentityPolicyToInternalIdentityPolicy(policy))
+	policySource.Add(&policy)
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return micClient.queue.Len() > 0, nil
+	}); err != nil {
+		t.Fatal("expected nodes to be enqueued when the policy is added")
+	}
+	if !micClient.processNextBatch(nil) {
+		t.Fatal("expected work queue not to be shut down")
+	}
+	if !crdClient.waitForAssignedIDs(0) {
+		t.Fatalf("expected len of assigned identities to be 0")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{}) {
+		t.Fatalf("expected identity to be removed from test-node1, got: %+v", cloudClient.ListMSI()["test-node1"])
+	}
+}
+
+func TestGetAzureErrorCode(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{
+			err:      errors.New(`failed to update identities for test-vmss in rg, error: compute.VirtualMachineScaleSetsClient#Update: Failure sending request: StatusCode=400 -- Original Error: Code="FailedIdentityOperation" Message="Identity operation for resource failed."`),
+			expected: "FailedIdentityOperation",
+		},
+		{
+			err:      errors.New("failed to get vm"),
+			expected: "AzureError",
+		},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.expected, getAzureErrorCode(tc.err))
+	}
+}
+
+func TestGetNodesForKeys(t *testing.T) {
+	nodeClient := NewTestNodeClient()
+	micClient := NewMICTestClient(nil, NewTestCloudClient(config.AzureConfig{}), NewTestCrdClient(nil), NewTestPodClient(), nodeClient, &TestEventRecorder{}, false, 4, nil)
+
+	nodeClient.AddNode("test-node1")
+	for i, vmss := range []string{"testvmss1", "testvmss1", "testvmss2"} {
+		vmss, i := vmss, i
+		nodeClient.AddNode(fmt.Sprintf("test-vmss-node%d", i), func(n *corev1.Node) {
+			n.Spec.ProviderID = fmt.Sprintf("azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/%d", vmss, i)
+		})
+	}
+	vmssKey := micClient.getNodeKey("test-vmss-node0")
+	if !isVMSSKey(vmssKey) {
+		t.Fatalf("expected key of test-vmss-node0 to be a VMSS ID, got: %s", vmssKey)
+	}
+
+	nodes, keyNodes, err := micClient.getNodesForKeys([]string{"test-node1", vmssKey, "deleted-node"})
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	expectedNodes := map[string]bool{"test-node1": true, "test-vmss-node0": true, "test-vmss-node1": true, "deleted-node": true}
+	if !reflect.DeepEqual(nodes, expectedNodes) {
+		t.Fatalf("expected nodes %v, got: %v", expectedNodes, nodes)
+	}
+	sort.Strings(keyNodes[vmssKey])
+	if !reflect.DeepEqual(keyNodes[vmssKey], []string{"test-vmss-node0", "test-vmss-node1"}) {
+		t.Fatalf("expected all nodes of testvmss1 to be synced, got: %v", keyNodes[vmssKey])
+	}
+}
+
+func TestSyncNodesPartial(t *testing.T) {
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, cloudClient, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	nodeClient.AddNode("test-node2")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+	podClient.AddPod("test-pod2", "default", "test-node2", "test-select1")
+
+	if errs := micClient.syncNodes(nil, []string{"test-node1", "test-node2"}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+	if !crdClient.waitForAssignedIDs(2) {
+		t.Fatalf("expected len of assigned identities to be 2")
+	}
+
+	// the AzureAssignedIdentity of test-pod2 is not deleted when only test-node1 is synced
+	podClient.DeletePod("test-pod1", "default")
+	if errs := micClient.syncNodes(nil, []string{"test-node1"}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+	if !crdClient.waitForAssignedIDs(1) {
+		t.Fatalf("expected len of assigned identities to be 1")
+	}
+	if !cloudClient.CompareMSI("test-node1", []string{}) {
+		t.Fatalf("expected identity to be removed from test-node1, got: %+v", cloudClient.ListMSI()["test-node1"])
+	}
+	if !cloudClient.CompareMSI("test-node2", []string{testResourceID}) {
+		t.Fatalf("missing identity: %+v", cloudClient.ListMSI()["test-node2"])
+	}
+}
+
+func TestProcessNextBatchRetry(t *testing.T) {
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, cloudClient, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	nodeClient.AddNode("test-node2")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+	podClient.AddPod("test-pod2", "default", "test-node2", "test-select1")
+
+	cloudClient.SetError(errors.New("error updating node"))
+	micClient.enqueueNode("test-node1")
+	micClient.enqueueNode("test-node2")
+	if !micClient.processNextBatch(nil) {
+		t.Fatal("expected work queue not to be shut down")
+	}
+
+	// only the node that failed is retried with backoff
+	requeues := micClient.queue.NumRequeues("test-node1") + micClient.queue.NumRequeues("test-node2")
+	if requeues != 1 {
+		t.Fatalf("expected 1 node to be retried, got: %d", requeues)
+	}
+	micClient.queue.ShutDown()
+}
+
+// throttledCloudClient is a cloud client whose ARM requests are blocked by throttling of the
+// subscriptions of the nodes and VMSS in retryAfter
+type throttledCloudClient struct {
+	*TestCloudClient
+	retryAfter map[string]time.Time
+}
+
+func (c *throttledCloudClient) RetryAfter(name string) time.Time {
+	return c.retryAfter[name]
+}
+
+func TestProcessNextBatchThrottled(t *testing.T) {
+	cloudClient := &throttledCloudClient{
+		TestCloudClient: NewTestCloudClient(config.AzureConfig{}),
+		retryAfter:      map[string]time.Time{"test-node1": time.Now().Add(time.Hour)},
+	}
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, cloudClient.TestCloudClient, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+	micClient.CloudClient = cloudClient
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	nodeClient.AddNode("test-node2")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+	podClient.AddPod("test-pod2", "default", "test-node2", "test-select1")
+
+	cloudClient.SetError(errors.New("throttled"))
+	micClient.enqueueNode("test-node1")
+	micClient.enqueueNode("test-node2")
+	if !micClient.processNextBatch(nil) {
+		t.Fatal("expected work queue not to be shut down")
+	}
+
+	// the node is retried once ARM stops throttling its subscription rather than with backoff
+	if requeues := micClient.queue.NumRequeues("test-node1"); requeues != 0 {
+		t.Fatalf("expected the node not to be retried with backoff, got %d requeues", requeues)
+	}
+	// the subscription of the other node is not throttled
+	if requeues := micClient.queue.NumRequeues("test-node2"); requeues != 1 {
+		t.Fatalf("expected the node of the subscription which is not throttled to be retried with backoff, got %d requeues", requeues)
+	}
+	if micClient.queue.Len() != 0 {
+		t.Fatalf("expected the nodes not to be retried before ARM stops throttling or the backoff elapses")
+	}
+	micClient.queue.ShutDown()
+}
+
+// cancelAwareCloudClient is a cloud client which records whether the context of an update is canceled
+type cancelAwareCloudClient struct {
+	*TestCloudClient
+	canceled int32
+}
+
+func (c *cancelAwareCloudClient) UpdateUserMSI(ctx context.Context, addUserAssignedMSIIDs, removeUserAssignedMSIIDs []string, name string, isvmss bool) error {
+	select {
+	case <-ctx.Done():
+		atomic.AddInt32(&c.canceled, 1)
+	case <-time.After(wait.ForeverTestTimeout):
+	}
+	return c.TestCloudClient.UpdateUserMSI(ctx, addUserAssignedMSIIDs, removeUserAssignedMSIIDs, name, isvmss)
+}
+
+func TestSyncNodesCanceledOnExit(t *testing.T) {
+	cloudClient := &cancelAwareCloudClient{TestCloudClient: NewTestCloudClient(config.AzureConfig{})}
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, cloudClient.TestCloudClient, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+	micClient.CloudClient = cloudClient
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	// the updates on Azure are no longer retried once MIC stops syncing
+	exit := make(chan struct{})
+	close(exit)
+	micClient.syncNodes(exit, []string{"test-node1"})
+	if canceled := atomic.LoadInt32(&cloudClient.canceled); canceled != 1 {
+		t.Fatalf("expected the context of 1 update to be canceled, got: %d", canceled)
+	}
+}
+
+func TestSyncNodesDryRun(t *testing.T) {
+	cloudClient := NewTestCloudClient(config.AzureConfig{})
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, cloudClient, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+	micClient.dryRun = true
+	micClient.plan = newDryRunPlan()
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	if errs := micClient.syncNodes(nil, []string{"test-node1"}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+
+	assignedIDs, err := crdClient.ListAssignedIDs()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	if len(*assignedIDs) != 0 {
+		t.Fatalf("expected no AzureAssignedIdentities to be created in dry-run mode, got: %d", len(*assignedIDs))
+	}
+	if ids := cloudClient.ListMSI()["test-node1"]; ids != nil {
+		t.Fatalf("expected test-node1 not to be updated in dry-run mode, got: %+v", *ids)
+	}
+
+	expected := []NodePlan{{
+		Name:                     "test-node1",
+		ResourceID:               "/subscriptions/testSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/test-node1",
+		AssignIdentities:         []string{testResourceID},
+		CreateAssignedIdentities: []string{"default/test-pod1-default-test-id1"},
+	}}
+	if plan := micClient.GetPlan(); !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("expected plan %+v, got: %+v", expected, plan)
+	}
+
+	recorder := httptest.NewRecorder()
+	micClient.PlanHandler(recorder, httptest.NewRequest(http.MethodGet, "/plan", nil))
+	var served []NodePlan
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil {
+		t.Fatalf("failed to unmarshal plan, error: %+v", err)
+	}
+	if !reflect.DeepEqual(served, expected) {
+		t.Fatalf("expected served plan %+v, got: %+v", expected, served)
+	}
+
+	// the plan of the node is cleared once there is nothing left to change
+	podClient.DeletePod("test-pod1", "default")
+	if errs := micClient.syncNodes(nil, []string{"test-node1"}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+	if plan := micClient.GetPlan(); len(plan) != 0 {
+		t.Fatalf("expected empty plan, got: %+v", plan)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	vmssNode := func(name string, i int) corev1.Node {
+		return corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.NodeSpec{
+				ProviderID: fmt.Sprintf("azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachineScaleSets/testvmss1/virtualMachines/%d", i),
+			},
+		}
+	}
+	id := internalaadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-id1", Namespace: "default"},
+		Spec: internalaadpodid.AzureIdentitySpec{
+			Type:       internalaadpodid.UserAssignedMSI,
+			ResourceID: testResourceID,
+			ClientID:   "test-user-msi-clientid",
+		},
+	}
+	binding := internalaadpodid.AzureIdentityBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "testbinding1", Namespace: "default"},
+		Spec: internalaadpodid.AzureIdentityBindingSpec{
+			AzureIdentity: "test-id1",
+			Selector:      "test-select1",
+		},
+	}
+	input := SimulationInput{
+		Pods: []corev1.Pod{{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod1", Namespace: "default", Labels: map[string]string{internalaadpodid.CRDLabelKey: "test-select1"}},
+			Spec:       corev1.PodSpec{NodeName: "test-node1"},
+		}},
+		Nodes:                 []corev1.Node{vmssNode("test-node1", 0), vmssNode("test-node2", 1)},
+		AzureIdentities:       []internalaadpodid.AzureIdentity{id},
+		AzureIdentityBindings: []internalaadpodid.AzureIdentityBinding{binding},
+		// the node of the pod no longer exists
+		AzureAssignedIdentities: []internalaadpodid.AzureAssignedIdentity{{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod2-default-test-id1", Namespace: "default"},
+			Spec: internalaadpodid.AzureAssignedIdentitySpec{
+				AzureIdentityRef: &id,
+				AzureBindingRef:  &binding,
+				Pod:              "test-pod2",
+				PodNamespace:     "default",
+				NodeName:         "deleted-node",
+			},
+			Status: internalaadpodid.AzureAssignedIdentityStatus{Status: internalaadpodid.AssignedIDAssigned},
+		}},
+	}
+
+	plan, err := Simulate(input)
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	expected := []NodePlan{
+		{
+			Name:                     "deleted-node",
+			DeleteAssignedIdentities: []string{"default/test-pod2-default-test-id1"},
+			RemoveIdentities:         []string{testResourceID},
+		},
+		{
+			Name:                     "testvmss1",
+			IsVMSS:                   true,
+			ResourceID:               "/subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachineScaleSets/testvmss1",
+			AssignIdentities:         []string{testResourceID},
+			CreateAssignedIdentities: []string{"default/test-pod1-default-test-id1"},
+		},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("expected plan %+v, got: %+v", expected, plan)
+	}
+}
+
+func TestSyncNodesWithFakeARM(t *testing.T) {
+	stats.Init()
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	server.AddVM("fakeGroup", "test-node1")
+	server.SetPollingAttempts(2)
+
+	cfg := server.AzureConfig("fakeGroup")
+	spt, err := fakearm.NewServicePrincipalToken()
+	if err != nil {
+		t.Fatalf("failed to create service principal token, error: %+v", err)
+	}
+	vmClient, err := cp.NewVirtualMachinesClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VM client, error: %+v", err)
+	}
+	vmssClient, err := cp.NewVMSSClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VMSS client, error: %+v", err)
+	}
+
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, nil, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+	micClient.CloudClient = &cp.Client{
+		VMClient:    vmClient,
+		VMSSClient:  vmssClient,
+		RetryClient: retry.NewRetryClient(0, 0),
+		Config:      cfg,
+	}
+
+	unauthorizedResourceID := "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/identity2"
+	server.SetUnauthorizedIdentities(unauthorizedResourceID)
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+
+	if errs := micClient.syncNodes(nil, []string{"test-node1"}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+	if !crdClient.waitForAssignedIDs(1) {
+		t.Fatalf("expected len of assigned identities to be 1")
+	}
+	assert.Equal(t, []string{strings.ToLower(testResourceID)}, server.VMIdentities("fakeGroup", "test-node1"))
+
+	// the identity which MIC isn't authorized to assign is reported in the status of the AzureIdentity
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, unauthorizedResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select2", "")
+	podClient.AddPod("test-pod2", "default", "test-node1", "test-select2")
+
+	if errs := micClient.syncNodes(nil, []string{"test-node1"}); len(errs) != 1 {
+		t.Fatalf("expected test-node1 to fail, got: %v", errs)
+	}
+	assert.Equal(t, []string{strings.ToLower(testResourceID)}, server.VMIdentities("fakeGroup", "test-node1"))
+	crdClient.mu.Lock()
+	failed := meta.FindStatusCondition(crdClient.idMap[getIDKey("default", "test-id2")].Status.Conditions, internalaadpodid.IdentityConditionAssignmentFailed)
+	crdClient.mu.Unlock()
+	if assert.NotNil(t, failed) {
+		assert.Equal(t, metav1.ConditionTrue, failed.Status)
+		assert.Equal(t, "LinkedAuthorizationFailed", failed.Reason)
+	}
+}
+
+func TestSyncNodesOverflowWithFakeARM(t *testing.T) {
+	stats.Init()
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+
+	// the node has room for a single identity
+	var existingIDs []string
+	for i := 0; i < fakearm.MaxUserAssignedIdentities-1; i++ {
+		existingIDs = append(existingIDs, fmt.Sprintf("/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/existing%03d", i))
+	}
+	server.AddVM("fakeGroup", "test-node1", existingIDs...)
+
+	cfg := server.AzureConfig("fakeGroup")
+	spt, err := fakearm.NewServicePrincipalToken()
+	if err != nil {
+		t.Fatalf("failed to create service principal token, error: %+v", err)
+	}
+	vmClient, err := cp.NewVirtualMachinesClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VM client, error: %+v", err)
+	}
+	vmssClient, err := cp.NewVMSSClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VMSS client, error: %+v", err)
+	}
+
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, nil, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+	micClient.CloudClient = &cp.Client{
+		VMClient:    vmClient,
+		VMSSClient:  vmssClient,
+		RetryClient: retry.NewRetryClient(0, 0),
+		Config:      cfg,
+	}
+
+	popularResourceID := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/popular"
+	rareResourceID := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/rare"
+	crdClient.CreateID("test-popular", "default", aadpodid.UserAssignedMSI, popularResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding-popular", "default", "test-popular", "test-select-popular", "")
+	crdClient.CreateID("test-rare", "default", aadpodid.UserAssignedMSI, rareResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding-rare", "default", "test-rare", "test-select-rare", "")
+	nodeClient.AddNode("test-node1")
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select-popular")
+	podClient.AddPod("test-pod2", "default", "test-node1", "test-select-popular")
+	podClient.AddPod("test-pod3", "default", "test-node1", "test-select-rare")
+
+	// the identity used by most pods is assigned and the other one overflows
+	if errs := micClient.syncNodes(nil, []string{"test-node1"}); len(errs) != 1 {
+		t.Fatalf("expected test-node1 to fail, got: %v", errs)
+	}
+	if !crdClient.waitForAssignedIDs(3) {
+		t.Fatalf("expected len of assigned identities to be 3")
+	}
+	assert.Len(t, server.VMIdentities("fakeGroup", "test-node1"), fakearm.MaxUserAssignedIdentities)
+	assert.Contains(t, server.VMIdentities("fakeGroup", "test-node1"), popularResourceID)
+
+	getStatus := func(pod string) string {
+		crdClient.mu.Lock()
+		defer crdClient.mu.Unlock()
+		for _, assignedID := range crdClient.assignedIDMap {
+			if assignedID.Spec.Pod == pod {
+				return assignedID.Status.Status
+			}
+		}
+		return ""
+	}
+	assert.Equal(t, internalaadpodid.AssignedIDAssigned, getStatus("test-pod1"))
+	assert.Equal(t, internalaadpodid.AssignedIDAssigned, getStatus("test-pod2"))
+	assert.Equal(t, internalaadpodid.AssignedIDOverflowed, getStatus("test-pod3"))
+
+	crdClient.mu.Lock()
+	failed := meta.FindStatusCondition(crdClient.idMap[getIDKey("default", "test-rare")].Status.Conditions, internalaadpodid.IdentityConditionAssignmentFailed)
+	crdClient.mu.Unlock()
+	if assert.NotNil(t, failed) {
+		assert.Equal(t, metav1.ConditionTrue, failed.Status)
+		assert.Equal(t, identityLimitReachedReason, failed.Reason)
+	}
+
+	// the overflowed identity is assigned once the node has capacity again
+	server.AddVM("fakeGroup", "test-node1", append(existingIDs[1:], popularResourceID)...)
+	if errs := micClient.syncNodes(nil, []string{"test-node1"}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+	assert.Contains(t, server.VMIdentities("fakeGroup", "test-node1"), rareResourceID)
+	assert.Equal(t, internalaadpodid.AssignedIDAssigned, getStatus("test-pod3"))
+}
+
+func TestSyncNodesInOtherResourceGroupsWithFakeARM(t *testing.T) {
+	stats.Init()
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	// the node pools are in other resource groups than the configured one
+	server.AddVM("vmGroup", "test-node1")
+	server.AddVMSS("vmssGroup", "test-vmss")
+
+	cfg := server.AzureConfig("fakeGroup")
+	spt, err := fakearm.NewServicePrincipalToken()
+	if err != nil {
+		t.Fatalf("failed to create service principal token, error: %+v", err)
+	}
+	vmClient, err := cp.NewVirtualMachinesClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VM client, error: %+v", err)
+	}
+	vmssClient, err := cp.NewVMSSClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VMSS client, error: %+v", err)
+	}
+
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, nil, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+	micClient.CloudClient = &cp.Client{
+		VMClient:    vmClient,
+		VMSSClient:  vmssClient,
+		RetryClient: retry.NewRetryClient(0, 0),
+		Config:      cfg,
+	}
+
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	nodeClient.AddNode("test-node1", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/fakeSub/resourceGroups/vmGroup/providers/Microsoft.Compute/virtualMachines/test-node1"
+	})
+	nodeClient.AddNode("test-vmss000000", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/fakeSub/resourceGroups/vmssGroup/providers/Microsoft.Compute/virtualMachineScaleSets/test-vmss/virtualMachines/0"
+	})
+	podClient.AddPod("test-pod1", "default", "test-node1", "test-select1")
+	podClient.AddPod("test-pod2", "default", "test-vmss000000", "test-select1")
+
+	if errs := micClient.syncNodes(nil, []string{"test-node1", "test-vmss000000"}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+	if !crdClient.waitForAssignedIDs(2) {
+		t.Fatalf("expected len of assigned identities to be 2")
+	}
+	assert.Equal(t, []string{strings.ToLower(testResourceID)}, server.VMIdentities("vmGroup", "test-node1"))
+	assert.Equal(t, []string{strings.ToLower(testResourceID)}, server.VMSSIdentities("vmssGroup", "test-vmss"))
+
+	// the identities removed on Azure are reassigned in the same resource groups
+	server.AddVM("vmGroup", "test-node1")
+	server.AddVMSS("vmssGroup", "test-vmss")
+	micClient.reconcileIdentityAssignment(context.Background())
+	assert.Equal(t, []string{strings.ToLower(testResourceID)}, server.VMIdentities("vmGroup", "test-node1"))
+	assert.Equal(t, []string{strings.ToLower(testResourceID)}, server.VMSSIdentities("vmssGroup", "test-vmss"))
+}
+
+func TestIsVMSS(t *testing.T) {
+	cases := []struct {
+		desc               string
+		providerID         string
+		expectedVMSSID     string
+		expectedIsVMSS     bool
+		expectedResourceID string
+	}{
+		{
+			desc:               "vm",
+			providerID:         "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-0",
+			expectedResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-0",
+		},
+		{
+			desc:               "instance of uniform vmss",
+			providerID:         "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/3",
+			expectedVMSSID:     "sub/rg/vmss",
+			expectedIsVMSS:     true,
+			expectedResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss",
+		},
+		{
+			desc:               "vm of flexible vmss",
+			providerID:         "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/flex_4d3c2b1a",
+			expectedResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/flex_4d3c2b1a",
+		},
+		{
+			// only the shape of the provider ID decides whether the node is a VMSS instance
+			desc:               "instance of vmss with non-numeric instance id",
+			providerID:         "azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/vmss_4d3c2b1a",
+			expectedVMSSID:     "sub/rg/vmss",
+			expectedIsVMSS:     true,
+			expectedResourceID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss",
+		},
+		{
+			desc: "no provider id",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			node := &corev1.Node{Spec: corev1.NodeSpec{ProviderID: tc.providerID}}
+			vmssID, isvmss, err := isVMSS(node)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedVMSSID, vmssID)
+			assert.Equal(t, tc.expectedIsVMSS, isvmss)
+
+			resourceID, err := getResourceID(node)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedResourceID, resourceID)
+		})
+	}
+}
+
+func TestConsolidateVMSSNodesMixed(t *testing.T) {
+	nodeClient := NewTestNodeClient()
+	micClient := NewMICTestClient(nil, NewTestCloudClient(config.AzureConfig{}), NewTestCrdClient(nil), NewTestPodClient(), nodeClient, &TestEventRecorder{}, false, 4, nil)
+	for i := 0; i < 2; i++ {
+		i := i
+		nodeClient.AddNode(fmt.Sprintf("uniform00000%d", i), func(n *corev1.Node) {
+			n.Spec.ProviderID = fmt.Sprintf("azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/uniform/virtualMachines/%d", i)
+		})
+		nodeClient.AddNode(fmt.Sprintf("flex00000%d", i), func(n *corev1.Node) {
+			n.Spec.ProviderID = fmt.Sprintf("azure:///subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/flex_%d", i)
+		})
+	}
+
+	nodeMap := map[string]trackUserAssignedMSIIds{
+		"uniform000000": {addUserAssignedMSIIDs: []string{"id1"}},
+		"uniform000001": {addUserAssignedMSIIDs: []string{"id2"}},
+		"flex000000":    {addUserAssignedMSIIDs: []string{"id1"}},
+		"flex000001":    {removeUserAssignedMSIIDs: []string{"id2"}},
+	}
+	var wg sync.WaitGroup
+	micClient.consolidateVMSSNodes(nodeMap, &wg)
+	wg.Wait()
+
+	// the nodes of the uniform scale set are consolidated, the VMs of the flexible scale set are not
+	var keys []string
+	for key := range nodeMap {
+		keys = append(keys, key)
+	}
+	assert.ElementsMatch(t, []string{"uniform", "flex000000", "flex000001"}, keys)
+
+	uniform := nodeMap["uniform"]
+	assert.True(t, uniform.isvmss)
+	assert.Equal(t, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/uniform", uniform.resourceID)
+	assert.ElementsMatch(t, []string{"id1", "id2"}, uniform.addUserAssignedMSIIDs)
+
+	for i, name := range []string{"flex000000", "flex000001"} {
+		flex := nodeMap[name]
+		assert.False(t, flex.isvmss, name)
+		assert.Equal(t, fmt.Sprintf("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/flex_%d", i), flex.resourceID, name)
+	}
+	assert.Equal(t, []string{"id1"}, nodeMap["flex000000"].addUserAssignedMSIIDs)
+	assert.Equal(t, []string{"id2"}, nodeMap["flex000001"].removeUserAssignedMSIIDs)
+}
+
+func TestSyncNodesFlexibleVMSSWithFakeARM(t *testing.T) {
+	stats.Init()
+	server := fakearm.NewServer("fakeSub")
+	defer server.Close()
+	server.AddVMSS("fakeGroup", "uniform")
+	server.AddVMSS("fakeGroup", "flex")
+	server.AddVM("fakeGroup", "flex_4d3c2b1a")
+	server.AddVM("fakeGroup", "flex_9f8e7d6c")
+
+	cfg := server.AzureConfig("fakeGroup")
+	spt, err := fakearm.NewServicePrincipalToken()
+	if err != nil {
+		t.Fatalf("failed to create service principal token, error: %+v", err)
+	}
+	vmClient, err := cp.NewVirtualMachinesClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VM client, error: %+v", err)
+	}
+	vmssClient, err := cp.NewVMSSClient(cfg, spt)
+	if err != nil {
+		t.Fatalf("failed to create VMSS client, error: %+v", err)
+	}
+
+	crdClient := NewTestCrdClient(nil)
+	podClient := NewTestPodClient()
+	nodeClient := NewTestNodeClient()
+	evtRecorder := &TestEventRecorder{lastEvent: new(LastEvent), eventChannel: make(chan bool, 100)}
+	micClient := NewMICTestClient(nil, nil, crdClient, podClient, nodeClient, evtRecorder, false, 4, nil)
+	micClient.CloudClient = &cp.Client{
+		VMClient:    vmClient,
+		VMSSClient:  vmssClient,
+		RetryClient: retry.NewRetryClient(0, 0),
+		Config:      cfg,
+	}
+
+	flexResourceID := "/subscriptions/fakesub/resourcegroups/fakegroup/providers/microsoft.managedidentity/userassignedidentities/flex"
+	crdClient.CreateID("test-id1", "default", aadpodid.UserAssignedMSI, testResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding1", "default", "test-id1", "test-select1", "")
+	crdClient.CreateID("test-id2", "default", aadpodid.UserAssignedMSI, flexResourceID, "test-user-msi-clientid", nil, "", "", "", "")
+	crdClient.CreateBinding("testbinding2", "default", "test-id2", "test-select2", "")
+	nodeClient.AddNode("uniform000000", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachineScaleSets/uniform/virtualMachines/0"
+	})
+	nodeClient.AddNode("uniform000001", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachineScaleSets/uniform/virtualMachines/1"
+	})
+	// the VMs of a flexible scale set are named differently than their nodes
+	nodeClient.AddNode("flex000000", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/flex_4d3c2b1a"
+	})
+	nodeClient.AddNode("flex000001", func(n *corev1.Node) {
+		n.Spec.ProviderID = "azure:///subscriptions/fakeSub/resourceGroups/fakeGroup/providers/Microsoft.Compute/virtualMachines/flex_9f8e7d6c"
+	})
+	podClient.AddPod("test-pod1", "default", "uniform000000", "test-select1")
+	podClient.AddPod("test-pod2", "default", "uniform000001", "test-select1")
+	podClient.AddPod("test-pod3", "default", "flex000000", "test-select1")
+	podClient.AddPod("test-pod4", "default", "flex000001", "test-select2")
+
+	nodes := []string{"uniform000000", "uniform000001", "flex000000", "flex000001"}
+	if errs := micClient.syncNodes(nil, nodes); len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+	if !crdClient.waitForAssignedIDs(4) {
+		t.Fatalf("expected len of assigned identities to be 4")
+	}
+	assert.Equal(t, []string{strings.ToLower(testResourceID)}, server.VMSSIdentities("fakeGroup", "uniform"))
+	assert.Equal(t, []string{strings.ToLower(testResourceID)}, server.VMIdentities("fakeGroup", "flex_4d3c2b1a"))
+	assert.Equal(t, []string{flexResourceID}, server.VMIdentities("fakeGroup", "flex_9f8e7d6c"))
+	// identities are not assigned to a flexible scale set
+	assert.Empty(t, server.VMSSIdentities("fakeGroup", "flex"))
+	// the uniform scale set is updated once for both of its nodes
+	assert.Equal(t, 3, server.RequestCount(http.MethodPatch))
+}
+
+func TestPrioritizeIDs(t *testing.T) {
+	nodeClient := NewTestNodeClient()
+	nodeClient.AddNode("test-node1")
+	nodeClient.AddNode("test-node2")
+	micClient := NewMICTestClient(nil, nil, nil, nil, nodeClient, nil, false, 4, nil)
+
+	newAssignedID := func(pod, node, resourceID string) internalaadpodid.AzureAssignedIdentity {
+		return internalaadpodid.AzureAssignedIdentity{
+			Spec: internalaadpodid.AzureAssignedIdentitySpec{
+				AzureIdentityRef: &internalaadpodid.AzureIdentity{
+					Spec: internalaadpodid.AzureIdentitySpec{Type: internalaadpodid.UserAssignedMSI, ResourceID: resourceID},
+				},
+				Pod:      pod,
+				NodeName: node,
+			},
+		}
+	}
+	newAssignedIDs := map[string]internalaadpodid.AzureAssignedIdentity{
+		"a1": newAssignedID("pod1", "test-node1", "id-a"),
+		"b1": newAssignedID("pod2", "test-node1", "id-b"),
+		"b2": newAssignedID("pod3", "test-node1", "ID-B"),
+		// pods on other nodes don't count
+		"c1": newAssignedID("pod4", "test-node2", "id-c"),
+		"c2": newAssignedID("pod5", "test-node2", "id-c"),
+		"c3": newAssignedID("pod6", "test-node2", "id-c"),
+	}
+
+	ids := micClient.prioritizeIDs([]string{"id-c", "id-a", "id-b", "id-a"}, "test-node1", newAssignedIDs)
+	assert.Equal(t, []string{"id-b", "id-a", "id-c"}, ids)
+}
@@ -0,0 +1,49 @@
+package mic
+
+import (
+	"reflect"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+
+	corev1 "k8s.io/api/core/v1"
+	informerv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// NamespaceClient handles fetching namespace details from kubernetes
+type NamespaceClient struct {
+	informer informerv1.NamespaceInformer
+}
+
+// NewNamespaceClient returns a namespace client which sends an event to eventCh
+// when the labels of a namespace change, as they are used to select the namespaces
+// allowed to bind to an AzureIdentity and the namespaces AzureIdentityPolicies apply to.
+func NewNamespaceClient(informer informerv1.NamespaceInformer, eventCh chan aadpodid.EventType) *NamespaceClient {
+	informer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldNamespace, newNamespace := oldObj.(*corev1.Namespace), newObj.(*corev1.Namespace)
+				if !reflect.DeepEqual(oldNamespace.Labels, newNamespace.Labels) {
+					klog.V(6).Infof("namespace %s labels updated", newNamespace.Name)
+					eventCh <- aadpodid.NamespaceUpdated
+				}
+			},
+		},
+	)
+	return &NamespaceClient{informer: informer}
+}
+
+// Get gets the specified kubernetes namespace.
+//
+// Note that this is using a local, eventually consistent cache which may not
+// be up to date with the actual state of the cluster.
+func (c *NamespaceClient) Get(name string) (*corev1.Namespace, error) {
+	return c.informer.Lister().Get(name)
+}
+
+// Start starts syncing the underlying cache with kubernetes.
+func (c *NamespaceClient) Start(exit <-chan struct{}) {
+	go c.informer.Informer().Run(exit)
+	cache.WaitForCacheSync(exit, c.informer.Informer().HasSynced)
+}
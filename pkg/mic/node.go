@@ -2,6 +2,7 @@ package mic
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	informerv1 "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
@@ -19,6 +20,11 @@ func (c *NodeClient) Get(name string) (*corev1.Node, error) {
 	return c.informer.Lister().Get(name)
 }
 
+// List lists all kubernetes nodes from the local cache.
+func (c *NodeClient) List() ([]*corev1.Node, error) {
+	return c.informer.Lister().List(labels.Everything())
+}
+
 // Start starts syncing the underlying cache with kubernetes.
 //
 // The passed in channel should be used to signal that the client should stop
@@ -0,0 +1,97 @@
+package mic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// identityLimitReachedReason is the reason of the AssignmentFailed condition and the event
+	// of identities which could not be assigned because a node or VMSS reached the identity limit
+	identityLimitReachedReason = "IdentityLimitReached"
+)
+
+// prioritizeIDs returns the unique identities of idList ordered by the number of pods on the node or VMSS
+// which use them, so that the identities used by the most pods are assigned first if the node or VMSS
+// reaches the limit of user-assigned identities.
+func (c *Client) prioritizeIDs(idList []string, nodeOrVMSSName string, newAssignedIDs map[string]aadpodid.AzureAssignedIdentity) []string {
+	ids := c.getUniqueIDs(idList)
+	if len(ids) < 2 {
+		return ids
+	}
+
+	inGroup := make(map[string]bool)
+	usage := make(map[string]int)
+	for _, assignedID := range newAssignedIDs {
+		id := assignedID.Spec.AzureIdentityRef
+		if id == nil || !c.checkIfUserAssignedMSI(*id) {
+			continue
+		}
+		nodeName := assignedID.Spec.NodeName
+		if _, ok := inGroup[nodeName]; !ok {
+			inGroup[nodeName] = c.getNodeOrVMSSName(nodeName) == nodeOrVMSSName
+		}
+		if inGroup[nodeName] {
+			usage[strings.ToLower(id.Spec.ResourceID)]++
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		usageI, usageJ := usage[strings.ToLower(ids[i])], usage[strings.ToLower(ids[j])]
+		if usageI != usageJ {
+			return usageI > usageJ
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// getOverflowedIDs returns the lowercase resource IDs of the identities which were not assigned
+// because the node or VMSS reached the limit of user-assigned identities.
+func getOverflowedIDs(err error) map[string]bool {
+	overflowed := make(map[string]bool)
+	var overflowErr *cloudprovider.OverflowError
+	if errors.As(err, &overflowErr) {
+		for _, id := range overflowErr.Identities {
+			overflowed[strings.ToLower(id)] = true
+		}
+	}
+	return overflowed
+}
+
+// setOverflowed updates the status of an AzureAssignedIdentity whose identity was not assigned to the node
+// because the node or VMSS reached the limit of user-assigned identities. The identity is assigned in a later
+// sync cycle once the node or VMSS has capacity again.
+func (c *Client) setOverflowed(assignedID aadpodid.AzureAssignedIdentity, isvmss bool, err error) {
+	binding := assignedID.Spec.AzureBindingRef
+	message := fmt.Sprintf("failed to apply binding %s/%s node %s for pod %s/%s, error: %+v", binding.Namespace, binding.Name, assignedID.Spec.NodeName, assignedID.Spec.PodNamespace, assignedID.Spec.Pod, err)
+	c.EventRecorder.Event(binding, corev1.EventTypeWarning, identityLimitReachedReason, message)
+	klog.Warning(message)
+	c.recordResult(assignedID, err)
+
+	operation := metrics.UpdateVMOperationName
+	if isvmss {
+		operation = metrics.UpdateVMSSOperationName
+	}
+	if reportErr := c.Reporter.ReportAssignedIdentityOverflow(operation); reportErr != nil {
+		klog.Warningf("failed to report metrics, error: %+v", reportErr)
+	}
+
+	if assignedID.Status.Status == aadpodid.AssignedIDOverflowed {
+		return
+	}
+	if updateErr := c.updateAssignedIdentityStatus(&assignedID, aadpodid.AssignedIDOverflowed); updateErr != nil {
+		message := fmt.Sprintf("failed to update AzureAssignedIdentity %s/%s status to %s for pod %s/%s, error: %+v", assignedID.Namespace, assignedID.Name, aadpodid.AssignedIDOverflowed, assignedID.Spec.PodNamespace, assignedID.Spec.Pod, updateErr)
+		c.EventRecorder.Event(&assignedID, corev1.EventTypeWarning, "status update error", message)
+		klog.Error(message)
+	}
+}
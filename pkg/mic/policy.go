@@ -0,0 +1,36 @@
+package mic
+
+import (
+	"fmt"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// policyViolatedReason is the reason of the PolicyViolated condition of identities which are
+	// ignored because they violate an AzureIdentityPolicy
+	policyViolatedReason = "PolicyViolated"
+)
+
+// getPolicyViolations returns the errors of the identities which violate an AzureIdentityPolicy that
+// applies to their namespace, by identity key. Identities whose namespace can't be looked up to check
+// the policies which select namespaces by their labels are considered in violation.
+func (c *Client) getPolicyViolations(identities []aadpodid.AzureIdentity) (map[string]error, error) {
+	policies, err := c.CRDClient.ListIdentityPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list AzureIdentityPolicies, error: %+v", err)
+	}
+
+	violations := make(map[string]error)
+	getNamespace := func(name string) (*corev1.Namespace, error) {
+		return c.NamespaceClient.Get(name)
+	}
+	for i, err := range aadpodid.GetPolicyViolations(policies, identities, getNamespace) {
+		if err != nil {
+			violations[getIDKey(identities[i].Namespace, identities[i].Name)] = err
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,371 @@
+package mic
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodv1 "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// nodeQueueBaseDelay is the delay before a node or VMSS is reconciled again after its first failure.
+	// The delay doubles with every consecutive failure up to nodeQueueMaxDelay.
+	nodeQueueBaseDelay = 5 * time.Second
+	nodeQueueMaxDelay  = 5 * time.Minute
+)
+
+// newNodeQueue returns the work queue of the nodes and VMSS to reconcile. Failed reconciles
+// are retried with an exponential backoff per node or VMSS.
+func newNodeQueue() workqueue.RateLimitingInterface {
+	return workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(nodeQueueBaseDelay, nodeQueueMaxDelay), "mic")
+}
+
+// isVMSSKey returns true if the work queue key is a VMSS ID (see makeVMSSID) rather than a node name,
+// which cannot contain a slash
+func isVMSSKey(key string) bool {
+	return strings.Contains(key, "/")
+}
+
+// getNodeKey returns the work queue key of a node. Identities are assigned to all the nodes
+// of a VMSS, so VMSS nodes are keyed by their VMSS ID.
+func (c *Client) getNodeKey(nodeName string) string {
+	node, err := c.NodeClient.Get(nodeName)
+	if err != nil {
+		return nodeName
+	}
+	if vmssID, isvmss, err := isVMSS(node); err == nil && isvmss {
+		return vmssID
+	}
+	return nodeName
+}
+
+// getNodeOrVMSSName returns the name the identities of a node are updated with on Azure,
+// which is the VMSS name for VMSS nodes and the node name otherwise.
+func (c *Client) getNodeOrVMSSName(nodeName string) string {
+	if key := c.getNodeKey(nodeName); isVMSSKey(key) {
+		return getVMSSName(key)
+	}
+	return nodeName
+}
+
+func (c *Client) enqueueNode(nodeName string) {
+	if nodeName == "" {
+		return
+	}
+	c.queue.Add(c.getNodeKey(nodeName))
+}
+
+// enqueueAllNodes enqueues all nodes in the cluster, the nodes of all pods and the
+// nodes of all AzureAssignedIdentities, which might no longer exist.
+func (c *Client) enqueueAllNodes() {
+	nodes, err := c.NodeClient.List()
+	if err != nil {
+		klog.Errorf("failed to list nodes, error: %+v", err)
+	}
+	for _, node := range nodes {
+		c.enqueueNode(node.Name)
+	}
+
+	pods, err := c.PodClient.ListPods()
+	if err != nil {
+		klog.Errorf("failed to list pods, error: %+v", err)
+	}
+	for _, pod := range pods {
+		c.enqueueNode(pod.Spec.NodeName)
+	}
+
+	assignedIDs, err := c.CRDClient.ListAssignedIDs()
+	if err != nil {
+		klog.Errorf("failed to list AzureAssignedIdentities, error: %+v", err)
+		return
+	}
+	for _, assignedID := range *assignedIDs {
+		c.enqueueNode(assignedID.Spec.NodeName)
+	}
+}
+
+// processNextBatch reconciles all the nodes and VMSS in the work queue in a single sync cycle,
+// waiting for the queue to be non-empty. It returns false once the queue is shut down.
+func (c *Client) processNextBatch(exit <-chan struct{}) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	keys := []string{item.(string)}
+	for c.queue.Len() > 0 {
+		item, shutdown = c.queue.Get()
+		if shutdown {
+			break
+		}
+		keys = append(keys, item.(string))
+	}
+	defer func() {
+		for _, key := range keys {
+			c.queue.Done(key)
+		}
+	}()
+
+	errs := c.syncNodes(exit, keys)
+	for _, key := range keys {
+		if err, ok := errs[key]; ok {
+			// retrying before ARM stops throttling the subscription of the key would only extend the throttling
+			var throttledErr *throttledError
+			if errors.As(err, &throttledErr) {
+				if delay := time.Until(throttledErr.retryAfter); delay > 0 {
+					klog.Errorf("failed to sync %s, retrying after ARM throttling ends in %s, error: %+v", key, delay.Round(time.Second), err)
+					c.queue.AddAfter(key, delay)
+					continue
+				}
+			}
+			klog.Errorf("failed to sync %s, retrying after %d failures, error: %+v", key, c.queue.NumRequeues(key)+1, err)
+			c.queue.AddRateLimited(key)
+			continue
+		}
+		c.queue.Forget(key)
+	}
+	return true
+}
+
+// getNodesForKeys returns the names of the nodes to reconcile for the work queue keys, and the
+// names of the nodes by key. All the nodes of a VMSS are reconciled together, as an identity
+// can only be removed from a VMSS if it's not in use by any of its nodes.
+func (c *Client) getNodesForKeys(keys []string) (map[string]bool, map[string][]string, error) {
+	nodes := make(map[string]bool)
+	keyNodes := make(map[string][]string)
+
+	vmssKeys := make(map[string]string)
+	for _, key := range keys {
+		if isVMSSKey(key) {
+			vmssKeys[key] = key
+			continue
+		}
+		// the node might have been added to the VMSS cache after it was enqueued
+		if nodeKey := c.getNodeKey(key); isVMSSKey(nodeKey) {
+			vmssKeys[nodeKey] = key
+			continue
+		}
+		nodes[key] = true
+		keyNodes[key] = []string{key}
+	}
+	if len(vmssKeys) == 0 {
+		return nodes, keyNodes, nil
+	}
+
+	allNodes, err := c.NodeClient.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, node := range allNodes {
+		vmssID, isvmss, err := isVMSS(node)
+		if err != nil || !isvmss {
+			continue
+		}
+		if key, ok := vmssKeys[vmssID]; ok {
+			nodes[node.Name] = true
+			keyNodes[key] = append(keyNodes[key], node.Name)
+		}
+	}
+	return nodes, keyNodes, nil
+}
+
+func failAll(keys []string, err error) map[string]error {
+	errs := make(map[string]error, len(keys))
+	for _, key := range keys {
+		errs[key] = err
+	}
+	return errs
+}
+
+// addEventHandlers enqueues the nodes affected by changes to pods, nodes, AzureIdentities
+// and AzureIdentityBindings, so that only those nodes are reconciled. AzureIdentityPolicies
+// may affect any identity, so changes to them enqueue all nodes.
+func (c *Client) addEventHandlers(podInformer, nodeInformer, bindingInformer, idInformer, policyInformer cache.SharedInformer) {
+	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.enqueueNode(pod.Spec.NodeName)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.enqueueNode(pod.Spec.NodeName)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, newPod := oldObj.(*corev1.Pod), newObj.(*corev1.Pod)
+			// only the node and labels of a pod are relevant to its bindings
+			if oldPod.Spec.NodeName != newPod.Spec.NodeName || !reflect.DeepEqual(oldPod.Labels, newPod.Labels) {
+				c.enqueueNode(oldPod.Spec.NodeName)
+				c.enqueueNode(newPod.Spec.NodeName)
+			}
+		},
+	})
+
+	nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if node, ok := obj.(*corev1.Node); ok {
+				// the node is no longer found, so its AzureAssignedIdentities are deleted
+				c.enqueueNode(node.Name)
+			}
+		},
+	})
+
+	bindingInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if binding, ok := toInternalBinding(obj); ok {
+				c.enqueueNodesForBindings([]aadpodid.AzureIdentityBinding{binding}, "")
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if binding, ok := toInternalBinding(obj); ok {
+				c.enqueueNodesForBindings([]aadpodid.AzureIdentityBinding{binding}, "")
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldBinding, ok := toInternalBinding(oldObj)
+			if !ok {
+				return
+			}
+			newBinding, ok := toInternalBinding(newObj)
+			if !ok || sameBindingSpec(&oldBinding, &newBinding) {
+				return
+			}
+			c.enqueueNodesForBindings([]aadpodid.AzureIdentityBinding{oldBinding, newBinding}, "")
+		},
+	})
+
+	idInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if id, ok := toInternalIdentity(obj); ok {
+				c.enqueueNodesForIdentity(id)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if id, ok := toInternalIdentity(obj); ok {
+				c.enqueueNodesForIdentity(id)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldID, ok := toInternalIdentity(oldObj)
+			if !ok {
+				return
+			}
+			newID, ok := toInternalIdentity(newObj)
+			if !ok || sameIdentitySpec(&oldID, &newID) {
+				return
+			}
+			c.enqueueNodesForIdentity(newID)
+		},
+	})
+
+	policyInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.enqueueAllNodes()
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.enqueueAllNodes()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPolicy, ok := oldObj.(*aadpodv1.AzureIdentityPolicy)
+			if !ok {
+				return
+			}
+			newPolicy, ok := newObj.(*aadpodv1.AzureIdentityPolicy)
+			// periodic resyncs deliver updates of unchanged policies
+			if !ok || oldPolicy.ResourceVersion == newPolicy.ResourceVersion {
+				return
+			}
+			c.enqueueAllNodes()
+		},
+	})
+}
+
+// enqueueNodesForIdentity enqueues the nodes affected by a change to an AzureIdentity
+func (c *Client) enqueueNodesForIdentity(id aadpodid.AzureIdentity) {
+	listBindings, err := c.CRDClient.ListBindings()
+	if err != nil {
+		klog.Errorf("failed to list AzureIdentityBindings, error: %+v", err)
+		return
+	}
+	idKey := getIDKey(id.Namespace, id.Name)
+	var bindings []aadpodid.AzureIdentityBinding
+	for _, binding := range *listBindings {
+		if getIDKey(binding.Namespace, binding.Spec.AzureIdentity) == idKey {
+			bindings = append(bindings, binding)
+		}
+	}
+	c.enqueueNodesForBindings(bindings, idKey)
+}
+
+// enqueueNodesForBindings enqueues the nodes of the pods matched by the bindings and the nodes
+// of the AzureAssignedIdentities created for the bindings or the identity with the given key.
+func (c *Client) enqueueNodesForBindings(bindings []aadpodid.AzureIdentityBinding, idKey string) {
+	bindingKeys := make(map[string]bool)
+	for _, binding := range bindings {
+		bindingKeys[getIDKey(binding.Namespace, binding.Name)] = true
+	}
+
+	if len(bindings) > 0 {
+		pods, err := c.getPods(bindings)
+		if err != nil {
+			klog.Errorf("failed to list pods, error: %+v", err)
+		}
+		for _, pod := range pods {
+			for _, binding := range bindings {
+				if matched, err := binding.MatchesPod(pod); err == nil && matched {
+					c.enqueueNode(pod.Spec.NodeName)
+					break
+				}
+			}
+		}
+	}
+
+	assignedIDs, err := c.CRDClient.ListAssignedIDs()
+	if err != nil {
+		klog.Errorf("failed to list AzureAssignedIdentities, error: %+v", err)
+		return
+	}
+	for _, assignedID := range *assignedIDs {
+		binding, id := assignedID.Spec.AzureBindingRef, assignedID.Spec.AzureIdentityRef
+		if (binding != nil && bindingKeys[getIDKey(binding.Namespace, binding.Name)]) ||
+			(id != nil && idKey != "" && getIDKey(id.Namespace, id.Name) == idKey) {
+			c.enqueueNode(assignedID.Spec.NodeName)
+		}
+	}
+}
+
+func toInternalBinding(obj interface{}) (aadpodid.AzureIdentityBinding, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	binding, ok := obj.(*aadpodv1.AzureIdentityBinding)
+	if !ok {
+		return aadpodid.AzureIdentityBinding{}, false
+	}
+	return aadpodv1.ConvertV1BindingToInternalBinding(*binding), true
+}
+
+func toInternalIdentity(obj interface{}) (aadpodid.AzureIdentity, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	id, ok := obj.(*aadpodv1.AzureIdentity)
+	if !ok {
+		return aadpodid.AzureIdentity{}, false
+	}
+	return aadpodv1.ConvertV1IdentityToInternalIdentity(*id), true
+}
@@ -0,0 +1,209 @@
+package mic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodv1 "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"github.com/Azure/aad-pod-identity/pkg/pod"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// SimulationInput contains the cluster state to simulate a MIC sync cycle with.
+type SimulationInput struct {
+	Pods                    []corev1.Pod
+	Nodes                   []corev1.Node
+	Namespaces              []corev1.Namespace
+	AzureIdentities         []aadpodid.AzureIdentity
+	AzureIdentityBindings   []aadpodid.AzureIdentityBinding
+	AzureAssignedIdentities []aadpodid.AzureAssignedIdentity
+	AzureIdentityPolicies   []aadpodid.AzureIdentityPolicy
+	// IsNamespaced and ImmutableUserMSIs have the same meaning as the forceNamespaced
+	// and immutable-user-msis flags of MIC
+	IsNamespaced      bool
+	ImmutableUserMSIs []string
+}
+
+// Simulate runs a MIC sync cycle of all nodes in dry-run mode against fake clients populated with
+// the input, and returns the changes MIC would make to each node or VMSS.
+func Simulate(input SimulationInput) ([]NodePlan, error) {
+	var objects []runtime.Object
+	for i := range input.Pods {
+		objects = append(objects, &input.Pods[i])
+	}
+	for i := range input.Nodes {
+		objects = append(objects, &input.Nodes[i])
+	}
+	for i := range input.Namespaces {
+		objects = append(objects, &input.Namespaces[i])
+	}
+	informer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(objects...), 0)
+
+	immutableUserMSIsMap := make(map[string]bool)
+	for _, item := range input.ImmutableUserMSIs {
+		immutableUserMSIsMap[strings.ToLower(item)] = true
+	}
+
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reporter for metrics, error: %+v", err)
+	}
+
+	c := &Client{
+		CRDClient:            newSimulationCRDClient(input),
+		PodClient:            pod.NewPodClient(informer, nil),
+		NodeClient:           &NodeClient{informer.Core().V1().Nodes()},
+		NamespaceClient:      NewNamespaceClient(informer.Core().V1().Namespaces(), nil),
+		IsNamespaced:         input.IsNamespaced,
+		createDeleteBatch:    1,
+		ImmutableUserMSIsMap: immutableUserMSIsMap,
+		Reporter:             reporter,
+		dryRun:               true,
+		plan:                 newDryRunPlan(),
+	}
+
+	exit := make(chan struct{})
+	defer close(exit)
+	c.PodClient.Start(exit)
+	c.NodeClient.Start(exit)
+	c.NamespaceClient.Start(exit)
+
+	// all the nodes which are known from the input are synced at once
+	keySet := make(map[string]bool)
+	for _, node := range input.Nodes {
+		keySet[c.getNodeKey(node.Name)] = true
+	}
+	for _, pod := range input.Pods {
+		if pod.Spec.NodeName != "" {
+			keySet[c.getNodeKey(pod.Spec.NodeName)] = true
+		}
+	}
+	for _, assignedID := range input.AzureAssignedIdentities {
+		if assignedID.Spec.NodeName != "" {
+			keySet[c.getNodeKey(assignedID.Spec.NodeName)] = true
+		}
+	}
+	var keys []string
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for key, err := range c.syncNodes(exit, keys) {
+		return nil, fmt.Errorf("failed to simulate sync of %s, error: %+v", key, err)
+	}
+	return c.GetPlan(), nil
+}
+
+// simulationCRDClient is a read-only CRD client which lists the AzureIdentities, AzureIdentityBindings,
+// AzureAssignedIdentities and AzureIdentityPolicies of a simulation. MIC doesn't write to it in dry-run mode.
+type simulationCRDClient struct {
+	identities  []aadpodid.AzureIdentity
+	bindings    []aadpodid.AzureIdentityBinding
+	assignedIDs []aadpodid.AzureAssignedIdentity
+	policies    []aadpodid.AzureIdentityPolicy
+}
+
+func newSimulationCRDClient(input SimulationInput) *simulationCRDClient {
+	return &simulationCRDClient{
+		identities:  input.AzureIdentities,
+		bindings:    input.AzureIdentityBindings,
+		assignedIDs: input.AzureAssignedIdentities,
+		policies:    input.AzureIdentityPolicies,
+	}
+}
+
+var errSimulationReadOnly = errors.New("simulation CRD client is read-only")
+
+func (c *simulationCRDClient) Start(exit <-chan struct{}) {}
+
+func (c *simulationCRDClient) SyncCache(exit <-chan struct{}, initial bool, cacheSyncs ...cache.InformerSynced) {
+}
+
+func (c *simulationCRDClient) SyncCacheAll(exit <-chan struct{}, initial bool) {}
+
+func (c *simulationCRDClient) RemoveAssignedIdentity(assignedIdentity *aadpodid.AzureAssignedIdentity) error {
+	return errSimulationReadOnly
+}
+
+func (c *simulationCRDClient) CreateAssignedIdentity(assignedIdentity *aadpodid.AzureAssignedIdentity) error {
+	return errSimulationReadOnly
+}
+
+func (c *simulationCRDClient) UpdateAssignedIdentity(assignedIdentity *aadpodid.AzureAssignedIdentity) error {
+	return errSimulationReadOnly
+}
+
+func (c *simulationCRDClient) UpdateAzureAssignedIdentityStatus(assignedIdentity *aadpodid.AzureAssignedIdentity, status string) error {
+	return errSimulationReadOnly
+}
+
+func (c *simulationCRDClient) UpdateAzureIdentityStatus(identity *aadpodid.AzureIdentity) error {
+	return errSimulationReadOnly
+}
+
+func (c *simulationCRDClient) UpdateAzureIdentityBindingStatus(binding *aadpodid.AzureIdentityBinding) error {
+	return errSimulationReadOnly
+}
+
+func (c *simulationCRDClient) UpgradeAll() error {
+	return errSimulationReadOnly
+}
+
+func (c *simulationCRDClient) ListBindings() (*[]aadpodid.AzureIdentityBinding, error) {
+	bindings := append([]aadpodid.AzureIdentityBinding{}, c.bindings...)
+	return &bindings, nil
+}
+
+func (c *simulationCRDClient) ListAssignedIDs() (*[]aadpodid.AzureAssignedIdentity, error) {
+	assignedIDs := append([]aadpodid.AzureAssignedIdentity{}, c.assignedIDs...)
+	return &assignedIDs, nil
+}
+
+func (c *simulationCRDClient) ListAssignedIDsInMap() (map[string]aadpodid.AzureAssignedIdentity, error) {
+	assignedIDs := make(map[string]aadpodid.AzureAssignedIdentity, len(c.assignedIDs))
+	for _, assignedID := range c.assignedIDs {
+		assignedIDs[assignedID.Name] = assignedID
+	}
+	return assignedIDs, nil
+}
+
+func (c *simulationCRDClient) ListIds() (*[]aadpodid.AzureIdentity, error) {
+	identities := append([]aadpodid.AzureIdentity{}, c.identities...)
+	return &identities, nil
+}
+
+func (c *simulationCRDClient) ListPodIds(podns, podname string) (map[string][]aadpodid.AzureIdentity, error) {
+	podIDs := make(map[string][]aadpodid.AzureIdentity)
+	for _, assignedID := range c.assignedIDs {
+		if assignedID.Spec.Pod == podname && assignedID.Spec.PodNamespace == podns && assignedID.Spec.AzureIdentityRef != nil {
+			podIDs[assignedID.Status.Status] = append(podIDs[assignedID.Status.Status], *assignedID.Spec.AzureIdentityRef)
+		}
+	}
+	return podIDs, nil
+}
+
+func (c *simulationCRDClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodIdentityException, error) {
+	return &[]aadpodid.AzurePodIdentityException{}, nil
+}
+
+func (c *simulationCRDClient) ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error) {
+	return append([]aadpodid.AzureIdentityPolicy{}, c.policies...), nil
+}
+
+func (c *simulationCRDClient) ListAssignedIDsFromAPIServer() (*aadpodv1.AzureAssignedIdentityList, error) {
+	list := &aadpodv1.AzureAssignedIdentityList{}
+	for _, assignedID := range c.assignedIDs {
+		list.Items = append(list.Items, aadpodv1.ConvertInternalAssignedIdentityToV1AssignedIdentity(assignedID))
+	}
+	return list, nil
+}
@@ -0,0 +1,327 @@
+package mic
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/cloudprovider"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// azureErrorReason is the reason of the AssignmentFailed condition for errors without an Azure error code
+	azureErrorReason = "AzureError"
+)
+
+// azureErrorCodeRegex matches the error code in the errors returned by Azure Resource Manager,
+// e.g. Code="LinkedAuthorizationFailed"
+var azureErrorCodeRegex = regexp.MustCompile(`Code="([A-Za-z][A-Za-z0-9_]*)"`)
+
+// syncStatus records the outcome of the identity assignments of a single sync cycle.
+// It is populated concurrently by the per node or VMSS updates.
+type syncStatus struct {
+	mu sync.Mutex
+	// assigned contains the AzureAssignedIdentities whose status was updated to Assigned, by name
+	assigned map[string]aadpodid.AzureAssignedIdentity
+	// removed contains the names of the AzureAssignedIdentities which were unassigned or deleted
+	removed map[string]bool
+	// errors contains the error of the last assignment or removal of an identity, by identity key.
+	// A nil error indicates that the identity was successfully assigned or removed.
+	errors map[string]error
+	// nodeErrors contains the error of updating the identities of a node or VMSS, by node or VMSS name
+	nodeErrors map[string]error
+}
+
+func newSyncStatus() *syncStatus {
+	return &syncStatus{
+		assigned:   make(map[string]aadpodid.AzureAssignedIdentity),
+		removed:    make(map[string]bool),
+		errors:     make(map[string]error),
+		nodeErrors: make(map[string]error),
+	}
+}
+
+func (s *syncStatus) setAssigned(assignedID aadpodid.AzureAssignedIdentity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assigned[assignedID.Name] = assignedID
+	delete(s.removed, assignedID.Name)
+}
+
+func (s *syncStatus) setRemoved(assignedID aadpodid.AzureAssignedIdentity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removed[assignedID.Name] = true
+	delete(s.assigned, assignedID.Name)
+}
+
+// setResult records the result of assigning or removing the identity of the AzureAssignedIdentity.
+// An error is never overwritten by a success, as the identity may be assigned to multiple nodes.
+func (s *syncStatus) setResult(assignedID aadpodid.AzureAssignedIdentity, err error) {
+	if assignedID.Spec.AzureIdentityRef == nil {
+		return
+	}
+	key := getIDKey(assignedID.Spec.AzureIdentityRef.Namespace, assignedID.Spec.AzureIdentityRef.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.errors[key]; ok && prev != nil && err == nil {
+		return
+	}
+	s.errors[key] = err
+}
+
+func (s *syncStatus) setNodeResult(nodeOrVMSSName string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodeErrors[nodeOrVMSSName] = err
+}
+
+// recordAssigned, recordRemoved, recordResult and recordNodeResult are no-ops outside of a sync cycle
+func (c *Client) recordAssigned(assignedID aadpodid.AzureAssignedIdentity) {
+	if c.syncStatus != nil {
+		c.syncStatus.setAssigned(assignedID)
+	}
+}
+
+func (c *Client) recordRemoved(assignedID aadpodid.AzureAssignedIdentity) {
+	if c.syncStatus != nil {
+		c.syncStatus.setRemoved(assignedID)
+	}
+}
+
+func (c *Client) recordResult(assignedID aadpodid.AzureAssignedIdentity, err error) {
+	if c.syncStatus != nil {
+		c.syncStatus.setResult(assignedID, err)
+	}
+}
+
+// recordNodeResult records the result of updating the node or VMSS, whose name on Azure is azureName.
+// The error is a throttledError if ARM throttles the subscription of the node or VMSS.
+func (c *Client) recordNodeResult(nodeOrVMSSName, azureName string, err error) {
+	if c.syncStatus == nil {
+		return
+	}
+	if err != nil && c.CloudClient != nil {
+		if retryAfter := c.CloudClient.RetryAfter(azureName); retryAfter.After(time.Now()) {
+			err = &throttledError{err: err, retryAfter: retryAfter}
+		}
+	}
+	c.syncStatus.setNodeResult(nodeOrVMSSName, err)
+}
+
+// throttledError is the error of a node or VMSS which couldn't be updated while ARM throttles its subscription.
+type throttledError struct {
+	err        error
+	retryAfter time.Time
+}
+
+func (e *throttledError) Error() string {
+	return e.err.Error()
+}
+
+func (e *throttledError) Unwrap() error {
+	return e.err
+}
+
+// updateStatus computes the status of the AzureIdentities and AzureIdentityBindings at the end of
+// a sync cycle and updates the status of the ones that changed.
+func (c *Client) updateStatus(listIDs *[]aadpodid.AzureIdentity, listBindings *[]aadpodid.AzureIdentityBinding, idMap map[string]aadpodid.AzureIdentity, currentAssignedIDs, newAssignedIDs map[string]aadpodid.AzureAssignedIdentity) {
+	identities, bindings := c.computeStatus(listIDs, listBindings, idMap, currentAssignedIDs, newAssignedIDs)
+
+	for i := range identities {
+		if err := c.CRDClient.UpdateAzureIdentityStatus(&identities[i]); err != nil {
+			klog.Errorf("failed to update status of AzureIdentity %s/%s, error: %+v", identities[i].Namespace, identities[i].Name, err)
+		}
+	}
+	for i := range bindings {
+		if err := c.CRDClient.UpdateAzureIdentityBindingStatus(&bindings[i]); err != nil {
+			klog.Errorf("failed to update status of AzureIdentityBinding %s/%s, error: %+v", bindings[i].Namespace, bindings[i].Name, err)
+		}
+	}
+}
+
+// computeStatus returns the AzureIdentities and AzureIdentityBindings whose status changed in the sync cycle.
+// idMap contains the identities which can be bound by key, and newAssignedIDs the desired AzureAssignedIdentities.
+func (c *Client) computeStatus(listIDs *[]aadpodid.AzureIdentity, listBindings *[]aadpodid.AzureIdentityBinding, idMap map[string]aadpodid.AzureIdentity, currentAssignedIDs, newAssignedIDs map[string]aadpodid.AzureAssignedIdentity) ([]aadpodid.AzureIdentity, []aadpodid.AzureIdentityBinding) {
+	status := c.syncStatus
+	if status == nil {
+		status = newSyncStatus()
+	}
+
+	// the identities which are assigned after this cycle are the previously assigned ones
+	// that were not removed and the ones assigned in this cycle
+	assignedIDs := make(map[string]aadpodid.AzureAssignedIdentity)
+	for name, assignedID := range currentAssignedIDs {
+		if assignedID.Status.Status == aadpodid.AssignedIDAssigned && !status.removed[name] {
+			assignedIDs[name] = assignedID
+		}
+	}
+	for name, assignedID := range status.assigned {
+		assignedIDs[name] = assignedID
+	}
+
+	// identities of VMSS nodes are assigned to the whole VMSS, which is counted once
+	assignedNodes := make(map[string]map[string]bool)
+	for _, assignedID := range assignedIDs {
+		id := assignedID.Spec.AzureIdentityRef
+		if id == nil {
+			continue
+		}
+		node := assignedID.Spec.NodeName
+		if vmssID, isvmss, err := vmssFromNodeRef(c.NodeClient, node); err == nil && isvmss {
+			node = vmssID
+		}
+		key := getIDKey(id.Namespace, id.Name)
+		if assignedNodes[key] == nil {
+			assignedNodes[key] = make(map[string]bool)
+		}
+		assignedNodes[key][node] = true
+	}
+
+	matchedPods := make(map[string]int32)
+	for _, assignedID := range newAssignedIDs {
+		if binding := assignedID.Spec.AzureBindingRef; binding != nil {
+			matchedPods[getIDKey(binding.Namespace, binding.Name)]++
+		}
+	}
+
+	var identities []aadpodid.AzureIdentity
+	if listIDs != nil {
+		violations, err := c.getPolicyViolations(*listIDs)
+		if err != nil {
+			klog.Errorf("failed to check AzureIdentityPolicies, error: %+v", err)
+		}
+		for _, id := range *listIDs {
+			key := getIDKey(id.Namespace, id.Name)
+			newStatus := *id.Status.DeepCopy()
+			newStatus.AssignedNodes = int32(len(assignedNodes[key]))
+			if newStatus.AssignedNodes > 0 {
+				meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+					Type:               aadpodid.IdentityConditionAssigned,
+					Status:             metav1.ConditionTrue,
+					ObservedGeneration: id.Generation,
+					Reason:             "Assigned",
+					Message:            fmt.Sprintf("identity is assigned to %d node(s)", newStatus.AssignedNodes),
+				})
+			} else {
+				meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+					Type:               aadpodid.IdentityConditionAssigned,
+					Status:             metav1.ConditionFalse,
+					ObservedGeneration: id.Generation,
+					Reason:             "NotAssigned",
+					Message:            "identity is not assigned to any node",
+				})
+			}
+			if err, ok := status.errors[key]; ok {
+				if err != nil {
+					meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+						Type:               aadpodid.IdentityConditionAssignmentFailed,
+						Status:             metav1.ConditionTrue,
+						ObservedGeneration: id.Generation,
+						Reason:             getAzureErrorCode(err),
+						Message:            err.Error(),
+					})
+				} else {
+					meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+						Type:               aadpodid.IdentityConditionAssignmentFailed,
+						Status:             metav1.ConditionFalse,
+						ObservedGeneration: id.Generation,
+						Reason:             "Succeeded",
+						Message:            "identity was successfully assigned or removed",
+					})
+				}
+			}
+			// the condition is only reported once an identity violated a policy
+			if err := violations[key]; err != nil {
+				meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+					Type:               aadpodid.IdentityConditionPolicyViolated,
+					Status:             metav1.ConditionTrue,
+					ObservedGeneration: id.Generation,
+					Reason:             policyViolatedReason,
+					Message:            err.Error(),
+				})
+			} else if violations != nil && meta.FindStatusCondition(newStatus.Conditions, aadpodid.IdentityConditionPolicyViolated) != nil {
+				meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+					Type:               aadpodid.IdentityConditionPolicyViolated,
+					Status:             metav1.ConditionFalse,
+					ObservedGeneration: id.Generation,
+					Reason:             "Compliant",
+					Message:            "identity is allowed by all AzureIdentityPolicies",
+				})
+			}
+			if !reflect.DeepEqual(newStatus, id.Status) {
+				id.Status = newStatus
+				identities = append(identities, id)
+			}
+		}
+	}
+
+	var bindings []aadpodid.AzureIdentityBinding
+	if listBindings != nil {
+		for _, binding := range *listBindings {
+			newStatus := *binding.Status.DeepCopy()
+			if _, ok := idMap[getIDKey(binding.Namespace, binding.Spec.AzureIdentity)]; ok {
+				meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+					Type:               aadpodid.BindingConditionIdentityFound,
+					Status:             metav1.ConditionTrue,
+					ObservedGeneration: binding.Generation,
+					Reason:             "IdentityFound",
+					Message:            fmt.Sprintf("AzureIdentity %s found", binding.Spec.AzureIdentity),
+				})
+			} else {
+				meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+					Type:               aadpodid.BindingConditionIdentityFound,
+					Status:             metav1.ConditionFalse,
+					ObservedGeneration: binding.Generation,
+					Reason:             "IdentityNotFound",
+					Message:            fmt.Sprintf("AzureIdentity %s not found in namespace %s or not valid", binding.Spec.AzureIdentity, binding.Namespace),
+				})
+			}
+			newStatus.MatchedPods = matchedPods[getIDKey(binding.Namespace, binding.Name)]
+			if newStatus.MatchedPods > 0 {
+				meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+					Type:               aadpodid.BindingConditionPodsMatched,
+					Status:             metav1.ConditionTrue,
+					ObservedGeneration: binding.Generation,
+					Reason:             "PodsMatched",
+					Message:            fmt.Sprintf("binding matches %d pod(s)", newStatus.MatchedPods),
+				})
+			} else {
+				meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+					Type:               aadpodid.BindingConditionPodsMatched,
+					Status:             metav1.ConditionFalse,
+					ObservedGeneration: binding.Generation,
+					Reason:             "NoPodsMatched",
+					Message:            "binding does not match any pod",
+				})
+			}
+			if !reflect.DeepEqual(newStatus, binding.Status) {
+				binding.Status = newStatus
+				bindings = append(bindings, binding)
+			}
+		}
+	}
+
+	return identities, bindings
+}
+
+// getAzureErrorCode returns the Azure error code in err, e.g. LinkedAuthorizationFailed
+func getAzureErrorCode(err error) string {
+	var overflowErr *cloudprovider.OverflowError
+	if errors.As(err, &overflowErr) {
+		return identityLimitReachedReason
+	}
+	if m := azureErrorCodeRegex.FindStringSubmatch(err.Error()); len(m) == 2 {
+		return m[1]
+	}
+	return azureErrorReason
+}
@@ -81,6 +81,11 @@ func getVMSSGroups(nc NodeGetter, refs map[string]bool) (*vmssGroupList, error)
 	return ls, nil
 }
 
+// isVMSS returns the VMSS ID of a node whose provider ID is an instance of a scale set, i.e.
+// .../virtualMachineScaleSets/<vmss>/virtualMachines/<instance>, whose identities are assigned to the
+// whole scale set. The cloud provider sets the provider ID of the VMs of scale sets in Flexible
+// orchestration mode to the standalone VM, i.e. .../virtualMachines/<vm>, so they are not VMSS nodes
+// and their identities are assigned per VM. The orchestration mode is not looked up on Azure.
 func isVMSS(n *corev1.Node) (string, bool, error) {
 	r, err := cloudprovider.ParseResourceID(n.Spec.ProviderID)
 	if err != nil && n.Spec.ProviderID != "" {
@@ -93,6 +98,20 @@ func isVMSS(n *corev1.Node) (string, bool, error) {
 	return makeVMSSID(r), true, nil
 }
 
+// getResourceID returns the ARM resource ID of the VM or VMSS of a node, which is parsed from its
+// provider ID so that nodes in other subscriptions and resource groups than the configured ones
+// are updated in place. It returns an empty string if the node has no provider ID.
+func getResourceID(n *corev1.Node) (string, error) {
+	if n.Spec.ProviderID == "" {
+		return "", nil
+	}
+	r, err := cloudprovider.ParseResourceID(n.Spec.ProviderID)
+	if err != nil {
+		return "", err
+	}
+	return cloudprovider.ComputeResourceID(r.SubscriptionID, r.ResourceGroup, r.ResourceType, r.ResourceName), nil
+}
+
 func makeVMSSID(r azure.Resource) string {
 	return path.Join(r.SubscriptionID, r.ResourceGroup, r.ResourceName)
 }
@@ -0,0 +1,83 @@
+package nmi
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"golang.org/x/sync/singleflight"
+	"k8s.io/klog/v2"
+)
+
+// DefaultTokenRequestTimeout is the maximum duration of a single token acquisition
+// shared by concurrent requests.
+const DefaultTokenRequestTimeout = 60 * time.Second
+
+// CoalescingTokenClient is a TokenClient which coalesces concurrent token requests
+// for the same identity, resource and auxiliary tenants into a single call to the
+// underlying TokenClient. All waiters share the result or error of that call.
+type CoalescingTokenClient struct {
+	TokenClient
+	// Timeout bounds the shared token acquisition. It is independent of the
+	// requests waiting for it, so that a cancelled request does not fail
+	// the other waiters.
+	Timeout time.Duration
+
+	group singleflight.Group
+}
+
+// NewCoalescingTokenClient creates a new coalescing token client on top of the given token client
+func NewCoalescingTokenClient(tokenClient TokenClient, timeout time.Duration) *CoalescingTokenClient {
+	if timeout <= 0 {
+		timeout = DefaultTokenRequestTimeout
+	}
+	return &CoalescingTokenClient{
+		TokenClient: tokenClient,
+		Timeout:     timeout,
+	}
+}
+
+// GetTokens acquires tokens using the underlying token client, joining an
+// in-flight acquisition for the same identity and resource if there is one.
+// It returns early with the context error if ctx is done before the tokens are acquired.
+func (cc *CoalescingTokenClient) GetTokens(ctx context.Context, rqClientID, rqResource string, azureID aadpodid.AzureIdentity) ([]*adal.Token, error) {
+	key := getCoalesceKey(ctx, azureID, rqResource)
+
+	ch := cc.group.DoChan(key, func() (interface{}, error) {
+		sharedCtx, cancel := context.WithTimeout(withPodInfoFrom(context.Background(), ctx), cc.Timeout)
+		defer cancel()
+		return cc.TokenClient.GetTokens(sharedCtx, rqClientID, rqResource, azureID)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Shared {
+			klog.V(5).Infof("shared token request for identity %s/%s, resource %s", azureID.Namespace, azureID.Name, rqResource)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		tokens, _ := res.Val.([]*adal.Token)
+		return copyTokens(tokens), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// getCoalesceKey returns the key used to coalesce token requests. Requests with the
+// same identity, resource and auxiliary tenants result in the same tokens, except for
+// federated identities whose tokens are acquired on behalf of the requesting pod.
+func getCoalesceKey(ctx context.Context, azureID aadpodid.AzureIdentity, resource string) string {
+	return strings.Join([]string{
+		azureID.Namespace,
+		azureID.Name,
+		azureID.Spec.ClientID,
+		azureID.Spec.TenantID,
+		strings.Join(azureID.Spec.AuxiliaryTenantIDs, ","),
+		resource,
+		getPodKey(ctx, azureID),
+	}, "/")
+}
@@ -0,0 +1,144 @@
+package nmi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+type blockingTokenClient struct {
+	TokenClient
+	calls   int32
+	release chan struct{}
+	err     error
+}
+
+func (c *blockingTokenClient) GetTokens(ctx context.Context, rqClientID, rqResource string, azureID aadpodid.AzureIdentity) ([]*adal.Token, error) {
+	atomic.AddInt32(&c.calls, 1)
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []*adal.Token{newTestToken("token", rqResource, time.Hour)}, nil
+}
+
+func TestCoalescingTokenClient(t *testing.T) {
+	cases := []struct {
+		desc string
+		err  error
+	}{
+		{
+			desc: "concurrent requests share the tokens",
+		},
+		{
+			desc: "concurrent requests share the error",
+			err:  errors.New("failed to get token"),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tokenClient := &blockingTokenClient{release: make(chan struct{}), err: tc.err}
+			cc := NewCoalescingTokenClient(tokenClient, time.Minute)
+			azureID := newTestAzureIdentity("id1", "clientid1")
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					tokens, err := cc.GetTokens(context.Background(), "", "https://management.azure.com/", azureID)
+					if err == nil && (len(tokens) != 1 || tokens[0].AccessToken != "token") {
+						err = errors.New("unexpected tokens")
+					}
+					errs <- err
+				}()
+			}
+
+			// wait for the first request to reach the token client before releasing it
+			for atomic.LoadInt32(&tokenClient.calls) == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(100 * time.Millisecond)
+			close(tokenClient.release)
+			wg.Wait()
+			close(errs)
+
+			if calls := atomic.LoadInt32(&tokenClient.calls); calls != 1 {
+				t.Fatalf("expected 1 call to token client, got: %d", calls)
+			}
+			for err := range errs {
+				if tc.err == nil && err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+				if tc.err != nil && err != tc.err {
+					t.Fatalf("expected error %v, got: %v", tc.err, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalescingTokenClientDifferentKeys(t *testing.T) {
+	tokenClient := &blockingTokenClient{release: make(chan struct{})}
+	close(tokenClient.release)
+	cc := NewCoalescingTokenClient(tokenClient, time.Minute)
+
+	azureID := newTestAzureIdentity("id1", "clientid1")
+	auxiliaryID := newTestAzureIdentity("id1", "clientid1")
+	auxiliaryID.Spec.AuxiliaryTenantIDs = []string{"22222222-2222-2222-2222-222222222222"}
+
+	requests := []struct {
+		azureID  aadpodid.AzureIdentity
+		resource string
+	}{
+		{azureID: azureID, resource: "https://management.azure.com/"},
+		{azureID: azureID, resource: "https://vault.azure.net"},
+		{azureID: auxiliaryID, resource: "https://management.azure.com/"},
+	}
+	for _, r := range requests {
+		if _, err := cc.GetTokens(context.Background(), "", r.resource, r.azureID); err != nil {
+			t.Fatalf("expected nil error, got: %v", err)
+		}
+	}
+	if calls := atomic.LoadInt32(&tokenClient.calls); calls != 3 {
+		t.Fatalf("expected 3 calls to token client, got: %d", calls)
+	}
+}
+
+func TestCoalescingTokenClientContextCancelled(t *testing.T) {
+	tokenClient := &blockingTokenClient{release: make(chan struct{})}
+	defer close(tokenClient.release)
+	cc := NewCoalescingTokenClient(tokenClient, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := cc.GetTokens(ctx, "", "https://management.azure.com/", newTestAzureIdentity("id1", "clientid1"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCoalescingTokenClientTimeout(t *testing.T) {
+	tokenClient := &blockingTokenClient{release: make(chan struct{})}
+	defer close(tokenClient.release)
+	cc := NewCoalescingTokenClient(tokenClient, 100*time.Millisecond)
+
+	_, err := cc.GetTokens(context.Background(), "", "https://management.azure.com/", newTestAzureIdentity("id1", "clientid1"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got: %v", context.DeadlineExceeded, err)
+	}
+}
@@ -11,14 +11,17 @@ import (
 	utils "github.com/Azure/aad-pod-identity/pkg/utils"
 
 	"github.com/Azure/go-autorest/autorest/adal"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
 // ManagedClient implements the TokenClient interface
 type ManagedClient struct {
 	TokenClient
-	KubeClient   k8s.Client
-	IsNamespaced bool
+	KubeClient    k8s.Client
+	IsNamespaced  bool
+	EventRecorder record.EventRecorder
 }
 
 // NewManagedTokenClient creates new managed token client
@@ -28,24 +31,30 @@ func NewManagedTokenClient(client k8s.Client, config Config) (*ManagedClient, er
 		return nil, fmt.Errorf("managed mode not intialized in force namespaced mode")
 	}
 	return &ManagedClient{
-		KubeClient:   client,
-		IsNamespaced: config.Namespaced,
+		KubeClient:    client,
+		IsNamespaced:  config.Namespaced,
+		EventRecorder: config.EventRecorder,
 	}, nil
 }
 
 // GetIdentities gets the azure identity that matches the podns/podname and client id
-func (mc *ManagedClient) GetIdentities(ctx context.Context, podns, podname, clientID, resourceID string) (*aadpodid.AzureIdentity, error) {
+func (mc *ManagedClient) GetIdentities(ctx context.Context, podns, podname, clientID, resourceID, objectID string) (*aadpodid.AzureIdentity, error) {
 	// get pod object to retrieve labels
 	pod, err := mc.KubeClient.GetPod(podns, podname)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get pod %s/%s, error: %+v", podns, podname, err)
 	}
 	// get all the azure identities based on azure identity bindings
-	azureIdentities, err := mc.KubeClient.ListPodIdsWithBinding(podns, pod.Labels)
+	azureIdentities, err := mc.KubeClient.ListPodIdsWithBinding(&pod)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get AzureIdentities for pod %s/%s, error: %+v", podns, podname, err)
 	}
-	identityUnspecified := len(clientID) == 0 && len(resourceID) == 0
+	azureIdentities = filterIdentitiesByNamespace(mc.KubeClient, mc.IsNamespaced, podns, podname, azureIdentities)
+	azureIdentities = filterIdentitiesByPolicy(mc.KubeClient, podns, podname, azureIdentities)
+	identityUnspecified := len(clientID) == 0 && len(resourceID) == 0 && len(objectID) == 0
+	if identityUnspecified {
+		return mc.getDefaultIdentity(&pod, azureIdentities)
+	}
 	for _, id := range azureIdentities {
 		// if client id exists in the request, then send the first identity that matched the client id
 		if len(clientID) != 0 && id.Spec.ClientID == clientID {
@@ -58,15 +67,48 @@ func (mc *ManagedClient) GetIdentities(ctx context.Context, podns, podname, clie
 			return &id, nil
 		}
 
-		// if client doesn't exist in the request, then return the first identity in the same namespace as the pod
-		if identityUnspecified && strings.EqualFold(id.Namespace, podns) {
-			klog.Infof("no clientID or resourceID in request. %s/%s has been matched with azure identity %s/%s", podns, podname, id.Namespace, id.Name)
+		// if object id exists in the request, then send the first identity that matched the object id
+		if len(objectID) != 0 && strings.EqualFold(id.Spec.ObjectID, objectID) {
+			klog.Infof("objectID in request: %s, %s/%s has been matched with azure identity %s/%s", objectID, podns, podname, id.Namespace, id.Name)
 			return &id, nil
 		}
+
 	}
 	return nil, fmt.Errorf("no azure identity found for request clientID %s", utils.RedactClientID(clientID))
 }
 
+// getDefaultIdentity returns the identity with the highest weight among the identities of the pod.
+func (mc *ManagedClient) getDefaultIdentity(pod *v1.Pod, candidates []aadpodid.AzureIdentity) (*aadpodid.AzureIdentity, error) {
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no azure identity found for pod %s/%s", pod.Namespace, pod.Name)
+	}
+
+	bindings, err := mc.KubeClient.ListPodBindingsWithSelector(pod)
+	if err != nil {
+		// the identities are still selected deterministically, as if they had the same weight
+		klog.Errorf("failed to get AzureIdentityBindings for pod %s/%s, error: %+v", pod.Namespace, pod.Name, err)
+	}
+	id, tied := SelectDefaultIdentity(candidates, bindings)
+	if len(tied) != 0 {
+		recordAmbiguousIdentityEvent(mc.EventRecorder, mc.KubeClient, pod.Namespace, pod.Name, id, tied)
+	}
+	klog.Infof("no clientID or resourceID in request. %s/%s has been matched with azure identity %s/%s", pod.Namespace, pod.Name, id.Namespace, id.Name)
+	return &id, nil
+}
+
+// IsResourceAllowed checks the resource against the bindings which select the pod.
+func (mc *ManagedClient) IsResourceAllowed(ctx context.Context, podns, podname, rqResource string, azureID aadpodid.AzureIdentity) (bool, error) {
+	pod, err := mc.KubeClient.GetPod(podns, podname)
+	if err != nil {
+		return false, fmt.Errorf("failed to get pod %s/%s, error: %+v", podns, podname, err)
+	}
+	bindings, err := mc.KubeClient.ListPodBindingsWithSelector(&pod)
+	if err != nil {
+		return false, fmt.Errorf("failed to get AzureIdentityBindings for pod %s/%s, error: %+v", podns, podname, err)
+	}
+	return isResourceAllowed(bindings, rqResource, azureID), nil
+}
+
 // GetTokens returns ADAL tokens based on the request and its pod identity.
 func (mc *ManagedClient) GetTokens(ctx context.Context, rqClientID, rqResource string, azureID aadpodid.AzureIdentity) (tokens []*adal.Token, err error) {
 	rqHasClientID := len(rqClientID) != 0
@@ -79,6 +121,12 @@ func (mc *ManagedClient) GetTokens(ctx context.Context, rqClientID, rqResource s
 			klog.Warningf("client ID mismatch, requested:%s available:%s", rqClientID, clientID)
 		}
 		klog.Infof("matched identityType:%v clientid:%s resource:%s", idType, utils.RedactClientID(clientID), rqResource)
+		// request the token by the resource ID when it's set, as that's what the AzureIdentityPolicies
+		// allow and the client ID alone could select any other identity assigned to the node
+		if resourceID := azureID.Spec.ResourceID; resourceID != "" {
+			token, err := auth.GetServicePrincipalTokenFromMSIWithIdentityResourceID(resourceID, rqResource)
+			return []*adal.Token{token}, err
+		}
 		token, err := auth.GetServicePrincipalTokenFromMSIWithUserAssignedID(clientID, rqResource)
 		return []*adal.Token{token}, err
 	case aadpodid.ServicePrincipal:
@@ -113,6 +161,8 @@ func (mc *ManagedClient) GetTokens(ctx context.Context, rqClientID, rqResource s
 		token, err := auth.GetServicePrincipalTokenWithCertificate(adEndpoint, tenantID, clientID,
 			certificate, string(password), rqResource)
 		return []*adal.Token{token}, err
+	case aadpodid.FederatedWorkloadIdentity:
+		return getFederatedTokens(ctx, mc.KubeClient, rqResource, azureID)
 	default:
 		return nil, fmt.Errorf("unsupported identity type %+v", idType)
 	}
@@ -9,15 +9,20 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 )
 
-func (c *TestKubeClient) ListPodIdsWithBinding(podns string, labels map[string]string) ([]aadpodid.AzureIdentity, error) {
+func (c *TestKubeClient) ListPodIdsWithBinding(pod *v1.Pod) ([]aadpodid.AzureIdentity, error) {
 	identities, _ := c.azureIdentities.([]aadpodid.AzureIdentity)
 	return identities, nil
 }
 
 func (c *TestKubeClient) GetPod(ns, name string) (v1.Pod, error) {
-	return v1.Pod{}, nil
+	return v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns}}, nil
+}
+
+func (c *TestKubeClient) ListPodBindingsWithSelector(pod *v1.Pod) ([]aadpodid.AzureIdentityBinding, error) {
+	return c.bindings, nil
 }
 
 func TestGetIdentitiesManagedClient(t *testing.T) {
@@ -26,6 +31,7 @@ func TestGetIdentitiesManagedClient(t *testing.T) {
 		azureIdentities       []aadpodid.AzureIdentity
 		clientID              string
 		resourceID            string
+		objectID              string
 		expectedErr           bool
 		expectedAzureIdentity *aadpodid.AzureIdentity
 		isNamespaced          bool
@@ -172,6 +178,75 @@ func TestGetIdentitiesManagedClient(t *testing.T) {
 			podName:      "pod4",
 			podNamespace: "default",
 		},
+		{
+			name: "objectID in request, found matching identity",
+			azureIdentities: []aadpodid.AzureIdentity{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "azid2",
+						Namespace: "default",
+					},
+					Spec: aadpodid.AzureIdentitySpec{
+						ClientID: "clientid2",
+						ObjectID: "objectid2",
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "azid3",
+						Namespace: "default",
+					},
+					Spec: aadpodid.AzureIdentitySpec{
+						ClientID: "clientid3",
+						ObjectID: "objectid3",
+					},
+				},
+			},
+			expectedErr: false,
+			expectedAzureIdentity: &aadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azid3",
+					Namespace: "default",
+				},
+				Spec: aadpodid.AzureIdentitySpec{
+					ClientID: "clientid3",
+					ObjectID: "objectid3",
+				},
+			},
+			podName:      "pod9",
+			podNamespace: "default",
+			objectID:     "objectid3",
+		},
+		{
+			name: "objectID in request, but no matching identity",
+			azureIdentities: []aadpodid.AzureIdentity{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "azid2",
+						Namespace: "default",
+					},
+					Spec: aadpodid.AzureIdentitySpec{
+						ClientID: "clientid2",
+						ObjectID: "objectid2",
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "azid3",
+						Namespace: "default",
+					},
+					Spec: aadpodid.AzureIdentitySpec{
+						ClientID: "clientid3",
+						ObjectID: "objectid3",
+					},
+				},
+			},
+			expectedErr:           true,
+			expectedAzureIdentity: nil,
+			podName:               "pod10",
+			podNamespace:          "default",
+			objectID:              "objectid1",
+		},
 	}
 
 	for _, tc := range cases {
@@ -181,7 +256,7 @@ func TestGetIdentitiesManagedClient(t *testing.T) {
 				t.Fatalf("expected err to be nil, got: %v", err)
 			}
 
-			azIdentity, err := tokenClient.GetIdentities(context.Background(), tc.podNamespace, tc.podName, tc.clientID, tc.resourceID)
+			azIdentity, err := tokenClient.GetIdentities(context.Background(), tc.podNamespace, tc.podName, tc.clientID, tc.resourceID, tc.objectID)
 			if tc.expectedErr != (err != nil) {
 				t.Fatalf("expected error: %v, got: %v", tc.expectedErr, err)
 			}
@@ -191,3 +266,81 @@ func TestGetIdentitiesManagedClient(t *testing.T) {
 		})
 	}
 }
+
+func TestIsResourceAllowedManagedClient(t *testing.T) {
+	azureID := aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "azid1", Namespace: "default"},
+	}
+	kubeClient := NewTestKubeClient(nil)
+	kubeClient.bindings = []aadpodid.AzureIdentityBinding{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "binding1", Namespace: "default"},
+			Spec: aadpodid.AzureIdentityBindingSpec{
+				AzureIdentity:    "azid1",
+				AllowedResources: []string{"https://vault.azure.net"},
+			},
+		},
+	}
+	tokenClient, err := NewManagedTokenClient(kubeClient, Config{Namespaced: true})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	for resource, expectedAllowed := range map[string]bool{
+		"https://vault.azure.net":       true,
+		"https://management.azure.com/": false,
+	} {
+		allowed, err := tokenClient.IsResourceAllowed(context.Background(), "default", "pod1", resource, azureID)
+		if err != nil {
+			t.Fatalf("expected err to be nil, got: %v", err)
+		}
+		if allowed != expectedAllowed {
+			t.Fatalf("expected allowed to be %v for resource %s, got: %v", expectedAllowed, resource, allowed)
+		}
+	}
+
+	// identities which aren't referenced by a binding of the pod are not allowed any resource
+	azureID.Name = "azid2"
+	allowed, err := tokenClient.IsResourceAllowed(context.Background(), "default", "pod1", "https://vault.azure.net", azureID)
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if allowed {
+		t.Fatalf("expected identity without binding not to be allowed any resource")
+	}
+}
+
+func TestGetIdentitiesManagedClientAmbiguousWeight(t *testing.T) {
+	newBinding := func(name, azureIdentity string, weight int) aadpodid.AzureIdentityBinding {
+		return aadpodid.AzureIdentityBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       aadpodid.AzureIdentityBindingSpec{AzureIdentity: azureIdentity, Weight: weight},
+		}
+	}
+	kubeClient := NewTestKubeClient([]aadpodid.AzureIdentity{
+		{ObjectMeta: metav1.ObjectMeta{Name: "azid2", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "azid1", Namespace: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "azid3", Namespace: "default"}},
+	})
+	kubeClient.bindings = []aadpodid.AzureIdentityBinding{
+		newBinding("binding1", "azid1", 1),
+		newBinding("binding2", "azid2", 1),
+		newBinding("binding3", "azid3", 0),
+	}
+	recorder := record.NewFakeRecorder(1)
+	tokenClient, err := NewManagedTokenClient(kubeClient, Config{Namespaced: true, EventRecorder: recorder})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	azIdentity, err := tokenClient.GetIdentities(context.Background(), "default", "pod1", "", "", "")
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	if azIdentity.Name != "azid1" {
+		t.Fatalf("expected azid1 to be selected, got: %s", azIdentity.Name)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected an event to be recorded for the ambiguous identity")
+	}
+}
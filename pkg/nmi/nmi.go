@@ -3,11 +3,18 @@ package nmi
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 
 	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/auth"
 	"github.com/Azure/aad-pod-identity/pkg/k8s"
+	"github.com/Azure/aad-pod-identity/pkg/utils"
 
 	"github.com/Azure/go-autorest/autorest/adal"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
@@ -29,6 +36,8 @@ type Config struct {
 	NodeName string
 	// Namespaced makes NMI looks for identities in same namespace as pods
 	Namespaced bool
+	// EventRecorder records events on pods, e.g. when the default identity of a pod is ambiguous
+	EventRecorder record.EventRecorder
 }
 
 const (
@@ -37,15 +46,42 @@ const (
 
 	// ManagedMode is the name of NMI's managed mode.
 	ManagedMode OperationMode = "managed"
+
+	// FederatedTokenAudience is the audience of the service account tokens exchanged for
+	// federated workload identities, as expected by Azure AD.
+	FederatedTokenAudience = "api://AzureADTokenExchange"
 )
 
+// PodInfo identifies the pod on whose behalf tokens are acquired.
+type PodInfo struct {
+	Namespace string
+	Name      string
+}
+
+type podInfoContextKey struct{}
+
+// WithPodInfo returns a copy of ctx which carries the pod on whose behalf tokens are acquired.
+func WithPodInfo(ctx context.Context, podns, podname string) context.Context {
+	return context.WithValue(ctx, podInfoContextKey{}, PodInfo{Namespace: podns, Name: podname})
+}
+
+// PodInfoFromContext returns the pod on whose behalf tokens are acquired, if any.
+func PodInfoFromContext(ctx context.Context) (PodInfo, bool) {
+	podInfo, ok := ctx.Value(podInfoContextKey{}).(PodInfo)
+	return podInfo, ok
+}
+
 // TokenClient is an abstraction used to retrieve pods' identities and ADAL tokens.
 type TokenClient interface {
 	// GetIdentities gets the list of identities which match the
-	// given pod in the form of AzureIdentity.
-	GetIdentities(ctx context.Context, podns, podname, clientID, resourceID string) (*aadpodid.AzureIdentity, error)
+	// given pod in the form of AzureIdentity. The identity can be requested
+	// by client id, resource id or object id.
+	GetIdentities(ctx context.Context, podns, podname, clientID, resourceID, objectID string) (*aadpodid.AzureIdentity, error)
 	// GetTokens acquires tokens by using the AzureIdentity.
 	GetTokens(ctx context.Context, clientID, resource string, podID aadpodid.AzureIdentity) (tokens []*adal.Token, err error)
+	// IsResourceAllowed returns true if the bindings of the AzureIdentity
+	// allow the given pod to request tokens for the resource.
+	IsResourceAllowed(ctx context.Context, podns, podname, resource string, podID aadpodid.AzureIdentity) (bool, error)
 }
 
 // GetTokenClient returns a token client
@@ -72,3 +108,208 @@ func GetKubeClient(nodeName, mode string, enableScaleFeatures bool) (k8s.Client,
 	// ManagedMode client doesn't require azure assigned identity informers
 	return k8s.NewKubeClient(nodeName, enableScaleFeatures, OperationMode(mode) == StandardMode)
 }
+
+// getPodKey returns the key of the pod on whose behalf tokens are acquired if the tokens
+// depend on the pod, which is only the case for federated workload identities.
+func getPodKey(ctx context.Context, azureID aadpodid.AzureIdentity) string {
+	if azureID.Spec.Type != aadpodid.FederatedWorkloadIdentity {
+		return ""
+	}
+	podInfo, ok := PodInfoFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return strings.Join([]string{podInfo.Namespace, podInfo.Name}, "/")
+}
+
+// withPodInfoFrom returns a copy of ctx which carries the pod from src, if any.
+func withPodInfoFrom(ctx, src context.Context) context.Context {
+	if podInfo, ok := PodInfoFromContext(src); ok {
+		return context.WithValue(ctx, podInfoContextKey{}, podInfo)
+	}
+	return ctx
+}
+
+// getFederatedTokens acquires tokens for a federated workload identity by exchanging
+// a token of the requesting pod's service account as client assertion.
+func getFederatedTokens(ctx context.Context, kubeClient k8s.Client, rqResource string, azureID aadpodid.AzureIdentity) ([]*adal.Token, error) {
+	podInfo, ok := PodInfoFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("pod is required to acquire tokens for federated identity %s/%s", azureID.Namespace, azureID.Name)
+	}
+
+	clientID := azureID.Spec.ClientID
+	tenantID := azureID.Spec.TenantID
+	adEndpoint := azureID.Spec.ADEndpoint
+	klog.Infof("matched identityType:%v adendpoint:%s tenantid:%s clientid:%s resource:%s",
+		azureID.Spec.Type, adEndpoint, tenantID, utils.RedactClientID(clientID), rqResource)
+
+	pod, err := kubeClient.GetPod(podInfo.Namespace, podInfo.Name)
+	if err != nil {
+		return nil, err
+	}
+	assertion, err := kubeClient.GetServiceAccountToken(&pod, FederatedTokenAudience)
+	if err != nil {
+		return nil, err
+	}
+	token, err := auth.GetServicePrincipalTokenWithClientAssertion(adEndpoint, tenantID, clientID, assertion, rqResource)
+	if err != nil {
+		return nil, err
+	}
+	return []*adal.Token{token}, nil
+}
+
+// isResourceAllowed returns true if one of the pod's bindings to the identity allows the resource.
+// A binding without allowed resources allows any resource. Pods without a binding to the identity
+// are not allowed any resource.
+func isResourceAllowed(bindings []aadpodid.AzureIdentityBinding, resource string, azureID aadpodid.AzureIdentity) bool {
+	for _, binding := range getIdentityBindings(bindings, azureID) {
+		if len(binding.Spec.AllowedResources) == 0 {
+			return true
+		}
+		for _, allowed := range binding.Spec.AllowedResources {
+			if strings.EqualFold(strings.TrimSuffix(allowed, "/"), strings.TrimSuffix(resource, "/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterIdentitiesByNamespace returns the identities which allow pods in podns to be bound to them.
+// The namespace of the pod is only looked up if an identity selects namespaces by their labels.
+func filterIdentitiesByNamespace(kubeClient k8s.Client, namespaced bool, podns, podname string, identities []aadpodid.AzureIdentity) []aadpodid.AzureIdentity {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: podns}}
+	nsFetched := false
+
+	var filtered []aadpodid.AzureIdentity
+	for i := range identities {
+		id := identities[i]
+		if id.Spec.NamespaceSelector != nil && id.Namespace != podns && !namespaced && !nsFetched {
+			fetched, err := kubeClient.GetNamespace(podns)
+			if err != nil {
+				klog.Errorf("failed to get namespace %s, identity %s/%s will be ignored for pod %s/%s, error: %+v", podns, id.Namespace, id.Name, podns, podname, err)
+				continue
+			}
+			ns, nsFetched = fetched, true
+		}
+		allowed, err := id.AllowsNamespace(ns, namespaced)
+		if err != nil {
+			klog.Errorf("failed to check if identity %s/%s allows namespace %s, error: %+v", id.Namespace, id.Name, podns, err)
+			continue
+		}
+		if !allowed {
+			klog.Errorf("pod:%s/%s has identity %s/%s but the namespace of the pod is not allowed, it will be ignored", podns, podname, id.Namespace, id.Name)
+			continue
+		}
+		filtered = append(filtered, id)
+	}
+	return filtered
+}
+
+// filterIdentitiesByPolicy returns the identities which are allowed by the AzureIdentityPolicies that apply
+// to their namespace. The namespaces of the identities are only looked up if a policy selects namespaces
+// by their labels.
+func filterIdentitiesByPolicy(kubeClient k8s.Client, podns, podname string, identities []aadpodid.AzureIdentity) []aadpodid.AzureIdentity {
+	if len(identities) == 0 {
+		return identities
+	}
+	policies, err := kubeClient.ListIdentityPolicies()
+	if err != nil {
+		klog.Errorf("failed to list AzureIdentityPolicies, identities of pod %s/%s will be ignored, error: %+v", podns, podname, err)
+		return nil
+	}
+	if len(policies) == 0 {
+		return identities
+	}
+
+	var filtered []aadpodid.AzureIdentity
+	for i, err := range aadpodid.GetPolicyViolations(policies, identities, kubeClient.GetNamespace) {
+		if err != nil {
+			klog.Errorf("pod:%s/%s has identity %s/%s which violates a policy, it will be ignored, error: %+v", podns, podname, identities[i].Namespace, identities[i].Name, err)
+			continue
+		}
+		filtered = append(filtered, identities[i])
+	}
+	return filtered
+}
+
+// getIdentityBindings returns the bindings which refer to the identity. Bindings can only
+// refer to identities in their own namespace.
+func getIdentityBindings(bindings []aadpodid.AzureIdentityBinding, azureID aadpodid.AzureIdentity) []aadpodid.AzureIdentityBinding {
+	var idBindings []aadpodid.AzureIdentityBinding
+	for _, binding := range bindings {
+		if binding.Spec.AzureIdentity == azureID.Name && binding.Namespace == azureID.Namespace {
+			idBindings = append(idBindings, binding)
+		}
+	}
+	return idBindings
+}
+
+// getIdentityWeight returns the highest weight of the bindings which refer to the identity
+func getIdentityWeight(bindings []aadpodid.AzureIdentityBinding, azureID aadpodid.AzureIdentity) int {
+	weight := 0
+	for i, binding := range getIdentityBindings(bindings, azureID) {
+		if i == 0 || binding.Spec.Weight > weight {
+			weight = binding.Spec.Weight
+		}
+	}
+	return weight
+}
+
+// SelectDefaultIdentity selects the identity used for token requests which don't specify one.
+// The identity with the highest weight among the pod's bindings wins; ties are broken by the
+// namespace and name of the identities so the selection doesn't depend on the order of the cache.
+// The identities with the same weight as the selected one are returned if the choice is ambiguous.
+func SelectDefaultIdentity(identities []aadpodid.AzureIdentity, bindings []aadpodid.AzureIdentityBinding) (aadpodid.AzureIdentity, []aadpodid.AzureIdentity) {
+	candidates := make([]aadpodid.AzureIdentity, len(identities))
+	copy(candidates, identities)
+	weights := make(map[string]int, len(candidates))
+	for _, id := range candidates {
+		weights[getIdentityKey(id)] = getIdentityWeight(bindings, id)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		wi, wj := weights[getIdentityKey(candidates[i])], weights[getIdentityKey(candidates[j])]
+		if wi != wj {
+			return wi > wj
+		}
+		return getIdentityKey(candidates[i]) < getIdentityKey(candidates[j])
+	})
+
+	var tied []aadpodid.AzureIdentity
+	for _, id := range candidates {
+		if weights[getIdentityKey(id)] == weights[getIdentityKey(candidates[0])] {
+			tied = append(tied, id)
+		}
+	}
+	if len(tied) == 1 {
+		return candidates[0], nil
+	}
+	return candidates[0], tied
+}
+
+func getIdentityKey(azureID aadpodid.AzureIdentity) string {
+	return strings.Join([]string{azureID.Namespace, azureID.Name}, "/")
+}
+
+// recordAmbiguousIdentityEvent records an event on the pod if its default identity was selected
+// among identities with the same weight.
+func recordAmbiguousIdentityEvent(recorder record.EventRecorder, kubeClient k8s.Client, podns, podname string, selected aadpodid.AzureIdentity, tied []aadpodid.AzureIdentity) {
+	var names []string
+	for _, id := range tied {
+		names = append(names, getIdentityKey(id))
+	}
+	message := fmt.Sprintf("identities %s are bound to the pod with the same weight, %s is used for token requests without client_id, object_id or msi_res_id",
+		strings.Join(names, ", "), getIdentityKey(selected))
+	klog.Warningf("%s, pod: %s/%s", message, podns, podname)
+	if recorder == nil {
+		return
+	}
+	pod, err := kubeClient.GetPod(podns, podname)
+	if err != nil {
+		klog.Errorf("failed to get pod %s/%s to record event, error: %+v", podns, podname, err)
+		return
+	}
+	recorder.Event(&pod, v1.EventTypeWarning, "ambiguous identity", message)
+}
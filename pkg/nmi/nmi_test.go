@@ -0,0 +1,94 @@
+package nmi
+
+import (
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSelectDefaultIdentity(t *testing.T) {
+	newIdentity := func(ns, name string) aadpodid.AzureIdentity {
+		return aadpodid.AzureIdentity{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns}}
+	}
+	newBinding := func(ns, name, azureIdentity string, weight int) aadpodid.AzureIdentityBinding {
+		return aadpodid.AzureIdentityBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+			Spec:       aadpodid.AzureIdentityBindingSpec{AzureIdentity: azureIdentity, Weight: weight},
+		}
+	}
+
+	cases := []struct {
+		desc             string
+		identities       []aadpodid.AzureIdentity
+		bindings         []aadpodid.AzureIdentityBinding
+		expectedIdentity string
+		expectedTied     int
+	}{
+		{
+			desc:             "single identity",
+			identities:       []aadpodid.AzureIdentity{newIdentity("default", "azid1")},
+			bindings:         []aadpodid.AzureIdentityBinding{newBinding("default", "binding1", "azid1", 0)},
+			expectedIdentity: "default/azid1",
+		},
+		{
+			desc:       "highest weight wins",
+			identities: []aadpodid.AzureIdentity{newIdentity("default", "azid1"), newIdentity("default", "azid2"), newIdentity("default", "azid3")},
+			bindings: []aadpodid.AzureIdentityBinding{
+				newBinding("default", "binding1", "azid1", 1),
+				newBinding("default", "binding2", "azid2", 10),
+				newBinding("default", "binding3", "azid3", 5),
+			},
+			expectedIdentity: "default/azid2",
+		},
+		{
+			desc:       "highest weight of multiple bindings to the identity",
+			identities: []aadpodid.AzureIdentity{newIdentity("default", "azid1"), newIdentity("default", "azid2")},
+			bindings: []aadpodid.AzureIdentityBinding{
+				newBinding("default", "binding1", "azid1", 1),
+				newBinding("default", "binding2", "azid1", 20),
+				newBinding("default", "binding3", "azid2", 10),
+			},
+			expectedIdentity: "default/azid1",
+		},
+		{
+			desc:       "bindings in another namespace are ignored",
+			identities: []aadpodid.AzureIdentity{newIdentity("default", "azid1"), newIdentity("default", "azid2")},
+			bindings: []aadpodid.AzureIdentityBinding{
+				newBinding("other", "binding1", "azid1", 20),
+				newBinding("default", "binding2", "azid2", 10),
+			},
+			expectedIdentity: "default/azid2",
+		},
+		{
+			desc:       "tie broken by namespace and name",
+			identities: []aadpodid.AzureIdentity{newIdentity("default", "azid3"), newIdentity("default", "azid2"), newIdentity("default", "azid1")},
+			bindings: []aadpodid.AzureIdentityBinding{
+				newBinding("default", "binding1", "azid1", 5),
+				newBinding("default", "binding2", "azid2", 5),
+				newBinding("default", "binding3", "azid3", 1),
+			},
+			expectedIdentity: "default/azid1",
+			expectedTied:     2,
+		},
+		{
+			desc:             "no bindings",
+			identities:       []aadpodid.AzureIdentity{newIdentity("default", "azid2"), newIdentity("default", "azid1")},
+			expectedIdentity: "default/azid1",
+			expectedTied:     2,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			id, tied := SelectDefaultIdentity(tc.identities, tc.bindings)
+			if key := getIdentityKey(id); key != tc.expectedIdentity {
+				t.Fatalf("expected identity %s, got: %s", tc.expectedIdentity, key)
+			}
+			if len(tied) != tc.expectedTied {
+				t.Fatalf("expected %d tied identities, got: %d", tc.expectedTied, len(tied))
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"net/http"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/nmi"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// identityHeader is the header which carries the secret of the App Service managed identity protocol
+	identityHeader = "X-IDENTITY-HEADER"
+)
+
+// identityEndpointResponse is the token response of the App Service managed identity protocol,
+// which is served at IDENTITY_ENDPOINT.
+type identityEndpointResponse struct {
+	AccessToken string `json:"access_token"`
+	// ExpiresOn is the expiry of the token in seconds since epoch
+	ExpiresOn string `json:"expires_on"`
+	Resource  string `json:"resource"`
+	Type      string `json:"token_type"`
+	ClientID  string `json:"client_id"`
+}
+
+// parseIdentityEndpointTokenRequest parses a token request of the App Service managed identity protocol.
+// It uses principal_id instead of object_id to identify an identity by its object id.
+func parseIdentityEndpointTokenRequest(r *http.Request) (request TokenRequest) {
+	request = parseTokenRequest(r)
+	if request.ObjectID == "" {
+		request.ObjectID = r.URL.Query().Get("principal_id")
+	}
+	return request
+}
+
+// identityEndpointHandler serves token requests of the App Service managed identity protocol
+// for pods that set IDENTITY_ENDPOINT to NMI. The pod is identified by its IP and has to present the
+// identity header of its IdentityHeaderAnnotationKey annotation, after which the same identity
+// matching as in msiHandler applies.
+func (s *Server) identityEndpointHandler(w http.ResponseWriter, r *http.Request) (ns string) {
+	podIP := parseRemoteAddr(r.RemoteAddr)
+	tokenRequest := parseIdentityEndpointTokenRequest(r)
+
+	if podIP == "" {
+		klog.Error("request remote address is empty")
+		writeErrorResponse(w, http.StatusInternalServerError, "request remote address is empty")
+		return
+	}
+	if !tokenRequest.ValidateResourceParamExists() {
+		klog.Warning("parameter resource cannot be empty")
+		writeErrorResponse(w, http.StatusBadRequest, missingResourceDescription)
+		return
+	}
+
+	podns, podname, _, _, err := s.KubeClient.GetPodInfo(podIP)
+	if err != nil {
+		klog.Errorf("failed to get pod info from pod IP: %s, error: %+v", podIP, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// set ns for using in metrics
+	ns = podns
+
+	pod, err := s.KubeClient.GetPod(podns, podname)
+	if err != nil {
+		klog.Errorf("failed to get pod %s/%s, error: %+v", podns, podname, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// the header is generated for each pod by the mutating webhook, pods without it can't use the protocol
+	expected := pod.Annotations[aadpodid.IdentityHeaderAnnotationKey]
+	if expected == "" || !hmac.Equal([]byte(r.Header.Get(identityHeader)), []byte(expected)) {
+		klog.Errorf("invalid %s in request from pod %s/%s", identityHeader, podns, podname)
+		writeErrorResponse(w, http.StatusUnauthorized, "invalid "+identityHeader)
+		return
+	}
+
+	podID, err := s.TokenClient.GetIdentities(r.Context(), podns, podname, tokenRequest.ClientID, tokenRequest.ResourceID, tokenRequest.ObjectID)
+	if err != nil {
+		klog.Errorf("failed to get matching identities for pod: %s/%s, error: %+v", podns, podname, err)
+		writeErrorResponse(w, getIdentitiesErrorStatusCode(w, podID), err.Error())
+		return
+	}
+	if statusCode, err := s.validateResource(r.Context(), podns, podname, tokenRequest.Resource, podID); err != nil {
+		writeErrorResponse(w, statusCode, err.Error())
+		return
+	}
+
+	tokens, err := s.TokenClient.GetTokens(nmi.WithPodInfo(r.Context(), podns, podname), tokenRequest.ClientID, tokenRequest.Resource, *podID)
+	if err != nil {
+		klog.Errorf("failed to get service principal token for pod: %s/%s, error: %+v", podns, podname, err)
+		writeErrorResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	// the protocol has no notion of auxiliary tokens, only the primary token is returned
+	token := tokens[0]
+	response, err := json.Marshal(identityEndpointResponse{
+		AccessToken: token.AccessToken,
+		ExpiresOn:   token.ExpiresOn.String(),
+		Resource:    token.Resource,
+		Type:        token.Type,
+		ClientID:    podID.Spec.ClientID,
+	})
+	if err != nil {
+		klog.Errorf("failed to marshal service principal token for pod: %s/%s, error: %+v", podns, podname, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, _ = w.Write(response)
+	return
+}
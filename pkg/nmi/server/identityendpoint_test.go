@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/k8s"
+	"github.com/Azure/aad-pod-identity/pkg/nmi"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakePodKubeClient struct {
+	k8s.Client
+	pod           v1.Pod
+	exceptionsErr error
+}
+
+func (c *fakePodKubeClient) GetPodInfo(podip string) (string, string, string, *metav1.LabelSelector, error) {
+	if podip != c.pod.Status.PodIP {
+		return "", "", "", nil, fmt.Errorf("failed to match pod IP %s", podip)
+	}
+	return c.pod.Namespace, c.pod.Name, "", &metav1.LabelSelector{MatchLabels: c.pod.Labels}, nil
+}
+
+func (c *fakePodKubeClient) GetPod(podns, podname string) (v1.Pod, error) {
+	return c.pod, nil
+}
+
+func (c *fakePodKubeClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodIdentityException, error) {
+	return &[]aadpodid.AzurePodIdentityException{}, c.exceptionsErr
+}
+
+type fakeIdentityTokenClient struct {
+	nmi.TokenClient
+	azureID *aadpodid.AzureIdentity
+	// identityErr is returned along with azureID, which is the contract
+	// for identities that are still in CREATED state
+	identityErr error
+	tokenErr    error
+	// deniedResource is not allowed by the bindings of the identity
+	deniedResource string
+}
+
+func (c *fakeIdentityTokenClient) IsResourceAllowed(ctx context.Context, podns, podname, resource string, azureID aadpodid.AzureIdentity) (bool, error) {
+	return resource != c.deniedResource, nil
+}
+
+func (c *fakeIdentityTokenClient) GetIdentities(ctx context.Context, podns, podname, clientID, resourceID, objectID string) (*aadpodid.AzureIdentity, error) {
+	if c.identityErr != nil {
+		return c.azureID, c.identityErr
+	}
+	if c.azureID == nil {
+		return nil, fmt.Errorf("no azure identity found for request clientID %s", clientID)
+	}
+	return c.azureID, nil
+}
+
+func (c *fakeIdentityTokenClient) GetTokens(ctx context.Context, clientID, resource string, azureID aadpodid.AzureIdentity) ([]*adal.Token, error) {
+	if _, ok := nmi.PodInfoFromContext(ctx); !ok {
+		return nil, fmt.Errorf("pod is missing from token request")
+	}
+	if c.tokenErr != nil {
+		return nil, c.tokenErr
+	}
+	return []*adal.Token{{
+		AccessToken: "token",
+		ExpiresOn:   "1600000000",
+		Resource:    resource,
+		Type:        "Bearer",
+	}}, nil
+}
+
+func TestIdentityEndpointHandler(t *testing.T) {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pod1",
+			Namespace:   "default",
+			Annotations: map[string]string{aadpodid.IdentityHeaderAnnotationKey: "header1"},
+		},
+		Spec:   v1.PodSpec{ServiceAccountName: "sa1"},
+		Status: v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	azureID := &aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "azid1", Namespace: "default"},
+		Spec:       aadpodid.AzureIdentitySpec{ClientID: "clientid1"},
+	}
+
+	cases := []struct {
+		desc               string
+		remoteAddr         string
+		query              string
+		header             string
+		podAnnotations     map[string]string
+		azureID            *aadpodid.AzureIdentity
+		expectedStatusCode int
+	}{
+		{
+			desc:               "token acquired",
+			remoteAddr:         "10.0.0.1:12345",
+			query:              "?resource=https://vault.azure.net&api-version=2019-08-01",
+			header:             "header1",
+			azureID:            azureID,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			desc:               "missing resource",
+			remoteAddr:         "10.0.0.1:12345",
+			query:              "?api-version=2019-08-01",
+			header:             "header1",
+			azureID:            azureID,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			desc:               "missing identity header",
+			remoteAddr:         "10.0.0.1:12345",
+			query:              "?resource=https://vault.azure.net&api-version=2019-08-01",
+			azureID:            azureID,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			desc:               "identity header of another pod",
+			remoteAddr:         "10.0.0.1:12345",
+			query:              "?resource=https://vault.azure.net&api-version=2019-08-01",
+			header:             "header2",
+			azureID:            azureID,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			desc:               "pod without identity header",
+			remoteAddr:         "10.0.0.1:12345",
+			query:              "?resource=https://vault.azure.net&api-version=2019-08-01",
+			podAnnotations:     map[string]string{},
+			azureID:            azureID,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			desc:               "unknown pod",
+			remoteAddr:         "10.0.0.2:12345",
+			query:              "?resource=https://vault.azure.net&api-version=2019-08-01",
+			header:             "header1",
+			azureID:            azureID,
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+		{
+			desc:               "no matching identity",
+			remoteAddr:         "10.0.0.1:12345",
+			query:              "?resource=https://vault.azure.net&api-version=2019-08-01",
+			header:             "header1",
+			expectedStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			setup()
+			defer teardown()
+
+			pod := pod
+			if tc.podAnnotations != nil {
+				pod.Annotations = tc.podAnnotations
+			}
+			s := &Server{
+				KubeClient:           &fakePodKubeClient{pod: pod},
+				TokenClient:          &fakeIdentityTokenClient{azureID: tc.azureID},
+				IdentityEndpointPath: "/msi/token",
+			}
+			mux.Handle(s.IdentityEndpointPath, appHandler(s.identityEndpointHandler))
+
+			req, err := http.NewRequest(http.MethodGet, s.IdentityEndpointPath+tc.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = tc.remoteAddr
+			if tc.header != "" {
+				req.Header.Set(identityHeader, tc.header)
+			}
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, got: %d, body: %s", tc.expectedStatusCode, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var resp identityEndpointResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal response, error: %+v", err)
+			}
+			expected := identityEndpointResponse{
+				AccessToken: "token",
+				ExpiresOn:   "1600000000",
+				Resource:    "https://vault.azure.net",
+				Type:        "Bearer",
+				ClientID:    "clientid1",
+			}
+			if resp != expected {
+				t.Fatalf("expected response %+v, got: %+v", expected, resp)
+			}
+		})
+	}
+}
+
+func TestParseIdentityEndpointTokenRequest(t *testing.T) {
+	const objectID = "2d1e5e6a-6b2c-4f0d-9b7d-6a2d1c3e4f5a"
+
+	req, err := http.NewRequest(http.MethodGet, "/msi/token?resource=https://vault.azure.net&principal_id="+objectID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := parseIdentityEndpointTokenRequest(req)
+	if result.ObjectID != objectID {
+		t.Errorf("invalid ObjectID - expected: %q, actual: %q", objectID, result.ObjectID)
+	}
+	if result.Resource != "https://vault.azure.net" {
+		t.Errorf("invalid Resource - expected: %q, actual: %q", "https://vault.azure.net", result.Resource)
+	}
+}
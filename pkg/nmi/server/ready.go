@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/klog/v2"
+)
+
+// IdentityReadyPath is the path at which pods check whether their identity is assigned,
+// e.g. from an init container which waits until the pod can acquire tokens.
+const IdentityReadyPath = "/aadpodidentity/ready"
+
+// identityReadyResponse is returned once the identity of a pod is assigned.
+type identityReadyResponse struct {
+	ClientID string `json:"client_id"`
+}
+
+// identityReadyHandler responds with 200 OK once the identity requested with client_id, object_id or
+// mi_res_id, or the default identity of the pod, is assigned to the node. The pod is identified by its
+// IP. Like token requests, it blocks until the identity is assigned or the retries of NMI are exhausted.
+func (s *Server) identityReadyHandler(w http.ResponseWriter, r *http.Request) (ns string) {
+	podIP := parseRemoteAddr(r.RemoteAddr)
+	tokenRequest := parseIdentityEndpointTokenRequest(r)
+
+	if podIP == "" {
+		klog.Error("request remote address is empty")
+		writeErrorResponse(w, http.StatusInternalServerError, "request remote address is empty")
+		return
+	}
+
+	podns, podname, _, _, err := s.KubeClient.GetPodInfo(podIP)
+	if err != nil {
+		klog.Errorf("failed to get pod info from pod IP: %s, error: %+v", podIP, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// set ns for using in metrics
+	ns = podns
+
+	podID, err := s.TokenClient.GetIdentities(r.Context(), podns, podname, tokenRequest.ClientID, tokenRequest.ResourceID, tokenRequest.ObjectID)
+	if err != nil {
+		klog.Errorf("failed to get matching identities for pod: %s/%s, error: %+v", podns, podname, err)
+		writeErrorResponse(w, getIdentitiesErrorStatusCode(w, podID), err.Error())
+		return
+	}
+
+	response, err := json.Marshal(identityReadyResponse{ClientID: podID.Spec.ClientID})
+	if err != nil {
+		klog.Errorf("failed to marshal response for pod: %s/%s, error: %+v", podns, podname, err)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, _ = w.Write(response)
+	return
+}
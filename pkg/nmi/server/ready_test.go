@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIdentityReadyHandler(t *testing.T) {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Status:     v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	azureID := &aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "azid1", Namespace: "default"},
+		Spec:       aadpodid.AzureIdentitySpec{ClientID: "clientid1"},
+	}
+
+	cases := []struct {
+		desc               string
+		remoteAddr         string
+		azureID            *aadpodid.AzureIdentity
+		identityErr        error
+		expectedStatusCode int
+	}{
+		{
+			desc:               "identity assigned",
+			remoteAddr:         "10.0.0.1:12345",
+			azureID:            azureID,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			desc:               "identity not assigned yet",
+			remoteAddr:         "10.0.0.1:12345",
+			azureID:            azureID,
+			identityErr:        errors.New("getting assigned identities in ASSIGNED state failed"),
+			expectedStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			desc:               "no matching identity",
+			remoteAddr:         "10.0.0.1:12345",
+			expectedStatusCode: http.StatusNotFound,
+		},
+		{
+			desc:               "unknown pod",
+			remoteAddr:         "10.0.0.2:12345",
+			azureID:            azureID,
+			expectedStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			setup()
+			defer teardown()
+
+			s := &Server{
+				KubeClient:  &fakePodKubeClient{pod: pod},
+				TokenClient: &fakeIdentityTokenClient{azureID: tc.azureID, identityErr: tc.identityErr},
+			}
+			mux.Handle(IdentityReadyPath, appHandler(s.identityReadyHandler))
+
+			req, err := http.NewRequest(http.MethodGet, IdentityReadyPath+"?client_id=clientid1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = tc.remoteAddr
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, got: %d, body: %s", tc.expectedStatusCode, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var resp identityReadyResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal response, error: %+v", err)
+			}
+			if resp.ClientID != "clientid1" {
+				t.Fatalf("expected client id clientid1, got: %s", resp.ClientID)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,12 +28,40 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
 const (
 	localhost = "127.0.0.1"
+
+	// identityNotAssignedRetryAfterSeconds is the Retry-After sent to clients
+	// while the matched identity is still being assigned to the node
+	identityNotAssignedRetryAfterSeconds = 5
+	// missingResourceDescription is the description IMDS returns when the resource parameter is missing
+	missingResourceDescription = "Required query variable 'resource' is missing"
+	// missingAPIVersionDescription is the description IMDS returns when the api-version parameter is missing
+	missingAPIVersionDescription = "Required query variable 'api-version' is missing"
+
+	// apiVersionLayout is the date format of IMDS api versions
+	apiVersionLayout = "2006-01-02"
+	// defaultScopeSuffix is the suffix of AAD v2 scopes which request all static permissions of a resource
+	defaultScopeSuffix = "/.default"
+)
+
+// minAPIVersion is the oldest IMDS api version with support for managed identity tokens
+var minAPIVersion = time.Date(2018, time.February, 1, 0, 0, 0, 0, time.UTC)
+
+// OAuth 2.0 error codes returned in error responses, as IMDS does.
+const (
+	invalidRequestError         = "invalid_request"
+	unauthorizedClientError     = "unauthorized_client"
+	accessDeniedError           = "access_denied"
+	temporarilyUnavailableError = "temporarily_unavailable"
+	serverError                 = "server_error"
 )
 
 // Server encapsulates all of the parameters necessary for starting up
@@ -50,9 +80,14 @@ type Server struct {
 	Initialized                        bool
 	BlockInstanceMetadata              bool
 	MetadataHeaderRequired             bool
+	// IdentityEndpointPath is the path at which the App Service managed identity protocol is served.
+	// The protocol is disabled if it is empty.
+	IdentityEndpointPath string
 	// TokenClient is client that fetches identities and tokens
 	TokenClient nmi.TokenClient
 	Reporter    *metrics.Reporter
+	// EventRecorder records events on pods whose token requests are denied
+	EventRecorder record.EventRecorder
 }
 
 type RedirectorFunc func(*Server, chan<- struct{}, <-chan struct{})
@@ -63,11 +98,12 @@ type NMIResponse struct {
 	ClientID string      `json:"clientid"`
 }
 
-// MetadataResponse represents the error returned
-// to caller when metadata header is not specified.
+// MetadataResponse represents the error returned to caller,
+// e.g. when metadata header is not specified.
 type MetadataResponse struct {
 	Error            string `json:"error"`
 	ErrorDescription string `json:"error_description"`
+	CorrelationID    string `json:"correlation_id,omitempty"`
 }
 
 // NewServer will create a new Server with default values.
@@ -77,6 +113,10 @@ func NewServer(micNamespace string, blockInstanceMetadata bool, metadataHeaderRe
 	podObjCh := make(chan *v1.Pod, 100)
 	podClient := pod.NewPodClientWithPodInfoCh(informer, podObjCh)
 
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "nmi"})
+
 	reporter, err := metrics.NewReporter()
 	if err != nil {
 		klog.Errorf("failed to create reporter for metrics, error: %+v", err)
@@ -92,6 +132,7 @@ func NewServer(micNamespace string, blockInstanceMetadata bool, metadataHeaderRe
 		Reporter:               reporter,
 		PodClient:              podClient,
 		PodObjChannel:          podObjCh,
+		EventRecorder:          recorder,
 	}
 }
 
@@ -101,6 +142,10 @@ func (s *Server) Run() error {
 	mux.Handle("/metadata/identity/oauth2/token/", appHandler(s.msiHandler))
 	mux.Handle("/host/token", appHandler(s.hostHandler))
 	mux.Handle("/host/token/", appHandler(s.hostHandler))
+	if s.IdentityEndpointPath != "" {
+		mux.Handle(s.IdentityEndpointPath, appHandler(s.identityEndpointHandler))
+	}
+	mux.Handle(IdentityReadyPath, appHandler(s.identityReadyHandler))
 	if s.BlockInstanceMetadata {
 		mux.Handle("/metadata/instance", http.HandlerFunc(forbiddenHandler))
 	}
@@ -154,7 +199,7 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				err = errors.New("unknown error")
 			}
 			klog.Errorf("panic processing request: %+v, file: %s, line: %d, stacktrace: '%s' %s res.status=%d", r, file, line, stack, tracker, http.StatusInternalServerError)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeErrorResponse(w, http.StatusInternalServerError, err.Error())
 		}
 	}()
 	rw := newResponseWriter(w)
@@ -184,32 +229,36 @@ func (s *Server) hostHandler(w http.ResponseWriter, r *http.Request) (ns string)
 	podns, podname := parsePodInfo(r)
 	if podns == "" || podname == "" {
 		klog.Error("missing podname and podns from request")
-		http.Error(w, "missing 'podname' and 'podns' from request header", http.StatusBadRequest)
+		writeErrorResponse(w, http.StatusBadRequest, "missing 'podname' and 'podns' from request header")
 		return
 	}
 	// set the ns so it can be used for metrics
 	ns = podns
 	if hostIP != localhost {
 		klog.Errorf("request remote address is not from a host")
-		http.Error(w, "request remote address is not from a host", http.StatusInternalServerError)
+		writeErrorResponse(w, http.StatusInternalServerError, "request remote address is not from a host")
 		return
 	}
 	if !tokenRequest.ValidateResourceParamExists() {
 		klog.Warning("parameter resource cannot be empty")
-		http.Error(w, "parameter resource cannot be empty", http.StatusBadRequest)
+		writeErrorResponse(w, http.StatusBadRequest, missingResourceDescription)
 		return
 	}
 
-	podID, err := s.TokenClient.GetIdentities(r.Context(), podns, podname, tokenRequest.ClientID, tokenRequest.ResourceID)
+	podID, err := s.TokenClient.GetIdentities(r.Context(), podns, podname, tokenRequest.ClientID, tokenRequest.ResourceID, tokenRequest.ObjectID)
 	if err != nil {
 		klog.Errorf("failed to get identities, error: %+v", err)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeErrorResponse(w, getIdentitiesErrorStatusCode(w, podID), err.Error())
 		return
 	}
-	tokens, err := s.TokenClient.GetTokens(r.Context(), tokenRequest.ClientID, tokenRequest.Resource, *podID)
+	if statusCode, err := s.validateResource(r.Context(), podns, podname, tokenRequest.Resource, podID); err != nil {
+		writeErrorResponse(w, statusCode, err.Error())
+		return
+	}
+	tokens, err := s.TokenClient.GetTokens(nmi.WithPodInfo(r.Context(), podns, podname), tokenRequest.ClientID, tokenRequest.Resource, *podID)
 	if err != nil {
 		klog.Errorf("failed to get service principal token for pod:%s/%s, error: %+v", podns, podname, err)
-		http.Error(w, err.Error(), http.StatusForbidden)
+		writeErrorResponse(w, http.StatusForbidden, err.Error())
 		return
 	}
 	nmiResp := NMIResponse{
@@ -219,7 +268,7 @@ func (s *Server) hostHandler(w http.ResponseWriter, r *http.Request) (ns string)
 	response, err := json.Marshal(nmiResp)
 	if err != nil {
 		klog.Errorf("failed to marshal service principal token and clientid for pod:%s/%s, error: %+v", podns, podname, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	_, _ = w.Write(response)
@@ -323,13 +372,19 @@ func (s *Server) msiHandler(w http.ResponseWriter, r *http.Request) (ns string)
 	if podIP == "" {
 		klog.Error("request remote address is empty")
 		stausCode = http.StatusInternalServerError
-		http.Error(w, "request remote address is empty", stausCode)
+		writeErrorResponse(w, stausCode, "request remote address is empty")
 		return
 	}
 	if !tokenRequest.ValidateResourceParamExists() {
 		klog.Warning("parameter resource cannot be empty")
 		stausCode = http.StatusBadRequest
-		http.Error(w, "parameter resource cannot be empty", stausCode)
+		writeErrorResponse(w, stausCode, missingResourceDescription)
+		return
+	}
+	if err = tokenRequest.Validate(); err != nil {
+		klog.Warningf("invalid token request, error: %+v", err)
+		stausCode = http.StatusBadRequest
+		writeErrorResponse(w, stausCode, err.Error())
 		return
 	}
 
@@ -337,7 +392,7 @@ func (s *Server) msiHandler(w http.ResponseWriter, r *http.Request) (ns string)
 	if err != nil {
 		klog.Errorf("failed to get pod info from pod IP: %s, error: %+v", podIP, err)
 		stausCode = http.StatusInternalServerError
-		http.Error(w, err.Error(), stausCode)
+		writeErrorResponse(w, stausCode, err.Error())
 		return
 	}
 	// set ns for using in metrics
@@ -347,7 +402,7 @@ func (s *Server) msiHandler(w http.ResponseWriter, r *http.Request) (ns string)
 	if err != nil {
 		klog.Errorf("getting list of azurepodidentityexception in %s namespace failed with error: %+v", podns, err)
 		stausCode = http.StatusInternalServerError
-		http.Error(w, err.Error(), stausCode)
+		writeErrorResponse(w, stausCode, err.Error())
 		return
 	}
 
@@ -359,27 +414,31 @@ func (s *Server) msiHandler(w http.ResponseWriter, r *http.Request) (ns string)
 		if err != nil {
 			klog.Errorf("failed to get service principal token for pod:%s/%s with error code %d, error: %+v", podns, podname, errorCode, err)
 			stausCode = errorCode
-			http.Error(w, err.Error(), errorCode)
+			writeErrorResponse(w, errorCode, err.Error())
 			return
 		}
 		_, _ = w.Write(response)
 		return
 	}
 
-	podID, err := s.TokenClient.GetIdentities(r.Context(), podns, podname, tokenRequest.ClientID, tokenRequest.ResourceID)
+	podID, err := s.TokenClient.GetIdentities(r.Context(), podns, podname, tokenRequest.ClientID, tokenRequest.ResourceID, tokenRequest.ObjectID)
 	if err != nil {
 		klog.Errorf("failed to get matching identities for pod: %s/%s, error: %+v", podns, podname, err)
-		stausCode = http.StatusNotFound
-		http.Error(w, err.Error(), stausCode)
+		stausCode = getIdentitiesErrorStatusCode(w, podID)
+		writeErrorResponse(w, stausCode, err.Error())
+		return
+	}
+	if stausCode, err = s.validateResource(r.Context(), podns, podname, tokenRequest.Resource, podID); err != nil {
+		writeErrorResponse(w, stausCode, err.Error())
 		return
 	}
 
-	tokens, err := s.TokenClient.GetTokens(r.Context(), tokenRequest.ClientID, tokenRequest.Resource, *podID)
+	tokens, err := s.TokenClient.GetTokens(nmi.WithPodInfo(r.Context(), podns, podname), tokenRequest.ClientID, tokenRequest.Resource, *podID)
 	if err != nil {
 		klog.Errorf("failed to get service principal token for pod: %s/%s, error: %+v", podns, podname, err)
 		// Mark stausCode as StatusInternalServerError since we would like to consider this as nmi itself issue for alerting purpose
 		stausCode = http.StatusInternalServerError
-		http.Error(w, err.Error(), http.StatusForbidden)
+		writeErrorResponse(w, http.StatusForbidden, err.Error())
 		return
 	}
 
@@ -398,33 +457,105 @@ func (s *Server) msiHandler(w http.ResponseWriter, r *http.Request) (ns string)
 	if err != nil {
 		klog.Errorf("failed to marshal service principal token for pod: %s/%s, error: %+v", podns, podname, err)
 		stausCode = http.StatusInternalServerError
-		http.Error(w, err.Error(), stausCode)
+		writeErrorResponse(w, stausCode, err.Error())
 		return
 	}
 	_, _ = w.Write(response)
 	return
 }
 
-// Error replies to the request without the specified metadata header.
+// validateResource checks that the bindings of the identity allow the pod to request a token
+// for the resource. Denied requests are recorded as an event on the pod. It returns the status
+// code with which the request should be answered if the resource can't be validated or is denied.
+func (s *Server) validateResource(ctx context.Context, podns, podname, resource string, podID *aadpodid.AzureIdentity) (int, error) {
+	allowed, err := s.TokenClient.IsResourceAllowed(ctx, podns, podname, resource, *podID)
+	if err != nil {
+		klog.Errorf("failed to validate resource %s for pod: %s/%s, error: %+v", resource, podns, podname, err)
+		return http.StatusInternalServerError, err
+	}
+	if allowed {
+		return http.StatusOK, nil
+	}
+
+	message := fmt.Sprintf("token request for resource %s with identity %s/%s is not allowed by the AzureIdentityBindings of the pod", resource, podID.Namespace, podID.Name)
+	klog.Errorf("%s, pod: %s/%s", message, podns, podname)
+	if s.EventRecorder != nil {
+		pod, err := s.KubeClient.GetPod(podns, podname)
+		if err != nil {
+			klog.Errorf("failed to get pod %s/%s to record event, error: %+v", podns, podname, err)
+		} else {
+			s.EventRecorder.Event(&pod, v1.EventTypeWarning, "resource not allowed", message)
+		}
+	}
+	return http.StatusForbidden, errors.New(message)
+}
+
+// metadataNotSpecifiedError replies to the request without the specified metadata header.
 // It does not otherwise end the request; the caller should ensure no further
 // writes are done to w.
 func metadataNotSpecifiedError(w http.ResponseWriter) {
-	metadataResp := MetadataResponse{
-		Error:            "invalid_request",
-		ErrorDescription: "Required metadata header not specified",
+	writeErrorResponse(w, http.StatusBadRequest, "Required metadata header not specified")
+}
+
+// writeErrorResponse replies to the request with the error in the format used by IMDS,
+// so that the azure-identity SDKs are able to parse the error and retry if applicable.
+// It does not otherwise end the request; the caller should ensure no further
+// writes are done to w.
+func writeErrorResponse(w http.ResponseWriter, statusCode int, description string) {
+	errorResp := MetadataResponse{
+		Error:            getErrorCode(statusCode),
+		ErrorDescription: description,
+		CorrelationID:    newCorrelationID(),
 	}
-	response, err := json.Marshal(metadataResp)
+	response, err := json.Marshal(errorResp)
 	if err != nil {
-		klog.Errorf("failed to marshal metadata response, %+v", err)
+		klog.Errorf("failed to marshal error response, %+v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	klog.Infof("responding with status code %d, correlation id: %s", statusCode, errorResp.CorrelationID)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(statusCode)
 	fmt.Fprintln(w, string(response))
 }
 
+// newCorrelationID returns a random (version 4) UUID which identifies an error response in the logs.
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// getIdentitiesErrorStatusCode returns the status code for a failure to get the identities of a pod.
+// A non-nil identity indicates that an identity has been matched but is still being assigned to the
+// node, in which case the client is asked to retry later.
+func getIdentitiesErrorStatusCode(w http.ResponseWriter, podID *aadpodid.AzureIdentity) int {
+	if podID != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(identityNotAssignedRetryAfterSeconds))
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusNotFound
+}
+
+// getErrorCode returns the OAuth 2.0 error code for the status code of an error response.
+func getErrorCode(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusNotFound:
+		return invalidRequestError
+	case http.StatusUnauthorized:
+		return unauthorizedClientError
+	case http.StatusForbidden:
+		return accessDeniedError
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return temporarilyUnavailableError
+	default:
+		return serverError
+	}
+}
+
 func parseMetadata(r *http.Request) (metadata string) {
 	return r.Header.Get("metadata")
 }
@@ -452,19 +583,34 @@ func parseRemoteAddr(addr string) string {
 type TokenRequest struct {
 	// ClientID identifies, by Azure AD client ID, a specific identity to use
 	// when authenticating to Azure AD. It is mutually exclusive with
-	// MsiResourceID.
+	// ObjectID and MsiResourceID.
 	// Example: 77788899-f67e-42e1-9a78-89985f6bff3e
 	ClientID string
 
+	// ObjectID identifies, by Azure AD object ID, a specific identity to use
+	// when authenticating to Azure AD. It is mutually exclusive with
+	// ClientID and MsiResourceID.
+	// Example: 2d1e5e6a-6b2c-4f0d-9b7d-6a2d1c3e4f5a
+	ObjectID string
+
 	// MsiResourceID identifies, by urlencoded ARM resource ID, a specific
 	// identity to use when authenticating to Azure AD. It is mutually exclusive
-	// with ClientID.
+	// with ClientID and ObjectID.
 	// Example: /subscriptions/<subid>/resourcegroups/<resourcegroup>/providers/Microsoft.ManagedIdentity/userAssignedIdentities/<name>
 	ResourceID string
 
 	// Resource is the urlencoded URI of the resource for the requested AD token.
+	// If the request only specifies an AAD v2 scope, the resource is derived from it.
 	// Example: https://vault.azure.net.
 	Resource string
+
+	// Scope is the AAD v2 scope of the requested AD token.
+	// Example: https://vault.azure.net/.default
+	Scope string
+
+	// APIVersion is the IMDS api version of the request.
+	// Example: 2018-02-01
+	APIVersion string
 }
 
 // ValidateResourceParamExists returns true if there exists a resource parameter from the request.
@@ -476,18 +622,67 @@ func (r TokenRequest) ValidateResourceParamExists() bool {
 	return len(r.Resource) != 0
 }
 
+// Validate validates the query parameters of the request the same way as IMDS does.
+// The returned error is used as the description of the 400 response.
+func (r TokenRequest) Validate() error {
+	if len(r.APIVersion) == 0 {
+		return errors.New(missingAPIVersionDescription)
+	}
+	version, err := time.Parse(apiVersionLayout, r.APIVersion)
+	if err != nil || version.Before(minAPIVersion) {
+		return fmt.Errorf("api-version %q is not supported", r.APIVersion)
+	}
+
+	specified := 0
+	for _, id := range []string{r.ClientID, r.ObjectID, r.ResourceID} {
+		if len(id) != 0 {
+			specified++
+		}
+	}
+	if specified > 1 {
+		return errors.New("only one of 'client_id', 'object_id' and 'msi_res_id' can be specified")
+	}
+
+	if len(strings.Fields(r.Scope)) > 1 {
+		return errors.New("only a single scope can be specified")
+	}
+	return nil
+}
+
 func parseTokenRequest(r *http.Request) (request TokenRequest) {
 	vals := r.URL.Query()
 	if vals != nil {
-		// These are mutually exclusive values (client_id, msi_resource_id)
+		// These are mutually exclusive values (client_id, object_id, msi_res_id)
 		request.ClientID = vals.Get("client_id")
+		request.ObjectID = vals.Get("object_id")
 		request.ResourceID = vals.Get("msi_res_id")
+		if request.ResourceID == "" {
+			// newer SDKs use mi_res_id to identify the identity by its resource id
+			request.ResourceID = vals.Get("mi_res_id")
+		}
 
 		request.Resource = vals.Get("resource")
+		request.Scope = vals.Get("scope")
+		if request.Resource == "" {
+			request.Resource = scopeToResource(request.Scope)
+		}
+		request.APIVersion = vals.Get("api-version")
 	}
 	return request
 }
 
+// scopeToResource converts an AAD v2 scope to the AAD v1 resource, e.g.
+// https://vault.azure.net/.default is converted to https://vault.azure.net.
+// Requests with multiple scopes are rejected by Validate, so no resource is
+// derived from them.
+func scopeToResource(scope string) string {
+	scope = strings.TrimSpace(scope)
+	if len(strings.Fields(scope)) != 1 {
+		return ""
+	}
+	return strings.TrimSuffix(scope, defaultScopeSuffix)
+}
+
 // defaultPathHandler creates a new request and returns the response body and code
 func (s *Server) defaultPathHandler(w http.ResponseWriter, r *http.Request) (ns string) {
 	if s.MetadataHeaderRequired && parseMetadata(r) != "true" {
@@ -1,13 +1,27 @@
 package server
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/auth"
+	"github.com/Azure/aad-pod-identity/pkg/auth/fakeaad"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+	"github.com/Azure/aad-pod-identity/pkg/nmi"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
@@ -46,18 +60,7 @@ func TestMsiHandler_NoMetadataHeader(t *testing.T) {
 		t.Errorf("Unexpected status code %d", recorder.Code)
 	}
 
-	resp := &MetadataResponse{
-		Error:            "invalid_request",
-		ErrorDescription: "Required metadata header not specified",
-	}
-	expected, err := json.Marshal(resp)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if string(expected) != strings.TrimSpace(recorder.Body.String()) {
-		t.Errorf("Unexpected response body %s", recorder.Body.String())
-	}
+	checkErrorResponse(t, recorder, "invalid_request", "Required metadata header not specified")
 }
 
 func TestMsiHandler_NoRemoteAddress(t *testing.T) {
@@ -81,9 +84,187 @@ func TestMsiHandler_NoRemoteAddress(t *testing.T) {
 		t.Errorf("Unexpected status code %d", recorder.Code)
 	}
 
-	expected := "request remote address is empty"
-	if expected != strings.TrimSpace(recorder.Body.String()) {
-		t.Errorf("Unexpected response body %s", recorder.Body.String())
+	checkErrorResponse(t, recorder, "server_error", "request remote address is empty")
+}
+
+// checkErrorResponse checks that the response is an error in the IMDS format
+func checkErrorResponse(t *testing.T, recorder *httptest.ResponseRecorder, expectedError, expectedDescription string) {
+	t.Helper()
+
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		t.Errorf("Unexpected content type %s", contentType)
+	}
+	resp := &MetadataResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil {
+		t.Fatalf("Unexpected response body %s, error: %+v", recorder.Body.String(), err)
+	}
+	if resp.Error != expectedError {
+		t.Errorf("Unexpected error %s, expected: %s", resp.Error, expectedError)
+	}
+	if !strings.Contains(resp.ErrorDescription, expectedDescription) {
+		t.Errorf("Unexpected error description %s, expected: %s", resp.ErrorDescription, expectedDescription)
+	}
+	if resp.CorrelationID == "" {
+		t.Error("Expected correlation id in error response")
+	}
+}
+
+func TestMsiHandler_ErrorResponses(t *testing.T) {
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Status:     v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	azureID := &aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "azid1", Namespace: "default"},
+		Spec:       aadpodid.AzureIdentitySpec{ClientID: "clientid1"},
+	}
+
+	cases := []struct {
+		desc                string
+		remoteAddr          string
+		query               string
+		kubeClient          *fakePodKubeClient
+		tokenClient         *fakeIdentityTokenClient
+		expectedStatusCode  int
+		expectedError       string
+		expectedDescription string
+		expectedRetryAfter  string
+		expectedEvent       bool
+	}{
+		{
+			desc:                "missing resource",
+			remoteAddr:          "10.0.0.1:12345",
+			kubeClient:          &fakePodKubeClient{pod: pod},
+			tokenClient:         &fakeIdentityTokenClient{azureID: azureID},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedError:       "invalid_request",
+			expectedDescription: "Required query variable 'resource' is missing",
+		},
+		{
+			desc:                "missing api-version",
+			remoteAddr:          "10.0.0.1:12345",
+			query:               "?resource=https://vault.azure.net",
+			kubeClient:          &fakePodKubeClient{pod: pod},
+			tokenClient:         &fakeIdentityTokenClient{azureID: azureID},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedError:       "invalid_request",
+			expectedDescription: "Required query variable 'api-version' is missing",
+		},
+		{
+			desc:                "multiple identities requested",
+			remoteAddr:          "10.0.0.1:12345",
+			query:               "?resource=https://vault.azure.net&api-version=2018-02-01&client_id=clientid1&object_id=objectid1",
+			kubeClient:          &fakePodKubeClient{pod: pod},
+			tokenClient:         &fakeIdentityTokenClient{azureID: azureID},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedError:       "invalid_request",
+			expectedDescription: "only one of 'client_id', 'object_id' and 'msi_res_id' can be specified",
+		},
+		{
+			desc:                "unknown pod",
+			remoteAddr:          "10.0.0.2:12345",
+			query:               "?resource=https://vault.azure.net&api-version=2018-02-01",
+			kubeClient:          &fakePodKubeClient{pod: pod},
+			tokenClient:         &fakeIdentityTokenClient{azureID: azureID},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedError:       "server_error",
+			expectedDescription: "failed to match pod IP",
+		},
+		{
+			desc:                "failed to list exceptions",
+			remoteAddr:          "10.0.0.1:12345",
+			query:               "?resource=https://vault.azure.net&api-version=2018-02-01",
+			kubeClient:          &fakePodKubeClient{pod: pod, exceptionsErr: errors.New("failed to list exceptions")},
+			tokenClient:         &fakeIdentityTokenClient{azureID: azureID},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedError:       "server_error",
+			expectedDescription: "failed to list exceptions",
+		},
+		{
+			desc:                "identity not found",
+			remoteAddr:          "10.0.0.1:12345",
+			query:               "?resource=https://vault.azure.net&api-version=2018-02-01",
+			kubeClient:          &fakePodKubeClient{pod: pod},
+			tokenClient:         &fakeIdentityTokenClient{},
+			expectedStatusCode:  http.StatusNotFound,
+			expectedError:       "invalid_request",
+			expectedDescription: "no azure identity found",
+		},
+		{
+			desc:       "identity in created state",
+			remoteAddr: "10.0.0.1:12345",
+			query:      "?resource=https://vault.azure.net&api-version=2018-02-01",
+			kubeClient: &fakePodKubeClient{pod: pod},
+			tokenClient: &fakeIdentityTokenClient{
+				azureID:     &aadpodid.AzureIdentity{},
+				identityErr: errors.New("getting assigned identities for pod default/pod1 in ASSIGNED state failed"),
+			},
+			expectedStatusCode:  http.StatusServiceUnavailable,
+			expectedError:       "temporarily_unavailable",
+			expectedDescription: "ASSIGNED state failed",
+			expectedRetryAfter:  "5",
+		},
+		{
+			desc:                "resource not allowed",
+			remoteAddr:          "10.0.0.1:12345",
+			query:               "?resource=https://vault.azure.net&api-version=2018-02-01",
+			kubeClient:          &fakePodKubeClient{pod: pod},
+			tokenClient:         &fakeIdentityTokenClient{azureID: azureID, deniedResource: "https://vault.azure.net"},
+			expectedStatusCode:  http.StatusForbidden,
+			expectedError:       "access_denied",
+			expectedDescription: "is not allowed by the AzureIdentityBindings of the pod",
+			expectedEvent:       true,
+		},
+		{
+			desc:                "failed to get token",
+			remoteAddr:          "10.0.0.1:12345",
+			query:               "?resource=https://vault.azure.net&api-version=2018-02-01",
+			kubeClient:          &fakePodKubeClient{pod: pod},
+			tokenClient:         &fakeIdentityTokenClient{azureID: azureID, tokenErr: errors.New("AADSTS700016")},
+			expectedStatusCode:  http.StatusForbidden,
+			expectedError:       "access_denied",
+			expectedDescription: "AADSTS700016",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			setup()
+			defer teardown()
+
+			eventRecorder := record.NewFakeRecorder(1)
+			s := &Server{
+				KubeClient:    tc.kubeClient,
+				TokenClient:   tc.tokenClient,
+				Reporter:      reporter,
+				EventRecorder: eventRecorder,
+			}
+			mux.Handle(tokenPath, appHandler(s.msiHandler))
+
+			req, err := http.NewRequest(http.MethodGet, tokenPath+tc.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = tc.remoteAddr
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatusCode {
+				t.Fatalf("Unexpected status code %d, expected: %d", recorder.Code, tc.expectedStatusCode)
+			}
+			checkErrorResponse(t, recorder, tc.expectedError, tc.expectedDescription)
+			if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != tc.expectedRetryAfter {
+				t.Errorf("Unexpected Retry-After %q, expected: %q", retryAfter, tc.expectedRetryAfter)
+			}
+			if events := len(eventRecorder.Events); tc.expectedEvent != (events == 1) {
+				t.Errorf("Unexpected number of events %d, expected event: %v", events, tc.expectedEvent)
+			}
+		})
 	}
 }
 
@@ -113,6 +294,43 @@ func TestParseTokenRequest(t *testing.T) {
 		}
 	})
 
+	t.Run("imds query parameters", func(t *testing.T) {
+		const objectID = "2d1e5e6a-6b2c-4f0d-9b7d-6a2d1c3e4f5a"
+		const resourceID = "/subscriptions/9f2be85c-f8ae-4569-9353-38e5e8b459ef/resourcegroups/test/providers/Microsoft.ManagedIdentity/userAssignedIdentities/test"
+
+		var r http.Request
+		r.URL, _ = url.Parse(fmt.Sprintf("%s?object_id=%s&mi_res_id=%s&scope=%s&api-version=2019-08-01", endpoint, objectID, resourceID, url.QueryEscape("https://vault.azure.net/.default")))
+
+		result := parseTokenRequest(&r)
+
+		if result.ObjectID != objectID {
+			t.Errorf("invalid ObjectID - expected: %q, actual: %q", objectID, result.ObjectID)
+		}
+
+		if result.ResourceID != resourceID {
+			t.Errorf("invalid ResourceID - expected: %q, actual: %q", resourceID, result.ResourceID)
+		}
+
+		if result.Resource != "https://vault.azure.net" {
+			t.Errorf("invalid Resource - expected: %q, actual: %q", "https://vault.azure.net", result.Resource)
+		}
+
+		if result.APIVersion != "2019-08-01" {
+			t.Errorf("invalid APIVersion - expected: %q, actual: %q", "2019-08-01", result.APIVersion)
+		}
+	})
+
+	t.Run("resource takes precedence over scope", func(t *testing.T) {
+		var r http.Request
+		r.URL, _ = url.Parse(fmt.Sprintf("%s?resource=%s&scope=%s", endpoint, "https://management.azure.com/", url.QueryEscape("https://vault.azure.net/.default")))
+
+		result := parseTokenRequest(&r)
+
+		if result.Resource != "https://management.azure.com/" {
+			t.Errorf("invalid Resource - expected: %q, actual: %q", "https://management.azure.com/", result.Resource)
+		}
+	})
+
 	t.Run("bare endpoint", func(t *testing.T) {
 		var r http.Request
 		r.URL, _ = url.Parse(endpoint)
@@ -147,3 +365,295 @@ func TestTokenRequest_ValidateResourceParamExists(t *testing.T) {
 		t.Error("ValidateResourceParamExists should have returned false when the resource is unset")
 	}
 }
+
+func TestTokenRequest_Validate(t *testing.T) {
+	cases := []struct {
+		desc        string
+		request     TokenRequest
+		expectedErr bool
+	}{
+		{
+			desc:    "valid request",
+			request: TokenRequest{Resource: "https://vault.azure.net", ClientID: "clientid1", APIVersion: "2018-02-01"},
+		},
+		{
+			desc:        "missing api-version",
+			request:     TokenRequest{Resource: "https://vault.azure.net"},
+			expectedErr: true,
+		},
+		{
+			desc:        "malformed api-version",
+			request:     TokenRequest{Resource: "https://vault.azure.net", APIVersion: "latest"},
+			expectedErr: true,
+		},
+		{
+			desc:        "unsupported api-version",
+			request:     TokenRequest{Resource: "https://vault.azure.net", APIVersion: "2017-12-01"},
+			expectedErr: true,
+		},
+		{
+			desc:        "client_id and msi_res_id",
+			request:     TokenRequest{Resource: "https://vault.azure.net", ClientID: "clientid1", ResourceID: "resourceid1", APIVersion: "2018-02-01"},
+			expectedErr: true,
+		},
+		{
+			desc:        "multiple scopes",
+			request:     TokenRequest{Scope: "https://vault.azure.net/.default https://storage.azure.com/.default", APIVersion: "2018-02-01"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.request.Validate()
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+// testCertificate is a PKCS#12 encoded self-signed certificate and private key with password "password"
+const testCertificate = "MIIF+QIBAzCCBb8GCSqGSIb3DQEHAaCCBbAEggWsMIIFqDCCAqcGCSqGSIb3DQEHBqCCApgwggKUAgEAMIICjQYJKoZIhvcNAQcBMBwGCiqGSIb3DQEMAQMwDgQIAwzrSEpYjk0CAggAgIICYHkZ5C1adAn/vJaJzb4N+Nheq3Dfl2/nsx4cmQB9AjQEoDrmzB7Wz06mY/7ByHpOjRiRhdxR10QEsF4LKj2xID0v5O26LXoDElESYGaf9ohl6pRZvSTT75I8F+NaJcEFtVH36USYjqeSvhMTKgyZJ7yGGCyrO03AEIfsLgsUGaIjtyMCLV/aWtSMA3DjIz94emqFXBnmd4h87ZlnEfwy5N/KHrsH/7ZWVaypfIyKetK/92Ovs7rjJyKJZeeQDAOm16nBR5K0DQ57LAZZp9uWHMhjfHGSMf4LY1sR6415ll5JqWPaeMkJiXQTudAbzu+LUhlP1TEHw3aUkzsxDofszaP4verKZvGaex1DCWW1CJJGqaj/9v5Pyu14+QfjI9nPSBWOUnhe2FLhaH5ohflBPwXC4jyqBQPJoE/qZ08UePvjHfANdWywstuUJpFCOtOTv/VcYxhLeZ/OsInsbAM8HPLl/Q+JaDh1a69suxpXAjpVmngmv8u6Blrv8P9thvr7rnZ6sfZnCkStJ3QPkFT29VRWwg3xuaSdGsAmtBPPbHBqRwNTtwFIZYRBPCJ0W1E8NB1gs/CefWHvDU+o8TEPYtBTRwaRnjyBqiNFGGttrR4/Nn84JrEkuw+SULF4n9XCzVRsID7lPA2taW0u4qQOtVaSMc8I36vVg01z7fRmNiIrfEv82V5IxQFJKGT4z+2KdKbA3UvEN6Ee3gegwmG/78U0n9vzascpUdcxATwPKFTS+Bj+dYjhj6W+2WzO1e4Dg7hnKRb8I0SKXSFGwCTIg8hbhtP9BC4eQycj4/fQSgUhMIIC+QYJKoZIhvcNAQcBoIIC6gSCAuYwggLiMIIC3gYLKoZIhvcNAQwKAQKgggKmMIICojAcBgoqhkiG9w0BDAEDMA4ECIDWQUpgjOwnAgIIAASCAoBC5gDUiHMDZlzhp+gFuO7RkOa3OOGtFKYFsQl/86dMW+1qzBNeyXhn9b2iWKCclaJ9R1GQmvbqLan4raHWJhtzcM7SB1p2ZVCiSTkNjr6NDxFpbQNU+psDb6/44TlSWflHI10rwaIrGw0zv9aQJJmaQAwZ0lctRTSxfgIAh4+gEDiVAuX+NsFgaOT1beiawGDa4Qiuoe+39x2QSOuQ0pgXr2RMTVL99d9h78C80DvfKJ1ukBEiPGvKmuhrDwbj1LaDp5md5zBtZ8E5tfb6+AH2WkEoU2fjtgT1SfWF8HZrhniUqV1p3tS6jSkois1v+EAn1TdFKkOSK9W51EYzXrAFsT2asqypbzoUsyzOJwKPXBiI9eJ765UfPrzRflRr+iojQAn9XuEEG7jPTieBrAut2LMtgJznq1vE/1uyopqmwHpZcDhYpTdroFmCt5Mpdnn/zBNeyf62fEei1sEir3TcM/JrMaL29oLrBKLMH1I1kg+pQSSd7e8hkkjUWhozv1IllCRe0OOcaojayjPMCv2tMjM2g4bFsjdngRnBRVOT9WFaxmYYk2a6qADStw+e0sIyJ5MOPBpJNDxDpqcUGIZedsXKa1i1U4ZCudfx/cIOKNPR1nUCcLsUmhrJ9LWfbgbm9XAw4Ib0e5Hmi86tXxz9KaXiwwK318dbgZVPwS7e1quYXVxXhdvjRIESJLxaX85IeykwiYfVBir8PNla6Vh3bAQMxy7lMHpWzGCinuRnsJrrqSgXTELFefSQpzRGZI4ccSps+Z8ySjkEoalldpy050wYR0IFrM88snTPytGENIc6WFsfosHLzCMIpojpon8d+zLNtRfnsVR/RfTZA38wMSUwIwYJKoZIhvcNAQkVMRYEFABfnwbT2C784fcU1ViS2Sz9JcxhMDEwITAJBgUrDgMCGgUABBRmk6FNspawvXEygAV4iGgq9dFGgAQItBlsyHKlD8kCAggA"
+
+// fakeAuthKubeClient returns the secrets and service account token used to acquire tokens
+type fakeAuthKubeClient struct {
+	*fakePodKubeClient
+	secrets             map[string]*v1.Secret
+	serviceAccountToken string
+	exceptions          []aadpodid.AzurePodIdentityException
+}
+
+func (c *fakeAuthKubeClient) GetSecret(secretRef *v1.SecretReference) (*v1.Secret, error) {
+	secret, ok := c.secrets[secretRef.Namespace+"/"+secretRef.Name]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s not found", secretRef.Namespace, secretRef.Name)
+	}
+	return secret, nil
+}
+
+func (c *fakeAuthKubeClient) GetServiceAccountToken(pod *v1.Pod, audience string) (string, error) {
+	return c.serviceAccountToken, nil
+}
+
+func (c *fakeAuthKubeClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodIdentityException, error) {
+	return &c.exceptions, nil
+}
+
+// authTokenClient acquires the tokens of the identity with the standard token client
+type authTokenClient struct {
+	*fakeIdentityTokenClient
+	standard *nmi.StandardClient
+}
+
+func (c *authTokenClient) GetTokens(ctx context.Context, clientID, resource string, azureID aadpodid.AzureIdentity) ([]*adal.Token, error) {
+	return c.standard.GetTokens(ctx, clientID, resource, azureID)
+}
+
+func TestMsiHandler_Tokens(t *testing.T) {
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	auth.InitReporter(reporter)
+
+	tokenServer := fakeaad.NewServer("tid")
+	defer tokenServer.Close()
+	auth.SetMSIEndpoint(tokenServer.MSIEndpoint())
+	defer auth.SetMSIEndpoint("")
+
+	tokenServer.AddSystemAssignedIdentity()
+	tokenServer.AddUserAssignedIdentity("msi-clientid")
+	tokenServer.AddClientSecret("tid", "sp-clientid", "secret")
+	tokenServer.AddClientAssertion("tid", "cert-clientid", "")
+	tokenServer.AddClientAssertion("tid", "federated-clientid", "sa-token")
+
+	certificate, err := base64.StdEncoding.DecodeString(testCertificate)
+	if err != nil {
+		t.Fatalf("failed to decode certificate, error: %+v", err)
+	}
+	kubeClient := &fakeAuthKubeClient{
+		fakePodKubeClient: &fakePodKubeClient{pod: v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", Labels: map[string]string{"app": "pod1"}},
+			Status:     v1.PodStatus{PodIP: "10.0.0.1"},
+		}},
+		secrets: map[string]*v1.Secret{
+			"default/sp-secret":   {Data: map[string][]byte{"clientSecret": []byte("secret")}},
+			"default/cert-secret": {Data: map[string][]byte{"certificate": certificate, "password": []byte("password")}},
+		},
+		serviceAccountToken: "sa-token",
+	}
+	newIdentity := func(idType aadpodid.IdentityType, clientID, secretName string) *aadpodid.AzureIdentity {
+		return &aadpodid.AzureIdentity{
+			ObjectMeta: metav1.ObjectMeta{Name: "azid1", Namespace: "default"},
+			Spec: aadpodid.AzureIdentitySpec{
+				Type:           idType,
+				ClientID:       clientID,
+				TenantID:       "tid",
+				ADEndpoint:     tokenServer.ActiveDirectoryEndpoint(),
+				ClientPassword: v1.SecretReference{Name: secretName, Namespace: "default"},
+			},
+		}
+	}
+
+	cases := []struct {
+		desc                string
+		azureID             *aadpodid.AzureIdentity
+		excepted            bool
+		query               string
+		setup               func()
+		expectedStatusCode  int
+		expectedDescription string
+		expectedClientID    string
+		expectedEndpoint    string
+	}{
+		{
+			desc:               "user-assigned managed identity",
+			azureID:            newIdentity(aadpodid.UserAssignedMSI, "msi-clientid", ""),
+			expectedStatusCode: http.StatusOK,
+			expectedClientID:   "msi-clientid",
+			expectedEndpoint:   fakeaad.EndpointIMDS,
+		},
+		{
+			desc:               "service principal",
+			azureID:            newIdentity(aadpodid.ServicePrincipal, "sp-clientid", "sp-secret"),
+			expectedStatusCode: http.StatusOK,
+			expectedClientID:   "sp-clientid",
+			expectedEndpoint:   fakeaad.EndpointAAD,
+		},
+		{
+			desc:               "service principal with certificate",
+			azureID:            newIdentity(aadpodid.ServicePrincipalCertificate, "cert-clientid", "cert-secret"),
+			expectedStatusCode: http.StatusOK,
+			expectedClientID:   "cert-clientid",
+			expectedEndpoint:   fakeaad.EndpointAAD,
+		},
+		{
+			desc:               "federated workload identity",
+			azureID:            newIdentity(aadpodid.FederatedWorkloadIdentity, "federated-clientid", ""),
+			expectedStatusCode: http.StatusOK,
+			expectedClientID:   "federated-clientid",
+			expectedEndpoint:   fakeaad.EndpointAAD,
+		},
+		{
+			desc:               "system-assigned identity of excepted pod",
+			excepted:           true,
+			expectedStatusCode: http.StatusOK,
+			expectedClientID:   "system-assigned",
+			expectedEndpoint:   fakeaad.EndpointIMDS,
+		},
+		{
+			desc:                "user-assigned managed identity not assigned to the node",
+			azureID:             newIdentity(aadpodid.UserAssignedMSI, "unknown-clientid", ""),
+			expectedStatusCode:  http.StatusForbidden,
+			expectedDescription: "Identity not found",
+			expectedEndpoint:    fakeaad.EndpointIMDS,
+		},
+		{
+			desc:                "service principal with invalid secret",
+			azureID:             newIdentity(aadpodid.ServicePrincipal, "sp-clientid", "cert-secret"),
+			expectedStatusCode:  http.StatusForbidden,
+			expectedDescription: "AADSTS7000215",
+			expectedEndpoint:    fakeaad.EndpointAAD,
+		},
+		{
+			desc:                "unknown application",
+			azureID:             newIdentity(aadpodid.FederatedWorkloadIdentity, "unknown-clientid", ""),
+			expectedStatusCode:  http.StatusForbidden,
+			expectedDescription: "AADSTS700016",
+			expectedEndpoint:    fakeaad.EndpointAAD,
+		},
+		{
+			desc:    "imds failure",
+			azureID: newIdentity(aadpodid.UserAssignedMSI, "msi-clientid", ""),
+			setup: func() {
+				tokenServer.FailRequests(1, http.StatusInternalServerError)
+			},
+			expectedStatusCode:  http.StatusForbidden,
+			expectedDescription: "fake failure of imds token request",
+			expectedEndpoint:    fakeaad.EndpointIMDS,
+		},
+		{
+			desc:     "imds failure of excepted pod",
+			excepted: true,
+			setup: func() {
+				tokenServer.FailRequests(1, http.StatusTooManyRequests)
+			},
+			expectedStatusCode:  http.StatusForbidden,
+			expectedDescription: "fake failure of imds token request",
+			expectedEndpoint:    fakeaad.EndpointIMDS,
+		},
+		{
+			desc:    "aad failure",
+			azureID: newIdentity(aadpodid.ServicePrincipal, "sp-clientid", "sp-secret"),
+			setup: func() {
+				tokenServer.FailRequests(1, http.StatusServiceUnavailable)
+			},
+			expectedStatusCode:  http.StatusForbidden,
+			expectedDescription: "fake failure of aad token request",
+			expectedEndpoint:    fakeaad.EndpointAAD,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			setup()
+			defer teardown()
+
+			kubeClient.exceptions = nil
+			if tc.excepted {
+				kubeClient.exceptions = []aadpodid.AzurePodIdentityException{{
+					Spec: aadpodid.AzurePodIdentityExceptionSpec{PodLabels: map[string]string{"app": "pod1"}},
+				}}
+			}
+			if tc.setup != nil {
+				tc.setup()
+			}
+			requests := len(tokenServer.Requests())
+
+			s := &Server{
+				KubeClient: kubeClient,
+				TokenClient: &authTokenClient{
+					fakeIdentityTokenClient: &fakeIdentityTokenClient{azureID: tc.azureID},
+					standard:                &nmi.StandardClient{KubeClient: kubeClient},
+				},
+				Reporter:      reporter,
+				EventRecorder: record.NewFakeRecorder(1),
+			}
+			mux.Handle(tokenPath, appHandler(s.msiHandler))
+
+			req, err := http.NewRequest(http.MethodGet, tokenPath+"?resource=https://vault.azure.net&api-version=2018-02-01", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = "10.0.0.1:12345"
+
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatusCode {
+				t.Fatalf("Unexpected status code %d, expected: %d, body: %s", recorder.Code, tc.expectedStatusCode, recorder.Body.String())
+			}
+			received := tokenServer.Requests()[requests:]
+			if len(received) != 1 || received[0].Endpoint != tc.expectedEndpoint {
+				t.Fatalf("Unexpected token requests %+v, expected 1 request to %s", received, tc.expectedEndpoint)
+			}
+			if tc.expectedStatusCode != http.StatusOK {
+				checkErrorResponse(t, recorder, "access_denied", tc.expectedDescription)
+				return
+			}
+
+			var resp msiResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal token response, error: %+v", err)
+			}
+			claims, err := fakeaad.ParseClaims(resp.AccessToken)
+			if err != nil {
+				t.Fatalf("failed to parse claims, error: %+v", err)
+			}
+			if claims["appid"] != tc.expectedClientID || claims["aud"] != "https://vault.azure.net" || resp.Resource != "https://vault.azure.net" {
+				t.Errorf("Unexpected token %+v with claims %+v", resp, claims)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/Azure/go-autorest/autorest/adal"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
@@ -23,6 +24,7 @@ type StandardClient struct {
 	ListPodIDsRetryAttemptsForAssigned int
 	ListPodIDsRetryIntervalInSeconds   int
 	IsNamespaced                       bool
+	EventRecorder                      record.EventRecorder
 }
 
 // NewStandardTokenClient creates new standard nmi client
@@ -33,43 +35,41 @@ func NewStandardTokenClient(client k8s.Client, config Config) (*StandardClient,
 		ListPodIDsRetryAttemptsForAssigned: config.RetryAttemptsForAssigned,
 		ListPodIDsRetryIntervalInSeconds:   config.FindIdentityRetryIntervalInSeconds,
 		IsNamespaced:                       config.Namespaced,
+		EventRecorder:                      config.EventRecorder,
 	}, nil
 }
 
 // GetIdentities gets the azure identity that matches the podns/podname and client id
-func (sc *StandardClient) GetIdentities(ctx context.Context, podns, podname, clientID, resourceID string) (*aadpodid.AzureIdentity, error) {
-	podIDs, identityInCreatedStateFound, err := sc.listPodIDsWithRetry(ctx, podns, podname, clientID, resourceID)
+func (sc *StandardClient) GetIdentities(ctx context.Context, podns, podname, clientID, resourceID, objectID string) (*aadpodid.AzureIdentity, error) {
+	podIDs, identityInCreatedStateFound, err := sc.listPodIDsWithRetry(ctx, podns, podname, clientID, resourceID, objectID)
 	if err != nil {
-		// if identity not found in created state return nil identity which is then used to send 403 error
+		// if identity not found in created state return nil identity which is then used to send 404 error
 		if !identityInCreatedStateFound {
 			return nil, err
 		}
-		// identity found in created state but there was an error, then return empty struct which will result in 404 error
+		// identity found in created state but there was an error, then return empty struct which will result in 503 error
+		// asking the client to retry while the identity is being assigned
 		return &aadpodid.AzureIdentity{}, err
 	}
 
-	// filter out if we are in namespaced mode
-	var filterPodIdentities []aadpodid.AzureIdentity
-	for _, val := range podIDs {
-		val := val // avoid implicit memory aliasing in for loop
-		if sc.IsNamespaced || aadpodid.IsNamespacedIdentity(&val) {
-			// namespaced mode
-			if val.Namespace == podns {
-				// matched namespace
-				filterPodIdentities = append(filterPodIdentities, val)
-			} else {
-				// unmatched namespaced
-				klog.Errorf("pod:%s/%s has identity %s/%s but identity is namespaced will be ignored", podns, podname, val.Name, val.Namespace)
-			}
-		} else {
-			// not in namespaced mode
-			filterPodIdentities = append(filterPodIdentities, val)
-		}
-	}
+	// filter out the identities which don't allow the namespace of the pod or violate a policy
+	filterPodIdentities := filterIdentitiesByNamespace(sc.KubeClient, sc.IsNamespaced, podns, podname, podIDs)
+	filterPodIdentities = filterIdentitiesByPolicy(sc.KubeClient, podns, podname, filterPodIdentities)
 
-	// If the client did not request a specific identity, then return the first identity
-	if len(clientID) == 0 && len(resourceID) == 0 {
-		id := filterPodIdentities[0]
+	// If the client did not request a specific identity, then return the identity with the highest weight
+	if len(clientID) == 0 && len(resourceID) == 0 && len(objectID) == 0 {
+		if len(filterPodIdentities) == 0 {
+			return nil, fmt.Errorf("no azure identity found for pod %s/%s", podns, podname)
+		}
+		bindings, err := sc.KubeClient.ListPodBindings(podns, podname)
+		if err != nil {
+			// the identities are still selected deterministically, as if they had the same weight
+			klog.Errorf("failed to get AzureIdentityBindings for pod %s/%s, error: %+v", podns, podname, err)
+		}
+		id, tied := SelectDefaultIdentity(filterPodIdentities, bindings)
+		if len(tied) != 0 {
+			recordAmbiguousIdentityEvent(sc.EventRecorder, sc.KubeClient, podns, podname, id, tied)
+		}
 		klog.Infof("no clientID or resourceID in request. %s/%s has been matched with azure identity %s/%s", podns, podname, id.Namespace, id.Name)
 		return &id, nil
 	}
@@ -85,21 +85,37 @@ func (sc *StandardClient) GetIdentities(ctx context.Context, podns, podname, cli
 		if len(resourceID) != 0 && id.Spec.ResourceID == resourceID {
 			return &id, nil
 		}
+
+		// if object id exists in the request, then send the first identity that matched the object id
+		if len(objectID) != 0 && strings.EqualFold(id.Spec.ObjectID, objectID) {
+			klog.Infof("objectID in request: %s, %s/%s has been matched with azure identity %s/%s", objectID, podns, podname, id.Namespace, id.Name)
+			return &id, nil
+		}
 	}
 
 	return nil, fmt.Errorf("no azure identity found for request clientID %s", utils.RedactClientID(clientID))
 }
 
+// IsResourceAllowed checks the resource against the bindings of the identities assigned to the pod.
+func (sc *StandardClient) IsResourceAllowed(ctx context.Context, podns, podname, rqResource string, azureID aadpodid.AzureIdentity) (bool, error) {
+	bindings, err := sc.KubeClient.ListPodBindings(podns, podname)
+	if err != nil {
+		return false, fmt.Errorf("failed to get AzureIdentityBindings for pod %s/%s, error: %+v", podns, podname, err)
+	}
+	return isResourceAllowed(bindings, rqResource, azureID), nil
+}
+
 // listPodIDsWithRetry returns a list of matched identities in Assigned state, boolean indicating if at least an identity was found in Created state and error if any
-func (sc *StandardClient) listPodIDsWithRetry(ctx context.Context, podns, podname, rqClientID, rqResourceID string) ([]aadpodid.AzureIdentity, bool, error) {
+func (sc *StandardClient) listPodIDsWithRetry(ctx context.Context, podns, podname, rqClientID, rqResourceID, rqObjectID string) ([]aadpodid.AzureIdentity, bool, error) {
 	attempt := 0
 	var err error
 	var idStateMap map[string][]aadpodid.AzureIdentity
 
-	identityUnspecified := len(rqClientID) == 0 && len(rqResourceID) == 0
+	identityUnspecified := len(rqClientID) == 0 && len(rqResourceID) == 0 && len(rqObjectID) == 0
 	isRequestedIdentity := func(podID aadpodid.AzureIdentity) bool {
 		return len(rqClientID) != 0 && strings.EqualFold(rqClientID, podID.Spec.ClientID) ||
-			len(rqResourceID) != 0 && strings.EqualFold(rqResourceID, podID.Spec.ResourceID)
+			len(rqResourceID) != 0 && strings.EqualFold(rqResourceID, podID.Spec.ResourceID) ||
+			len(rqObjectID) != 0 && strings.EqualFold(rqObjectID, podID.Spec.ObjectID)
 	}
 
 	// this loop will run to ensure we have assigned identities before we return. If there are no assigned identities in created state within 80s (16 retries * 5s wait) then we return an error.
@@ -177,6 +193,12 @@ func (sc *StandardClient) GetTokens(ctx context.Context, rqClientID, rqResource
 			klog.Warningf("clientid mismatch, requested:%s available:%s", rqClientID, clientID)
 		}
 		klog.Infof("matched identityType:%v clientid:%s resource:%s", idType, utils.RedactClientID(clientID), rqResource)
+		// request the token by the resource ID when it's set, as that's what the AzureIdentityPolicies
+		// allow and the client ID alone could select any other identity assigned to the node
+		if resourceID := azureID.Spec.ResourceID; resourceID != "" {
+			token, err := auth.GetServicePrincipalTokenFromMSIWithIdentityResourceID(resourceID, rqResource)
+			return []*adal.Token{token}, err
+		}
 		token, err := auth.GetServicePrincipalTokenFromMSIWithUserAssignedID(clientID, rqResource)
 		return []*adal.Token{token}, err
 	case aadpodid.ServicePrincipal:
@@ -211,6 +233,8 @@ func (sc *StandardClient) GetTokens(ctx context.Context, rqClientID, rqResource
 		token, err := auth.GetServicePrincipalTokenWithCertificate(adEndpoint, tenantID, clientID,
 			certificate, string(password), rqResource)
 		return []*adal.Token{token}, err
+	case aadpodid.FederatedWorkloadIdentity:
+		return getFederatedTokens(ctx, sc.KubeClient, rqResource, azureID)
 	default:
 		return nil, fmt.Errorf("unsupported identity type %+v", idType)
 	}
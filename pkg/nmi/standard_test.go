@@ -3,22 +3,34 @@ package nmi
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
 	auth "github.com/Azure/aad-pod-identity/pkg/auth"
+	"github.com/Azure/aad-pod-identity/pkg/auth/fakeaad"
 	"github.com/Azure/aad-pod-identity/pkg/k8s"
 	"github.com/Azure/aad-pod-identity/pkg/metrics"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 type TestKubeClient struct {
 	k8s.Client
 	azureIdentities interface{}
+	bindings        []aadpodid.AzureIdentityBinding
+	namespaces      map[string]*v1.Namespace
+	policies        []aadpodid.AzureIdentityPolicy
 	err             error
 }
 
@@ -33,6 +45,22 @@ func (c *TestKubeClient) ListPodIds(podns, podname string) (map[string][]aadpodi
 	return identities, c.err
 }
 
+func (c *TestKubeClient) ListPodBindings(podns, podname string) ([]aadpodid.AzureIdentityBinding, error) {
+	return c.bindings, c.err
+}
+
+func (c *TestKubeClient) ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error) {
+	return c.policies, nil
+}
+
+func (c *TestKubeClient) GetNamespace(name string) (*v1.Namespace, error) {
+	ns, ok := c.namespaces[name]
+	if !ok {
+		return nil, fmt.Errorf("namespace %s not found", name)
+	}
+	return ns, nil
+}
+
 func TestGetTokenForMatchingIDBySP(t *testing.T) {
 	fakeClient := fake.NewSimpleClientset()
 	reporter, err := metrics.NewReporter()
@@ -116,6 +144,7 @@ func TestGetIdentitiesStandardClient(t *testing.T) {
 		azureIdentities       map[string][]aadpodid.AzureIdentity
 		clientID              string
 		resourceID            string
+		objectID              string
 		expectedErr           bool
 		expectedAzureIdentity *aadpodid.AzureIdentity
 		isNamespaced          bool
@@ -428,6 +457,79 @@ func TestGetIdentitiesStandardClient(t *testing.T) {
 			podNamespace: "testns",
 			isNamespaced: true,
 		},
+		{
+			name: "objectID in request, found matching identity",
+			azureIdentities: map[string][]aadpodid.AzureIdentity{
+				aadpodid.AssignedIDAssigned: {
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid2",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							ClientID: "clientid2",
+							ObjectID: "objectid2",
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid3",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							ClientID: "clientid3",
+							ObjectID: "objectid3",
+						},
+					},
+				},
+			},
+			expectedErr: false,
+			expectedAzureIdentity: &aadpodid.AzureIdentity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "azid3",
+					Namespace: "default",
+				},
+				Spec: aadpodid.AzureIdentitySpec{
+					ClientID: "clientid3",
+					ObjectID: "objectid3",
+				},
+			},
+			podName:      "pod9",
+			podNamespace: "default",
+			objectID:     "objectid3",
+		},
+		{
+			name: "objectID in request, but no matching identity",
+			azureIdentities: map[string][]aadpodid.AzureIdentity{
+				aadpodid.AssignedIDAssigned: {
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid2",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							ClientID: "clientid2",
+							ObjectID: "objectid2",
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "azid3",
+							Namespace: "default",
+						},
+						Spec: aadpodid.AzureIdentitySpec{
+							ClientID: "clientid3",
+							ObjectID: "objectid3",
+						},
+					},
+				},
+			},
+			expectedErr:           true,
+			expectedAzureIdentity: nil,
+			podName:               "pod10",
+			podNamespace:          "default",
+			objectID:              "objectid1",
+		},
 	}
 
 	for _, tc := range cases {
@@ -443,7 +545,7 @@ func TestGetIdentitiesStandardClient(t *testing.T) {
 				t.Fatalf("expected err to be nil, got: %v", err)
 			}
 
-			azIdentity, err := tokenClient.GetIdentities(context.Background(), tc.podNamespace, tc.podName, tc.clientID, tc.resourceID)
+			azIdentity, err := tokenClient.GetIdentities(context.Background(), tc.podNamespace, tc.podName, tc.clientID, tc.resourceID, tc.objectID)
 			if tc.expectedErr != (err != nil) {
 				t.Fatalf("expected error: %v, got: %v", tc.expectedErr, err)
 			}
@@ -453,3 +555,388 @@ func TestGetIdentitiesStandardClient(t *testing.T) {
 		})
 	}
 }
+
+func TestGetIdentitiesStandardClientNamespacePolicy(t *testing.T) {
+	newIdentity := func(name, clientID string, spec aadpodid.AzureIdentitySpec) aadpodid.AzureIdentity {
+		spec.ClientID = clientID
+		return aadpodid.AzureIdentity{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "platform"}, Spec: spec}
+	}
+	kubeClient := NewTestKubeClient(map[string][]aadpodid.AzureIdentity{
+		aadpodid.AssignedIDAssigned: {
+			newIdentity("global", "clientid1", aadpodid.AzureIdentitySpec{}),
+			newIdentity("listed", "clientid2", aadpodid.AzureIdentitySpec{AllowedNamespaces: []string{"tenant1"}}),
+			newIdentity("selected", "clientid3", aadpodid.AzureIdentitySpec{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+			}),
+		},
+	})
+	kubeClient.namespaces = map[string]*v1.Namespace{
+		"tenant1": {ObjectMeta: metav1.ObjectMeta{Name: "tenant1", Labels: map[string]string{"team": "checkout"}}},
+		"tenant2": {ObjectMeta: metav1.ObjectMeta{Name: "tenant2", Labels: map[string]string{"team": "payments"}}},
+	}
+
+	cases := []struct {
+		desc         string
+		podNamespace string
+		clientID     string
+		isNamespaced bool
+		expectedErr  bool
+	}{
+		{desc: "no namespace policy", podNamespace: "tenant1", clientID: "clientid1"},
+		{desc: "no namespace policy in namespaced mode", podNamespace: "tenant1", clientID: "clientid1", isNamespaced: true, expectedErr: true},
+		{desc: "allowed namespace", podNamespace: "tenant1", clientID: "clientid2"},
+		{desc: "allowed namespace in namespaced mode", podNamespace: "tenant1", clientID: "clientid2", isNamespaced: true, expectedErr: true},
+		{desc: "namespace not allowed", podNamespace: "tenant2", clientID: "clientid2", expectedErr: true},
+		{desc: "namespace selected", podNamespace: "tenant2", clientID: "clientid3"},
+		{desc: "namespace selected in namespaced mode", podNamespace: "tenant2", clientID: "clientid3", isNamespaced: true, expectedErr: true},
+		{desc: "namespace not selected", podNamespace: "tenant1", clientID: "clientid3", expectedErr: true},
+		{desc: "namespace not found", podNamespace: "tenant3", clientID: "clientid3", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tokenClient, err := NewStandardTokenClient(kubeClient, Config{
+				Mode:                               "standard",
+				RetryAttemptsForCreated:            1,
+				RetryAttemptsForAssigned:           1,
+				FindIdentityRetryIntervalInSeconds: 1,
+				Namespaced:                         tc.isNamespaced,
+			})
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+
+			azIdentity, err := tokenClient.GetIdentities(context.Background(), tc.podNamespace, "pod1", tc.clientID, "", "")
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedErr, err)
+			}
+			if !tc.expectedErr && azIdentity.Spec.ClientID != tc.clientID {
+				t.Fatalf("expected identity with client id %s, got: %s", tc.clientID, azIdentity.Spec.ClientID)
+			}
+		})
+	}
+}
+
+func TestGetIdentitiesStandardClientIdentityPolicy(t *testing.T) {
+	newIdentity := func(name, namespace, clientID string, spec aadpodid.AzureIdentitySpec) aadpodid.AzureIdentity {
+		spec.ClientID = clientID
+		return aadpodid.AzureIdentity{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}, Spec: spec}
+	}
+	kubeClient := NewTestKubeClient(map[string][]aadpodid.AzureIdentity{
+		aadpodid.AssignedIDAssigned: {
+			newIdentity("allowed", "payments", "clientid1", aadpodid.AzureIdentitySpec{
+				ResourceID: "/subscriptions/sub1/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id1",
+			}),
+			newIdentity("other-subscription", "payments", "clientid2", aadpodid.AzureIdentitySpec{
+				ResourceID: "/subscriptions/sub2/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id2",
+			}),
+			newIdentity("other-namespace", "checkout", "clientid3", aadpodid.AzureIdentitySpec{
+				ResourceID: "/subscriptions/sub2/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id3",
+			}),
+			newIdentity("unknown-namespace", "unknown", "clientid4", aadpodid.AzureIdentitySpec{
+				ResourceID: "/subscriptions/sub1/resourcegroups/rg1/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id4",
+			}),
+		},
+	})
+	kubeClient.namespaces = map[string]*v1.Namespace{
+		"payments": {ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"team": "payments"}}},
+		"checkout": {ObjectMeta: metav1.ObjectMeta{Name: "checkout", Labels: map[string]string{"team": "checkout"}}},
+	}
+	kubeClient.policies = []aadpodid.AzureIdentityPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "payments-subscription"},
+			Spec: aadpodid.AzureIdentityPolicySpec{
+				NamespaceSelector:         &metav1.LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+				AllowedResourceIDPrefixes: []string{"/subscriptions/sub1"},
+			},
+		},
+	}
+
+	cases := []struct {
+		desc        string
+		clientID    string
+		expectedErr bool
+	}{
+		{desc: "allowed by policy", clientID: "clientid1"},
+		{desc: "not allowed by policy", clientID: "clientid2", expectedErr: true},
+		{desc: "policy doesn't apply to namespace", clientID: "clientid3"},
+		{desc: "namespace not found", clientID: "clientid4", expectedErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tokenClient, err := NewStandardTokenClient(kubeClient, Config{
+				Mode:                               "standard",
+				RetryAttemptsForCreated:            1,
+				RetryAttemptsForAssigned:           1,
+				FindIdentityRetryIntervalInSeconds: 1,
+			})
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+
+			azIdentity, err := tokenClient.GetIdentities(context.Background(), "default", "pod1", tc.clientID, "", "")
+			if tc.expectedErr != (err != nil) {
+				t.Fatalf("expected error: %v, got: %v", tc.expectedErr, err)
+			}
+			if !tc.expectedErr && azIdentity.Spec.ClientID != tc.clientID {
+				t.Fatalf("expected identity with client id %s, got: %s", tc.clientID, azIdentity.Spec.ClientID)
+			}
+		})
+	}
+}
+
+type federatedKubeClient struct {
+	*k8s.KubeClient
+	pod v1.Pod
+}
+
+func (c *federatedKubeClient) GetPod(podns, podname string) (v1.Pod, error) {
+	if podns != c.pod.Namespace || podname != c.pod.Name {
+		return v1.Pod{}, fmt.Errorf("pod %s/%s doesn't exist", podns, podname)
+	}
+	return c.pod, nil
+}
+
+func TestGetTokenForFederatedIdentity(t *testing.T) {
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	auth.InitReporter(reporter)
+
+	// fake TokenRequest API which issues tokens for the pod's service account
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		createAction := action.(k8stesting.CreateAction)
+		tokenRequest := createAction.GetObject().(*authenticationv1.TokenRequest)
+		if createAction.GetSubresource() != "token" || tokenRequest.Spec.Audiences[0] != FederatedTokenAudience {
+			return true, nil, fmt.Errorf("unexpected token request")
+		}
+		tokenRequest.Status.Token = "sa-token-" + tokenRequest.Spec.BoundObjectRef.Name
+		return true, tokenRequest, nil
+	})
+
+	// fake AAD token endpoint which only accepts the service account token of pod1
+	aad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("client_assertion") != "sa-token-pod1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		_, _ = fmt.Fprintf(w, `{"access_token":"token","expires_in":"3600","expires_on":"%s","not_before":"%s","resource":"%s","token_type":"Bearer"}`,
+			expiresOn, expiresOn, r.PostForm.Get("resource"))
+	}))
+	defer aad.Close()
+
+	kubeClient := &federatedKubeClient{
+		KubeClient: &k8s.KubeClient{ClientSet: fakeClient},
+		pod: v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+			Spec:       v1.PodSpec{ServiceAccountName: "sa1"},
+		},
+	}
+	standardClient, err := NewStandardTokenClient(kubeClient, Config{})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	managedClient, err := NewManagedTokenClient(kubeClient, Config{Namespaced: true})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	podID := aadpodid.AzureIdentity{
+		Spec: aadpodid.AzureIdentitySpec{
+			Type:       aadpodid.FederatedWorkloadIdentity,
+			TenantID:   "11111111-1111-1111-1111-111111111111",
+			ClientID:   "aabc0000-a83v-9h4m-000j-2c0a66b0c1f9",
+			ADEndpoint: aad.URL,
+		},
+	}
+
+	for _, tokenClient := range []TokenClient{standardClient, managedClient} {
+		cases := []struct {
+			desc        string
+			ctx         context.Context
+			expectedErr bool
+		}{
+			{
+				desc: "token acquired for pod",
+				ctx:  WithPodInfo(context.Background(), "default", "pod1"),
+			},
+			{
+				desc:        "pod not found",
+				ctx:         WithPodInfo(context.Background(), "default", "pod2"),
+				expectedErr: true,
+			},
+			{
+				desc:        "no pod in request",
+				ctx:         context.Background(),
+				expectedErr: true,
+			},
+		}
+
+		for _, tc := range cases {
+			t.Run(fmt.Sprintf("%T/%s", tokenClient, tc.desc), func(t *testing.T) {
+				tokens, err := tokenClient.GetTokens(tc.ctx, podID.Spec.ClientID, "https://management.azure.com/", podID)
+				if tc.expectedErr {
+					if err == nil {
+						t.Fatal("expected error, got nil")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("expected nil error, got: %v", err)
+				}
+				if len(tokens) != 1 || tokens[0].AccessToken != "token" {
+					t.Fatalf("unexpected tokens: %+v", tokens)
+				}
+			})
+		}
+	}
+}
+
+func TestGetTokenForUserAssignedIdentityByResourceID(t *testing.T) {
+	reporter, err := metrics.NewReporter()
+	if err != nil {
+		t.Fatalf("expected nil error, got: %+v", err)
+	}
+	auth.InitReporter(reporter)
+
+	const (
+		allowedResourceID = "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/allowed"
+		foreignResourceID = "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/foreign"
+	)
+	tokenServer := fakeaad.NewServer("tid")
+	defer tokenServer.Close()
+	auth.SetMSIEndpoint(tokenServer.MSIEndpoint())
+	defer auth.SetMSIEndpoint("")
+	tokenServer.AddUserAssignedIdentityWithResourceID("allowed-clientid", allowedResourceID)
+	tokenServer.AddUserAssignedIdentityWithResourceID("foreign-clientid", foreignResourceID)
+
+	kubeClient := &k8s.KubeClient{ClientSet: fake.NewSimpleClientset()}
+	standardClient, err := NewStandardTokenClient(kubeClient, Config{})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+	managedClient, err := NewManagedTokenClient(kubeClient, Config{Namespaced: true})
+	if err != nil {
+		t.Fatalf("expected err to be nil, got: %v", err)
+	}
+
+	// the resource ID is allowed by the AzureIdentityPolicies, while the client ID
+	// is the one of another identity assigned to the node
+	podID := aadpodid.AzureIdentity{
+		Spec: aadpodid.AzureIdentitySpec{
+			Type:       aadpodid.UserAssignedMSI,
+			ResourceID: allowedResourceID,
+			ClientID:   "foreign-clientid",
+		},
+	}
+
+	for _, tokenClient := range []TokenClient{standardClient, managedClient} {
+		t.Run(fmt.Sprintf("%T", tokenClient), func(t *testing.T) {
+			tokens, err := tokenClient.GetTokens(context.Background(), "", "https://management.azure.com/", podID)
+			if err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+			if len(tokens) != 1 {
+				t.Fatalf("expected 1 token, got: %d", len(tokens))
+			}
+			claims, err := fakeaad.ParseClaims(tokens[0].AccessToken)
+			if err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+			if claims["appid"] != "allowed-clientid" {
+				t.Fatalf("expected token of allowed-clientid, got token of %v", claims["appid"])
+			}
+			requests := tokenServer.Requests()
+			request := requests[len(requests)-1]
+			if request.ResourceID != allowedResourceID || request.ClientID != "" {
+				t.Fatalf("expected token request by resource ID %s, got: %+v", allowedResourceID, request)
+			}
+		})
+	}
+}
+
+func TestIsResourceAllowedStandardClient(t *testing.T) {
+	azureID := aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: "azid1", Namespace: "default"},
+		Spec:       aadpodid.AzureIdentitySpec{ClientID: "clientid1"},
+	}
+	newBinding := func(name, azureIdentity string, allowedResources ...string) aadpodid.AzureIdentityBinding {
+		return aadpodid.AzureIdentityBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: aadpodid.AzureIdentityBindingSpec{
+				AzureIdentity:    azureIdentity,
+				AllowedResources: allowedResources,
+			},
+		}
+	}
+
+	cases := []struct {
+		name            string
+		bindings        []aadpodid.AzureIdentityBinding
+		resource        string
+		expectedAllowed bool
+	}{
+		{
+			name:            "no binding for the identity",
+			bindings:        []aadpodid.AzureIdentityBinding{newBinding("binding1", "azid2")},
+			resource:        "https://vault.azure.net",
+			expectedAllowed: false,
+		},
+		{
+			name:            "no bindings",
+			resource:        "https://vault.azure.net",
+			expectedAllowed: false,
+		},
+		{
+			name:            "binding without allowed resources",
+			bindings:        []aadpodid.AzureIdentityBinding{newBinding("binding1", "azid1")},
+			resource:        "https://vault.azure.net",
+			expectedAllowed: true,
+		},
+		{
+			name:            "resource allowed by binding",
+			bindings:        []aadpodid.AzureIdentityBinding{newBinding("binding1", "azid1", "https://vault.azure.net")},
+			resource:        "https://vault.azure.net/",
+			expectedAllowed: true,
+		},
+		{
+			name:            "resource not allowed by binding",
+			bindings:        []aadpodid.AzureIdentityBinding{newBinding("binding1", "azid1", "https://vault.azure.net")},
+			resource:        "https://management.azure.com/",
+			expectedAllowed: false,
+		},
+		{
+			name: "resource allowed by another binding to the identity",
+			bindings: []aadpodid.AzureIdentityBinding{
+				newBinding("binding1", "azid1", "https://vault.azure.net"),
+				newBinding("binding2", "azid1", "https://management.azure.com/"),
+			},
+			resource:        "https://management.azure.com/",
+			expectedAllowed: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			kubeClient := NewTestKubeClient(nil)
+			kubeClient.bindings = tc.bindings
+			tokenClient, err := NewStandardTokenClient(kubeClient, Config{Mode: "standard"})
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+
+			allowed, err := tokenClient.IsResourceAllowed(context.Background(), "default", "pod1", tc.resource, azureID)
+			if err != nil {
+				t.Fatalf("expected err to be nil, got: %v", err)
+			}
+			if allowed != tc.expectedAllowed {
+				t.Fatalf("expected allowed to be %v, got: %v", tc.expectedAllowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package nmi
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/k8s"
+	"github.com/Azure/aad-pod-identity/pkg/metrics"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"go.opencensus.io/stats"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultTokenRefreshWindow is how long before expiry a cached token is refreshed in the background.
+	DefaultTokenRefreshWindow = 5 * time.Minute
+	// minTokenValidity is the minimum remaining lifetime a cached token must have to be served.
+	minTokenValidity = 1 * time.Minute
+	// tokenCacheSyncInterval is the interval at which the cache is scanned for tokens to refresh or evict.
+	tokenCacheSyncInterval = 30 * time.Second
+	// tokenRefreshTimeout is the maximum duration of a single background token refresh.
+	tokenRefreshTimeout = 30 * time.Second
+)
+
+// tokenCacheKey identifies a set of cached tokens by identity, resource and tenant.
+// Tokens of federated identities are additionally keyed by the requesting pod.
+type tokenCacheKey struct {
+	identity string
+	resource string
+	tenant   string
+	pod      string
+}
+
+func newTokenCacheKey(ctx context.Context, azureID aadpodid.AzureIdentity, resource string) tokenCacheKey {
+	return tokenCacheKey{
+		identity: strings.Join([]string{azureID.Namespace, azureID.Name}, "/"),
+		resource: resource,
+		tenant:   azureID.Spec.TenantID,
+		pod:      getPodKey(ctx, azureID),
+	}
+}
+
+type tokenCacheEntry struct {
+	// azureID is the identity that was used to acquire the tokens
+	azureID aadpodid.AzureIdentity
+	// rqClientID is the client id from the request that populated the entry
+	rqClientID string
+	// podInfo is the pod on whose behalf the tokens were acquired, if any
+	podInfo *PodInfo
+	tokens  []*adal.Token
+	// used is set when the entry is served and reset after every refresh,
+	// so that tokens which are no longer requested are not refreshed forever
+	used bool
+}
+
+// TokenCache is a TokenClient which caches the tokens acquired by the underlying
+// TokenClient and refreshes them in the background before they expire.
+type TokenCache struct {
+	TokenClient
+	KubeClient    k8s.Client
+	Reporter      *metrics.Reporter
+	RefreshWindow time.Duration
+
+	mu      sync.Mutex
+	entries map[tokenCacheKey]*tokenCacheEntry
+}
+
+// NewTokenCache creates a new token cache on top of the given token client
+func NewTokenCache(tokenClient TokenClient, kubeClient k8s.Client, reporter *metrics.Reporter, refreshWindow time.Duration) *TokenCache {
+	if refreshWindow <= 0 {
+		refreshWindow = DefaultTokenRefreshWindow
+	}
+	return &TokenCache{
+		TokenClient:   tokenClient,
+		KubeClient:    kubeClient,
+		Reporter:      reporter,
+		RefreshWindow: refreshWindow,
+		entries:       make(map[tokenCacheKey]*tokenCacheEntry),
+	}
+}
+
+// Run periodically refreshes tokens which are about to expire and evicts
+// entries whose identity no longer exists until the exit channel is closed.
+func (tc *TokenCache) Run(exit <-chan struct{}) {
+	klog.Infof("starting token cache with refresh window %v", tc.RefreshWindow)
+	ticker := time.NewTicker(tokenCacheSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exit:
+			return
+		case <-ticker.C:
+			tc.sync()
+		}
+	}
+}
+
+// GetTokens returns the cached tokens for the identity and resource if they are
+// still valid, otherwise acquires new tokens using the underlying token client.
+func (tc *TokenCache) GetTokens(ctx context.Context, rqClientID, rqResource string, azureID aadpodid.AzureIdentity) ([]*adal.Token, error) {
+	key := newTokenCacheKey(ctx, azureID, rqResource)
+
+	tc.mu.Lock()
+	entry, ok := tc.entries[key]
+	if ok && isSameIdentity(entry.azureID, azureID) && tokensValidFor(entry.tokens, minTokenValidity) {
+		entry.used = true
+		tokens := copyTokens(entry.tokens)
+		tc.mu.Unlock()
+
+		klog.V(5).Infof("token cache hit for identity %s, resource %s", key.identity, rqResource)
+		tc.report(metrics.NMITokenCacheHitCountM.M(1))
+		return tokens, nil
+	}
+	tc.mu.Unlock()
+
+	tc.report(metrics.NMITokenCacheMissCountM.M(1))
+	tokens, err := tc.TokenClient.GetTokens(ctx, rqClientID, rqResource, azureID)
+	if err != nil {
+		return tokens, err
+	}
+
+	entry = &tokenCacheEntry{
+		azureID:    azureID,
+		rqClientID: rqClientID,
+		tokens:     copyTokens(tokens),
+		used:       true,
+	}
+	if podInfo, ok := PodInfoFromContext(ctx); ok {
+		entry.podInfo = &podInfo
+	}
+	tc.mu.Lock()
+	tc.entries[key] = entry
+	tc.mu.Unlock()
+	return tokens, nil
+}
+
+// sync evicts entries whose identity is no longer active and refreshes
+// the tokens which will expire within the refresh window.
+func (tc *TokenCache) sync() {
+	activeIdentities, err := tc.KubeClient.ListActiveIdentities()
+	if err != nil {
+		klog.Errorf("failed to list active identities for token cache, error: %+v", err)
+		return
+	}
+	active := make(map[string]aadpodid.AzureIdentity)
+	for _, id := range activeIdentities {
+		active[strings.Join([]string{id.Namespace, id.Name}, "/")] = id
+	}
+
+	toRefresh := make(map[tokenCacheKey]tokenCacheEntry)
+	tc.mu.Lock()
+	for key, entry := range tc.entries {
+		id, exists := active[key.identity]
+		if !exists || !isSameIdentity(entry.azureID, id) {
+			klog.V(5).Infof("evicting identity %s, resource %s from token cache", key.identity, key.resource)
+			delete(tc.entries, key)
+			tc.report(metrics.NMITokenCacheEvictionCountM.M(1))
+			continue
+		}
+		if tokensValidFor(entry.tokens, tc.RefreshWindow) {
+			continue
+		}
+		if !entry.used {
+			// nobody requested the token since it was last refreshed
+			delete(tc.entries, key)
+			tc.report(metrics.NMITokenCacheEvictionCountM.M(1))
+			continue
+		}
+		toRefresh[key] = *entry
+	}
+	tc.mu.Unlock()
+
+	for key, entry := range toRefresh {
+		tc.refresh(key, entry)
+	}
+}
+
+func (tc *TokenCache) refresh(key tokenCacheKey, entry tokenCacheEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+	defer cancel()
+	if entry.podInfo != nil {
+		ctx = WithPodInfo(ctx, entry.podInfo.Namespace, entry.podInfo.Name)
+	}
+
+	klog.V(5).Infof("refreshing token for identity %s, resource %s", key.identity, key.resource)
+	tokens, err := tc.TokenClient.GetTokens(ctx, entry.rqClientID, key.resource, entry.azureID)
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.report(metrics.NMITokenCacheRefreshCountM.M(1))
+	if err != nil {
+		klog.Errorf("failed to refresh token for identity %s, resource %s, error: %+v", key.identity, key.resource, err)
+		tc.report(metrics.NMITokenCacheRefreshFailureCountM.M(1))
+		// keep serving the current tokens until they can no longer be used
+		if current, ok := tc.entries[key]; ok && !tokensValidFor(current.tokens, minTokenValidity) {
+			delete(tc.entries, key)
+			tc.report(metrics.NMITokenCacheEvictionCountM.M(1))
+		}
+		return
+	}
+	// the entry might have been evicted or replaced while refreshing
+	if current, ok := tc.entries[key]; ok && isSameIdentity(current.azureID, entry.azureID) {
+		current.tokens = copyTokens(tokens)
+		current.used = false
+	}
+}
+
+func (tc *TokenCache) report(ms ...stats.Measurement) {
+	if tc.Reporter != nil {
+		tc.Reporter.Report(ms...)
+	}
+}
+
+// isSameIdentity returns true if both identities would result in the same tokens
+func isSameIdentity(a, b aadpodid.AzureIdentity) bool {
+	return a.Namespace == b.Namespace && a.Name == b.Name && reflect.DeepEqual(a.Spec, b.Spec)
+}
+
+// tokensValidFor returns true if none of the tokens expire within the given duration
+func tokensValidFor(tokens []*adal.Token, d time.Duration) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	for _, token := range tokens {
+		if token == nil || token.WillExpireIn(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyTokens returns a copy of the tokens with ExpiresIn
+// updated to reflect the remaining lifetime of each token.
+func copyTokens(tokens []*adal.Token) []*adal.Token {
+	res := make([]*adal.Token, 0, len(tokens))
+	for _, token := range tokens {
+		if token == nil {
+			continue
+		}
+		t := *token
+		if remaining := int64(time.Until(t.Expires()).Seconds()); remaining > 0 {
+			t.ExpiresIn = json.Number(strconv.FormatInt(remaining, 10))
+		}
+		res = append(res, &t)
+	}
+	return res
+}
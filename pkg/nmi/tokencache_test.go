@@ -0,0 +1,210 @@
+package nmi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/k8s"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeTokenClient struct {
+	TokenClient
+	mu        sync.Mutex
+	calls     int
+	expiresIn time.Duration
+	err       error
+}
+
+func (c *fakeTokenClient) GetTokens(ctx context.Context, rqClientID, rqResource string, azureID aadpodid.AzureIdentity) ([]*adal.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []*adal.Token{newTestToken(strconv.Itoa(c.calls), rqResource, c.expiresIn)}, nil
+}
+
+func (c *fakeTokenClient) getCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+type activeIdentitiesKubeClient struct {
+	k8s.Client
+	identities []aadpodid.AzureIdentity
+}
+
+func (c *activeIdentitiesKubeClient) ListActiveIdentities() ([]aadpodid.AzureIdentity, error) {
+	return c.identities, nil
+}
+
+func newTestToken(accessToken, resource string, expiresIn time.Duration) *adal.Token {
+	return &adal.Token{
+		AccessToken: accessToken,
+		Resource:    resource,
+		ExpiresIn:   json.Number(strconv.FormatInt(int64(expiresIn.Seconds()), 10)),
+		ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(expiresIn).Unix(), 10)),
+	}
+}
+
+func newTestAzureIdentity(name, clientID string) aadpodid.AzureIdentity {
+	return aadpodid.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: aadpodid.AzureIdentitySpec{
+			Type:     aadpodid.UserAssignedMSI,
+			ClientID: clientID,
+			TenantID: "11111111-1111-1111-1111-111111111111",
+		},
+	}
+}
+
+func TestTokenCacheGetTokens(t *testing.T) {
+	tokenClient := &fakeTokenClient{expiresIn: time.Hour}
+	cache := NewTokenCache(tokenClient, &activeIdentitiesKubeClient{}, nil, DefaultTokenRefreshWindow)
+	azureID := newTestAzureIdentity("id1", "clientid1")
+
+	cases := []struct {
+		desc          string
+		azureID       aadpodid.AzureIdentity
+		resource      string
+		expectedToken string
+		expectedCalls int
+	}{
+		{
+			desc:          "cache miss",
+			azureID:       azureID,
+			resource:      "https://management.azure.com/",
+			expectedToken: "1",
+			expectedCalls: 1,
+		},
+		{
+			desc:          "cache hit",
+			azureID:       azureID,
+			resource:      "https://management.azure.com/",
+			expectedToken: "1",
+			expectedCalls: 1,
+		},
+		{
+			desc:          "different resource",
+			azureID:       azureID,
+			resource:      "https://vault.azure.net",
+			expectedToken: "2",
+			expectedCalls: 2,
+		},
+		{
+			desc:          "identity spec changed",
+			azureID:       newTestAzureIdentity("id1", "clientid2"),
+			resource:      "https://management.azure.com/",
+			expectedToken: "3",
+			expectedCalls: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			tokens, err := cache.GetTokens(context.Background(), "", tc.resource, tc.azureID)
+			if err != nil {
+				t.Fatalf("expected nil error, got: %v", err)
+			}
+			if len(tokens) != 1 || tokens[0].AccessToken != tc.expectedToken {
+				t.Fatalf("expected token %s, got: %+v", tc.expectedToken, tokens)
+			}
+			if calls := tokenClient.getCalls(); calls != tc.expectedCalls {
+				t.Fatalf("expected %d calls to token client, got: %d", tc.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestTokenCacheExpiredToken(t *testing.T) {
+	// tokens expiring within minTokenValidity are never served from the cache
+	tokenClient := &fakeTokenClient{expiresIn: 30 * time.Second}
+	cache := NewTokenCache(tokenClient, &activeIdentitiesKubeClient{}, nil, DefaultTokenRefreshWindow)
+	azureID := newTestAzureIdentity("id1", "clientid1")
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetTokens(context.Background(), "", "https://management.azure.com/", azureID); err != nil {
+			t.Fatalf("expected nil error, got: %v", err)
+		}
+	}
+	if calls := tokenClient.getCalls(); calls != 2 {
+		t.Fatalf("expected 2 calls to token client, got: %d", calls)
+	}
+}
+
+func TestTokenCacheError(t *testing.T) {
+	tokenClient := &fakeTokenClient{expiresIn: time.Hour, err: errors.New("failed to get token")}
+	cache := NewTokenCache(tokenClient, &activeIdentitiesKubeClient{}, nil, DefaultTokenRefreshWindow)
+	azureID := newTestAzureIdentity("id1", "clientid1")
+
+	if _, err := cache.GetTokens(context.Background(), "", "https://management.azure.com/", azureID); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if len(cache.entries) != 0 {
+		t.Fatalf("expected failed token requests not to be cached, got %d entries", len(cache.entries))
+	}
+}
+
+func TestTokenCacheSync(t *testing.T) {
+	azureID1 := newTestAzureIdentity("id1", "clientid1")
+	azureID2 := newTestAzureIdentity("id2", "clientid2")
+	azureID3 := newTestAzureIdentity("id3", "clientid3")
+
+	tokenClient := &fakeTokenClient{expiresIn: 3 * time.Minute}
+	kubeClient := &activeIdentitiesKubeClient{identities: []aadpodid.AzureIdentity{azureID1, azureID2}}
+	cache := NewTokenCache(tokenClient, kubeClient, nil, DefaultTokenRefreshWindow)
+
+	for _, id := range []aadpodid.AzureIdentity{azureID1, azureID2, azureID3} {
+		if _, err := cache.GetTokens(context.Background(), "", "https://management.azure.com/", id); err != nil {
+			t.Fatalf("expected nil error, got: %v", err)
+		}
+	}
+
+	// id1 and id2 are refreshed as their tokens expire within the refresh window,
+	// id3 is evicted since it is no longer active
+	tokenClient.expiresIn = time.Hour
+	cache.sync()
+
+	if len(cache.entries) != 2 {
+		t.Fatalf("expected 2 entries in token cache, got: %d", len(cache.entries))
+	}
+	if _, ok := cache.entries[newTokenCacheKey(context.Background(), azureID3, "https://management.azure.com/")]; ok {
+		t.Fatalf("expected %s to be evicted from token cache", azureID3.Name)
+	}
+	if calls := tokenClient.getCalls(); calls != 5 {
+		t.Fatalf("expected 5 calls to token client, got: %d", calls)
+	}
+
+	tokens, err := cache.GetTokens(context.Background(), "", "https://management.azure.com/", azureID1)
+	if err != nil {
+		t.Fatalf("expected nil error, got: %v", err)
+	}
+	if tokens[0].AccessToken != "4" && tokens[0].AccessToken != "5" {
+		t.Fatalf("expected refreshed token to be served, got: %s", tokens[0].AccessToken)
+	}
+
+	// tokens which were not requested since the last refresh are evicted instead of refreshed
+	tokenClient.expiresIn = 3 * time.Minute
+	for key, entry := range cache.entries {
+		entry.tokens = []*adal.Token{newTestToken("expiring", key.resource, 3*time.Minute)}
+	}
+	cache.sync()
+
+	if len(cache.entries) != 1 {
+		t.Fatalf("expected 1 entry in token cache, got: %d", len(cache.entries))
+	}
+	if _, ok := cache.entries[newTokenCacheKey(context.Background(), azureID1, "https://management.azure.com/")]; !ok {
+		t.Fatalf("expected %s to be refreshed in token cache", azureID1.Name)
+	}
+}
@@ -2,6 +2,7 @@ package pod
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"time"
 
@@ -78,10 +79,11 @@ func addPodHandler(i informersv1.PodInformer, eventCh chan aadpodid.EventType, p
 					}
 				}
 
-				// We are only interested in updates to pod if the node or label changes.
+				// We are only interested in updates to pod if the node or labels change.
 				// Having this check will ensure that mic sync loop does not do extra work
-				// for every pod update.
-				if oldPod.Spec.NodeName != newPod.Spec.NodeName || oldPod.ObjectMeta.Labels[aadpodid.CRDLabelKey] != newPod.ObjectMeta.Labels[aadpodid.CRDLabelKey] {
+				// for every pod update. All labels are compared since bindings can select
+				// pods by label selector.
+				if oldPod.Spec.NodeName != newPod.Spec.NodeName || !reflect.DeepEqual(oldPod.ObjectMeta.Labels, newPod.ObjectMeta.Labels) {
 					klog.V(6).Infof("Pod Updated")
 					if eventCh != nil {
 						eventCh <- aadpodid.PodUpdated
@@ -1,8 +1,15 @@
 package retry
 
 import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/Azure/go-autorest/autorest"
 )
 
 // Func is a function that is being retried.
@@ -20,59 +27,124 @@ type RetriableError string
 // function based on what type of error has occurred
 type ClientInt interface {
 	Do(f Func, shouldRetry ShouldRetryFunc) error
+	DoWithContext(ctx context.Context, f Func, shouldRetry ShouldRetryFunc) ([]Attempt, error)
 	RegisterRetriableErrors(rerrs ...RetriableError)
 	UnregisterRetriableErrors(rerrs ...RetriableError)
+	RegisterRetriableStatusCodes(statusCodes ...int)
+	UnregisterRetriableStatusCodes(statusCodes ...int)
+}
+
+// Backoff configures the delays between the runs of a retried function.
+type Backoff struct {
+	// InitialInterval is the delay before the first retry.
+	InitialInterval time.Duration
+	// Multiplier is the factor by which the delay grows after every retry.
+	// A multiplier less than 1 is treated as 1, i.e. a constant delay.
+	Multiplier float64
+	// Jitter randomizes every delay by up to the fraction in both directions,
+	// e.g. 0.2 for a delay between 80% and 120% of the computed delay.
+	Jitter float64
+	// MaxInterval caps the delay between two runs if not zero.
+	MaxInterval time.Duration
+	// MaxRetries is the maximum number of retries after the first run.
+	MaxRetries int
+	// MaxElapsedTime stops the retries if not zero and the next run would
+	// start later than MaxElapsedTime after the first run.
+	MaxElapsedTime time.Duration
+}
+
+// Attempt is a run of a retried function.
+type Attempt struct {
+	// Delay is the time waited before the run, which is zero for the first run
+	Delay time.Duration
+	// Start is when the run started and Duration how long it took
+	Start    time.Time
+	Duration time.Duration
+	// Err is the error returned by the run
+	Err error
 }
 
 type client struct {
-	retriableErrors map[RetriableError]bool
-	maxRetry        int
-	retryInterval   time.Duration
+	mu                   sync.RWMutex
+	retriableErrors      map[RetriableError]bool
+	retriableStatusCodes map[int]bool
+	backoff              Backoff
 }
 
 var _ ClientInt = &client{}
 
+// randFloat64 returns a random number in [0.0,1.0) to compute the jitter of delays.
+var randFloat64 = rand.Float64
+
 // NewRetryClient returns an implementation of ClientInt that retries
-// running a given function based on the parameters provided.
+// running a given function based on the parameters provided, waiting
+// retryInterval between the runs.
 func NewRetryClient(maxRetry int, retryInterval time.Duration) ClientInt {
+	return NewBackoffRetryClient(Backoff{
+		InitialInterval: retryInterval,
+		Multiplier:      1,
+		MaxRetries:      maxRetry,
+	})
+}
+
+// NewBackoffRetryClient returns an implementation of ClientInt that retries
+// running a given function with the exponential backoff.
+func NewBackoffRetryClient(backoff Backoff) ClientInt {
 	return &client{
-		retriableErrors: make(map[RetriableError]bool),
-		maxRetry:        maxRetry,
-		retryInterval:   retryInterval,
+		retriableErrors:      make(map[RetriableError]bool),
+		retriableStatusCodes: make(map[int]bool),
+		backoff:              backoff,
 	}
 }
 
 // Do runs the targeted function f and will retry running
 // it if it returns an error and shouldRetry returns true.
+// It returns the error of the last run.
 func (c *client) Do(f Func, shouldRetry ShouldRetryFunc) error {
-	// The original error
-	err := f()
-	if err == nil {
-		return nil
-	}
+	_, err := c.DoWithContext(context.Background(), f, shouldRetry)
+	return err
+}
 
-	// Error occurred when retrying
-	rerr := err
-	for i := 0; i < c.maxRetry; i++ {
-		if rerr == nil || !c.isRetriable(rerr) || !shouldRetry(rerr) {
-			break
-		}
+// DoWithContext runs the targeted function f and retries running it with
+// backoff while the error it returns is retriable and shouldRetry returns
+// true, until the backoff is exhausted or ctx is done. It returns all the
+// runs of f and the error of the last run.
+func (c *client) DoWithContext(ctx context.Context, f Func, shouldRetry ShouldRetryFunc) ([]Attempt, error) {
+	var attempts []Attempt
+	first := time.Now()
+	var delay time.Duration
+	for retries := 0; ; retries++ {
+		start := time.Now()
+		err := f()
+		attempts = append(attempts, Attempt{
+			Delay:    delay,
+			Start:    start,
+			Duration: time.Since(start),
+			Err:      err,
+		})
 
-		time.Sleep(c.retryInterval)
 		// We should retry if:
 		// 1) the last known error is not nil
 		// 2) the error is retriable
 		// 3) shouldRetry returns true
-		rerr = f()
+		// 4) the backoff is not exhausted
+		if err == nil || retries >= c.backoff.MaxRetries || !c.isRetriable(err) || !shouldRetry(err) {
+			return attempts, err
+		}
+		delay = c.backoff.delay(retries)
+		if c.backoff.MaxElapsedTime > 0 && time.Since(first)+delay > c.backoff.MaxElapsedTime {
+			return attempts, err
+		}
+		if !sleep(ctx, delay) {
+			return attempts, err
+		}
 	}
-
-	// Return the original error from the first run,
-	// indicating that we retried running the function
-	return err
 }
 
 // RegisterRetriableErrors registers a retriable error to the retrier.
 func (c *client) RegisterRetriableErrors(rerrs ...RetriableError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, rerr := range rerrs {
 		c.retriableErrors[rerr] = true
 	}
@@ -80,17 +152,45 @@ func (c *client) RegisterRetriableErrors(rerrs ...RetriableError) {
 
 // UnregisterRetriableErrors unregisters an error from the retrier.
 func (c *client) UnregisterRetriableErrors(rerrs ...RetriableError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, rerr := range rerrs {
 		delete(c.retriableErrors, rerr)
 	}
 }
 
-// isRetriable returns true if an error is retriable.
+// RegisterRetriableStatusCodes registers HTTP status codes of autorest.DetailedErrors
+// which are retriable to the retrier.
+func (c *client) RegisterRetriableStatusCodes(statusCodes ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, statusCode := range statusCodes {
+		c.retriableStatusCodes[statusCode] = true
+	}
+}
+
+// UnregisterRetriableStatusCodes unregisters HTTP status codes from the retrier.
+func (c *client) UnregisterRetriableStatusCodes(statusCodes ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, statusCode := range statusCodes {
+		delete(c.retriableStatusCodes, statusCode)
+	}
+}
+
+// isRetriable returns true if an error contains a registered retriable error
+// or is an autorest.DetailedError with a registered status code.
 func (c *client) isRetriable(err error) bool {
 	if err == nil {
 		return false
 	}
 
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if statusCode, ok := StatusCode(err); ok && c.retriableStatusCodes[statusCode] {
+		return true
+	}
 	for rerr := range c.retriableErrors {
 		if strings.Contains(err.Error(), string(rerr)) {
 			return true
@@ -99,3 +199,52 @@ func (c *client) isRetriable(err error) bool {
 
 	return false
 }
+
+// StatusCode returns the HTTP status code of the autorest.DetailedError in the chain of err.
+func StatusCode(err error) (int, bool) {
+	var detailedErr autorest.DetailedError
+	if errors.As(err, &detailedErr) {
+		statusCode, ok := detailedErr.StatusCode.(int)
+		return statusCode, ok && statusCode != 0
+	}
+	var detailedErrPtr *autorest.DetailedError
+	if errors.As(err, &detailedErrPtr) && detailedErrPtr != nil {
+		statusCode, ok := detailedErrPtr.StatusCode.(int)
+		return statusCode, ok && statusCode != 0
+	}
+	return 0, false
+}
+
+// delay returns the delay before the retry with the given zero-based index.
+func (b Backoff) delay(retry int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(b.InitialInterval) * math.Pow(multiplier, float64(retry))
+	if b.MaxInterval > 0 && delay > float64(b.MaxInterval) {
+		delay = float64(b.MaxInterval)
+	}
+	if b.Jitter > 0 {
+		delay *= 1 + b.Jitter*(2*randFloat64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// sleep waits for the delay and returns false if ctx is done first.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	if err := ctx.Err(); err != nil {
+		return false
+	}
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,9 +1,14 @@
 package retry
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -54,4 +59,199 @@ func TestDo(t *testing.T) {
 	// Targeted function only ran once since err2 was not registered
 	assert.Equal(t, 1, ran)
 	assert.Error(t, err)
+
+	ran = 0
+	err = r.Do(func() error {
+		ran++
+		return fmt.Errorf("err1 occurred in run %d", ran)
+	}, func(err error) bool {
+		return true
+	})
+	// The error of the last run is returned
+	assert.EqualError(t, err, "err1 occurred in run 3")
+}
+
+func TestDoWithContext(t *testing.T) {
+	r := NewRetryClient(3, 0)
+	r.RegisterRetriableErrors("err1")
+
+	ran := 0
+	attempts, err := r.DoWithContext(context.Background(), func() error {
+		ran++
+		if ran < 3 {
+			return fmt.Errorf("err1 occurred in run %d", ran)
+		}
+		return nil
+	}, func(err error) bool {
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Len(t, attempts, 3)
+	assert.EqualError(t, attempts[0].Err, "err1 occurred in run 1")
+	assert.EqualError(t, attempts[1].Err, "err1 occurred in run 2")
+	assert.NoError(t, attempts[2].Err)
+	for i := 1; i < len(attempts); i++ {
+		assert.False(t, attempts[i].Start.Before(attempts[i-1].Start))
+	}
+
+	// Targeted function is not retried once the context is done
+	r = NewRetryClient(3, time.Hour)
+	r.RegisterRetriableErrors("err1")
+	ctx, cancel := context.WithCancel(context.Background())
+	ran = 0
+	attempts, err = r.DoWithContext(ctx, func() error {
+		ran++
+		cancel()
+		return errors.New("err1 occurred")
+	}, func(err error) bool {
+		return true
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, ran)
+	assert.Len(t, attempts, 1)
+}
+
+func TestDoWithMaxElapsedTime(t *testing.T) {
+	r := NewBackoffRetryClient(Backoff{
+		InitialInterval: 20 * time.Millisecond,
+		Multiplier:      2,
+		MaxRetries:      10,
+		MaxElapsedTime:  100 * time.Millisecond,
+	})
+	r.RegisterRetriableErrors("err1")
+
+	attempts, err := r.DoWithContext(context.Background(), func() error {
+		return errors.New("err1 occurred")
+	}, func(err error) bool {
+		return true
+	})
+	assert.Error(t, err)
+	// The retries after 20ms and 40ms are within the max elapsed time, but not a third one after 80ms
+	assert.Len(t, attempts, 3)
+	assert.Equal(t, time.Duration(0), attempts[0].Delay)
+	assert.Equal(t, 20*time.Millisecond, attempts[1].Delay)
+	assert.Equal(t, 40*time.Millisecond, attempts[2].Delay)
+}
+
+func TestBackoffDelay(t *testing.T) {
+	defer func(f func() float64) { randFloat64 = f }(randFloat64)
+
+	cases := []struct {
+		desc     string
+		backoff  Backoff
+		rand     float64
+		expected []time.Duration
+	}{
+		{
+			desc:     "constant delay",
+			backoff:  Backoff{InitialInterval: time.Second, Multiplier: 1},
+			expected: []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			desc:     "multiplier less than 1 is a constant delay",
+			backoff:  Backoff{InitialInterval: time.Second},
+			expected: []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			desc:     "exponential delay",
+			backoff:  Backoff{InitialInterval: time.Second, Multiplier: 2},
+			expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			desc:     "exponential delay capped by max interval",
+			backoff:  Backoff{InitialInterval: time.Second, Multiplier: 2, MaxInterval: 3 * time.Second},
+			expected: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			desc:     "lowest jitter",
+			backoff:  Backoff{InitialInterval: time.Second, Multiplier: 2, Jitter: 0.2},
+			rand:     0,
+			expected: []time.Duration{800 * time.Millisecond, 1600 * time.Millisecond},
+		},
+		{
+			desc:     "highest jitter",
+			backoff:  Backoff{InitialInterval: time.Second, Multiplier: 2, Jitter: 0.2},
+			rand:     1,
+			expected: []time.Duration{1200 * time.Millisecond, 2400 * time.Millisecond},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			randFloat64 = func() float64 { return tc.rand }
+			for i, expected := range tc.expected {
+				assert.Equal(t, expected, tc.backoff.delay(i), "delay of retry %d", i)
+			}
+		})
+	}
+}
+
+func TestRetriableStatusCodes(t *testing.T) {
+	r := NewRetryClient(2, 0)
+	r.RegisterRetriableStatusCodes(http.StatusConflict)
+
+	cases := []struct {
+		desc     string
+		err      error
+		expected int
+	}{
+		{
+			desc:     "detailed error with a registered status code",
+			err:      autorest.DetailedError{StatusCode: http.StatusConflict},
+			expected: 3,
+		},
+		{
+			desc:     "pointer to a detailed error with a registered status code",
+			err:      &autorest.DetailedError{StatusCode: http.StatusConflict},
+			expected: 3,
+		},
+		{
+			desc:     "wrapped detailed error with a registered status code",
+			err:      fmt.Errorf("failed to update, error: %w", autorest.DetailedError{StatusCode: http.StatusConflict}),
+			expected: 3,
+		},
+		{
+			desc:     "detailed error with an unregistered status code",
+			err:      autorest.DetailedError{StatusCode: http.StatusForbidden},
+			expected: 1,
+		},
+		{
+			desc:     "error without a status code",
+			err:      errors.New("409 Conflict"),
+			expected: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			attempts, err := r.DoWithContext(context.Background(), func() error {
+				return tc.err
+			}, func(err error) bool {
+				return true
+			})
+			assert.Error(t, err)
+			assert.Len(t, attempts, tc.expected)
+		})
+	}
+
+	r.UnregisterRetriableStatusCodes(http.StatusConflict)
+	attempts, err := r.DoWithContext(context.Background(), func() error {
+		return autorest.DetailedError{StatusCode: http.StatusConflict}
+	}, func(err error) bool {
+		return true
+	})
+	assert.Error(t, err)
+	assert.Len(t, attempts, 1)
+}
+
+func TestStatusCode(t *testing.T) {
+	statusCode, ok := StatusCode(fmt.Errorf("wrapped: %w", autorest.DetailedError{StatusCode: http.StatusTooManyRequests}))
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusTooManyRequests, statusCode)
+
+	_, ok = StatusCode(autorest.DetailedError{})
+	assert.False(t, ok)
+
+	_, ok = StatusCode(errors.New("no status code"))
+	assert.False(t, ok)
 }
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"regexp"
@@ -36,3 +38,15 @@ func IsKubenetCNI(kubeletConfig string) (bool, error) {
 	}
 	return strings.Contains(string(bytes), "--network-plugin=kubenet"), nil
 }
+
+// NewIdentityHeader returns a random value of the X-IDENTITY-HEADER a pod must present when requesting
+// tokens through the App Service managed identity protocol. A new value is generated for every pod when
+// it is admitted and stored in its annotations. The value is only accepted in requests sent from the IP
+// of that pod, so it proves that a request was sent deliberately by the pod rather than forged through SSRF.
+func NewIdentityHeader() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate identity header, error: %+v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -112,3 +112,20 @@ KUBELET_NODE_LABELS=kubernetes.azure.com/role=agent,agentpool=agentpool,storagep
 		})
 	}
 }
+
+func TestNewIdentityHeader(t *testing.T) {
+	header, err := NewIdentityHeader()
+	if err != nil {
+		t.Fatalf("expected no error, got: %+v", err)
+	}
+	if len(header) != 64 {
+		t.Fatalf("expected 32 hex encoded bytes, got: %s", header)
+	}
+	other, err := NewIdentityHeader()
+	if err != nil {
+		t.Fatalf("expected no error, got: %+v", err)
+	}
+	if header == other {
+		t.Fatalf("expected identity headers to differ, got: %s", other)
+	}
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/Azure/aad-pod-identity/pkg/filewatcher"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+)
+
+// CertLoader loads the serving certificate of the webhook server and reloads it
+// when the certificate or key files change, e.g. when the secret they are mounted
+// from is rotated.
+type CertLoader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertLoader returns a CertLoader with the certificate loaded from certFile and keyFile.
+func NewCertLoader(certFile, keyFile string) (*CertLoader, error) {
+	l := &CertLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := l.Load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Load loads the certificate from the certificate and key files.
+func (l *CertLoader) Load() error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate from %s and %s, error: %+v", l.certFile, l.keyFile, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cert = &cert
+	return nil
+}
+
+// GetCertificate returns the last loaded certificate and is meant to be used as tls.Config.GetCertificate.
+func (l *CertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cert, nil
+}
+
+// Watch reloads the certificate whenever the directories of the certificate and key files change
+// until exit is closed. The directories are watched since mounted secrets are updated by swapping
+// symlinks rather than writing the files. The last loaded certificate is kept if reloading fails.
+func (l *CertLoader) Watch(exit <-chan struct{}) error {
+	watcher, err := filewatcher.NewFileWatcher(
+		func(event fsnotify.Event) {
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+				return
+			}
+			if err := l.Load(); err != nil {
+				klog.Errorf("failed to reload certificate, error: %+v", err)
+				return
+			}
+			klog.Infof("reloaded certificate from %s", l.certFile)
+		},
+		func(err error) {
+			klog.Errorf("failed to watch certificate, error: %+v", err)
+		})
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher, error: %+v", err)
+	}
+
+	for _, dir := range []string{filepath.Dir(l.certFile), filepath.Dir(l.keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s, error: %+v", dir, err)
+		}
+	}
+	watcher.Start(exit)
+	return nil
+}
@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert writes a self-signed certificate for the common name and its key to certFile and keyFile.
+func writeCert(t *testing.T, commonName, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key, error: %+v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate, error: %+v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key, error: %+v", err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write certificate, error: %+v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("failed to write key, error: %+v", err)
+	}
+}
+
+// commonName returns the common name of the certificate currently served by the loader.
+func commonName(t *testing.T, l *CertLoader) string {
+	cert, err := l.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("failed to get certificate, error: %+v", err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate, error: %+v", err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook-certs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir, error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	_, err = NewCertLoader(certFile, keyFile)
+	assert.Error(t, err)
+
+	writeCert(t, "first", certFile, keyFile)
+	l, err := NewCertLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to create cert loader, error: %+v", err)
+	}
+	assert.Equal(t, "first", commonName(t, l))
+
+	// the last loaded certificate is kept if the files are invalid
+	if err := ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("failed to write key, error: %+v", err)
+	}
+	assert.Error(t, l.Load())
+	assert.Equal(t, "first", commonName(t, l))
+
+	exit := make(chan struct{})
+	defer close(exit)
+	if err := l.Watch(exit); err != nil {
+		t.Fatalf("failed to watch certificate, error: %+v", err)
+	}
+
+	writeCert(t, "second", certFile, keyFile)
+	assert.Eventually(t, func() bool {
+		return commonName(t, l) == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,409 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/nmi"
+	"github.com/Azure/aad-pod-identity/pkg/nmi/server"
+	"github.com/Azure/aad-pod-identity/pkg/utils"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// MutatePath is the path of the mutating webhook for pods.
+	MutatePath = "/mutate"
+
+	// MutationLabelKey is the label of namespaces and pods which are not mutated when it is set to
+	// MutationDisabled. The MutatingWebhookConfiguration excludes them with its namespaceSelector
+	// and objectSelector, so that the API server doesn't even call the webhook.
+	MutationLabelKey = "aadpodidentity.k8s.io/mutate"
+	// MutationDisabled is the value of MutationLabelKey which disables the mutation.
+	MutationDisabled = "disabled"
+
+	// DefaultNMIEndpoint is the address at which pods reach NMI, as requests to the
+	// instance metadata endpoint are redirected to NMI.
+	DefaultNMIEndpoint = "http://169.254.169.254"
+
+	// initContainerName is the name of the init container which waits until the identity of the pod is assigned
+	initContainerName = "aad-pod-identity-wait"
+	// initContainerAttempts and initContainerIntervalSeconds bound the wait of the init container to
+	// 5 minutes, after which it fails and is restarted with backoff according to the restart policy of the pod
+	initContainerAttempts        = 60
+	initContainerIntervalSeconds = 5
+	// defaultServiceAccountName is the service account of pods which don't specify one
+	defaultServiceAccountName = "default"
+
+	clientIDEnvVar         = "AZURE_CLIENT_ID"
+	identityEndpointEnvVar = "IDENTITY_ENDPOINT"
+	identityHeaderEnvVar   = "IDENTITY_HEADER"
+)
+
+// InjectionConfig configures what the mutating webhook injects into pods in addition to the
+// CRDLabelKey label. Environment variables and the init container are only injected into pods
+// which are bound to an identity.
+type InjectionConfig struct {
+	// Namespaced only binds pods to identities in their own namespace, like --forceNamespaced of MIC and NMI.
+	Namespaced bool
+	// InjectEnv injects AZURE_CLIENT_ID with the client ID of the default identity of the pod.
+	InjectEnv bool
+	// IdentityEndpoint is injected as IDENTITY_ENDPOINT along with the IDENTITY_HEADER of the pod if
+	// InjectEnv is set. It is the address of the App Service managed identity protocol served by NMI,
+	// e.g. http://169.254.169.254/msi/token. The IDENTITY_HEADER is generated randomly for each pod and
+	// stored in its IdentityHeaderAnnotationKey annotation, from which the variable is referenced.
+	IdentityEndpoint string
+	// InitContainerImage is the image of the init container which waits until the default identity
+	// of the pod is assigned. It has to provide sh and wget. No init container is injected if empty.
+	InitContainerImage string
+	// NMIEndpoint is the address at which the init container reaches NMI.
+	NMIEndpoint string
+}
+
+// patchOperation is an operation of a JSON patch.
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ServeMutate injects the CRDLabelKey label, environment variables and the init container into pods
+// when they are created.
+func (s *Server) ServeMutate(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, s.mutate)
+}
+
+// mutate patches pods. Pods are admitted unchanged rather than rejected if the patch cannot be computed.
+func (s *Server) mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation != admissionv1.Create || req.Resource.Resource != "pods" {
+		return allowed()
+	}
+
+	var pod corev1.Pod
+	if err := decode(req, &pod); err != nil {
+		return errored(http.StatusBadRequest, err)
+	}
+	// pods created by controllers only have a generated name
+	podName := pod.Name
+	if podName == "" {
+		podName = pod.GenerateName
+	}
+
+	patch, err := s.getPodPatch(&pod)
+	if err != nil {
+		klog.Errorf("failed to compute patch of pod %s/%s, error: %+v", pod.Namespace, podName, err)
+		return allowed()
+	}
+	if len(patch) == 0 {
+		return allowed()
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		klog.Errorf("failed to encode patch of pod %s/%s, error: %+v", pod.Namespace, podName, err)
+		return allowed()
+	}
+	klog.Infof("patching pod %s/%s with %s", pod.Namespace, podName, string(patchBytes))
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &patchType,
+	}
+}
+
+// getPodPatch returns the JSON patch of the pod.
+func (s *Server) getPodPatch(pod *corev1.Pod) ([]patchOperation, error) {
+	var patch []patchOperation
+
+	ns, err := s.getNamespace(pod.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if ns.Labels[MutationLabelKey] == MutationDisabled || pod.Labels[MutationLabelKey] == MutationDisabled {
+		return nil, nil
+	}
+
+	if _, ok := pod.Labels[aadpodid.CRDLabelKey]; !ok {
+		selector, err := s.getBindingSelector(pod, ns)
+		if err != nil {
+			return nil, err
+		}
+		if selector != "" {
+			if pod.Labels == nil {
+				pod.Labels = make(map[string]string)
+				patch = append(patch, patchOperation{Op: "add", Path: "/metadata/labels", Value: map[string]string{aadpodid.CRDLabelKey: selector}})
+			} else {
+				patch = append(patch, patchOperation{Op: "add", Path: "/metadata/labels/" + escapeJSONPointer(aadpodid.CRDLabelKey), Value: selector})
+			}
+			// the label is matched by the bindings below
+			pod.Labels[aadpodid.CRDLabelKey] = selector
+		}
+	}
+
+	if !s.Injection.InjectEnv && s.Injection.InitContainerImage == "" {
+		return patch, nil
+	}
+	id, err := s.getDefaultIdentity(pod, ns)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return patch, nil
+	}
+	if s.Injection.InjectEnv {
+		envPatch, err := s.getEnvPatch(pod, id)
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, envPatch...)
+	}
+	if s.Injection.InitContainerImage != "" {
+		patch = append(patch, s.getInitContainerPatch(pod, id)...)
+	}
+	return patch, nil
+}
+
+// getBindingSelector returns the value of the BindingSelectorAnnotationKey annotation of the service
+// account of the pod, or else of its namespace.
+func (s *Server) getBindingSelector(pod *corev1.Pod, ns *corev1.Namespace) (string, error) {
+	sa, err := s.getServiceAccount(pod.Namespace, getServiceAccountName(pod))
+	if err != nil {
+		return "", err
+	}
+	if sa != nil && sa.Annotations[aadpodid.BindingSelectorAnnotationKey] != "" {
+		return sa.Annotations[aadpodid.BindingSelectorAnnotationKey], nil
+	}
+	return ns.Annotations[aadpodid.BindingSelectorAnnotationKey], nil
+}
+
+// getNamespace returns the namespace from the cache of the namespace informer. Namespaces which
+// were created just before the pod may not be cached yet, so they are read from the API server.
+func (s *Server) getNamespace(name string) (*corev1.Namespace, error) {
+	obj, exists, err := s.NamespaceInformer.GetStore().GetByKey(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s from cache, error: %+v", name, err)
+	}
+	if exists {
+		if ns, ok := obj.(*corev1.Namespace); ok {
+			return ns, nil
+		}
+	}
+	ns, err := s.KubeClient.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s, error: %+v", name, err)
+	}
+	return ns, nil
+}
+
+// getServiceAccount returns the service account from the cache of the service account informer,
+// or else from the API server, or nil if it doesn't exist.
+func (s *Server) getServiceAccount(namespace, name string) (*corev1.ServiceAccount, error) {
+	obj, exists, err := s.ServiceAccountInformer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service account %s/%s from cache, error: %+v", namespace, name, err)
+	}
+	if exists {
+		if sa, ok := obj.(*corev1.ServiceAccount); ok {
+			return sa, nil
+		}
+	}
+	sa, err := s.KubeClient.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service account %s/%s, error: %+v", namespace, name, err)
+	}
+	return sa, nil
+}
+
+// getDefaultIdentity returns the identity NMI uses for token requests of the pod which don't specify
+// an identity, or nil if the pod isn't bound to an identity.
+func (s *Server) getDefaultIdentity(pod *corev1.Pod, ns *corev1.Namespace) (*aadpodid.AzureIdentity, error) {
+	ids, err := s.CRDClient.GetPodIDsWithBinding(pod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AzureIdentities of pod, error: %+v", err)
+	}
+	var allowed []aadpodid.AzureIdentity
+	for i := range ids {
+		ok, err := ids[i].AllowsNamespace(ns, s.Injection.Namespaced)
+		if err != nil {
+			klog.Errorf("failed to check if identity %s/%s allows namespace %s, error: %+v", ids[i].Namespace, ids[i].Name, ns.Name, err)
+			continue
+		}
+		if ok {
+			allowed = append(allowed, ids[i])
+		}
+	}
+	allowed, err = s.filterIdentitiesByPolicy(allowed)
+	if err != nil {
+		return nil, err
+	}
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+
+	bindings, err := s.CRDClient.GetPodBindings(pod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get AzureIdentityBindings of pod, error: %+v", err)
+	}
+	id, _ := nmi.SelectDefaultIdentity(allowed, bindings)
+	return &id, nil
+}
+
+// filterIdentitiesByPolicy returns the identities which don't violate the AzureIdentityPolicies,
+// as NMI doesn't serve tokens of the other identities.
+func (s *Server) filterIdentitiesByPolicy(ids []aadpodid.AzureIdentity) ([]aadpodid.AzureIdentity, error) {
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	policies, err := s.CRDClient.ListIdentityPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list AzureIdentityPolicies, error: %+v", err)
+	}
+	if len(policies) == 0 {
+		return ids, nil
+	}
+
+	var filtered []aadpodid.AzureIdentity
+	for i, err := range aadpodid.GetPolicyViolations(policies, ids, s.getNamespace) {
+		if err != nil {
+			klog.Infof("identity %s/%s violates a policy, it will not be injected, error: %+v", ids[i].Namespace, ids[i].Name, err)
+			continue
+		}
+		filtered = append(filtered, ids[i])
+	}
+	return filtered, nil
+}
+
+// getEnvPatch returns the patch which adds the environment variables of the identity to the
+// containers of the pod. Variables already set by a container are kept.
+func (s *Server) getEnvPatch(pod *corev1.Pod, id *aadpodid.AzureIdentity) ([]patchOperation, error) {
+	var patch []patchOperation
+	env := []corev1.EnvVar{{Name: clientIDEnvVar, Value: id.Spec.ClientID}}
+	if s.Injection.IdentityEndpoint != "" {
+		headerPatch, err := getIdentityHeaderPatch(pod)
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, headerPatch...)
+		env = append(env,
+			corev1.EnvVar{Name: identityEndpointEnvVar, Value: s.Injection.IdentityEndpoint},
+			corev1.EnvVar{Name: identityHeaderEnvVar, ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: fmt.Sprintf("metadata.annotations['%s']", aadpodid.IdentityHeaderAnnotationKey),
+				},
+			}},
+		)
+	}
+
+	for i, container := range pod.Spec.Containers {
+		var missing []corev1.EnvVar
+		for _, envVar := range env {
+			if !hasEnvVar(container, envVar.Name) {
+				missing = append(missing, envVar)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		path := fmt.Sprintf("/spec/containers/%d/env", i)
+		if len(container.Env) == 0 {
+			patch = append(patch, patchOperation{Op: "add", Path: path, Value: missing})
+			continue
+		}
+		for _, envVar := range missing {
+			patch = append(patch, patchOperation{Op: "add", Path: path + "/-", Value: envVar})
+		}
+	}
+	return patch, nil
+}
+
+// getIdentityHeaderPatch returns the patch which adds a random IDENTITY_HEADER to the annotations of
+// the pod. NMI only serves requests of the pod which present this header. An existing header is kept.
+func getIdentityHeaderPatch(pod *corev1.Pod) ([]patchOperation, error) {
+	if pod.Annotations[aadpodid.IdentityHeaderAnnotationKey] != "" {
+		return nil, nil
+	}
+	header, err := utils.NewIdentityHeader()
+	if err != nil {
+		return nil, err
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{aadpodid.IdentityHeaderAnnotationKey: header}
+		return []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: pod.Annotations}}, nil
+	}
+	pod.Annotations[aadpodid.IdentityHeaderAnnotationKey] = header
+	return []patchOperation{{Op: "add", Path: "/metadata/annotations/" + escapeJSONPointer(aadpodid.IdentityHeaderAnnotationKey), Value: header}}, nil
+}
+
+// getInitContainerPatch returns the patch which adds the init container waiting for the identity to be
+// assigned. It runs before all other init containers, which may already request tokens.
+func (s *Server) getInitContainerPatch(pod *corev1.Pod, id *aadpodid.AzureIdentity) []patchOperation {
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == initContainerName {
+			return nil
+		}
+	}
+
+	nmiEndpoint := s.Injection.NMIEndpoint
+	if nmiEndpoint == "" {
+		nmiEndpoint = DefaultNMIEndpoint
+	}
+	url := fmt.Sprintf("%s%s?client_id=%s", strings.TrimSuffix(nmiEndpoint, "/"), server.IdentityReadyPath, id.Spec.ClientID)
+	container := corev1.Container{
+		Name:  initContainerName,
+		Image: s.Injection.InitContainerImage,
+		Command: []string{"sh", "-c", fmt.Sprintf(
+			`i=0; until wget -q -O /dev/null "%[1]s"; do `+
+				`i=$((i+1)); if [ "$i" -ge %[4]d ]; then echo "timed out waiting for identity %[2]s/%[3]s to be assigned" >&2; exit 1; fi; `+
+				`echo "waiting for identity %[2]s/%[3]s to be assigned"; sleep %[5]d; done`,
+			url, id.Namespace, id.Name, initContainerAttempts, initContainerIntervalSeconds)},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("10m"),
+				corev1.ResourceMemory: resource.MustParse("16Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("32Mi"),
+			},
+		},
+	}
+
+	if len(pod.Spec.InitContainers) == 0 {
+		return []patchOperation{{Op: "add", Path: "/spec/initContainers", Value: []corev1.Container{container}}}
+	}
+	return []patchOperation{{Op: "add", Path: "/spec/initContainers/0", Value: container}}
+}
+
+func getServiceAccountName(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return defaultServiceAccountName
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+func hasEnvVar(container corev1.Container, name string) bool {
+	for _, envVar := range container.Env {
+		if envVar.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeJSONPointer escapes a key for use in the path of a JSON patch.
+func escapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,227 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newMutateHandler returns the handler of a server whose informers are synchronized.
+func newMutateHandler(t *testing.T, crdClient CRDClient, kubeClient kubernetes.Interface, injection InjectionConfig) http.Handler {
+	server := NewServer(crdClient, kubeClient, injection)
+	exit := make(chan struct{})
+	t.Cleanup(func() { close(exit) })
+	server.Start(exit)
+	return server.Handler()
+}
+
+// getPatch returns the operations of the patch in the response.
+func getPatch(t *testing.T, resp *admissionv1.AdmissionResponse) []patchOperation {
+	if !resp.Allowed {
+		t.Fatalf("expected pod to be allowed, got %+v", resp.Result)
+	}
+	if resp.Patch == nil {
+		return nil
+	}
+	assert.Equal(t, admissionv1.PatchTypeJSONPatch, *resp.PatchType)
+	var patch []patchOperation
+	if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+		t.Fatalf("failed to decode patch, error: %+v", err)
+	}
+	return patch
+}
+
+func TestMutateLabel(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "default",
+			Annotations: map[string]string{aadpodid.BindingSelectorAnnotationKey: "ns-selector"},
+		}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "default"}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+			Name:        "annotated",
+			Namespace:   "default",
+			Annotations: map[string]string{aadpodid.BindingSelectorAnnotationKey: "sa-selector"},
+		}},
+	)
+	handler := newMutateHandler(t, &testCRDClient{}, kubeClient, InjectionConfig{})
+
+	cases := []struct {
+		desc     string
+		pod      corev1.Pod
+		expected []patchOperation
+	}{
+		{
+			desc:     "pod without labels gets the label of its namespace",
+			pod:      corev1.Pod{},
+			expected: []patchOperation{{Op: "add", Path: "/metadata/labels", Value: map[string]interface{}{aadpodid.CRDLabelKey: "ns-selector"}}},
+		},
+		{
+			desc:     "pod with labels gets the label of its namespace",
+			pod:      corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "test"}}},
+			expected: []patchOperation{{Op: "add", Path: "/metadata/labels/aadpodidbinding", Value: "ns-selector"}},
+		},
+		{
+			desc:     "annotation of the service account takes precedence",
+			pod:      corev1.Pod{Spec: corev1.PodSpec{ServiceAccountName: "annotated"}},
+			expected: []patchOperation{{Op: "add", Path: "/metadata/labels", Value: map[string]interface{}{aadpodid.CRDLabelKey: "sa-selector"}}},
+		},
+		{
+			desc: "existing label is kept",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{aadpodid.CRDLabelKey: "selector"}}},
+		},
+		{
+			desc: "pod with mutation disabled",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{MutationLabelKey: MutationDisabled}}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			patch := getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", tc.pod))
+			assert.Equal(t, tc.expected, patch)
+		})
+	}
+
+	// namespaces and service accounts are read from the informer caches
+	for _, action := range kubeClient.Actions() {
+		assert.NotEqual(t, "get", action.GetVerb(), "unexpected request %+v", action)
+	}
+
+	// pods in namespaces with mutation disabled are not patched
+	handler = newMutateHandler(t, &testCRDClient{}, fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "default",
+		Labels:      map[string]string{MutationLabelKey: MutationDisabled},
+		Annotations: map[string]string{aadpodid.BindingSelectorAnnotationKey: "ns-selector"},
+	}}), InjectionConfig{})
+	assert.Nil(t, getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", corev1.Pod{})))
+	// pods in namespaces without the annotation are not patched
+	handler = newMutateHandler(t, &testCRDClient{}, fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}), InjectionConfig{})
+	assert.Nil(t, getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", corev1.Pod{})))
+	// pods are admitted unchanged if the namespace can't be read
+	handler = newMutateHandler(t, &testCRDClient{}, fake.NewSimpleClientset(), InjectionConfig{})
+	assert.Nil(t, getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", corev1.Pod{})))
+}
+
+func TestMutateInjection(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "default",
+			Annotations: map[string]string{aadpodid.BindingSelectorAnnotationKey: "selector"},
+		}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "default"}},
+	)
+	crdClient := &testCRDClient{
+		bindings: []aadpodid.AzureIdentityBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "binding", Namespace: "default"},
+				Spec:       aadpodid.AzureIdentityBindingSpec{AzureIdentity: "id", Selector: "selector"},
+			},
+		},
+		identities: []aadpodid.AzureIdentity{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "id", Namespace: "default"},
+				Spec:       aadpodid.AzureIdentitySpec{Type: aadpodid.UserAssignedMSI, ClientID: "clientid"},
+			},
+		},
+	}
+	injection := InjectionConfig{
+		InjectEnv:          true,
+		IdentityEndpoint:   "http://169.254.169.254/msi/token",
+		InitContainerImage: "busybox",
+	}
+	handler := newMutateHandler(t, crdClient, kubeClient, injection)
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "test"}},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init"}},
+			Containers: []corev1.Container{
+				{Name: "no-env"},
+				{Name: "env", Env: []corev1.EnvVar{{Name: "FOO", Value: "bar"}}},
+				{Name: "client-id", Env: []corev1.EnvVar{{Name: clientIDEnvVar, Value: "other"}}},
+			},
+		},
+	}
+	patch := getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", pod))
+	if len(patch) != 9 {
+		t.Fatalf("expected 9 patch operations, got %+v", patch)
+	}
+
+	assert.Equal(t, patchOperation{Op: "add", Path: "/metadata/labels/aadpodidbinding", Value: "selector"}, patch[0])
+	// the IDENTITY_HEADER is generated for the pod and stored in its annotations
+	assert.Equal(t, "/metadata/annotations", patch[1].Path)
+	annotations := patch[1].Value.(map[string]interface{})
+	identityHeader := annotations[aadpodid.IdentityHeaderAnnotationKey].(string)
+	assert.Len(t, identityHeader, 64)
+
+	env := []interface{}{
+		map[string]interface{}{"name": clientIDEnvVar, "value": "clientid"},
+		map[string]interface{}{"name": identityEndpointEnvVar, "value": "http://169.254.169.254/msi/token"},
+		map[string]interface{}{"name": identityHeaderEnvVar, "valueFrom": map[string]interface{}{
+			"fieldRef": map[string]interface{}{"fieldPath": "metadata.annotations['aadpodidentity.k8s.io/identity-header']"},
+		}},
+	}
+	assert.Equal(t, patchOperation{Op: "add", Path: "/spec/containers/0/env", Value: env}, patch[2])
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, patchOperation{Op: "add", Path: "/spec/containers/1/env/-", Value: env[i]}, patch[3+i])
+	}
+	// variables set by the container are kept
+	for i := 1; i < 3; i++ {
+		assert.Equal(t, patchOperation{Op: "add", Path: "/spec/containers/2/env/-", Value: env[i]}, patch[5+i])
+	}
+
+	initContainer := patch[8]
+	assert.Equal(t, "/spec/initContainers/0", initContainer.Path)
+	container := initContainer.Value.(map[string]interface{})
+	assert.Equal(t, initContainerName, container["name"])
+	assert.Equal(t, "busybox", container["image"])
+	command := container["command"].([]interface{})
+	assert.True(t, strings.Contains(command[2].(string), "http://169.254.169.254/aadpodidentity/ready?client_id=clientid"))
+	// the init container fails if the identity isn't assigned in time
+	assert.True(t, strings.Contains(command[2].(string), `if [ "$i" -ge 60 ]; then echo "timed out waiting for identity default/id to be assigned" >&2; exit 1; fi`))
+
+	// every pod gets its own IDENTITY_HEADER
+	patch = getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", pod))
+	assert.NotEqual(t, identityHeader, patch[1].Value.(map[string]interface{})[aadpodid.IdentityHeaderAnnotationKey])
+	// an existing IDENTITY_HEADER is kept
+	pod.Annotations = map[string]string{aadpodid.IdentityHeaderAnnotationKey: "header"}
+	patch = getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", pod))
+	for _, op := range patch {
+		assert.False(t, strings.HasPrefix(op.Path, "/metadata/annotations"), "unexpected patch operation %+v", op)
+	}
+
+	// pods which aren't bound to an identity are not patched
+	pod.Labels[aadpodid.CRDLabelKey] = "other"
+	assert.Nil(t, getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", pod)))
+
+	// identities which violate an AzureIdentityPolicy are ignored
+	pod.Labels[aadpodid.CRDLabelKey] = "selector"
+	crdClient.policies = []aadpodid.AzureIdentityPolicy{{
+		ObjectMeta: metav1.ObjectMeta{Name: "policy"},
+		Spec:       aadpodid.AzureIdentityPolicySpec{AllowedTypes: []aadpodid.IdentityType{aadpodid.ServicePrincipal}},
+	}}
+	patch = getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", pod))
+	assert.Nil(t, patch)
+	crdClient.policies[0].Spec.AllowedTypes = append(crdClient.policies[0].Spec.AllowedTypes, aadpodid.UserAssignedMSI)
+	patch = getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", pod))
+	assert.NotEmpty(t, patch)
+	crdClient.policies = nil
+
+	// identities which don't allow the namespace of the pod are ignored
+	crdClient.identities[0].Namespace = "other"
+	crdClient.bindings[0].Namespace = "other"
+	pod.Labels[aadpodid.CRDLabelKey] = "selector"
+	handler = newMutateHandler(t, crdClient, kubeClient, InjectionConfig{InjectEnv: true, Namespaced: true})
+	assert.Nil(t, getPatch(t, review(t, handler, MutatePath, admissionv1.Create, "pods", pod)))
+}
@@ -0,0 +1,208 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	"github.com/Azure/aad-pod-identity/pkg/utils"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// certificateKey is the key of the PKCS #12 certificate in the secret of a ServicePrincipalCertificate identity
+const certificateKey = "certificate"
+
+// validateIdentity validates the fields required by the type of the identity and that the secret
+// of a service principal exists.
+func (s *Server) validateIdentity(id *aadpodid.AzureIdentity) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	switch id.Spec.Type {
+	case aadpodid.UserAssignedMSI:
+		if id.Spec.ResourceID == "" {
+			errs = append(errs, field.Required(specPath.Child("resourceID"), "required for user-assigned identities"))
+		} else if err := utils.ValidateResourceID(id.Spec.ResourceID); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("resourceID"), id.Spec.ResourceID, err.Error()))
+		}
+		if id.Spec.ClientID == "" {
+			errs = append(errs, field.Required(specPath.Child("clientID"), "required for user-assigned identities"))
+		}
+	case aadpodid.ServicePrincipal, aadpodid.ServicePrincipalCertificate:
+		if id.Spec.ClientID == "" {
+			errs = append(errs, field.Required(specPath.Child("clientID"), "required for service principals"))
+		}
+		if id.Spec.TenantID == "" {
+			errs = append(errs, field.Required(specPath.Child("tenantID"), "required for service principals"))
+		}
+		errs = append(errs, s.validateSecretReference(id, specPath.Child("clientPassword"))...)
+	case aadpodid.FederatedWorkloadIdentity:
+		if id.Spec.ClientID == "" {
+			errs = append(errs, field.Required(specPath.Child("clientID"), "required for federated workload identities"))
+		}
+		if id.Spec.TenantID == "" {
+			errs = append(errs, field.Required(specPath.Child("tenantID"), "required for federated workload identities"))
+		}
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("type"), id.Spec.Type, []string{
+			fmt.Sprint(aadpodid.UserAssignedMSI),
+			fmt.Sprint(aadpodid.ServicePrincipal),
+			fmt.Sprint(aadpodid.ServicePrincipalCertificate),
+			fmt.Sprint(aadpodid.FederatedWorkloadIdentity),
+		}))
+	}
+
+	if id.Spec.NamespaceSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(id.Spec.NamespaceSelector); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("namespaceSelector"), id.Spec.NamespaceSelector, err.Error()))
+		}
+	}
+	return errs
+}
+
+// validateSecretReference validates that the secret with the credential of a service principal exists
+// and contains a certificate for ServicePrincipalCertificate identities.
+func (s *Server) validateSecretReference(id *aadpodid.AzureIdentity, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	secretRef := id.Spec.ClientPassword
+	if secretRef.Name == "" {
+		errs = append(errs, field.Required(path.Child("name"), "required for service principals"))
+	}
+	if secretRef.Namespace == "" {
+		errs = append(errs, field.Required(path.Child("namespace"), "required for service principals"))
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+
+	secret, err := s.KubeClient.CoreV1().Secrets(secretRef.Namespace).Get(context.TODO(), secretRef.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return field.ErrorList{field.NotFound(path, fmt.Sprintf("%s/%s", secretRef.Namespace, secretRef.Name))}
+	}
+	if err != nil {
+		return field.ErrorList{field.InternalError(path, fmt.Errorf("failed to get secret %s/%s, error: %+v", secretRef.Namespace, secretRef.Name, err))}
+	}
+	if id.Spec.Type == aadpodid.ServicePrincipalCertificate {
+		if _, ok := secret.Data[certificateKey]; !ok {
+			return field.ErrorList{field.Invalid(path, fmt.Sprintf("%s/%s", secretRef.Namespace, secretRef.Name), fmt.Sprintf("secret has no %q key", certificateKey))}
+		}
+	} else if len(secret.Data) == 0 {
+		return field.ErrorList{field.Invalid(path, fmt.Sprintf("%s/%s", secretRef.Namespace, secretRef.Name), "secret has no data")}
+	}
+	return nil
+}
+
+// validateBinding validates that the binding refers to an identity and selects pods, and that no other
+// binding in its namespace already binds the same identity to the same pods. It returns a warning for
+// each other binding which selects the same pods with the same weight, as the identity used for token
+// requests without a client ID is ambiguous then.
+func (s *Server) validateBinding(binding *aadpodid.AzureIdentityBinding) (field.ErrorList, []string) {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if binding.Spec.AzureIdentity == "" {
+		errs = append(errs, field.Required(specPath.Child("azureIdentity"), ""))
+	}
+	if binding.Spec.Selector == "" && !binding.HasPodSelector() {
+		errs = append(errs, field.Required(specPath.Child("selector"), "one of selector, labelSelector or serviceAccountName is required"))
+	}
+	if binding.Spec.Selector != "" {
+		for _, msg := range validation.IsValidLabelValue(binding.Spec.Selector) {
+			errs = append(errs, field.Invalid(specPath.Child("selector"), binding.Spec.Selector, msg))
+		}
+	}
+	if binding.Spec.LabelSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(binding.Spec.LabelSelector); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("labelSelector"), binding.Spec.LabelSelector, err.Error()))
+		}
+	}
+	if binding.Spec.ServiceAccountName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(binding.Spec.ServiceAccountName) {
+			errs = append(errs, field.Invalid(specPath.Child("serviceAccountName"), binding.Spec.ServiceAccountName, msg))
+		}
+	}
+	if len(errs) != 0 {
+		return errs, nil
+	}
+
+	bindings, err := s.CRDClient.ListBindings()
+	if err != nil {
+		return field.ErrorList{field.InternalError(specPath, fmt.Errorf("failed to list AzureIdentityBindings, error: %+v", err))}, nil
+	}
+	var warnings []string
+	for _, other := range *bindings {
+		if other.Namespace != binding.Namespace || other.Name == binding.Name || !selectsSamePods(&other, binding) {
+			continue
+		}
+		if other.Spec.AzureIdentity == binding.Spec.AzureIdentity {
+			errs = append(errs, field.Duplicate(specPath.Child("azureIdentity"),
+				fmt.Sprintf("AzureIdentityBinding %s/%s already binds %s to the same pods", other.Namespace, other.Name, other.Spec.AzureIdentity)))
+		} else if other.Spec.Weight == binding.Spec.Weight {
+			warnings = append(warnings, fmt.Sprintf("AzureIdentityBinding %s/%s selects the same pods with weight %d, the identity used for token requests without a client ID is ambiguous",
+				other.Namespace, other.Name, other.Spec.Weight))
+		}
+	}
+	return errs, warnings
+}
+
+// selectsSamePods returns true if the bindings have the same selection criteria.
+func selectsSamePods(a, b *aadpodid.AzureIdentityBinding) bool {
+	return a.Spec.Selector == b.Spec.Selector &&
+		a.Spec.ServiceAccountName == b.Spec.ServiceAccountName &&
+		reflect.DeepEqual(a.Spec.LabelSelector, b.Spec.LabelSelector)
+}
+
+// validateException validates the pod labels of the exception and that no other exception in
+// its namespace already excepts pods with one of the labels.
+func (s *Server) validateException(exception *aadpodid.AzurePodIdentityException) field.ErrorList {
+	var errs field.ErrorList
+	podLabelsPath := field.NewPath("spec", "podLabels")
+
+	if len(exception.Spec.PodLabels) == 0 {
+		return field.ErrorList{field.Required(podLabelsPath, "")}
+	}
+	keys := make([]string, 0, len(exception.Spec.PodLabels))
+	for k := range exception.Spec.PodLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := exception.Spec.PodLabels[k]
+		for _, msg := range validation.IsQualifiedName(k) {
+			errs = append(errs, field.Invalid(podLabelsPath, k, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			errs = append(errs, field.Invalid(podLabelsPath.Key(k), v, msg))
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+
+	exceptions, err := s.CRDClient.ListPodIdentityExceptions(exception.Namespace)
+	if err != nil {
+		return field.ErrorList{field.InternalError(podLabelsPath, fmt.Errorf("failed to list AzurePodIdentityExceptions, error: %+v", err))}
+	}
+	for _, other := range *exceptions {
+		if other.Name == exception.Name {
+			continue
+		}
+		for _, k := range keys {
+			v := exception.Spec.PodLabels[k]
+			// pod labels of exceptions are matched case-insensitively
+			if otherValue, ok := other.Spec.PodLabels[k]; ok && strings.EqualFold(otherValue, v) {
+				errs = append(errs, field.Duplicate(podLabelsPath.Key(k),
+					fmt.Sprintf("AzurePodIdentityException %s/%s already excepts pods with %s=%s", other.Namespace, other.Name, k, otherValue)))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodv1 "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	informersv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ValidatePath is the path of the validating webhook for AzureIdentities,
+	// AzureIdentityBindings and AzurePodIdentityExceptions.
+	ValidatePath = "/validate"
+
+	// maxRequestBodyBytes limits the size of admission reviews read by the server
+	maxRequestBodyBytes = 3 * 1024 * 1024
+)
+
+// CRDClient lists the aad-pod-identity resources the webhook validates objects against
+// and matches pods with their bindings and identities.
+type CRDClient interface {
+	ListBindings() (*[]aadpodid.AzureIdentityBinding, error)
+	ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodIdentityException, error)
+	GetPodBindings(pod *corev1.Pod) ([]aadpodid.AzureIdentityBinding, error)
+	GetPodIDsWithBinding(pod *corev1.Pod) ([]aadpodid.AzureIdentity, error)
+	ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error)
+}
+
+// Server serves the admission webhooks of aad-pod-identity.
+type Server struct {
+	CRDClient  CRDClient
+	KubeClient kubernetes.Interface
+	Injection  InjectionConfig
+	// NamespaceInformer and ServiceAccountInformer serve the lookups of the mutating webhook,
+	// which is called for every pod created in the cluster.
+	NamespaceInformer      cache.SharedIndexInformer
+	ServiceAccountInformer cache.SharedIndexInformer
+}
+
+// admitFunc admits or rejects the object of an admission request.
+type admitFunc func(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse
+
+// NewServer returns a new webhook server.
+func NewServer(crdClient CRDClient, kubeClient kubernetes.Interface, injection InjectionConfig) *Server {
+	return &Server{
+		CRDClient:              crdClient,
+		KubeClient:             kubeClient,
+		Injection:              injection,
+		NamespaceInformer:      informersv1.NewNamespaceInformer(kubeClient, 10*time.Minute, cache.Indexers{}),
+		ServiceAccountInformer: informersv1.NewServiceAccountInformer(kubeClient, corev1.NamespaceAll, 10*time.Minute, cache.Indexers{}),
+	}
+}
+
+// Start runs the informers of the server and waits until their caches are synchronized.
+func (s *Server) Start(exit <-chan struct{}) {
+	go s.NamespaceInformer.Run(exit)
+	go s.ServiceAccountInformer.Run(exit)
+	if !cache.WaitForCacheSync(exit, s.NamespaceInformer.HasSynced, s.ServiceAccountInformer.HasSynced) {
+		klog.Error("namespace and service account caches could not be synchronized")
+	}
+}
+
+// Handler returns the handler serving all webhooks of the server.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ValidatePath, s.ServeValidate)
+	mux.HandleFunc(MutatePath, s.ServeMutate)
+	return mux
+}
+
+// ServeValidate validates AzureIdentities, AzureIdentityBindings and AzurePodIdentityExceptions
+// when they are created or updated.
+func (s *Server) ServeValidate(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, s.validate)
+}
+
+func (s *Server) validate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return allowed()
+	}
+
+	var errs field.ErrorList
+	var warnings []string
+	switch req.Resource.Resource {
+	case aadpodv1.AzureIDResource:
+		var id aadpodv1.AzureIdentity
+		if err := decode(req, &id); err != nil {
+			return errored(http.StatusBadRequest, err)
+		}
+		internalID := aadpodv1.ConvertV1IdentityToInternalIdentity(id)
+		errs = s.validateIdentity(&internalID)
+	case aadpodv1.AzureIDBindingResource:
+		var binding aadpodv1.AzureIdentityBinding
+		if err := decode(req, &binding); err != nil {
+			return errored(http.StatusBadRequest, err)
+		}
+		internalBinding := aadpodv1.ConvertV1BindingToInternalBinding(binding)
+		errs, warnings = s.validateBinding(&internalBinding)
+	case aadpodv1.AzurePodIdentityExceptionResource:
+		var exception aadpodv1.AzurePodIdentityException
+		if err := decode(req, &exception); err != nil {
+			return errored(http.StatusBadRequest, err)
+		}
+		internalException := aadpodv1.ConvertV1PodIdentityExceptionToInternalPodIdentityException(exception)
+		errs = s.validateException(&internalException)
+	default:
+		return allowed()
+	}
+
+	if len(errs) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+	}
+	klog.Infof("rejected %s %s/%s, error: %+v", req.Resource.Resource, req.Namespace, req.Name, errs.ToAggregate())
+	return denied(errs)
+}
+
+// decode decodes the object of the admission request. The namespace of the request is used
+// if the object doesn't have one, e.g. when it is created with kubectl without a namespace.
+func decode(req *admissionv1.AdmissionRequest, obj metav1.Object) error {
+	if err := json.Unmarshal(req.Object.Raw, obj); err != nil {
+		return fmt.Errorf("failed to decode %s, error: %+v", req.Resource.Resource, err)
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(req.Namespace)
+	}
+	return nil
+}
+
+// serve reads the admission review of a request, calls admit and writes the admission
+// review with its response. Both admission.k8s.io/v1 and v1beta1 reviews are served as
+// their JSON representations are identical.
+func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		http.Error(w, fmt.Sprintf("unsupported content type %q, expected application/json", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request body, error: %+v", err), http.StatusBadRequest)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "failed to decode admission review", http.StatusBadRequest)
+		return
+	}
+
+	response := admit(review.Request)
+	response.UID = review.Request.UID
+	review.Request = nil
+	review.Response = response
+
+	resp, err := json.Marshal(review)
+	if err != nil {
+		klog.Errorf("failed to encode admission review, error: %+v", err)
+		http.Error(w, "failed to encode admission review", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		klog.Errorf("failed to write admission review, error: %+v", err)
+	}
+}
+
+func allowed() *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func denied(errs field.ErrorList) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: errs.ToAggregate().Error(),
+		},
+	}
+}
+
+func errored(code int32, err error) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Message: err.Error(),
+		},
+	}
+}
@@ -0,0 +1,469 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	aadpodid "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity"
+	aadpodv1 "github.com/Azure/aad-pod-identity/pkg/apis/aadpodidentity/v1"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testResourceID = "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id"
+
+type testCRDClient struct {
+	bindings   []aadpodid.AzureIdentityBinding
+	identities []aadpodid.AzureIdentity
+	exceptions []aadpodid.AzurePodIdentityException
+	policies   []aadpodid.AzureIdentityPolicy
+}
+
+func (c *testCRDClient) ListBindings() (*[]aadpodid.AzureIdentityBinding, error) {
+	return &c.bindings, nil
+}
+
+func (c *testCRDClient) ListPodIdentityExceptions(ns string) (*[]aadpodid.AzurePodIdentityException, error) {
+	var exceptions []aadpodid.AzurePodIdentityException
+	for _, exception := range c.exceptions {
+		if exception.Namespace == ns {
+			exceptions = append(exceptions, exception)
+		}
+	}
+	return &exceptions, nil
+}
+
+func (c *testCRDClient) ListIdentityPolicies() ([]aadpodid.AzureIdentityPolicy, error) {
+	return c.policies, nil
+}
+
+func (c *testCRDClient) GetPodBindings(pod *corev1.Pod) ([]aadpodid.AzureIdentityBinding, error) {
+	var bindings []aadpodid.AzureIdentityBinding
+	for _, binding := range c.bindings {
+		matched, err := binding.MatchesPod(pod)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings, nil
+}
+
+func (c *testCRDClient) GetPodIDsWithBinding(pod *corev1.Pod) ([]aadpodid.AzureIdentity, error) {
+	bindings, err := c.GetPodBindings(pod)
+	if err != nil {
+		return nil, err
+	}
+	var ids []aadpodid.AzureIdentity
+	for _, id := range c.identities {
+		for _, binding := range bindings {
+			if binding.Namespace == id.Namespace && binding.Spec.AzureIdentity == id.Name {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+// review sends an admission review for the object to the handler and returns the response.
+func review(t *testing.T, handler http.Handler, path string, operation admissionv1.Operation, resource string, obj interface{}) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("failed to encode object, error: %+v", err)
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Resource:  metav1.GroupVersionResource{Group: aadpodv1.CRDGroup, Version: aadpodv1.CRDVersion, Resource: resource},
+			Namespace: "default",
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode admission review, error: %+v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var resp admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode admission review, error: %+v", err)
+	}
+	assert.Equal(t, "admission.k8s.io/v1", resp.APIVersion)
+	assert.Equal(t, "AdmissionReview", resp.Kind)
+	if resp.Response == nil {
+		t.Fatalf("expected admission review with response")
+	}
+	assert.Equal(t, types.UID("test-uid"), resp.Response.UID)
+	return resp.Response
+}
+
+func newIdentity(name string, spec aadpodv1.AzureIdentitySpec) *aadpodv1.AzureIdentity {
+	return &aadpodv1.AzureIdentity{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       spec,
+	}
+}
+
+func TestValidateIdentity(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "sp-secret", Namespace: "default"},
+			Data:       map[string][]byte{"clientSecret": []byte("secret")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "cert-secret", Namespace: "default"},
+			Data:       map[string][]byte{"certificate": []byte("cert"), "password": []byte("password")},
+		},
+	)
+	handler := NewServer(&testCRDClient{}, kubeClient, InjectionConfig{}).Handler()
+
+	cases := []struct {
+		desc     string
+		spec     aadpodv1.AzureIdentitySpec
+		expected string
+	}{
+		{
+			desc: "valid user-assigned identity",
+			spec: aadpodv1.AzureIdentitySpec{Type: aadpodv1.UserAssignedMSI, ResourceID: testResourceID, ClientID: "clientid"},
+		},
+		{
+			desc:     "user-assigned identity with invalid resource id",
+			spec:     aadpodv1.AzureIdentitySpec{Type: aadpodv1.UserAssignedMSI, ResourceID: "/subscriptions/sub/resourcegroups/rg", ClientID: "clientid"},
+			expected: "spec.resourceID: Invalid value",
+		},
+		{
+			desc:     "user-assigned identity without client id",
+			spec:     aadpodv1.AzureIdentitySpec{Type: aadpodv1.UserAssignedMSI, ResourceID: testResourceID},
+			expected: "spec.clientID: Required value",
+		},
+		{
+			desc: "valid service principal",
+			spec: aadpodv1.AzureIdentitySpec{
+				Type:           aadpodv1.ServicePrincipal,
+				ClientID:       "clientid",
+				TenantID:       "tenantid",
+				ClientPassword: corev1.SecretReference{Name: "sp-secret", Namespace: "default"},
+			},
+		},
+		{
+			desc: "service principal with missing secret",
+			spec: aadpodv1.AzureIdentitySpec{
+				Type:           aadpodv1.ServicePrincipal,
+				ClientID:       "clientid",
+				TenantID:       "tenantid",
+				ClientPassword: corev1.SecretReference{Name: "missing", Namespace: "default"},
+			},
+			expected: "spec.clientPassword: Not found: \"default/missing\"",
+		},
+		{
+			desc:     "service principal without tenant id and secret",
+			spec:     aadpodv1.AzureIdentitySpec{Type: aadpodv1.ServicePrincipal, ClientID: "clientid"},
+			expected: "spec.tenantID: Required value",
+		},
+		{
+			desc: "valid service principal certificate",
+			spec: aadpodv1.AzureIdentitySpec{
+				Type:           aadpodv1.IdentityType(aadpodid.ServicePrincipalCertificate),
+				ClientID:       "clientid",
+				TenantID:       "tenantid",
+				ClientPassword: corev1.SecretReference{Name: "cert-secret", Namespace: "default"},
+			},
+		},
+		{
+			desc: "service principal certificate with secret without certificate",
+			spec: aadpodv1.AzureIdentitySpec{
+				Type:           aadpodv1.IdentityType(aadpodid.ServicePrincipalCertificate),
+				ClientID:       "clientid",
+				TenantID:       "tenantid",
+				ClientPassword: corev1.SecretReference{Name: "sp-secret", Namespace: "default"},
+			},
+			expected: "secret has no \"certificate\" key",
+		},
+		{
+			desc:     "federated workload identity without tenant id",
+			spec:     aadpodv1.AzureIdentitySpec{Type: aadpodv1.FederatedWorkloadIdentity, ClientID: "clientid"},
+			expected: "spec.tenantID: Required value",
+		},
+		{
+			desc:     "unsupported type",
+			spec:     aadpodv1.AzureIdentitySpec{Type: 4, ClientID: "clientid"},
+			expected: "spec.type: Unsupported value: 4",
+		},
+		{
+			desc: "invalid namespace selector",
+			spec: aadpodv1.AzureIdentitySpec{
+				Type:       aadpodv1.UserAssignedMSI,
+				ResourceID: testResourceID,
+				ClientID:   "clientid",
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Unknown"}},
+				},
+			},
+			expected: "spec.namespaceSelector: Invalid value",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp := review(t, handler, ValidatePath, admissionv1.Create, aadpodv1.AzureIDResource, newIdentity("test", tc.spec))
+			if tc.expected == "" {
+				assert.True(t, resp.Allowed, resp.Result)
+				return
+			}
+			assert.False(t, resp.Allowed)
+			if assert.NotNil(t, resp.Result) {
+				assert.Contains(t, resp.Result.Message, tc.expected)
+			}
+		})
+	}
+}
+
+func TestValidateBinding(t *testing.T) {
+	crdClient := &testCRDClient{
+		bindings: []aadpodid.AzureIdentityBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "default"},
+				Spec:       aadpodid.AzureIdentityBindingSpec{AzureIdentity: "id1", Selector: "app1", Weight: 1},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "other-namespace", Namespace: "other"},
+				Spec:       aadpodid.AzureIdentityBindingSpec{AzureIdentity: "id1", Selector: "app2"},
+			},
+		},
+	}
+	handler := NewServer(crdClient, fake.NewSimpleClientset(), InjectionConfig{}).Handler()
+
+	cases := []struct {
+		desc      string
+		name      string
+		operation admissionv1.Operation
+		spec      aadpodv1.AzureIdentityBindingSpec
+		expected  string
+		warning   string
+	}{
+		{
+			desc:      "valid binding",
+			name:      "test",
+			operation: admissionv1.Create,
+			spec:      aadpodv1.AzureIdentityBindingSpec{AzureIdentity: "id2", Selector: "app2"},
+		},
+		{
+			desc:      "binding without identity",
+			name:      "test",
+			operation: admissionv1.Create,
+			spec:      aadpodv1.AzureIdentityBindingSpec{Selector: "app2"},
+			expected:  "spec.azureIdentity: Required value",
+		},
+		{
+			desc:      "binding without selection criteria",
+			name:      "test",
+			operation: admissionv1.Create,
+			spec:      aadpodv1.AzureIdentityBindingSpec{AzureIdentity: "id2"},
+			expected:  "spec.selector: Required value",
+		},
+		{
+			desc:      "binding with invalid selector",
+			name:      "test",
+			operation: admissionv1.Create,
+			spec:      aadpodv1.AzureIdentityBindingSpec{AzureIdentity: "id2", Selector: "app 2"},
+			expected:  "spec.selector: Invalid value",
+		},
+		{
+			desc:      "binding duplicating an existing binding",
+			name:      "test",
+			operation: admissionv1.Create,
+			spec:      aadpodv1.AzureIdentityBindingSpec{AzureIdentity: "id1", Selector: "app1", Weight: 2},
+			expected:  "AzureIdentityBinding default/existing already binds id1 to the same pods",
+		},
+		{
+			desc:      "binding with the selector and weight of an existing binding",
+			name:      "test",
+			operation: admissionv1.Create,
+			spec:      aadpodv1.AzureIdentityBindingSpec{AzureIdentity: "id2", Selector: "app1", Weight: 1},
+			warning:   "AzureIdentityBinding default/existing selects the same pods with weight 1",
+		},
+		{
+			desc:      "binding with the selector of an existing binding and a different weight",
+			name:      "test",
+			operation: admissionv1.Create,
+			spec:      aadpodv1.AzureIdentityBindingSpec{AzureIdentity: "id2", Selector: "app1", Weight: 2},
+		},
+		{
+			desc:      "binding with the selector of an existing binding and a service account",
+			name:      "test",
+			operation: admissionv1.Create,
+			spec:      aadpodv1.AzureIdentityBindingSpec{AzureIdentity: "id1", Selector: "app1", Weight: 1, ServiceAccountName: "sa"},
+		},
+		{
+			desc:      "update of an existing binding",
+			name:      "existing",
+			operation: admissionv1.Update,
+			spec:      aadpodv1.AzureIdentityBindingSpec{AzureIdentity: "id1", Selector: "app1", Weight: 1},
+		},
+		{
+			desc:      "deletion is not validated",
+			name:      "test",
+			operation: admissionv1.Delete,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			binding := &aadpodv1.AzureIdentityBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: tc.name},
+				Spec:       tc.spec,
+			}
+			resp := review(t, handler, ValidatePath, tc.operation, aadpodv1.AzureIDBindingResource, binding)
+			if tc.expected == "" {
+				assert.True(t, resp.Allowed, resp.Result)
+				if tc.warning == "" {
+					assert.Empty(t, resp.Warnings)
+				} else if assert.Len(t, resp.Warnings, 1) {
+					assert.Contains(t, resp.Warnings[0], tc.warning)
+				}
+				return
+			}
+			assert.False(t, resp.Allowed)
+			if assert.NotNil(t, resp.Result) {
+				assert.Contains(t, resp.Result.Message, tc.expected)
+			}
+		})
+	}
+}
+
+func TestValidateException(t *testing.T) {
+	crdClient := &testCRDClient{
+		exceptions: []aadpodid.AzurePodIdentityException{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "default"},
+				Spec:       aadpodid.AzurePodIdentityExceptionSpec{PodLabels: map[string]string{"app": "mic"}},
+			},
+		},
+	}
+	handler := NewServer(crdClient, fake.NewSimpleClientset(), InjectionConfig{}).Handler()
+
+	cases := []struct {
+		desc      string
+		name      string
+		podLabels map[string]string
+		expected  string
+	}{
+		{
+			desc:      "valid exception",
+			name:      "test",
+			podLabels: map[string]string{"app": "custom"},
+		},
+		{
+			desc:     "exception without pod labels",
+			name:     "test",
+			expected: "spec.podLabels: Required value",
+		},
+		{
+			desc:      "exception with invalid label",
+			name:      "test",
+			podLabels: map[string]string{"app/name/x": "custom"},
+			expected:  "spec.podLabels: Invalid value: \"app/name/x\"",
+		},
+		{
+			desc:      "exception colliding with an existing exception",
+			name:      "test",
+			podLabels: map[string]string{"app": "MIC"},
+			expected:  "AzurePodIdentityException default/existing already excepts pods with app=mic",
+		},
+		{
+			desc:      "update of an existing exception",
+			name:      "existing",
+			podLabels: map[string]string{"app": "mic"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			exception := &aadpodv1.AzurePodIdentityException{
+				ObjectMeta: metav1.ObjectMeta{Name: tc.name},
+				Spec:       aadpodv1.AzurePodIdentityExceptionSpec{PodLabels: tc.podLabels},
+			}
+			resp := review(t, handler, ValidatePath, admissionv1.Create, aadpodv1.AzurePodIdentityExceptionResource, exception)
+			if tc.expected == "" {
+				assert.True(t, resp.Allowed, resp.Result)
+				return
+			}
+			assert.False(t, resp.Allowed)
+			if assert.NotNil(t, resp.Result) {
+				assert.Contains(t, resp.Result.Message, tc.expected)
+			}
+		})
+	}
+}
+
+func TestServeInvalidRequests(t *testing.T) {
+	handler := NewServer(&testCRDClient{}, fake.NewSimpleClientset(), InjectionConfig{}).Handler()
+
+	cases := []struct {
+		desc        string
+		method      string
+		contentType string
+		body        string
+		expected    int
+	}{
+		{
+			desc:        "wrong method",
+			method:      http.MethodGet,
+			contentType: "application/json",
+			expected:    http.StatusMethodNotAllowed,
+		},
+		{
+			desc:        "wrong content type",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        "{}",
+			expected:    http.StatusUnsupportedMediaType,
+		},
+		{
+			desc:        "invalid admission review",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        "{",
+			expected:    http.StatusBadRequest,
+		},
+		{
+			desc:        "admission review without request",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`,
+			expected:    http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, ValidatePath, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expected, rec.Code)
+		})
+	}
+}
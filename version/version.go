@@ -17,9 +17,12 @@ var MICVersion string
 // NMIVersion is the version of the NMI component
 var NMIVersion string
 
+// WebhookVersion is the version of the admission webhook component
+var WebhookVersion string
+
 // GetUserAgent is used to get the user agent string which is then provided to adal
 // to use as the extended user agent header.
-// The format is: aad-pod-identity/<component - either NMI or MIC>/<Version of component>/<Git commit>/<Build date>
+// The format is: aad-pod-identity/<component - NMI, MIC or webhook>/<Version of component>/<Git commit>/<Build date>
 func GetUserAgent(component, version string) string {
 	return fmt.Sprintf("aad-pod-identity/%s/%s/%s/%s", component, version, GitCommit, BuildDate)
 }